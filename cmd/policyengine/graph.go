@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/yaml"
+)
+
+// graph_main prints which rules feed which, for Graphviz or as JSON.
+func graph_main(p yaml.PolicyYaml, args []string) error {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	format := fs.String("f", "dot", "output format, dot or json")
+	out := fs.String("o", "", "output file, stdout if unset")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	rules, err := newRules(p, nil)
+	if err != nil {
+		return err
+	}
+	rg, err := newGraph(p, rules)
+	if err != nil {
+		return err
+	}
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	switch *format {
+	case "dot":
+		return rg.WriteDOT(w)
+	case "json":
+		return rg.WriteJSON(w)
+	}
+	return fmt.Errorf("unknown format: %s", *format)
+}
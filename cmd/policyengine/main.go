@@ -3,14 +3,27 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/action"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/collectd"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/graph"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/ha"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/inhibit"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
 	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/prometheus"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/redists"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/silence"
 	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/tsdb"
 	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/yaml"
+	"github.com/go-redis/redis"
 	"github.com/oklog/run"
 )
 
@@ -18,38 +31,825 @@ import (
   requirements:
 */
 
-func policyProcess(p yaml.PolicyYaml) error {
+func optDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return parser.ParseDuration(s)
+}
+
+// newDataSource returns the datasource configured in the policy, and the
+// collectd listener feeding it when it is the embedded store.
+func newDataSource(p yaml.PolicyYaml) (threshold.DataSource, *collectd.Server, error) {
+	c := p.Datasource
+	addr := c.Address
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	switch c.Type {
+	case "", "redis":
+		return threshold.NewRedisSource(&redis.Options{
+			Addr:     addr,
+			Password: c.Password,
+			DB:       c.DB,
+		}), nil, nil
+	case "redistimeseries":
+		return redists.NewSource(&redis.Options{
+			Addr:     addr,
+			Password: c.Password,
+			DB:       c.DB,
+		}, redists.Config{
+			MetricLabel: c.MetricLabel,
+			Metrics:     c.Metrics,
+			Labels:      c.Labels,
+		}), nil, nil
+	case "prometheus":
+		timeout, err := optDuration(c.Timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		step, err := optDuration(c.Step)
+		if err != nil {
+			return nil, nil, err
+		}
+		return prometheus.NewSource(prometheus.Config{
+			URL:     c.URL,
+			Timeout: timeout,
+			Step:    step,
+			Metrics: c.Metrics,
+			Labels:  c.Labels,
+		}), nil, nil
+	case "collectd":
+		level := collectd.SecurityNone
+		switch c.SecurityLevel {
+		case "", "none":
+		case "sign":
+			level = collectd.SecuritySign
+		default:
+			return nil, nil, fmt.Errorf("unknown security_level: %s", c.SecurityLevel)
+		}
+		store := tsdb.NewStore(c.Capacity)
+		return store, &collectd.Server{
+			Addr:   c.Listen,
+			Parser: collectd.Parser{SecurityLevel: level, Users: c.Users},
+			Store:  store,
+		}, nil
+	case "unixsock":
+		timeout, err := optDuration(c.Timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &collectd.UnixsockSource{Path: c.Socket, Timeout: timeout}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown datasource type: %s", c.Type)
+}
+
+// putnotifReceiver is the receiver standing for the putnotif block.
+const putnotifReceiver = "putnotif"
+
+// receiverConfigs returns the receivers of the policy, with the one of
+// the putnotif block if it is set.
+func receiverConfigs(p yaml.PolicyYaml) []notify.ReceiverConfig {
+	configs := p.Receivers
+	if c := p.Putnotif; c.Socket != "" {
+		configs = append(configs, notify.ReceiverConfig{
+			Name:    putnotifReceiver,
+			Type:    "collectd",
+			Socket:  c.Socket,
+			Plugin:  c.Plugin,
+			Timeout: c.Timeout,
+		})
+	}
+	return configs
+}
+
+type engineState struct {
+	stale     *threshold.StaleTracker
+	alerts    *threshold.AlertTracker
+	models    *threshold.ModelTracker
+	dispatch  *notify.Dispatcher
+	actions   map[string][]*action.Action // by rule ID
+	queue     *action.Queue
+	silencer  *silence.Silencer
+	inhibitor *inhibit.Inhibitor
+	putnotif  bool                 // every rule also notifies putnotifReceiver
+	hosts     *inhibit.Topology    // labels series with their host, nil if not
+	state     threshold.StateStore // nil if the state is not kept
+	leader    *ha.Elector          // nil without leader election
+	shard     *ha.Shard            // nil without sharding
+
+	workers  int                       // rules evaluated at once per group
+	rules    map[string]threshold.Rule // by ID
+	timeouts map[string]time.Duration  // by rule ID
+	writer   threshold.Writer          // of recording rules, nil if none
+	graph    *graph.Graph
+	deps     map[int][]int // groups each group reads the records of
+
+	mu      sync.Mutex
+	running map[int]bool // groups being evaluated, by index
+	wg      sync.WaitGroup
+}
+
+// newRule describes rule i of group g to the alert tracker and receivers.
+func newRule(p yaml.PolicyYaml, g, i int) (threshold.Rule, error) {
+	group := p.Groups[g]
+	r := group.Rules[i]
+	rule := threshold.Rule{
+		ID:          fmt.Sprintf("%s[%d]", group.Name, i),
+		Group:       group.Name,
+		Record:      r.Record,
+		Annotations: group.Annotation,
+		Notify:      group.Notify,
+	}
+	if len(r.Notify) > 0 {
+		rule.Notify = r.Notify
+	}
+	d, err := optDuration(r.For)
+	if err != nil {
+		return rule, fmt.Errorf("%s: for: %v", rule.ID, err)
+	}
+	rule.For = d
+	if rule.Expr, err = parser.ParseExpr(r.Expr); err != nil {
+		return rule, fmt.Errorf("%s: bad expression %s: %v", rule.ID, r.Expr, err)
+	}
+	rule.Threshold = threshold.Threshold(rule.Expr)
+	if r.Summary != "" || r.Description != "" || r.RunbookURL != "" {
+		if rule.Templates, err = notify.NewTemplates(r.Summary, r.Description, r.RunbookURL, ""); err != nil {
+			return rule, fmt.Errorf("%s: %v", rule.ID, err)
+		}
+	}
+	return rule, nil
+}
+
+// newRules describes every rule, by ID, making sure each is well formed
+// and every receiver the rules notify is configured; the rule raising the
+// silent series of a rule with nodata is under its ID plus ":nodata".
+// Rules are built once, with their parsed expressions and templates, and
+// reused by every evaluation. Receivers are not checked if nil.
+func newRules(p yaml.PolicyYaml, receivers *notify.Receivers) (map[string]threshold.Rule, error) {
+	rules := map[string]threshold.Rule{}
+	for g := range p.Groups {
+		for i := range p.Groups[g].Rules {
+			rule, err := newRule(p, g, i)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range rule.Notify {
+				if receivers != nil && !receivers.Has(name) {
+					return nil, fmt.Errorf("%s: unknown receiver %s", rule.ID, name)
+				}
+			}
+			rules[rule.ID] = rule
+			if nodata := p.Groups[g].Rules[i].NoData; nodata != "" {
+				after, err := parser.ParseDuration(nodata)
+				if err != nil {
+					return nil, fmt.Errorf("%s: nodata: %v", rule.ID, err)
+				}
+				rules[rule.ID+":nodata"] = rule.NoData(after)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// checkRecords makes sure recording rules, those without a comparison,
+// have a unique record name and no alerting fields, and that the
+// datasource can store what they record. It returns the datasource as
+// their writer, nil if there are none.
+func checkRecords(p yaml.PolicyYaml, rules map[string]threshold.Rule, ds threshold.DataSource) (threshold.Writer, error) {
+	records := map[string]string{}
+	for _, g := range p.Groups {
+		for i, r := range g.Rules {
+			id := fmt.Sprintf("%s[%d]", g.Name, i)
+			if !threshold.Recording(rules[id].Expr) {
+				continue
+			}
+			switch {
+			case r.Record == "":
+				return nil, fmt.Errorf("%s: recording rule without record", id)
+			case records[r.Record] != "":
+				return nil, fmt.Errorf("%s: %s already recorded by %s", id, r.Record, records[r.Record])
+			case r.For != "" || len(r.Notify) > 0 || len(r.Actions) > 0 || r.NoData != "":
+				return nil, fmt.Errorf("%s: recording rule cannot alert", id)
+			}
+			records[r.Record] = id
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	w, ok := ds.(threshold.Writer)
+	if !ok {
+		return nil, fmt.Errorf("datasource %s cannot store recorded series", p.Datasource.Type)
+	}
+	return w, nil
+}
+
+// newGraph returns which rules feed which, rejecting cycles.
+func newGraph(p yaml.PolicyYaml, rules map[string]threshold.Rule) (*graph.Graph, error) {
+	list := []graph.Rule{}
+	for _, g := range p.Groups {
+		for i, r := range g.Rules {
+			rule := graph.Rule{ID: fmt.Sprintf("%s[%d]", g.Name, i), Group: g.Name, Index: i, Record: r.Record}
+			expr := rules[rule.ID].Expr
+			rule.Recording = threshold.Recording(expr)
+			rule.Metrics = threshold.Metrics(expr)
+			list = append(list, rule)
+		}
+	}
+	return graph.New(list)
+}
+
+// groupDeps returns, for each group, the indexes of the other groups
+// recording series its rules read.
+func groupDeps(p yaml.PolicyYaml, rg *graph.Graph) map[int][]int {
+	index := map[string]int{}
+	for gi, g := range p.Groups {
+		index[g.Name] = gi
+	}
+	deps := map[int][]int{}
+	for gi, g := range p.Groups {
+		for _, name := range rg.GroupDeps(g.Name) {
+			deps[gi] = append(deps[gi], index[name])
+		}
+	}
+	return deps
+}
+
+// newTimeouts returns how long each rule may take to read its series.
+func newTimeouts(p yaml.PolicyYaml) (map[string]time.Duration, error) {
+	def, err := optDuration(p.Evaluation.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("evaluation: timeout: %v", err)
+	}
+	if def == 0 {
+		def = 10 * time.Second
+	}
+	timeouts := map[string]time.Duration{}
 	for _, g := range p.Groups {
 		for i, r := range g.Rules {
-			expr := parser.Policyexpr_main(r.Expr)
-			rdlist := threshold.Read(expr)
-			rllist := threshold.Evaluate(expr, rdlist)
-			fmt.Printf("transmit: %s[%d], %+v\n", g.Name, i, rllist)
+			id := fmt.Sprintf("%s[%d]", g.Name, i)
+			t, err := optDuration(r.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("%s: timeout: %v", id, err)
+			}
+			if t == 0 {
+				t = def
+			}
+			timeouts[id] = t
+		}
+	}
+	return timeouts, nil
+}
+
+// newOutbox returns the outbox configured in the policy, or nil.
+func newOutbox(p yaml.PolicyYaml, receivers *notify.Receivers) (*notify.Outbox, error) {
+	c := p.Outbox
+	var store notify.OutboxStore
+	switch c.Type {
+	case "":
+		return nil, nil
+	case "file":
+		s, err := notify.NewFileStore(c.Path)
+		if err != nil {
+			return nil, err
+		}
+		store = s
+	case "redis":
+		opts := stateRedis(p)
+		if opts == nil {
+			return nil, fmt.Errorf("no redis to keep it in")
+		}
+		store = notify.NewRedisStore(opts)
+	default:
+		return nil, fmt.Errorf("unknown type: %s", c.Type)
+	}
+	o := notify.NewOutbox(store, receivers)
+	o.MaxAttempts = c.MaxAttempts
+	var err error
+	if o.Backoff, err = optDuration(c.Backoff); err != nil {
+		return nil, err
+	}
+	if o.MaxBackoff, err = optDuration(c.MaxBackoff); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// newStateStore returns where the policy keeps the alert state, or nil.
+// Sharded engines each keep their own in redis.
+func newStateStore(p yaml.PolicyYaml, shard *ha.Shard) (threshold.StateStore, error) {
+	switch p.State.Type {
+	case "":
+		return nil, nil
+	case "file":
+		if p.State.Path == "" {
+			return nil, fmt.Errorf("state file needs a path")
+		}
+		return &threshold.StateFile{Path: p.State.Path}, nil
+	case "redis":
+		opts := stateRedis(p)
+		if opts == nil {
+			return nil, fmt.Errorf("no redis to keep the state in")
+		}
+		state := threshold.NewRedisState(opts)
+		if shard != nil {
+			// the key must outlive the process for a restart to find it
+			if p.Sharding.ID == "" {
+				return nil, fmt.Errorf("sharding needs an id to keep the state in redis")
+			}
+			state.Key = threshold.StateKey + ":" + shard.ID()
+		}
+		return state, nil
+	}
+	return nil, fmt.Errorf("unknown state type: %s", p.State.Type)
+}
+
+// newActions sets up the actions of every rule.
+func newActions(p yaml.PolicyYaml) (map[string][]*action.Action, error) {
+	actions := map[string][]*action.Action{}
+	for g := range p.Groups {
+		for i, r := range p.Groups[g].Rules {
+			id := fmt.Sprintf("%s[%d]", p.Groups[g].Name, i)
+			for _, c := range r.Actions {
+				a, err := action.New(c)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", id, err)
+				}
+				actions[id] = append(actions[id], a)
+			}
+		}
+	}
+	return actions, nil
+}
+
+// unmuted drops the firing transitions that a silence or a maintenance
+// window mutes, so that their actions are not run; resolved ones are
+// kept. Notifications are muted by the dispatcher instead.
+func unmuted(st *engineState, rule threshold.Rule, alerts []threshold.Alert, now time.Time) []threshold.Alert {
+	kept := []threshold.Alert{}
+	for _, a := range alerts {
+		if a.State == threshold.StateFiring {
+			if by := st.silencer.Muted(a.Payload(), now); by != "" {
+				fmt.Printf("muted: %s %s %v by %s\n", rule.ID, a.State, a.Key, by)
+				continue
+			}
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// newElector returns the leader elector of the policy, or nil.
+func newElector(p yaml.PolicyYaml) (*ha.Elector, error) {
+	if !p.HA.Enabled {
+		return nil, nil
+	}
+	opts := stateRedis(p)
+	if opts == nil {
+		return nil, fmt.Errorf("no redis to hold the lock in")
+	}
+	ttl, err := optDuration(p.HA.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("ttl: %v", err)
+	}
+	return ha.NewElector(opts, p.HA.ID, ttl), nil
+}
+
+// newShard returns the share of the rules of this engine, or nil.
+func newShard(p yaml.PolicyYaml) (*ha.Shard, error) {
+	c := p.Sharding
+	if !c.Enabled {
+		return nil, nil
+	}
+	if p.HA.Enabled {
+		return nil, fmt.Errorf("cannot be combined with ha")
+	}
+	if c.By != "" && c.By != "group" && c.By != "series" {
+		return nil, fmt.Errorf("unknown by: %s", c.By)
+	}
+	opts := stateRedis(p)
+	if opts == nil {
+		return nil, fmt.Errorf("no redis to keep the members in")
+	}
+	ttl, err := optDuration(c.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("ttl: %v", err)
+	}
+	return ha.NewShard(opts, c.ID, ttl), nil
+}
+
+// owned returns whether a series of the rule is this engine's to
+// evaluate; nil when sharding by group or not at all.
+func owned(p yaml.PolicyYaml, st *engineState) func(threshold.ResourceLabel) bool {
+	if st.shard == nil || p.Sharding.By != "series" {
+		return nil
+	}
+	return func(key threshold.ResourceLabel) bool {
+		return st.shard.Owns(key.Fingerprint())
+	}
+}
+
+// forget drops the alerts and models of a rule evaluated by another
+// engine now. The firing alerts are withdrawn rather than resolved, so
+// that they do not flap on the receivers: their new owner fires them
+// again if they still match.
+func forget(st *engineState, ruleID string, keep func(threshold.ResourceLabel) bool) {
+	for _, id := range []string{ruleID, ruleID + ":nodata"} {
+		keepID := keep
+		if keep != nil && id != ruleID {
+			// nodata alerts also carry the metric of their series
+			keepID = func(key threshold.ResourceLabel) bool {
+				return keep(threshold.NoDataKey(key))
+			}
+		}
+		if firing := st.alerts.Forget(id, keepID); len(firing) > 0 {
+			fmt.Printf("shard: %s: %d firing alerts handed over\n", id, len(firing))
+			withdraw(st, st.rules[id], firing)
+		}
+	}
+	st.stale.Forget(ruleID, keep)
+	if keep == nil {
+		st.models.Forget(ruleID)
+	}
+}
+
+// transmit hands the alert transitions of rule to the dispatcher, for
+// putnotifReceiver as well when the putnotif block is set.
+func transmit(st *engineState, rule threshold.Rule, alerts []threshold.Alert, now time.Time) {
+	threshold.Transmit(st.dispatch, rule, alerts, now)
+	if st.putnotif && len(alerts) > 0 {
+		rule.Notify = []string{putnotifReceiver}
+		threshold.Transmit(st.dispatch, rule, alerts, now)
+	}
+}
+
+// withdraw takes the firing alerts of rule back from the dispatcher, for
+// putnotifReceiver as well when the putnotif block is set.
+func withdraw(st *engineState, rule threshold.Rule, alerts []threshold.Alert) {
+	for _, a := range alerts {
+		payload := a.Payload()
+		st.dispatch.Withdraw(rule.Notify, payload)
+		if st.putnotif {
+			st.dispatch.Withdraw([]string{putnotifReceiver}, payload)
+		}
+	}
+}
+
+// restore gives the firing alerts restored from the state back to the
+// dispatcher, and so to the receivers, for putnotifReceiver as well when
+// the putnotif block is set.
+func restore(st *engineState) {
+	for _, a := range st.alerts.Firing() {
+		payload := a.Payload()
+		st.dispatch.Restore(a.Rule.Notify, payload, a.NotifiedAt)
+		if st.putnotif {
+			st.dispatch.Restore([]string{putnotifReceiver}, payload, a.NotifiedAt)
+		}
+	}
+}
+
+// act queues the actions of rule for its alert transitions; standbys
+// leave them to the leader.
+func act(ctx context.Context, st *engineState, rule threshold.Rule, alerts []threshold.Alert) {
+	if st.leader != nil && len(alerts) > 0 {
+		if !st.leader.IsLeader() {
+			fmt.Printf("standby: %s: %d transitions left to the leader\n", rule.ID, len(alerts))
+			return
+		}
+		ctx = notify.WithFencingToken(ctx, st.leader.Token())
+	}
+	for _, a := range alerts {
+		payload := a.Payload()
+		for _, ac := range st.actions[rule.ID] {
+			if ac.Triggers(payload) {
+				st.queue.Submit(ctx, ac, rule.ID, payload)
+			}
+		}
+	}
+}
+
+// evaluate runs rule i of group gi once, reading its series within the
+// rule's timeout.
+func evaluate(ctx context.Context, p yaml.PolicyYaml, ds threshold.DataSource, st *engineState, gi, i int, now time.Time) {
+	g, r := p.Groups[gi], p.Groups[gi].Rules[i]
+	rule := st.rules[fmt.Sprintf("%s[%d]", g.Name, i)]
+	expr := rule.Expr
+	rctx, cancel := context.WithTimeout(ctx, st.timeouts[rule.ID])
+	rdlist, err := threshold.Read(rctx, ds, expr)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read: %s[%d]: %v\n", g.Name, i, err)
+		return
+	}
+	if st.hosts != nil {
+		for _, sr := range rdlist {
+			if host := st.hosts.Host(sr.Key["vm"]); host != "" && sr.Key["host"] == "" {
+				sr.Key["host"] = host
+			}
+		}
+	}
+	if keep := owned(p, st); keep != nil && threshold.CrossSeries(expr) {
+		// aggregations and joins need every series: the rule is sharded whole
+		if !st.shard.Owns(rule.ID) {
+			forget(st, rule.ID, nil)
+			return
+		}
+	} else if keep != nil {
+		mine := []threshold.Series{}
+		for _, sr := range rdlist {
+			if keep(sr.Key) {
+				mine = append(mine, sr)
+			}
+		}
+		rdlist = mine
+		forget(st, rule.ID, keep)
+	}
+	if threshold.Recording(expr) {
+		recorded := st.models.EvaluateRecord(rule.ID, expr, rdlist)
+		wctx, cancel := context.WithTimeout(ctx, st.timeouts[rule.ID])
+		defer cancel()
+		if err := st.writer.Write(wctx, r.Record, recorded, now); err != nil {
+			fmt.Fprintf(os.Stderr, "record: %s: %v\n", rule.ID, err)
+		}
+		return
+	}
+	matched := st.models.EvaluateSeries(rule.ID, expr, rdlist)
+
+	st.alerts.Observe(rule.ID, rdlist)
+	alerts := st.alerts.Update(rule, matched, now)
+	transmit(st, rule, alerts, now)
+	act(ctx, st, rule, unmuted(st, rule, alerts, now))
+
+	st.stale.Update(rule.ID, rdlist, now)
+	nodata, ok := st.rules[rule.ID+":nodata"]
+	if !ok {
+		return
+	}
+	stale := st.stale.Stale(rule.ID, nodata.NoDataAfter, now)
+	for _, s := range stale {
+		fmt.Printf("nodata: %s, no data for %v: %s%+v\n", rule.ID, now.Sub(s.LastSeen).Truncate(time.Second), s.Metric, s.Key)
+	}
+	transmit(st, nodata, st.alerts.Update(nodata, threshold.NoDataSeries(stale), now), now)
+}
+
+// evaluateGroup runs the rules of group gi on at most st.workers at once,
+// each after the rules of the group it reads the records of.
+func evaluateGroup(ctx context.Context, p yaml.PolicyYaml, ds threshold.DataSource, st *engineState, gi int, now time.Time) {
+	g := p.Groups[gi]
+	if st.shard != nil && p.Sharding.By != "series" && !st.shard.Owns(g.Name) {
+		for i := range g.Rules {
+			forget(st, fmt.Sprintf("%s[%d]", g.Name, i), nil)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, st.workers)
+	done := map[string]chan struct{}{}
+	for i := range g.Rules {
+		done[fmt.Sprintf("%s[%d]", g.Name, i)] = make(chan struct{})
+	}
+	// in dependency order, so that the rules holding a worker only wait
+	// for rules already started
+	for _, i := range st.graph.Order(g.Name) {
+		id := fmt.Sprintf("%s[%d]", g.Name, i)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, id string) {
+			defer func() { <-sem; wg.Done() }()
+			for _, dep := range st.graph.DependsOn(id) {
+				if ch, ok := done[dep]; ok {
+					<-ch
+				}
+			}
+			evaluate(ctx, p, ds, st, gi, i, now)
+			close(done[id])
+		}(i, id)
+	}
+	wg.Wait()
+}
+
+// settle shares the firing alerts with the inhibitor and saves the state
+// once a group has been evaluated.
+func settle(st *engineState) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	firing := []notify.Alert{}
+	for _, a := range st.alerts.Firing() {
+		firing = append(firing, a.Payload())
+	}
+	st.inhibitor.Update(firing)
+	if st.state != nil && (st.leader == nil || st.leader.IsLeader()) {
+		if err := st.state.Save(st.alerts.Snapshot()); err != nil {
+			fmt.Fprintf(os.Stderr, "state: %v\n", err)
+		}
+	}
+}
+
+// policyProcess starts evaluating every group concurrently, each after
+// the groups whose records it reads. A group whose previous run is still
+// in progress is skipped this time.
+func policyProcess(ctx context.Context, p yaml.PolicyYaml, ds threshold.DataSource, st *engineState) error {
+	now := time.Now()
+	if err := st.silencer.Refresh(now); err != nil {
+		fmt.Fprintf(os.Stderr, "silences: %v\n", err)
+	}
+	done := make([]chan struct{}, len(p.Groups))
+	for gi := range done {
+		done[gi] = make(chan struct{})
+	}
+	for gi, g := range p.Groups {
+		st.mu.Lock()
+		running := st.running[gi]
+		st.running[gi] = true
+		st.mu.Unlock()
+		if running {
+			fmt.Printf("skip: group %s: previous run still in progress\n", g.Name)
+			close(done[gi])
+			continue
 		}
+		st.wg.Add(1)
+		go func(gi int) {
+			defer st.wg.Done()
+			for _, dep := range st.deps[gi] {
+				<-done[dep]
+			}
+			evaluateGroup(ctx, p, ds, st, gi, now)
+			close(done[gi])
+			settle(st)
+			st.mu.Lock()
+			st.running[gi] = false
+			st.mu.Unlock()
+		}(gi)
 	}
-	fmt.Printf("\n")
 	return nil
 }
 
-func engineLoop(ctx context.Context, p yaml.PolicyYaml) error {
+func engineLoop(ctx context.Context, p yaml.PolicyYaml, ds threshold.DataSource, silencer *silence.Silencer, elector *ha.Elector, shard *ha.Shard) error {
 	fmt.Printf("loop start!\n")
+	receivers, err := notify.NewReceivers(receiverConfigs(p))
+	if err != nil {
+		return err
+	}
+	rules, err := newRules(p, receivers)
+	if err != nil {
+		return err
+	}
+	if elector != nil {
+		receivers.SetLeader(elector)
+	}
+	var topo *inhibit.Topology
+	if p.Topology != "" {
+		if topo, err = inhibit.LoadTopology(p.Topology); err != nil {
+			return fmt.Errorf("topology: %v", err)
+		}
+	}
+	var hosts *inhibit.Topology
+	if p.Evaluation.HostLabel {
+		if topo == nil {
+			return fmt.Errorf("evaluation: host_label needs a topology")
+		}
+		hosts = topo
+	}
+	inhibitor, err := inhibit.NewInhibitor(p.InhibitRules, topo)
+	if err != nil {
+		return err
+	}
+	dispatch, err := notify.NewDispatcher(receivers, p.Route, inhibitor)
+	if err != nil {
+		return err
+	}
+	actions, err := newActions(p)
+	if err != nil {
+		return err
+	}
+	recorder, err := action.NewRecorder(p.ActionLog)
+	if err != nil {
+		return err
+	}
+	queue := action.NewQueue(recorder, p.ActionQueue, p.ActionWorkers)
+	go queue.Run(ctx)
+	outbox, err := newOutbox(p, receivers)
+	if err != nil {
+		return fmt.Errorf("outbox: %v", err)
+	}
+	if outbox != nil {
+		dispatch.SendThrough(outbox)
+		go outbox.Run(ctx)
+	}
+	dispatch.MuteWith(silencer)
+	go receivers.Run(ctx)
+	go dispatch.Run(ctx)
+	state, err := newStateStore(p, shard)
+	if err != nil {
+		return err
+	}
+	alerts := threshold.NewAlertTracker()
+	if state != nil {
+		grace, err := optDuration(p.State.Grace)
+		if err != nil {
+			return fmt.Errorf("state: grace: %v", err)
+		}
+		if grace == 0 {
+			grace = time.Minute
+		}
+		records, err := state.Load()
+		if err != nil {
+			return fmt.Errorf("state: %v", err)
+		}
+		n := alerts.Restore(records, rules, time.Now().Add(grace))
+		fmt.Printf("state: restored %d alerts\n", n)
+		if dropped := len(records) - n; dropped > 0 {
+			fmt.Printf("state: dropped %d alerts of rules no longer in the policy\n", dropped)
+		}
+	}
+	timeouts, err := newTimeouts(p)
+	if err != nil {
+		return err
+	}
+	writer, err := checkRecords(p, rules, ds)
+	if err != nil {
+		return err
+	}
+	rg, err := newGraph(p, rules)
+	if err != nil {
+		return err
+	}
+	workers := p.Evaluation.Workers
+	if workers <= 0 {
+		workers = 4
+	}
 	ticker := time.NewTicker(time.Second) // need to change Nanoseconds()
+	st := &engineState{
+		stale:     threshold.NewStaleTracker(),
+		alerts:    alerts,
+		models:    threshold.NewModelTracker(),
+		state:     state,
+		dispatch:  dispatch,
+		actions:   actions,
+		queue:     queue,
+		silencer:  silencer,
+		inhibitor: inhibitor,
+		putnotif:  p.Putnotif.Socket != "",
+		hosts:     hosts,
+		leader:    elector,
+		shard:     shard,
+		rules:     rules,
+		workers:   workers,
+		timeouts:  timeouts,
+		writer:    writer,
+		graph:     rg,
+		deps:      groupDeps(p, rg),
+		running:   map[int]bool{},
+	}
+	restore(st)
+	if shard != nil {
+		// until the first heartbeat, the engine owns nothing and would
+		// resolve every alert it restored
+		fmt.Printf("shard: waiting for the first heartbeat\n")
+		select {
+		case <-shard.Ready():
+		case <-ctx.Done():
+			return nil
+		}
+	}
 	for {
 		select {
 		case t := <-ticker.C:
 			fmt.Printf("Current time: %v\n", t)
-			policyProcess(p)
+			policyProcess(ctx, p, ds, st)
 		case <-ctx.Done():
+			st.wg.Wait()
 			fmt.Printf("canceled!\n")
 			return nil
 		}
 	}
-	return nil
 }
 
 func engine_loop_main(p yaml.PolicyYaml) {
 	var g run.Group
 	ctx := context.Background()
+
+	ds, listener, err := newDataSource(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "datasource: %v\n", err)
+		os.Exit(1)
+	}
+	silencer, store, err := newSilencer(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "maintenance: %v\n", err)
+		os.Exit(1)
+	}
+	elector, err := newElector(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ha: %v\n", err)
+		os.Exit(1)
+	}
+	shard, err := newShard(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sharding: %v\n", err)
+		os.Exit(1)
+	}
 	{
 		signal_chan := make(chan os.Signal, 1)
 		signal.Notify(signal_chan,
@@ -87,7 +887,43 @@ func engine_loop_main(p yaml.PolicyYaml) {
 		ctx, cancel := context.WithCancel(ctx)
 		g.Add(
 			func() error {
-				return engineLoop(ctx, p)
+				return engineLoop(ctx, p, ds, silencer, elector, shard)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
+	if elector != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(
+			func() error {
+				return elector.Run(ctx)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
+	if shard != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(
+			func() error {
+				return shard.Run(ctx)
+			},
+			func(err error) {
+				cancel()
+			},
+		)
+	}
+
+	if listener != nil {
+		ctx, cancel := context.WithCancel(ctx)
+		g.Add(
+			func() error {
+				return listener.ListenAndServe(ctx)
 			},
 			func(err error) {
 				cancel()
@@ -95,6 +931,18 @@ func engine_loop_main(p yaml.PolicyYaml) {
 		)
 	}
 
+	if p.API.Listen != "" && store != nil {
+		srv := &http.Server{Addr: p.API.Listen, Handler: silence.Handler(store)}
+		g.Add(
+			func() error {
+				return srv.ListenAndServe()
+			},
+			func(err error) {
+				srv.Shutdown(context.Background())
+			},
+		)
+	}
+
 	if err := g.Run(); err != nil {
 		fmt.Fprintf(os.Stderr, "err: %v", err)
 	}
@@ -103,5 +951,19 @@ func engine_loop_main(p yaml.PolicyYaml) {
 
 func main() {
 	p := yaml.ParseYaml("sample.yaml")
+	if len(os.Args) > 1 && os.Args[1] == "silence" {
+		if err := silence_main(p, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "silence: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "graph" {
+		if err := graph_main(p, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "graph: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	engine_loop_main(p)
 }
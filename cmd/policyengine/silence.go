@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/silence"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/yaml"
+	"github.com/go-redis/redis"
+)
+
+// stateRedis returns where the engine keeps its own state: the redis
+// section of the policy, or else the datasource's redis. It is nil when
+// there is no redis to use.
+func stateRedis(p yaml.PolicyYaml) *redis.Options {
+	if p.Redis.Address != "" {
+		return &redis.Options{Addr: p.Redis.Address, Password: p.Redis.Password, DB: p.Redis.DB}
+	}
+	switch p.Datasource.Type {
+	case "", "redis", "redistimeseries":
+		addr := p.Datasource.Address
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		return &redis.Options{Addr: addr, Password: p.Datasource.Password, DB: p.Datasource.DB}
+	}
+	return nil
+}
+
+// newSilencer sets up the maintenance windows and, when there is a redis,
+// the silence store.
+func newSilencer(p yaml.PolicyYaml) (*silence.Silencer, *silence.Store, error) {
+	windows := []*silence.Window{}
+	for _, c := range p.Maintenance {
+		w, err := silence.NewWindow(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows = append(windows, w)
+	}
+	var store *silence.Store
+	if opts := stateRedis(p); opts != nil {
+		store = silence.NewStore(opts)
+	}
+	return silence.NewSilencer(store, windows), store, nil
+}
+
+// silence_main handles "policyengine silence add|list|expire".
+func silence_main(p yaml.PolicyYaml, args []string) error {
+	opts := stateRedis(p)
+	if opts == nil {
+		return fmt.Errorf("silences need a redis")
+	}
+	store := silence.NewStore(opts)
+	usage := fmt.Errorf("usage: silence add -m MATCHERS [-d DURATION] [-s START] [-b BY] [-c COMMENT] | list | expire ID")
+	if len(args) == 0 {
+		return usage
+	}
+	now := time.Now()
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("silence add", flag.ContinueOnError)
+		matchers := fs.String("m", "", `label matchers, e.g. '{vm=~"instance-0000000[1-4]"}'`)
+		duration := fs.String("d", "1h", "how long the silence lasts")
+		start := fs.String("s", "", "when it starts (RFC 3339), now if unset")
+		by := fs.String("b", os.Getenv("USER"), "who creates it")
+		comment := fs.String("c", "", "why")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *matchers == "" {
+			return usage
+		}
+		d, err := parser.ParseDuration(*duration)
+		if err != nil {
+			return err
+		}
+		startsAt := now
+		if *start != "" {
+			if startsAt, err = time.Parse(time.RFC3339, *start); err != nil {
+				return err
+			}
+		}
+		s := &silence.Silence{
+			Matchers:  *matchers,
+			StartsAt:  startsAt,
+			EndsAt:    startsAt.Add(d),
+			CreatedBy: *by,
+			Comment:   *comment,
+		}
+		if err := store.Add(s); err != nil {
+			return err
+		}
+		fmt.Println(s.ID)
+	case "list":
+		list, err := store.List(now, 24*time.Hour)
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			state := "active"
+			if now.Before(s.StartsAt) {
+				state = "pending"
+			} else if !s.Active(now) {
+				state = "expired"
+			}
+			fmt.Printf("%s %s\n", state, s.String())
+		}
+	case "expire":
+		if len(args) != 2 {
+			return usage
+		}
+		return store.Expire(args[1], now)
+	default:
+		return usage
+	}
+	return nil
+}
@@ -3,7 +3,11 @@ module github.com/distributed-monitoring/policy-engine-sandbox
 go 1.12
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20180125190556-5a6b3ba71ee6 // indirect
+	github.com/alicebob/miniredis v2.5.0+incompatible
 	github.com/go-redis/redis v6.15.2+incompatible
+	github.com/gomodule/redigo v2.0.0+incompatible // indirect
 	github.com/oklog/run v1.0.0
+	github.com/yuin/gopher-lua v0.0.0-20180827083657-b942cacc89fe // indirect
 	gopkg.in/yaml.v2 v2.2.2
 )
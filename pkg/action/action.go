@@ -0,0 +1,450 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package action runs the remediation actions rules declare for their
+// alerts: a local command, or a call to an HTTP endpoint such as Nova's
+// server action API. Every run is bounded by a timeout, a cooldown per
+// alerting series and a maximum number of runs per window.
+package action
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// maxOutput bounds the command output or response body kept in a Result.
+const maxOutput = 1024
+
+// Config is one entry of a rule's actions list.
+type Config struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // command or http
+	On   string `yaml:"on"`   // firing (default), resolved or any
+
+	// command: argv, run with the alert in POLICY_* environment variables
+	Command []string `yaml:"command"`
+
+	// http: url, body and headers may refer to the same variables, e.g.
+	// ${POLICY_LABEL_VM}, escaped for where they appear: the URL path or
+	// query, a JSON string in the body, a header value
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"` // POST if unset
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+
+	Timeout       string `yaml:"timeout"`        // 30s if unset
+	Cooldown      string `yaml:"cooldown"`       // per series, none if unset
+	MaxExecutions int    `yaml:"max_executions"` // per window, unlimited if 0
+	Window        string `yaml:"window"`         // 1h if unset
+	DryRun        bool   `yaml:"dry_run"`        // record what would run, run nothing
+}
+
+// Result records one execution, or why it was skipped.
+type Result struct {
+	Action   string            `json:"action"`
+	Rule     string            `json:"rule"`
+	Labels   map[string]string `json:"labels"`
+	State    string            `json:"state"`
+	Time     time.Time         `json:"time"`
+	Duration time.Duration     `json:"duration"`
+	DryRun   bool              `json:"dryRun,omitempty"`
+	Skipped  string            `json:"skipped,omitempty"` // cooldown, limit or queue full
+	Output   string            `json:"output,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func (r *Result) String() string {
+	status := "ok"
+	switch {
+	case r.Skipped != "":
+		status = "skipped (" + r.Skipped + ")"
+	case r.DryRun:
+		status = "dry-run"
+	case r.Error != "":
+		status = "failed: " + r.Error
+	}
+	return fmt.Sprintf("%s %s %s %v: %s", r.Action, r.Rule, r.State, threshold.ResourceLabel(r.Labels), status)
+}
+
+type runner func(ctx context.Context, env map[string]string) (string, error)
+
+type Action struct {
+	name     string
+	on       string
+	timeout  time.Duration
+	cooldown time.Duration
+	max      int
+	window   time.Duration
+	dryRun   bool
+	run      runner
+
+	mu   sync.Mutex
+	last map[string]time.Time // last run per series fingerprint
+	runs []time.Time          // runs within the window, oldest first
+}
+
+func optDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return parser.ParseDuration(s)
+}
+
+func New(c Config) (*Action, error) {
+	a := &Action{
+		name:   c.Name,
+		on:     c.On,
+		max:    c.MaxExecutions,
+		dryRun: c.DryRun,
+		last:   map[string]time.Time{},
+	}
+	if a.name == "" {
+		a.name = c.Type
+	}
+	switch a.on {
+	case "":
+		a.on = "firing"
+	case "firing", "resolved", "any":
+	default:
+		return nil, fmt.Errorf("action %s: on: %q is not firing, resolved or any", a.name, c.On)
+	}
+	var err error
+	if a.timeout, err = optDuration(c.Timeout, 30*time.Second); err != nil {
+		return nil, fmt.Errorf("action %s: timeout: %v", a.name, err)
+	}
+	if a.cooldown, err = optDuration(c.Cooldown, 0); err != nil {
+		return nil, fmt.Errorf("action %s: cooldown: %v", a.name, err)
+	}
+	if a.window, err = optDuration(c.Window, time.Hour); err != nil {
+		return nil, fmt.Errorf("action %s: window: %v", a.name, err)
+	}
+
+	switch c.Type {
+	case "command":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("action %s: command is empty", a.name)
+		}
+		a.run = commandRunner(c.Command)
+	case "http":
+		if c.URL == "" {
+			return nil, fmt.Errorf("action %s: http needs a url", a.name)
+		}
+		a.run = httpRunner(c, a.timeout)
+	default:
+		return nil, fmt.Errorf("action %s: unknown type %q (command or http)", a.name, c.Type)
+	}
+	return a, nil
+}
+
+var envInvalid = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// Env describes an alert to actions: POLICY_RULE, POLICY_GROUP,
+// POLICY_STATE, POLICY_VALUES, POLICY_LABELS (as JSON) and one
+// POLICY_LABEL_<NAME> per label, e.g. POLICY_LABEL_VM. Actions run by an
+// elected leader also get POLICY_FENCING_TOKEN.
+func Env(alert notify.Alert) map[string]string {
+	env := map[string]string{
+		"POLICY_RULE":  alert.Rule,
+		"POLICY_GROUP": alert.Group,
+		"POLICY_STATE": alert.State,
+	}
+	values := make([]string, 0, len(alert.Values))
+	for _, v := range alert.Values {
+		values = append(values, fmt.Sprint(v))
+	}
+	env["POLICY_VALUES"] = strings.Join(values, " ")
+	labels, _ := json.Marshal(alert.Labels)
+	env["POLICY_LABELS"] = string(labels)
+	for k, v := range alert.Labels {
+		env["POLICY_LABEL_"+envInvalid.ReplaceAllString(strings.ToUpper(k), "_")] = v
+	}
+	return env
+}
+
+func truncate(b []byte) string {
+	if len(b) > maxOutput {
+		b = b[:maxOutput]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func commandRunner(argv []string) runner {
+	return func(ctx context.Context, env map[string]string) (string, error) {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Env = os.Environ()
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		out, err := cmd.CombinedOutput()
+		return truncate(out), err
+	}
+}
+
+// jsonEscape escapes s to be placed between the quotes of a JSON string.
+func jsonEscape(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b[1 : len(b)-1])
+}
+
+// headerEscape percent-encodes the control characters of s, which would
+// otherwise end the header or make the request invalid.
+func headerEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c < 0x20 || c == 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func httpRunner(c Config, timeout time.Duration) runner {
+	client := &http.Client{Timeout: timeout}
+	method := c.Method
+	if method == "" {
+		method = "POST"
+	}
+	path, query := c.URL, ""
+	if i := strings.IndexByte(c.URL, '?'); i >= 0 {
+		path, query = c.URL[:i], c.URL[i:]
+	}
+	return func(ctx context.Context, env map[string]string) (string, error) {
+		expand := func(s string, escape func(string) string) string {
+			return os.Expand(s, func(k string) string { return escape(env[k]) })
+		}
+		target := expand(path, url.PathEscape) + expand(query, url.QueryEscape)
+		req, err := http.NewRequest(method, target, strings.NewReader(expand(c.Body, jsonEscape)))
+		if err != nil {
+			return "", err
+		}
+		req = req.WithContext(ctx)
+		if c.Body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token, ok := env["POLICY_FENCING_TOKEN"]; ok {
+			req.Header.Set("Fencing-Token", token)
+		}
+		for k, v := range c.Headers {
+			req.Header.Set(k, expand(v, headerEscape))
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		io.Copy(&body, io.LimitReader(resp.Body, maxOutput))
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return truncate(body.Bytes()), fmt.Errorf("%s %s: %s", method, target, resp.Status)
+		}
+		return truncate(body.Bytes()), nil
+	}
+}
+
+// Triggers reports whether the action runs on the alert's transition.
+func (a *Action) Triggers(alert notify.Alert) bool {
+	return a.on == "any" || a.on == alert.State
+}
+
+// allow applies the cooldown and the window limit, and counts the run
+// when it is allowed.
+func (a *Action) allow(fp string, now time.Time) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if last, ok := a.last[fp]; ok && a.cooldown > 0 && now.Sub(last) < a.cooldown {
+		return "cooldown"
+	}
+	runs := a.runs[:0]
+	for _, t := range a.runs {
+		if now.Sub(t) < a.window {
+			runs = append(runs, t)
+		}
+	}
+	a.runs = runs
+	if a.max > 0 && len(a.runs) >= a.max {
+		return "limit"
+	}
+	a.last[fp] = now
+	a.runs = append(a.runs, now)
+	return ""
+}
+
+// Execute runs the action for one alert transition of rule.
+func (a *Action) Execute(ctx context.Context, rule string, alert notify.Alert, now time.Time) Result {
+	res := Result{
+		Action: a.name,
+		Rule:   rule,
+		Labels: alert.Labels,
+		State:  alert.State,
+		Time:   now,
+		DryRun: a.dryRun,
+	}
+	if res.Skipped = a.allow(threshold.ResourceLabel(alert.Labels).Fingerprint(), now); res.Skipped != "" {
+		return res
+	}
+	if a.dryRun {
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+	start := time.Now()
+	env := Env(alert)
+	if token := notify.FencingToken(ctx); token != 0 {
+		env["POLICY_FENCING_TOKEN"] = fmt.Sprint(token)
+	}
+	out, err := a.run(ctx, env)
+	res.Duration = time.Since(start)
+	res.Output = out
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Queue sizes used when the policy sets none.
+const (
+	DefaultQueueSize    = 100
+	DefaultQueueWorkers = 4
+)
+
+type job struct {
+	ctx    context.Context
+	action *Action
+	rule   string
+	alert  notify.Alert
+}
+
+// Queue runs actions on a few workers so that slow ones do not hold up
+// evaluation. Submit never blocks: once size runs are waiting, further
+// ones are recorded as skipped.
+type Queue struct {
+	jobs     chan job
+	workers  int
+	recorder *Recorder
+}
+
+func NewQueue(recorder *Recorder, size, workers int) *Queue {
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	if workers <= 0 {
+		workers = DefaultQueueWorkers
+	}
+	return &Queue{jobs: make(chan job, size), workers: workers, recorder: recorder}
+}
+
+// Submit queues a run of the action for one alert transition of rule.
+// ctx is the context of the run, e.g. with the fencing token.
+func (q *Queue) Submit(ctx context.Context, a *Action, rule string, alert notify.Alert) {
+	select {
+	case q.jobs <- job{ctx: ctx, action: a, rule: rule, alert: alert}:
+	default:
+		q.record(Result{
+			Action:  a.name,
+			Rule:    rule,
+			Labels:  alert.Labels,
+			State:   alert.State,
+			Time:    time.Now(),
+			Skipped: "queue full",
+		})
+	}
+}
+
+// Run executes the queued runs until ctx is done, then waits for the
+// ones in progress.
+func (q *Queue) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case j := <-q.jobs:
+					q.record(j.action.Execute(j.ctx, j.rule, j.alert, time.Now()))
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (q *Queue) record(res Result) {
+	if err := q.recorder.Record(res); err != nil {
+		fmt.Fprintf(os.Stderr, "action log: %v\n", err)
+	}
+}
+
+// Recorder keeps the results of actions: each is printed, and appended as
+// a JSON line to the action log when there is one.
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewRecorder opens the action log at path; with no path results are
+// only printed.
+func NewRecorder(path string) (*Recorder, error) {
+	r := &Recorder{}
+	if path == "" {
+		return r, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+func (r *Recorder) Record(res Result) error {
+	fmt.Printf("action: %s\n", res.String())
+	if r.f == nil {
+		return nil
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(b, '\n'))
+	return err
+}
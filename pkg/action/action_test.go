@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package action
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+)
+
+func TestHTTPEscaping(t *testing.T) {
+	var path, query, body, header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query, header = r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Get("X-VM")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer srv.Close()
+
+	a, err := New(Config{
+		Type:    "http",
+		URL:     srv.URL + "/servers/${POLICY_LABEL_VM}/action?if=${POLICY_LABEL_IF}",
+		Body:    `{"vm": "${POLICY_LABEL_VM}"}`,
+		Headers: map[string]string{"X-VM": "${POLICY_LABEL_VM}"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := a.Execute(context.Background(), "test1[0]", notify.Alert{
+		Rule:   "test-rec1",
+		State:  "firing",
+		Labels: map[string]string{"vm": "a/b?\"c\"\r\nX-Evil: 1", "if": "tap&x=1"},
+	}, time.Now())
+	if res.Error != "" {
+		t.Fatal(res.Error)
+	}
+	tests := []struct{ name, got, want string }{
+		{"path", path, "/servers/a%2Fb%3F%22c%22%0D%0AX-Evil:%201/action"},
+		{"query", query, "if=tap%26x%3D1"},
+		{"body", body, `{"vm": "a/b?\"c\"\r\nX-Evil: 1"}`},
+		{"header", header, "a/b?\"c\"%0D%0AX-Evil: 1"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// blockingRunner runs until released, counting the runs started.
+func blockingRunner(started chan<- string, release <-chan struct{}) runner {
+	return func(ctx context.Context, env map[string]string) (string, error) {
+		started <- env["POLICY_LABEL_VM"]
+		<-release
+		return "", nil
+	}
+}
+
+func TestQueue(t *testing.T) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	a, err := New(Config{Type: "command", Command: []string{"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.run = blockingRunner(started, release)
+
+	recorder, _ := NewRecorder("")
+	q := NewQueue(recorder, 1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	alert := func(vm string) notify.Alert {
+		return notify.Alert{State: "firing", Labels: map[string]string{"vm": vm}}
+	}
+	// vm1 runs, vm2 waits, vm3 finds the queue full; none blocks Submit
+	q.Submit(context.Background(), a, "test1[0]", alert("vm1"))
+	if vm := <-started; vm != "vm1" {
+		t.Fatalf("started %s, want vm1", vm)
+	}
+	q.Submit(context.Background(), a, "test1[0]", alert("vm2"))
+	q.Submit(context.Background(), a, "test1[0]", alert("vm3"))
+
+	close(release)
+	if vm := <-started; vm != "vm2" {
+		t.Fatalf("started %s, want vm2", vm)
+	}
+	select {
+	case vm := <-started:
+		t.Errorf("%s ran past a full queue", vm)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	<-done
+}
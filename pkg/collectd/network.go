@@ -0,0 +1,242 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package collectd talks to collectd directly: it decodes the binary
+// network protocol sent by the network plugin, and reads values from and
+// puts notifications into the unixsock plugin.
+package collectd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Part types of the binary network protocol,
+// see https://collectd.org/wiki/index.php/Binary_protocol
+const (
+	partHost           = 0x0000
+	partTime           = 0x0001
+	partPlugin         = 0x0002
+	partPluginInstance = 0x0003
+	partType           = 0x0004
+	partTypeInstance   = 0x0005
+	partValues         = 0x0006
+	partInterval       = 0x0007
+	partTimeHR         = 0x0008
+	partIntervalHR     = 0x0009
+	partSignature      = 0x0200
+	partEncryption     = 0x0210
+)
+
+// Data source types of a values part.
+const (
+	dsCounter  = 0
+	dsGauge    = 1
+	dsDerive   = 2
+	dsAbsolute = 3
+)
+
+// SecurityLevel tells which packets are accepted, as in the network plugin.
+type SecurityLevel int
+
+const (
+	SecurityNone SecurityLevel = iota // accept anything, verify signatures when possible
+	SecuritySign                      // accept only packets signed by a known user
+)
+
+var (
+	ErrUnsigned    = errors.New("collectd: packet is not signed")
+	ErrSignature   = errors.New("collectd: signature mismatch")
+	ErrEncrypted   = errors.New("collectd: encrypted packets are not supported")
+	ErrMalformed   = errors.New("collectd: malformed packet")
+	ErrUnknownUser = errors.New("collectd: unknown user")
+)
+
+// ValueList is one sample of one collectd identifier.
+type ValueList struct {
+	Host           string
+	Plugin         string
+	PluginInstance string
+	Type           string
+	TypeInstance   string
+	Time           time.Time
+	Interval       time.Duration
+	Values         []float64
+}
+
+// Key returns the key write_redis would store the values under,
+// e.g. collectd/instance-00000001/virt/if_octets-tapd21acb51-35.
+func (vl *ValueList) Key() string {
+	plugin, typ := vl.Plugin, vl.Type
+	if vl.PluginInstance != "" {
+		plugin += "-" + vl.PluginInstance
+	}
+	if vl.TypeInstance != "" {
+		typ += "-" + vl.TypeInstance
+	}
+	return strings.Join([]string{"collectd", vl.Host, plugin, typ}, "/")
+}
+
+// Parser decodes network packets; Users maps user names onto the
+// passwords used to sign their packets.
+type Parser struct {
+	SecurityLevel SecurityLevel
+	Users         map[string]string
+}
+
+// cdtime converts collectd's 2^-30 second fixed point time.
+func cdtime(v uint64) time.Duration {
+	sec := v >> 30
+	frac := v & (1<<30 - 1)
+	return time.Duration(sec)*time.Second + time.Duration(frac*uint64(time.Second)>>30)
+}
+
+func parseString(b []byte) (string, error) {
+	if len(b) == 0 || b[len(b)-1] != 0 {
+		return "", ErrMalformed
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func parseNumber(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, ErrMalformed
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func parseValues(b []byte) ([]float64, error) {
+	if len(b) < 2 {
+		return nil, ErrMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) != n*9 {
+		return nil, ErrMalformed
+	}
+	types, data := b[:n], b[n:]
+	values := make([]float64, n)
+	for i, t := range types {
+		raw := data[i*8 : i*8+8]
+		switch t {
+		case dsGauge:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case dsDerive:
+			values[i] = float64(int64(binary.BigEndian.Uint64(raw)))
+		case dsCounter, dsAbsolute:
+			values[i] = float64(binary.BigEndian.Uint64(raw))
+		default:
+			return nil, fmt.Errorf("collectd: unknown data source type %d", t)
+		}
+	}
+	return values, nil
+}
+
+// verify checks a signature part against the rest of the packet.
+func (p *Parser) verify(part, rest []byte) error {
+	if len(part) < sha256.Size {
+		return ErrMalformed
+	}
+	sum, user := part[:sha256.Size], part[sha256.Size:]
+	password, ok := p.Users[string(user)]
+	if !ok {
+		return ErrUnknownUser
+	}
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(user)
+	mac.Write(rest)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return ErrSignature
+	}
+	return nil
+}
+
+// Parse decodes every value list of one packet.
+func (p *Parser) Parse(b []byte) ([]ValueList, error) {
+	var (
+		vl     ValueList
+		vls    []ValueList
+		signed bool
+	)
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrMalformed
+		}
+		typ := binary.BigEndian.Uint16(b)
+		length := int(binary.BigEndian.Uint16(b[2:]))
+		if length < 4 || length > len(b) {
+			return nil, ErrMalformed
+		}
+		part, rest := b[4:length], b[length:]
+
+		var err error
+		switch typ {
+		case partSignature:
+			if err = p.verify(part, rest); err == ErrUnknownUser && p.SecurityLevel == SecurityNone {
+				err = nil
+			}
+			signed = err == nil
+		case partEncryption:
+			err = ErrEncrypted
+		case partHost:
+			vl.Host, err = parseString(part)
+		case partPlugin:
+			vl.Plugin, err = parseString(part)
+		case partPluginInstance:
+			vl.PluginInstance, err = parseString(part)
+		case partType:
+			vl.Type, err = parseString(part)
+		case partTypeInstance:
+			vl.TypeInstance, err = parseString(part)
+		case partTime, partTimeHR, partInterval, partIntervalHR:
+			var v uint64
+			if v, err = parseNumber(part); err != nil {
+				break
+			}
+			switch typ {
+			case partTime:
+				vl.Time = time.Unix(int64(v), 0)
+			case partTimeHR:
+				vl.Time = time.Unix(0, int64(cdtime(v)))
+			case partInterval:
+				vl.Interval = time.Duration(v) * time.Second
+			case partIntervalHR:
+				vl.Interval = cdtime(v)
+			}
+		case partValues:
+			if p.SecurityLevel == SecuritySign && !signed {
+				return nil, ErrUnsigned
+			}
+			if vl.Values, err = parseValues(part); err != nil {
+				break
+			}
+			vls = append(vls, vl)
+			vl.Values = nil
+		}
+		// Other parts (notifications, ...) are skipped.
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+	}
+	return vls, nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package collectd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func part(typ uint16, body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(b, typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(body)))
+	return append(b, body...)
+}
+
+func stringPart(typ uint16, s string) []byte {
+	return part(typ, append([]byte(s), 0))
+}
+
+func numberPart(typ uint16, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return part(typ, b)
+}
+
+// valuesPart encodes one gauge, one derive and one counter.
+func valuesPart(gauge float64, derive int64, counter uint64) []byte {
+	b := []byte{0, 3, dsGauge, dsDerive, dsCounter}
+	b = append(b, make([]byte, 24)...)
+	binary.LittleEndian.PutUint64(b[5:], math.Float64bits(gauge))
+	binary.BigEndian.PutUint64(b[13:], uint64(derive))
+	binary.BigEndian.PutUint64(b[21:], counter)
+	return part(partValues, b)
+}
+
+func packet(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// sign prepends the signature part of user to the packet.
+func sign(user, password string, b []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write([]byte(user))
+	mac.Write(b)
+	return append(part(partSignature, append(mac.Sum(nil), user...)), b...)
+}
+
+var sample = packet(
+	stringPart(partHost, "instance-00000001"),
+	numberPart(partTimeHR, 1500000000<<30|1<<29), // and a half second
+	numberPart(partIntervalHR, 10<<30),
+	stringPart(partPlugin, "virt"),
+	stringPart(partType, "if_octets"),
+	stringPart(partTypeInstance, "tapd21acb51-35"),
+	valuesPart(1.5, -2, 3),
+	stringPart(partType, "memory"),
+	stringPart(partTypeInstance, "total"),
+	numberPart(partTime, 1500000001),
+	numberPart(partInterval, 20),
+	valuesPart(4, 5, 6),
+)
+
+func TestParse(t *testing.T) {
+	vls, err := (&Parser{}).Parse(sample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ValueList{{
+		Host:         "instance-00000001",
+		Plugin:       "virt",
+		Type:         "if_octets",
+		TypeInstance: "tapd21acb51-35",
+		Time:         time.Unix(1500000000, 500000000),
+		Interval:     10 * time.Second,
+		Values:       []float64{1.5, -2, 3},
+	}, {
+		Host:         "instance-00000001",
+		Plugin:       "virt",
+		Type:         "memory",
+		TypeInstance: "total",
+		Time:         time.Unix(1500000001, 0),
+		Interval:     20 * time.Second,
+		Values:       []float64{4, 5, 6},
+	}}
+	if !reflect.DeepEqual(vls, want) {
+		t.Errorf("got %+v\nwant %+v", vls, want)
+	}
+	if key := vls[0].Key(); key != "collectd/instance-00000001/virt/if_octets-tapd21acb51-35" {
+		t.Errorf("key %s", key)
+	}
+}
+
+func TestParseSecurity(t *testing.T) {
+	users := map[string]string{"collectd": "secret"}
+	tampered := sign("collectd", "secret", sample)
+	tampered[len(tampered)-1]++
+
+	tests := []struct {
+		name   string
+		level  SecurityLevel
+		packet []byte
+		err    error
+	}{
+		{"unsigned, none", SecurityNone, sample, nil},
+		{"unsigned, sign", SecuritySign, sample, ErrUnsigned},
+		{"signed, sign", SecuritySign, sign("collectd", "secret", sample), nil},
+		{"wrong password", SecuritySign, sign("collectd", "guess", sample), ErrSignature},
+		{"wrong password, none", SecurityNone, sign("collectd", "guess", sample), ErrSignature},
+		{"tampered", SecuritySign, tampered, ErrSignature},
+		{"unknown user, none", SecurityNone, sign("other", "secret", sample), nil},
+		{"unknown user, sign", SecuritySign, sign("other", "secret", sample), ErrUnknownUser},
+		{"short signature", SecurityNone, packet(part(partSignature, []byte("x")), sample), ErrMalformed},
+		{"encrypted", SecurityNone, packet(part(partEncryption, []byte("x"))), ErrEncrypted},
+		{"truncated", SecurityNone, sample[:len(sample)-3], ErrMalformed},
+		{"part length", SecurityNone, []byte{0, 0, 0, 2}, ErrMalformed},
+		{"unterminated string", SecurityNone, part(partHost, []byte("x")), ErrMalformed},
+		{"short number", SecurityNone, part(partTime, []byte{1}), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Parser{SecurityLevel: tt.level, Users: users}
+			vls, err := p.Parse(tt.packet)
+			if err != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if err == nil && len(vls) != 2 {
+				t.Errorf("got %d value lists, want 2", len(vls))
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package collectd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// DefaultAddr is where the network plugin sends to by default.
+const DefaultAddr = ":25826"
+
+// Appender receives the decoded samples, e.g. a tsdb.Store.
+type Appender interface {
+	Append(key string, t time.Time, values []float64)
+}
+
+// Server listens for network plugin packets on UDP.
+type Server struct {
+	Addr   string
+	Parser Parser
+	Store  Appender
+}
+
+// ListenAndServe receives packets until ctx is canceled. Packets that
+// fail to decode or verify are reported and dropped.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	addr := s.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		vls, err := s.Parser.Parse(buf[:n])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "collectd: %v: %v\n", from, err)
+			continue
+		}
+		for _, vl := range vls {
+			s.Store.Append(vl.Key(), vl.Time, vl.Values)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package collectd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// DefaultSocket is where the unixsock plugin listens by default.
+const DefaultSocket = "/var/run/collectd-unixsock"
+
+// DefaultTimeout bounds a connection, from dialing to its last reply,
+// when no timeout is given.
+const DefaultTimeout = 5 * time.Second
+
+// Conn is a connection to the unixsock plugin,
+// see https://collectd.org/documentation/manpages/collectd-unixsock.5.shtml
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Dial connects to the socket at path, DefaultSocket if empty; every
+// command on the connection must be done within timeout, DefaultTimeout
+// if 0.
+func Dial(path string, timeout time.Duration) (*Conn, error) {
+	return DialContext(context.Background(), path, timeout)
+}
+
+// DialContext is Dial giving up by ctx's deadline, if earlier.
+func DialContext(ctx context.Context, path string, timeout time.Duration) (*Conn, error) {
+	if path == "" {
+		path = DefaultSocket
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+		deadline = t
+	}
+	conn.SetDeadline(deadline)
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// command sends one command and returns the lines following the status
+// line; a negative status is returned as an error.
+func (c *Conn) command(cmd string) ([]string, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	status, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.SplitN(strings.TrimSpace(status), " ", 2)
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("unixsock: bad status line %q", status)
+	}
+	if n < 0 {
+		msg := ""
+		if len(fields) == 2 {
+			msg = fields[1]
+		}
+		return nil, fmt.Errorf("unixsock: %s: %s", strings.Fields(cmd)[0], msg)
+	}
+	lines := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.TrimRight(line, "\n"))
+	}
+	return lines, nil
+}
+
+// ListVal returns every identifier in collectd's value cache with the
+// time it was last updated.
+func (c *Conn) ListVal() (map[string]time.Time, error) {
+	lines, err := c.command("LISTVAL")
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]time.Time{}
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		t, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		ids[fields[1]] = time.Unix(0, int64(t*float64(time.Second)))
+	}
+	return ids, nil
+}
+
+// GetVal returns the cached values of one identifier, in data source order.
+func (c *Conn) GetVal(id string) ([]float64, error) {
+	lines, err := c.command(fmt.Sprintf("GETVAL %s", quote(id)))
+	if err != nil {
+		return nil, err
+	}
+	values := []float64{}
+	for _, line := range lines {
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unixsock: GETVAL %s: %v", id, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// Notification is what PUTNOTIF hands to collectd's notification plugins.
+type Notification struct {
+	Severity       string // failure, warning or okay
+	Time           time.Time
+	Host           string
+	Plugin         string
+	PluginInstance string
+	Type           string
+	TypeInstance   string
+	Message        string
+}
+
+func (c *Conn) PutNotif(n Notification) error {
+	opts := []string{
+		"severity=" + n.Severity,
+		fmt.Sprintf("time=%d", n.Time.Unix()),
+	}
+	for _, o := range []struct{ name, value string }{
+		{"host", n.Host},
+		{"plugin", n.Plugin},
+		{"plugin_instance", n.PluginInstance},
+		{"type", n.Type},
+		{"type_instance", n.TypeInstance},
+		{"message", n.Message},
+	} {
+		if o.value != "" {
+			opts = append(opts, o.name+"="+quote(o.value))
+		}
+	}
+	_, err := c.command("PUTNOTIF " + strings.Join(opts, " "))
+	return err
+}
+
+func quote(s string) string {
+	if !strings.ContainsAny(s, " \t\"\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// UnixsockSource is a threshold.DataSource reading collectd's value cache.
+// The cache holds only the current value of each identifier, so a query
+// yields at most one sample per series.
+type UnixsockSource struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (s *UnixsockSource) Query(ctx context.Context, q threshold.Query) ([]threshold.Series, error) {
+	pattern, index := threshold.MetricKey(q.Metric)
+
+	c, err := DialContext(ctx, s.Path, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	ids, err := c.ListVal()
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+
+	series := []threshold.Series{}
+	for _, id := range sorted {
+		updated := ids[id]
+		key := "collectd/" + id
+		if !strings.Contains(key, pattern) {
+			continue
+		}
+		rl, ok := threshold.SeriesLabels(key, q.Metric)
+		if !ok || !threshold.MatchLabels(q.Matchers, rl) {
+			continue
+		}
+		sr := threshold.Series{Key: rl, Samples: []threshold.Sample{}, LastSeen: updated}
+		if !updated.Before(q.Start) && !updated.After(q.End) {
+			values, err := c.GetVal(id)
+			if err != nil {
+				return nil, err
+			}
+			if index < len(values) {
+				sr.Samples = append(sr.Samples, threshold.Sample{Time: updated, Value: values[index]})
+			}
+		}
+		series = append(series, sr)
+	}
+	return series, nil
+}
+
+func init() {
+	notify.Register("collectd", newNotifier)
+}
+
+// Notifier feeds alerts back into collectd through PUTNOTIF, so that its
+// notification plugins (notify_email, write_*, ...) see them.
+type Notifier struct {
+	Path    string
+	Timeout time.Duration
+	Plugin  string // "policyengine" if unset
+}
+
+func newNotifier(c notify.ReceiverConfig) (notify.Notifier, error) {
+	timeout, err := c.TimeoutOr(0)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{Path: c.Socket, Timeout: timeout, Plugin: c.Plugin}, nil
+}
+
+func (n *Notifier) notification(a notify.Alert) Notification {
+	plugin := n.Plugin
+	if plugin == "" {
+		plugin = "policyengine"
+	}
+	message := fmt.Sprintf("%s %s: %v", a.Rule, a.State, threshold.ResourceLabel(a.Labels))
+	if a.Summary != "" {
+		message = a.Summary
+	}
+	severity, t := "failure", a.StartsAt
+	if !a.Firing() {
+		severity, t = "okay", *a.EndsAt
+	}
+	return Notification{
+		Severity:       severity,
+		Time:           t,
+		Host:           a.Labels["vm"],
+		Plugin:         plugin,
+		PluginInstance: a.Group,
+		Type:           a.Rule,
+		TypeInstance:   a.Labels["if"],
+		Message:        message,
+	}
+}
+
+func (n *Notifier) Notify(ctx context.Context, alerts []notify.Alert) error {
+	c, err := DialContext(ctx, n.Path, n.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	for _, a := range alerts {
+		if err := c.PutNotif(n.notification(a)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
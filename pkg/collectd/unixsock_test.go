@@ -0,0 +1,218 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package collectd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// fakeCollectd serves the unixsock protocol from a temporary socket,
+// answering LISTVAL and GETVAL from values and accepting PUTNOTIF.
+type fakeCollectd struct {
+	path    string
+	ln      net.Listener
+	updated map[string]time.Time
+	values  map[string]string // GETVAL reply lines, by identifier
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeCollectd(t *testing.T) *fakeCollectd {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCollectd{path: filepath.Join(dir, "collectd-unixsock")}
+	if f.ln, err = net.Listen("unix", f.path); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := f.ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeCollectd) Close() {
+	f.ln.Close()
+	os.RemoveAll(filepath.Dir(f.path))
+}
+
+func (f *fakeCollectd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSpace(line)
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		f.mu.Unlock()
+
+		fields := strings.SplitN(line, " ", 2)
+		switch fields[0] {
+		case "LISTVAL":
+			fmt.Fprintf(conn, "%d Values found\n", len(f.updated))
+			for id, t := range f.updated {
+				fmt.Fprintf(conn, "%d.000 %s\n", t.Unix(), id)
+			}
+		case "GETVAL":
+			v, ok := f.values[fields[1]]
+			if !ok {
+				fmt.Fprintf(conn, "-1 No such value\n")
+				continue
+			}
+			lines := strings.Split(v, "\n")
+			fmt.Fprintf(conn, "%d Values found\n", len(lines))
+			for _, l := range lines {
+				fmt.Fprintf(conn, "%s\n", l)
+			}
+		case "PUTNOTIF":
+			fmt.Fprintf(conn, "0 Success\n")
+		default:
+			fmt.Fprintf(conn, "-1 Unknown command: %s\n", fields[0])
+		}
+	}
+}
+
+func TestUnixsockSource(t *testing.T) {
+	f := newFakeCollectd(t)
+	defer f.Close()
+	now := time.Unix(1500000000, 0)
+	f.updated = map[string]time.Time{
+		"instance-00000001/virt/if_octets-tap1": now,
+		"instance-00000002/virt/if_octets-tap2": now.Add(-time.Hour),
+		"instance-00000001/virt/memory-total":   now,
+	}
+	f.values = map[string]string{
+		"instance-00000001/virt/if_octets-tap1": "rx=1.500000e+01\ntx=2.500000e+01",
+	}
+
+	matchers, _ := parser.ParseMatchers(`{vm=~"instance-.*"}`)
+	s := &UnixsockSource{Path: f.path, Timeout: time.Second}
+	series, err := s.Query(context.Background(), threshold.Query{
+		Metric:   "vm.if_octets.tx",
+		Matchers: matchers,
+		Start:    now.Add(-time.Minute),
+		End:      now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want 2: %+v", len(series), series)
+	}
+	if got := series[0]; got.Key["if"] != "tap1" || len(got.Samples) != 1 || got.Samples[0].Value != 25 {
+		t.Errorf("current series: %+v", got)
+	}
+	if got := series[1]; got.Key["if"] != "tap2" || len(got.Samples) != 0 || !got.LastSeen.Equal(now.Add(-time.Hour)) {
+		t.Errorf("stale series: %+v", got)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	f := newFakeCollectd(t)
+	defer f.Close()
+	startsAt := time.Unix(1500000000, 0)
+	endsAt := startsAt.Add(time.Minute)
+
+	n := &Notifier{Path: f.path, Timeout: time.Second}
+	err := n.Notify(context.Background(), []notify.Alert{{
+		Rule:     "test-rec1",
+		Group:    "test1",
+		Labels:   map[string]string{"vm": "instance-00000001", "if": "tap1"},
+		State:    "firing",
+		StartsAt: startsAt,
+		Summary:  `rx of "tap1" is low`,
+	}, {
+		Rule:     "test-rec1",
+		Group:    "test1",
+		Labels:   map[string]string{"vm": "instance-00000001"},
+		State:    "resolved",
+		StartsAt: startsAt,
+		EndsAt:   &endsAt,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`PUTNOTIF severity=failure time=1500000000 host=instance-00000001 plugin=policyengine plugin_instance=test1 type=test-rec1 type_instance=tap1 message="rx of \"tap1\" is low"`,
+		`PUTNOTIF severity=okay time=1500000060 host=instance-00000001 plugin=policyengine plugin_instance=test1 type=test-rec1 message="test-rec1 resolved: {vm=\"instance-00000001\"}"`,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.Join(f.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(f.commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "collectd-unixsock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept and never answer
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	c, err := Dial(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.ListVal(); err == nil {
+		t.Fatal("LISTVAL on a stuck socket succeeded")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package graph tells which rules feed which: a rule depends on the
+// recording rules whose records its expression reads.
+package graph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Rule is a node of the graph.
+type Rule struct {
+	ID        string   `json:"id"` // e.g. test1[0]
+	Group     string   `json:"group"`
+	Index     int      `json:"-"` // within the group
+	Record    string   `json:"record,omitempty"`
+	Recording bool     `json:"recording"`
+	Metrics   []string `json:"metrics"` // read by the expression
+}
+
+// Edge tells that To reads what From records.
+type Edge struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Metric string `json:"metric"`
+}
+
+type Graph struct {
+	Rules []Rule `json:"rules"`
+	Edges []Edge `json:"edges"`
+
+	deps map[string][]string // rule ID to the IDs it reads from
+	byID map[string]*Rule
+}
+
+// New builds the graph of rules, listed group by group, and rejects it
+// if rules depend on each other in a cycle.
+func New(rules []Rule) (*Graph, error) {
+	g := &Graph{Rules: rules, Edges: []Edge{}, deps: map[string][]string{}, byID: map[string]*Rule{}}
+	recordedBy := map[string]string{}
+	for i := range rules {
+		r := &g.Rules[i]
+		g.byID[r.ID] = r
+		if r.Recording {
+			recordedBy[r.Record] = r.ID
+		}
+	}
+	for _, r := range g.Rules {
+		for _, m := range r.Metrics {
+			from, ok := recordedBy[m]
+			if !ok {
+				continue
+			}
+			g.Edges = append(g.Edges, Edge{From: from, To: r.ID, Metric: m})
+			g.deps[r.ID] = append(g.deps[r.ID], from)
+		}
+	}
+	if cycle := g.cycle(); cycle != nil {
+		return nil, fmt.Errorf("rules depend on each other: %s", strings.Join(cycle, " -> "))
+	}
+	if cycle := g.groupCycle(); cycle != nil {
+		return nil, fmt.Errorf("groups depend on each other: %s", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// findCycle walks deps depth-first from every node and returns the first
+// cycle found, nil if none.
+func findCycle(nodes []string, deps func(string) []string) []string {
+	state := map[string]int{} // 1 visiting, 2 done
+	var visit func(n string, path []string) []string
+	visit = func(n string, path []string) []string {
+		path = append(path, n)
+		switch state[n] {
+		case 1:
+			return path
+		case 2:
+			return nil
+		}
+		state[n] = 1
+		for _, d := range deps(n) {
+			if cycle := visit(d, path); cycle != nil {
+				return cycle
+			}
+		}
+		state[n] = 2
+		return nil
+	}
+	for _, n := range nodes {
+		if cycle := visit(n, nil); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+func (g *Graph) cycle() []string {
+	ids := []string{}
+	for _, r := range g.Rules {
+		ids = append(ids, r.ID)
+	}
+	return findCycle(ids, func(id string) []string { return g.deps[id] })
+}
+
+func (g *Graph) groupCycle() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, r := range g.Rules {
+		if !seen[r.Group] {
+			seen[r.Group] = true
+			names = append(names, r.Group)
+		}
+	}
+	return findCycle(names, g.GroupDeps)
+}
+
+// DependsOn returns the IDs of the rules id reads the records of.
+func (g *Graph) DependsOn(id string) []string {
+	return g.deps[id]
+}
+
+// GroupDeps returns the other groups whose records the rules of group
+// read, sorted.
+func (g *Graph) GroupDeps(group string) []string {
+	seen := map[string]bool{}
+	deps := []string{}
+	for _, r := range g.Rules {
+		if r.Group != group {
+			continue
+		}
+		for _, id := range g.deps[r.ID] {
+			dep := g.byID[id].Group
+			if dep != group && !seen[dep] {
+				seen[dep] = true
+				deps = append(deps, dep)
+			}
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// Order returns the indexes of the rules of group such that each comes
+// after the rules of the group it depends on, otherwise in file order.
+func (g *Graph) Order(group string) []int {
+	order := []int{}
+	done := map[string]bool{}
+	var visit func(r *Rule)
+	visit = func(r *Rule) {
+		if done[r.ID] {
+			return
+		}
+		done[r.ID] = true
+		for _, id := range g.deps[r.ID] {
+			if dep := g.byID[id]; dep.Group == group {
+				visit(dep)
+			}
+		}
+		order = append(order, r.Index)
+	}
+	for i := range g.Rules {
+		if g.Rules[i].Group == group {
+			visit(&g.Rules[i])
+		}
+	}
+	return order
+}
+
+// WriteDOT writes the graph for Graphviz, one cluster per group.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	fmt.Fprintf(w, "digraph rules {\n\trankdir=LR;\n")
+	groups := []string{}
+	members := map[string][]*Rule{}
+	for i := range g.Rules {
+		r := &g.Rules[i]
+		if _, ok := members[r.Group]; !ok {
+			groups = append(groups, r.Group)
+		}
+		members[r.Group] = append(members[r.Group], r)
+	}
+	for i, name := range groups {
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n\t\tlabel=%q;\n", i, name)
+		for _, r := range members[name] {
+			shape := "box"
+			if r.Recording {
+				shape = "ellipse"
+			}
+			label := r.ID
+			if r.Record != "" {
+				label += "\\n" + r.Record
+			}
+			fmt.Fprintf(w, "\t\t%q [label=\"%s\", shape=%s];\n", r.ID, strings.Replace(label, `"`, `\"`, -1), shape)
+		}
+		fmt.Fprintf(w, "\t}\n")
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "\t%q -> %q;\n", e.From, e.To)
+	}
+	_, err := fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// WriteJSON writes the rules and edges as JSON.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
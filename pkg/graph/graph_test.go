@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package graph
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// rules builds the rules of one or more groups from "group: record <- metric, ..."
+// specs, one per rule, a record starting with "!" being an alerting rule.
+func rules(specs ...string) []Rule {
+	list := []Rule{}
+	index := map[string]int{}
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		group := parts[0]
+		sides := strings.SplitN(strings.TrimSpace(parts[1]), "<-", 2)
+		record := strings.TrimSpace(sides[0])
+		r := Rule{
+			ID:        fmt.Sprintf("%s[%d]", group, index[group]),
+			Group:     group,
+			Index:     index[group],
+			Record:    strings.TrimPrefix(record, "!"),
+			Recording: !strings.HasPrefix(record, "!"),
+		}
+		for _, m := range strings.Split(sides[1], ",") {
+			r.Metrics = append(r.Metrics, strings.TrimSpace(m))
+		}
+		index[group]++
+		list = append(list, r)
+	}
+	return list
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		edges []Edge
+		err   string // in the error, "" if none
+	}{
+		{
+			name:  "independent",
+			rules: rules("g: a <- vm.cpu", "g: !b <- vm.mem"),
+			edges: []Edge{},
+		},
+		{
+			name:  "chain",
+			rules: rules("g: !alert <- rate", "g: rate <- vm.rx", "h: !other <- rate, vm.tx"),
+			edges: []Edge{{From: "g[1]", To: "g[0]", Metric: "rate"}, {From: "g[1]", To: "h[0]", Metric: "rate"}},
+		},
+		{
+			name:  "alerting rules record nothing",
+			rules: rules("g: !x <- vm.rx", "g: !y <- x"),
+			edges: []Edge{},
+		},
+		{
+			name:  "self",
+			rules: rules("g: a <- a"),
+			err:   "rules depend on each other: g[0] -> g[0]",
+		},
+		{
+			name:  "rule cycle",
+			rules: rules("g: a <- c", "g: b <- a", "g: c <- b"),
+			err:   "rules depend on each other: g[0] -> g[2] -> g[1] -> g[0]",
+		},
+		{
+			name:  "group cycle",
+			rules: rules("g: a <- vm.rx", "g: b <- d", "h: c <- vm.tx", "h: d <- a"),
+			err:   "groups depend on each other: g -> h -> g",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := New(tt.rules)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(g.Edges, tt.edges) {
+				t.Errorf("edges %v, want %v", g.Edges, tt.edges)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		group string
+		want  []int
+	}{
+		{
+			name:  "file order",
+			rules: rules("g: a <- vm.rx", "g: b <- vm.tx", "g: !c <- vm.mem"),
+			group: "g",
+			want:  []int{0, 1, 2},
+		},
+		{
+			name:  "dependencies first",
+			rules: rules("g: !alert <- sum", "g: sum <- rate", "g: rate <- vm.rx"),
+			group: "g",
+			want:  []int{2, 1, 0},
+		},
+		{
+			name:  "only what must move",
+			rules: rules("g: !x <- b", "g: a <- vm.rx", "g: b <- vm.tx", "g: !y <- a"),
+			group: "g",
+			want:  []int{2, 0, 1, 3},
+		},
+		{
+			name:  "other groups ignored",
+			rules: rules("g: !x <- r", "g: !y <- vm.rx", "h: r <- vm.tx"),
+			group: "g",
+			want:  []int{0, 1},
+		},
+		{
+			name:  "group of its own",
+			rules: rules("g: !x <- r", "h: r <- vm.tx", "h: !z <- r"),
+			group: "h",
+			want:  []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := New(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := g.Order(tt.group); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Order(%s) = %v, want %v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupDeps(t *testing.T) {
+	g, err := New(rules("a: !x <- r, s", "b: r <- vm.rx", "c: s <- vm.tx", "c: !y <- r"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for group, want := range map[string][]string{"a": {"b", "c"}, "b": {}, "c": {"b"}} {
+		if got := g.GroupDeps(group); !reflect.DeepEqual(got, want) {
+			t.Errorf("GroupDeps(%s) = %v, want %v", group, got, want)
+		}
+	}
+	if got, want := g.DependsOn("a[0]"), []string{"b[0]", "c[0]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DependsOn(a[0]) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package ha lets several engines run side by side: either one of them
+// is elected through a redis lock to notify and act while the others
+// stand by, or they split the rules between them.
+package ha
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Redis keys of the election.
+const (
+	LeaderKey = "policyengine:leader"       // holds the leader's ID, with the TTL
+	TokenKey  = "policyengine:leader:token" // fencing token, incremented on each election
+)
+
+// acquire renews the lock if it is ours and returns our fencing token,
+// or takes it if it is free and returns the new token; it returns 0 if
+// someone else holds it.
+var acquire = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	local token = redis.call("GET", KEYS[2])
+	if not token then
+		token = redis.call("INCR", KEYS[2])
+	end
+	return tonumber(token)
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return redis.call("INCR", KEYS[2])
+end
+return 0
+`)
+
+// release deletes the lock if it is still ours.
+var release = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Elector takes part in the election. It implements notify.Leader.
+type Elector struct {
+	client *redis.Client
+	id     string
+	ttl    time.Duration
+
+	mu    sync.RWMutex
+	token int64
+	until time.Time // leadership is assumed lost from then on
+}
+
+// NewElector returns an elector for the engine id, hostname and pid if
+// empty. The lock expires ttl after the leader last renewed it.
+func NewElector(opts *redis.Options, id string, ttl time.Duration) *Elector {
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	return &Elector{client: redis.NewClient(opts), id: id, ttl: ttl}
+}
+
+// ID is what the elector writes into the lock.
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// IsLeader reports whether this engine holds the lock. Leadership ends a
+// little before the lock expires, to leave room for clock drift.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.token != 0 && time.Now().Before(e.until)
+}
+
+// Token returns the fencing token of the current leadership, 0 if none.
+// It grows with each election, so that whatever receives it can refuse
+// a former leader.
+func (e *Elector) Token() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.token
+}
+
+// campaign renews the lock when it is ours, tries to take it otherwise.
+// On errors leadership goes on until it was last renewed for, which the
+// lock outlives, so that a transient failure does not step down a leader
+// no one can replace yet.
+func (e *Elector) campaign(ctx context.Context) error {
+	client := e.client.WithContext(ctx)
+	start := time.Now()
+	ms := int64(e.ttl / time.Millisecond)
+	until := start.Add(e.ttl - e.ttl/5)
+
+	token, err := acquire.Run(client, []string{LeaderKey, TokenKey}, e.id, ms).Int64()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case token == 0 && e.token != 0:
+		fmt.Printf("leader: %s lost leadership (token %d)\n", e.id, e.token)
+	case token != 0 && token != e.token:
+		fmt.Printf("leader: %s elected (token %d)\n", e.id, token)
+	}
+	e.token = token
+	if token != 0 {
+		e.until = until
+	}
+	return nil
+}
+
+// Run campaigns every third of the TTL until ctx is done, then gives the
+// lock up so that a standby takes over at once.
+func (e *Elector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		if err := e.campaign(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "leader: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			e.mu.Lock()
+			leading := e.token != 0
+			e.token = 0
+			e.mu.Unlock()
+			if leading {
+				release.Run(e.client, []string{LeaderKey}, e.id)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package ha
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func testElectors(t *testing.T, ttl time.Duration, ids ...string) ([]*Elector, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	electors := []*Elector{}
+	for _, id := range ids {
+		electors = append(electors, NewElector(&redis.Options{Addr: m.Addr()}, id, ttl))
+	}
+	return electors, m
+}
+
+// expect checks the leadership and token of e after a campaign.
+func expect(t *testing.T, e *Elector, leader bool, token int64) {
+	t.Helper()
+	if err := e.campaign(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e.IsLeader() != leader || e.Token() != token {
+		t.Errorf("%s: leader %v, token %d; want %v, %d", e.ID(), e.IsLeader(), e.Token(), leader, token)
+	}
+}
+
+func TestElection(t *testing.T) {
+	electors, m := testElectors(t, 10*time.Second, "engine-1", "engine-2")
+	defer m.Close()
+	e1, e2 := electors[0], electors[1]
+
+	// the first to campaign takes the lock with the first token
+	expect(t, e1, true, 1)
+	expect(t, e2, false, 0)
+	if got, _ := m.Get(LeaderKey); got != "engine-1" {
+		t.Errorf("lock held by %q", got)
+	}
+	if ttl := m.TTL(LeaderKey); ttl != 10*time.Second {
+		t.Errorf("lock TTL %v", ttl)
+	}
+
+	// renewing keeps the token and pushes the expiry back
+	m.FastForward(6 * time.Second)
+	expect(t, e1, true, 1)
+	if ttl := m.TTL(LeaderKey); ttl != 10*time.Second {
+		t.Errorf("renewed lock TTL %v", ttl)
+	}
+	m.FastForward(6 * time.Second)
+	expect(t, e2, false, 0)
+
+	// once the lock expires the standby takes over with a greater token
+	m.FastForward(10 * time.Second)
+	expect(t, e2, true, 2)
+
+	// the former leader's renewal is refused: it steps down, and its
+	// token, older than the new leader's, is dropped
+	expect(t, e1, false, 0)
+	if got, _ := m.Get(LeaderKey); got != "engine-2" {
+		t.Errorf("lock held by %q after the refused renewal", got)
+	}
+	if got, _ := m.Get(TokenKey); got != "2" {
+		t.Errorf("token %s after the refused renewal", got)
+	}
+
+	// and it cannot release the lock it lost
+	release.Run(e1.client, []string{LeaderKey}, e1.ID())
+	expect(t, e2, true, 2)
+}
+
+func TestElectionRedisDown(t *testing.T) {
+	electors, m := testElectors(t, 500*time.Millisecond, "engine-1")
+	e := electors[0]
+	expect(t, e, true, 1)
+
+	// leadership outlives a failed renewal until it would have expired,
+	// less a fifth of the TTL
+	m.Close()
+	if err := e.campaign(context.Background()); err == nil {
+		t.Fatal("no error with redis down")
+	}
+	if !e.IsLeader() || e.Token() != 1 {
+		t.Errorf("stepped down at once: leader %v, token %d", e.IsLeader(), e.Token())
+	}
+	time.Sleep(400 * time.Millisecond)
+	if e.IsLeader() {
+		t.Error("still leading once the lock may have expired")
+	}
+}
+
+func TestElectorRun(t *testing.T) {
+	electors, m := testElectors(t, 300*time.Millisecond, "engine-1")
+	defer m.Close()
+	e := electors[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for !e.IsLeader() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !e.IsLeader() {
+		t.Fatal("not elected")
+	}
+	// stopping gives the lock up at once
+	cancel()
+	<-done
+	if e.IsLeader() || m.Exists(LeaderKey) {
+		t.Errorf("lock kept after Run: leader %v", e.IsLeader())
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package ha
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// MembersKey is the sorted set of engine IDs scored by their last
+// heartbeat, in unix milliseconds.
+const MembersKey = "policyengine:members"
+
+// Ring places keys on members by consistent hashing, as go-redis's
+// internal/consistenthash does for ring shards: each member is hashed
+// replicas times around a circle and owns the keys up to its points.
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	members  map[uint32]string
+}
+
+func NewRing(replicas int, members ...string) *Ring {
+	r := &Ring{replicas: replicas, members: map[uint32]string{}}
+	for _, m := range members {
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + m))
+			r.hashes = append(r.hashes, h)
+			r.members[h] = m
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Get returns the member owning key, "" if the ring is empty.
+func (r *Ring) Get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.members[r.hashes[i]]
+}
+
+// Shard is one engine's share of the rules. Engines announce themselves
+// with heartbeats in redis; the ring is rebuilt, and the keys moved to
+// their new owners, whenever one joins or stops beating for ttl.
+type Shard struct {
+	client *redis.Client
+	id     string
+	ttl    time.Duration
+
+	mu      sync.RWMutex
+	members []string
+	ring    *Ring
+
+	ready     chan struct{} // closed once the first heartbeat went through
+	readyOnce sync.Once
+}
+
+// NewShard returns the shard of the engine id, hostname and pid if empty.
+func NewShard(opts *redis.Options, id string, ttl time.Duration) *Shard {
+	if id == "" {
+		host, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	return &Shard{client: redis.NewClient(opts), id: id, ttl: ttl, ring: NewRing(0), ready: make(chan struct{})}
+}
+
+// Ready is closed once the first heartbeat went through, and the engine
+// knows its share.
+func (s *Shard) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// ID is what the shard announces in its heartbeats.
+func (s *Shard) ID() string {
+	return s.id
+}
+
+// Members returns the engines sharing the rules, sorted.
+func (s *Shard) Members() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.members
+}
+
+// Owns reports whether key belongs to this engine. Nothing does until
+// the first heartbeat went through: wait for Ready first.
+func (s *Shard) Owns(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ring.Get(key) == s.id
+}
+
+// beat renews this engine's heartbeat, drops the members whose heartbeat
+// is older than ttl and rebuilds the ring if they changed.
+func (s *Shard) beat(ctx context.Context) error {
+	client := s.client.WithContext(ctx)
+	now := time.Now()
+	ms := func(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+	var members *redis.StringSliceCmd
+	_, err := client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(MembersKey, redis.Z{Score: float64(ms(now)), Member: s.id})
+		pipe.ZRemRangeByScore(MembersKey, "-inf", fmt.Sprintf("(%d", ms(now.Add(-s.ttl))))
+		members = pipe.ZRange(MembersKey, 0, -1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ids := members.Val()
+	sort.Strings(ids)
+
+	s.mu.Lock()
+	if strings.Join(ids, ",") != strings.Join(s.members, ",") {
+		fmt.Printf("shard: %s rebalanced over %d members: %v\n", s.id, len(ids), ids)
+		s.members = ids
+		s.ring = NewRing(100, ids...)
+	}
+	s.mu.Unlock()
+	s.readyOnce.Do(func() { close(s.ready) })
+	return nil
+}
+
+// Run beats every third of the TTL until ctx is done, then leaves the
+// ring so that the others take this engine's keys over at once.
+func (s *Shard) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		if err := s.beat(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "shard: %v\n", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.client.ZRem(MembersKey, s.id)
+			return nil
+		}
+	}
+}
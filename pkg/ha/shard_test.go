@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package ha
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func testKeys(n int) []string {
+	keys := []string{}
+	for i := 0; i < n; i++ {
+		keys = append(keys, fmt.Sprintf("test%d[%d]", i/10, i%10))
+	}
+	return keys
+}
+
+func TestRingDistribution(t *testing.T) {
+	if got := NewRing(100).Get("test1[0]"); got != "" {
+		t.Errorf("empty ring: Get = %q", got)
+	}
+	members := []string{"engine-1", "engine-2", "engine-3"}
+	r := NewRing(100, members...)
+	keys := testKeys(3000)
+	count := map[string]int{}
+	for _, k := range keys {
+		count[r.Get(k)]++
+	}
+	for _, m := range members {
+		// a third each, give or take
+		if count[m] < 700 || count[m] > 1300 {
+			t.Errorf("%s owns %d of %d keys: %v", m, count[m], len(keys), count)
+		}
+	}
+	if len(count) != len(members) {
+		t.Errorf("owners %v", count)
+	}
+	// the same members in another order place the keys alike
+	other := NewRing(100, "engine-3", "engine-1", "engine-2")
+	for _, k := range keys {
+		if r.Get(k) != other.Get(k) {
+			t.Fatalf("%s placed on %s and %s", k, r.Get(k), other.Get(k))
+		}
+	}
+}
+
+func TestRingRebalance(t *testing.T) {
+	keys := testKeys(3000)
+	before := NewRing(100, "engine-1", "engine-2", "engine-3")
+	tests := []struct {
+		name    string
+		members []string
+		moved   func(from, to string) bool // the moves allowed
+	}{
+		{
+			name:    "join",
+			members: []string{"engine-1", "engine-2", "engine-3", "engine-4"},
+			moved:   func(from, to string) bool { return to == "engine-4" },
+		},
+		{
+			name:    "leave",
+			members: []string{"engine-1", "engine-3"},
+			moved:   func(from, to string) bool { return from == "engine-2" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			after := NewRing(100, tt.members...)
+			moved := 0
+			for _, k := range keys {
+				from, to := before.Get(k), after.Get(k)
+				if from == to {
+					continue
+				}
+				moved++
+				if !tt.moved(from, to) {
+					t.Errorf("%s moved from %s to %s", k, from, to)
+				}
+			}
+			// only the share of the member joining or leaving moves
+			if moved < len(keys)/6 || moved > len(keys)/2 {
+				t.Errorf("%d of %d keys moved", moved, len(keys))
+			}
+		})
+	}
+}
+
+func TestShardBeat(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	opts := &redis.Options{Addr: m.Addr()}
+	ctx := context.Background()
+
+	s1 := NewShard(opts, "engine-1", time.Minute)
+	s2 := NewShard(opts, "engine-2", time.Minute)
+	keys := testKeys(100)
+	if s1.Owns(keys[0]) {
+		t.Error("owns keys before the first heartbeat")
+	}
+	select {
+	case <-s1.Ready():
+		t.Error("ready before the first heartbeat")
+	default:
+	}
+
+	// alone, then joined by engine-2: keys split between them
+	if err := s1.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-s1.Ready()
+	for _, k := range keys {
+		if !s1.Owns(k) {
+			t.Fatalf("engine-1 alone does not own %s", k)
+		}
+	}
+	if err := s2.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"engine-1", "engine-2"}
+	if got := s1.Members(); !reflect.DeepEqual(got, want) {
+		t.Errorf("members %v, want %v", got, want)
+	}
+	owned := 0
+	for _, k := range keys {
+		if s1.Owns(k) == s2.Owns(k) {
+			t.Errorf("%s: owned by both or neither", k)
+		}
+		if s1.Owns(k) {
+			owned++
+		}
+	}
+	if owned == 0 || owned == len(keys) {
+		t.Errorf("engine-1 owns %d of %d keys", owned, len(keys))
+	}
+
+	// engine-2 stops beating for the TTL: engine-1 takes everything back
+	old := float64(time.Now().Add(-2*time.Minute).UnixNano() / int64(time.Millisecond))
+	if _, err := m.ZAdd(MembersKey, old, "engine-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.beat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := s1.Members(); !reflect.DeepEqual(got, []string{"engine-1"}) {
+		t.Errorf("members %v after engine-2 went silent", got)
+	}
+	if members, _ := m.ZMembers(MembersKey); !reflect.DeepEqual(members, []string{"engine-1"}) {
+		t.Errorf("%s = %v", MembersKey, members)
+	}
+	for _, k := range keys {
+		if !s1.Owns(k) {
+			t.Fatalf("engine-1 does not own %s back", k)
+		}
+	}
+}
+
+func TestShardRunLeaves(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	s := NewShard(&redis.Options{Addr: m.Addr()}, "engine-1", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	<-s.Ready()
+	cancel()
+	<-done
+	if members, _ := m.ZMembers(MembersKey); len(members) != 0 {
+		t.Errorf("still a member after Run: %v", members)
+	}
+}
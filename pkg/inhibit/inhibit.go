@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package inhibit holds back the alerts that other firing alerts explain:
+// those selected by inhibition rules, and those of resources depending on
+// a host or network that has a firing alert of its own, which are linked
+// to that root cause instead.
+package inhibit
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// RuleConfig is one entry of the policy's inhibit_rules: while an alert
+// matching the source fires, alerts matching the target with the same
+// values of the equal labels are inhibited.
+type RuleConfig struct {
+	SourceMatch   map[string]string `yaml:"source_match"`
+	SourceMatchRE map[string]string `yaml:"source_match_re"`
+	TargetMatch   map[string]string `yaml:"target_match"`
+	TargetMatchRE map[string]string `yaml:"target_match_re"`
+	Equal         []string          `yaml:"equal"`
+}
+
+type matcher struct {
+	match   map[string]string
+	matchRE map[string]*regexp.Regexp
+}
+
+func newMatcher(match, matchRE map[string]string) (*matcher, error) {
+	m := &matcher{match: match, matchRE: map[string]*regexp.Regexp{}}
+	for name, expr := range matchRE {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		m.matchRE[name] = re
+	}
+	return m, nil
+}
+
+type rule struct {
+	source, target *matcher
+	equal          []string
+}
+
+// Inhibitor implements notify.Inhibitor over the alerts firing at the
+// last evaluation.
+type Inhibitor struct {
+	rules []rule
+	topo  *Topology
+
+	mu     sync.RWMutex
+	firing []notify.Alert
+}
+
+// NewInhibitor sets up the rules; topo may be nil.
+func NewInhibitor(configs []RuleConfig, topo *Topology) (*Inhibitor, error) {
+	in := &Inhibitor{topo: topo}
+	for i, c := range configs {
+		source, err := newMatcher(c.SourceMatch, c.SourceMatchRE)
+		if err != nil {
+			return nil, fmt.Errorf("inhibit_rules[%d]: source_match_re %v", i, err)
+		}
+		target, err := newMatcher(c.TargetMatch, c.TargetMatchRE)
+		if err != nil {
+			return nil, fmt.Errorf("inhibit_rules[%d]: target_match_re %v", i, err)
+		}
+		in.rules = append(in.rules, rule{source: source, target: target, equal: c.Equal})
+	}
+	return in, nil
+}
+
+// Update replaces the firing alerts.
+func (in *Inhibitor) Update(firing []notify.Alert) {
+	in.mu.Lock()
+	in.firing = firing
+	in.mu.Unlock()
+}
+
+// label is a.Label, plus "host" looked up in the topology from the vm
+// label when the alert has none.
+func (in *Inhibitor) label(a notify.Alert, name string) string {
+	v := a.Label(name)
+	if v == "" && name == "host" && in.topo != nil {
+		v = in.topo.Host(a.Labels["vm"])
+	}
+	return v
+}
+
+func (in *Inhibitor) matches(m *matcher, a notify.Alert) bool {
+	for name, value := range m.match {
+		if in.label(a, name) != value {
+			return false
+		}
+	}
+	for name, re := range m.matchRE {
+		if !re.MatchString(in.label(a, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+func describe(a notify.Alert) string {
+	return fmt.Sprintf("%s %v", a.Rule, threshold.ResourceLabel(a.Labels))
+}
+
+func same(a, b notify.Alert) bool {
+	return a.Rule == b.Rule && threshold.ResourceLabel(a.Labels).Fingerprint() == threshold.ResourceLabel(b.Labels).Fingerprint()
+}
+
+// rootCause reports whether src, firing on a host or network, explains a
+// on a resource depending on it.
+func (in *Inhibitor) rootCause(src, a notify.Alert) bool {
+	if in.topo == nil {
+		return false
+	}
+	root, resource := src.Labels["vm"], a.Labels["vm"]
+	return root != "" && resource != "" && in.topo.DependsOn(resource, root)
+}
+
+// Inhibited returns the firing alert that explains a, or "" if none does.
+// Only firing alerts inhibit and are inhibited, and never themselves.
+func (in *Inhibitor) Inhibited(a notify.Alert) string {
+	if !a.Firing() {
+		return ""
+	}
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	for _, src := range in.firing {
+		if !src.Firing() || same(src, a) {
+			continue
+		}
+		if in.rootCause(src, a) {
+			return describe(src)
+		}
+		for _, r := range in.rules {
+			if !in.matches(r.target, a) || !in.matches(r.source, src) {
+				continue
+			}
+			equal := true
+			for _, name := range r.equal {
+				if in.label(a, name) != in.label(src, name) {
+					equal = false
+					break
+				}
+			}
+			if equal {
+				return describe(src)
+			}
+		}
+	}
+	return ""
+}
+
+// Linked lists the firing alerts a is the topological root cause of.
+func (in *Inhibitor) Linked(a notify.Alert) []string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	linked := []string{}
+	for _, f := range in.firing {
+		if f.Firing() && !same(f, a) && in.rootCause(a, f) {
+			linked = append(linked, describe(f))
+		}
+	}
+	return linked
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package inhibit
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+)
+
+func alert(rule, state string, labels map[string]string) notify.Alert {
+	return notify.Alert{Rule: rule, RuleID: rule + "[0]", Labels: labels, State: state}
+}
+
+func TestInhibited(t *testing.T) {
+	hostDown := RuleConfig{
+		SourceMatch: map[string]string{"rule": "host-down"},
+		TargetMatch: map[string]string{"rule": "rx-low"},
+		Equal:       []string{"host"},
+	}
+	critical := RuleConfig{
+		SourceMatch:   map[string]string{"severity": "critical"},
+		TargetMatchRE: map[string]string{"severity": "warning|critical"},
+		Equal:         []string{"vm"},
+	}
+	tests := []struct {
+		name   string
+		rules  []RuleConfig
+		topo   bool
+		firing []notify.Alert
+		alert  notify.Alert
+		want   string
+	}{
+		{
+			name:   "equal labels",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+			want:   `host-down {host="compute-1"}`,
+		},
+		{
+			name:   "equal labels differ",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-2"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+		},
+		{
+			name:   "equal label missing on both",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"vm": "instance-00000003"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000001"}),
+			want:   `host-down {vm="instance-00000003"}`,
+		},
+		{
+			name:   "target not matched",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("tx-low", "firing", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+		},
+		{
+			name:   "source resolved",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "resolved", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+		},
+		{
+			name:   "no source firing",
+			rules:  []RuleConfig{hostDown},
+			firing: nil,
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+		},
+		{
+			name:   "target resolved",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "resolved", map[string]string{"vm": "instance-00000001", "host": "compute-1"}),
+		},
+		{
+			name:   "not by itself",
+			rules:  []RuleConfig{critical},
+			firing: []notify.Alert{alert("cpu-high", "firing", map[string]string{"vm": "instance-00000001", "severity": "critical"})},
+			alert:  alert("cpu-high", "firing", map[string]string{"vm": "instance-00000001", "severity": "critical"}),
+		},
+		{
+			name:  "by another alert of the same resource",
+			rules: []RuleConfig{critical},
+			firing: []notify.Alert{
+				alert("cpu-high", "firing", map[string]string{"vm": "instance-00000001", "severity": "critical"}),
+				alert("vm-down", "firing", map[string]string{"vm": "instance-00000001", "severity": "critical"}),
+			},
+			alert: alert("cpu-high", "firing", map[string]string{"vm": "instance-00000001", "severity": "critical"}),
+			want:  `vm-down {severity="critical", vm="instance-00000001"}`,
+		},
+		{
+			name:   "host from the topology",
+			rules:  []RuleConfig{hostDown},
+			topo:   true,
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000002"}),
+			want:   `host-down {host="compute-1"}`,
+		},
+		{
+			name:   "host label before the topology",
+			rules:  []RuleConfig{hostDown},
+			topo:   true,
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000002", "host": "compute-2"}),
+		},
+		{
+			name:   "host not looked up without topology",
+			rules:  []RuleConfig{hostDown},
+			firing: []notify.Alert{alert("host-down", "firing", map[string]string{"host": "compute-1"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000002"}),
+		},
+		{
+			name:   "root cause",
+			topo:   true,
+			firing: []notify.Alert{alert("net-down", "firing", map[string]string{"vm": "net-a"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000003", "if": "tap0"}),
+			want:   `net-down {vm="net-a"}`,
+		},
+		{
+			name:   "root cause resolved",
+			topo:   true,
+			firing: []notify.Alert{alert("net-down", "resolved", map[string]string{"vm": "net-a"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000003", "if": "tap0"}),
+		},
+		{
+			name:   "not a root cause",
+			topo:   true,
+			firing: []notify.Alert{alert("net-down", "firing", map[string]string{"vm": "net-a"})},
+			alert:  alert("rx-low", "firing", map[string]string{"vm": "instance-00000002", "if": "tap0"}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var topo *Topology
+			if tt.topo {
+				topo = loadTopology(t, testTopology)
+			}
+			in, err := NewInhibitor(tt.rules, topo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in.Update(tt.firing)
+			if got := in.Inhibited(tt.alert); got != tt.want {
+				t.Errorf("Inhibited = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinked(t *testing.T) {
+	in, err := NewInhibitor(nil, loadTopology(t, testTopology))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := alert("host-down", "firing", map[string]string{"vm": "compute-1"})
+	in.Update([]notify.Alert{
+		root,
+		alert("rx-low", "firing", map[string]string{"vm": "instance-00000001", "if": "tap0"}),
+		alert("rx-low", "resolved", map[string]string{"vm": "instance-00000002", "if": "tap1"}),
+		alert("rx-low", "firing", map[string]string{"vm": "instance-00000003", "if": "tap2"}),
+	})
+	want := []string{`rx-low {if="tap0", vm="instance-00000001"}`}
+	if got := in.Linked(root); !reflect.DeepEqual(got, want) {
+		t.Errorf("Linked = %v, want %v", got, want)
+	}
+}
+
+func TestNewInhibitorErrors(t *testing.T) {
+	for _, c := range []RuleConfig{
+		{SourceMatchRE: map[string]string{"vm": "("}},
+		{TargetMatchRE: map[string]string{"vm": "[a-"}},
+	} {
+		if _, err := NewInhibitor([]RuleConfig{c}, nil); err == nil {
+			t.Errorf("NewInhibitor(%+v) accepted", c)
+		}
+	}
+}
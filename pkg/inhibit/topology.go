@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package inhibit
+
+import (
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Topology tells which hosts and networks each resource depends on. It
+// is read from a file such as
+//
+//	hosts:
+//	  compute-1: [instance-00000001, instance-00000002]
+//	networks:
+//	  net-a: [instance-00000001, compute-1]
+type Topology struct {
+	hosts   map[string]bool
+	parents map[string][]string // resource -> hosts and networks it is on
+}
+
+type topologyFile struct {
+	Hosts    map[string][]string `yaml:"hosts"`
+	Networks map[string][]string `yaml:"networks"`
+}
+
+func LoadTopology(path string) (*Topology, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f topologyFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	t := &Topology{hosts: map[string]bool{}, parents: map[string][]string{}}
+	for _, m := range []map[string][]string{f.Hosts, f.Networks} {
+		for parent, children := range m {
+			for _, child := range children {
+				t.parents[child] = append(t.parents[child], parent)
+			}
+		}
+	}
+	for host := range f.Hosts {
+		t.hosts[host] = true
+	}
+	for child := range t.parents {
+		sort.Strings(t.parents[child])
+	}
+	return t, nil
+}
+
+// Host returns the host a resource runs on, the resource itself if it
+// is a host, or "" if the topology does not know it.
+func (t *Topology) Host(resource string) string {
+	if t.hosts[resource] {
+		return resource
+	}
+	for _, p := range t.parents[resource] {
+		if t.hosts[p] {
+			return p
+		}
+	}
+	return ""
+}
+
+// DependsOn reports whether resource depends on root, directly or not.
+func (t *Topology) DependsOn(resource, root string) bool {
+	seen := map[string]bool{}
+	queue := []string{resource}
+	for len(queue) > 0 {
+		r := queue[0]
+		queue = queue[1:]
+		for _, p := range t.parents[r] {
+			if p == root {
+				return true
+			}
+			if !seen[p] {
+				seen[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	return false
+}
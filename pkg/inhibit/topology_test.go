@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package inhibit
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testTopology = `
+hosts:
+  compute-1: [instance-00000001, instance-00000002]
+  compute-2: [instance-00000003]
+networks:
+  net-a: [instance-00000001, compute-2]
+`
+
+// loadTopology loads the topology from a temporary file.
+func loadTopology(t *testing.T, content string) *Topology {
+	t.Helper()
+	f, err := ioutil.TempFile("", "topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	topo, err := LoadTopology(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return topo
+}
+
+func TestTopologyHost(t *testing.T) {
+	topo := loadTopology(t, testTopology)
+	tests := []struct {
+		resource, want string
+	}{
+		{"instance-00000001", "compute-1"},
+		{"instance-00000003", "compute-2"},
+		{"compute-1", "compute-1"},
+		{"net-a", ""},
+		{"instance-00000009", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := topo.Host(tt.resource); got != tt.want {
+			t.Errorf("Host(%q) = %q, want %q", tt.resource, got, tt.want)
+		}
+	}
+}
+
+func TestTopologyDependsOn(t *testing.T) {
+	topo := loadTopology(t, testTopology)
+	tests := []struct {
+		resource, root string
+		want           bool
+	}{
+		{"instance-00000001", "compute-1", true},
+		{"instance-00000001", "net-a", true},
+		{"instance-00000002", "net-a", false},
+		// through its host
+		{"instance-00000003", "net-a", true},
+		{"compute-2", "net-a", true},
+		{"compute-1", "instance-00000001", false},
+		{"instance-00000001", "instance-00000001", false},
+		{"instance-00000001", "compute-2", false},
+		{"instance-00000009", "compute-1", false},
+	}
+	for _, tt := range tests {
+		if got := topo.DependsOn(tt.resource, tt.root); got != tt.want {
+			t.Errorf("DependsOn(%q, %q) = %v, want %v", tt.resource, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestLoadTopologyErrors(t *testing.T) {
+	if _, err := LoadTopology("/nonexistent/topology.yaml"); err == nil {
+		t.Error("no error on a missing file")
+	}
+	f, err := ioutil.TempFile("", "topology")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hosts: [compute-1]\n")
+	f.Close()
+	if _, err := LoadTopology(f.Name()); err == nil {
+		t.Error("no error on hosts as a list")
+	}
+}
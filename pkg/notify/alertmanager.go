@@ -0,0 +1,189 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+func init() {
+	Register("alertmanager", newAlertmanager)
+}
+
+// amAlert is an alert as posted to /api/v2/alerts.
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Alertmanager pushes alerts to a Prometheus Alertmanager. Like
+// Prometheus, it resends firing alerts every resend delay with endsAt set
+// four resend delays ahead, so that Alertmanager resolves them on its own
+// if the engine goes away.
+type Alertmanager struct {
+	url         string
+	headers     map[string]string
+	client      *http.Client
+	resendDelay time.Duration
+
+	mu     sync.Mutex
+	active map[string]amAlert
+	resent time.Time
+}
+
+func newAlertmanager(c ReceiverConfig) (Notifier, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("alertmanager needs a url")
+	}
+	timeout, err := c.TimeoutOr(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	resendDelay := time.Minute
+	if c.ResendDelay != "" {
+		if resendDelay, err = parser.ParseDuration(c.ResendDelay); err != nil {
+			return nil, err
+		}
+	}
+	return &Alertmanager{
+		url:         strings.TrimSuffix(c.URL, "/") + "/api/v2/alerts",
+		headers:     c.Headers,
+		client:      &http.Client{Timeout: timeout},
+		resendDelay: resendDelay,
+		active:      map[string]amAlert{},
+	}, nil
+}
+
+// annotations maps the group annotation list: "name=value" entries
+// become annotations of their own, the others are joined as description.
+func annotations(list []string) map[string]string {
+	m := map[string]string{}
+	desc := []string{}
+	for _, a := range list {
+		if kv := strings.SplitN(a, "=", 2); len(kv) == 2 {
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		} else {
+			desc = append(desc, a)
+		}
+	}
+	if len(desc) > 0 {
+		m["description"] = strings.Join(desc, "\n")
+	}
+	return m
+}
+
+func fingerprint(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// convert labels the alert with its record name as alertname and, since
+// several rules may share it, with its rule ID as rule_id.
+func (am *Alertmanager) convert(a Alert, now time.Time) amAlert {
+	labels := map[string]string{"alertname": a.Rule, "rule_id": a.RuleID}
+	for k, v := range a.Labels {
+		labels[k] = v
+	}
+	annots := annotations(a.Annotations)
+	for name, v := range map[string]string{
+		"summary":     a.Summary,
+		"description": a.Description,
+		"runbook_url": a.RunbookURL,
+	} {
+		if v != "" {
+			annots[name] = v
+		}
+	}
+	aa := amAlert{
+		Labels:      labels,
+		Annotations: annots,
+		StartsAt:    a.StartsAt,
+		EndsAt:      now.Add(4 * am.resendDelay),
+	}
+	if a.EndsAt != nil {
+		aa.EndsAt = *a.EndsAt
+	}
+	return aa
+}
+
+// observe records which alerts fire, for resending, and converts them.
+func (am *Alertmanager) observe(alerts []Alert) []amAlert {
+	now := time.Now()
+	posts := []amAlert{}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	for _, a := range alerts {
+		aa := am.convert(a, now)
+		fp := fingerprint(aa.Labels)
+		if a.Firing() {
+			am.active[fp] = aa
+		} else {
+			delete(am.active, fp)
+		}
+		posts = append(posts, aa)
+	}
+	return posts
+}
+
+// Observe records which alerts fire without posting them.
+func (am *Alertmanager) Observe(alerts []Alert) {
+	am.observe(alerts)
+}
+
+func (am *Alertmanager) Notify(ctx context.Context, alerts []Alert) error {
+	return postJSON(ctx, am.client, am.url, am.headers, am.observe(alerts))
+}
+
+// Tick resends the firing alerts once the resend delay has passed.
+func (am *Alertmanager) Tick(ctx context.Context, now time.Time) {
+	am.mu.Lock()
+	if now.Sub(am.resent) < am.resendDelay {
+		am.mu.Unlock()
+		return
+	}
+	am.resent = now
+	posts := []amAlert{}
+	for fp, aa := range am.active {
+		aa.EndsAt = now.Add(4 * am.resendDelay)
+		am.active[fp] = aa
+		posts = append(posts, aa)
+	}
+	am.mu.Unlock()
+	if len(posts) == 0 {
+		return
+	}
+	if err := postJSON(ctx, am.client, am.url, am.headers, posts); err != nil {
+		fmt.Fprintf(os.Stderr, "alertmanager: resend: %v\n", err)
+	}
+}
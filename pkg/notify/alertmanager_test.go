@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// amPosts decodes the alerts of every request fakeHook received.
+func amPosts(t *testing.T, requests []hookRequest) [][]amAlert {
+	t.Helper()
+	posts := [][]amAlert{}
+	for _, req := range requests {
+		var alerts []amAlert
+		if err := json.Unmarshal([]byte(req.body), &alerts); err != nil {
+			t.Fatalf("%v: %s", err, req.body)
+		}
+		posts = append(posts, alerts)
+	}
+	return posts
+}
+
+func testAlertmanager(t *testing.T, url string) *Alertmanager {
+	n, err := newAlertmanager(ReceiverConfig{URL: url + "/", ResendDelay: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.(*Alertmanager)
+}
+
+func TestAlertmanagerPayload(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	end := start.Add(5 * time.Minute)
+	firing := Alert{
+		Rule:        "test-rec1",
+		RuleID:      "test1[0]",
+		Labels:      map[string]string{"vm": "vm1", "if": "tap0"},
+		State:       "firing",
+		StartsAt:    start,
+		Annotations: []string{"severity=critical", "rx is low", "on tap0"},
+		Summary:     "rx low on vm1",
+		RunbookURL:  "http://runbooks/rx",
+	}
+	resolved := firing
+	resolved.State = "resolved"
+	resolved.EndsAt = &end
+	resolved.Summary = ""
+	resolved.RunbookURL = ""
+	resolved.Annotations = nil
+	labels := map[string]string{"alertname": "test-rec1", "rule_id": "test1[0]", "vm": "vm1", "if": "tap0"}
+
+	tests := []struct {
+		name  string
+		alert Alert
+		want  amAlert // EndsAt is checked apart for firing alerts
+	}{
+		{"firing", firing, amAlert{
+			Labels: labels,
+			Annotations: map[string]string{
+				"severity":    "critical",
+				"description": "rx is low\non tap0",
+				"summary":     "rx low on vm1",
+				"runbook_url": "http://runbooks/rx",
+			},
+			StartsAt: start,
+		}},
+		{"resolved", resolved, amAlert{
+			Labels:   labels,
+			StartsAt: start,
+			EndsAt:   end,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := fakeHook(http.StatusOK)
+			defer srv.Close()
+			am := testAlertmanager(t, srv.URL)
+			before := time.Now()
+			if err := am.Notify(context.Background(), []Alert{tt.alert}); err != nil {
+				t.Fatal(err)
+			}
+			posts := amPosts(t, requests())
+			if len(posts) != 1 || len(posts[0]) != 1 {
+				t.Fatalf("posts = %+v", posts)
+			}
+			got := posts[0][0]
+			if tt.alert.Firing() {
+				// endsAt is four resend delays ahead
+				if got.EndsAt.Before(before.Add(4*time.Minute).Truncate(time.Second)) || got.EndsAt.After(time.Now().Add(4*time.Minute)) {
+					t.Errorf("endsAt = %v, want about 4m from now", got.EndsAt)
+				}
+				got.EndsAt = time.Time{}
+			}
+			got.StartsAt = got.StartsAt.UTC()
+			got.EndsAt = got.EndsAt.UTC()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if ct := requests()[0].header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+		})
+	}
+}
+
+// TestAlertmanagerResend checks that firing alerts are posted again every
+// resend delay, before the endsAt of the previous post.
+func TestAlertmanagerResend(t *testing.T) {
+	srv, requests := fakeHook(http.StatusOK)
+	defer srv.Close()
+	am := testAlertmanager(t, srv.URL)
+	ctx := context.Background()
+
+	a1 := alert("test-rec1", "vm1", "firing")
+	a1.RuleID = "test1[0]"
+	a2 := alert("test-rec1", "vm2", "firing")
+	a2.RuleID = "test1[0]"
+	if err := am.Notify(ctx, []Alert{a1, a2}); err != nil {
+		t.Fatal(err)
+	}
+	// a standby's observed alerts are resent once it leads
+	a3 := alert("test-rec1", "vm3", "firing")
+	a3.RuleID = "test1[1]"
+	am.Observe([]Alert{a3})
+	if n := len(requests()); n != 1 {
+		t.Fatalf("observe posted: %d requests", n)
+	}
+
+	t0 := time.Now()
+	steps := []struct {
+		at   time.Duration
+		vms  []string // resent, none if nothing is posted
+		then []Alert  // notified after the tick
+	}{
+		{0, []string{"vm1", "vm2", "vm3"}, nil},
+		{30 * time.Second, nil, nil},
+		{time.Minute, []string{"vm1", "vm2", "vm3"}, []Alert{resolvedAlert(a2)}},
+		{2 * time.Minute, []string{"vm1", "vm3"}, nil},
+	}
+	posted := 1
+	for _, step := range steps {
+		now := t0.Add(step.at)
+		am.Tick(ctx, now)
+		posts := amPosts(t, requests())
+		if step.vms == nil {
+			if len(posts) != posted {
+				t.Errorf("at %v: posted %v", step.at, posts[posted:])
+			}
+		} else if len(posts) != posted+1 {
+			t.Errorf("at %v: %d posts, want one", step.at, len(posts)-posted)
+		} else {
+			resent := map[string]bool{}
+			for _, aa := range posts[posted] {
+				resent[aa.Labels["vm"]] = true
+				if !aa.EndsAt.Equal(now.Add(4 * time.Minute)) {
+					t.Errorf("at %v: %s endsAt %v, want %v", step.at, aa.Labels["vm"], aa.EndsAt, now.Add(4*time.Minute))
+				}
+			}
+			want := map[string]bool{}
+			for _, vm := range step.vms {
+				want[vm] = true
+			}
+			if !reflect.DeepEqual(resent, want) {
+				t.Errorf("at %v: resent %v, want %v", step.at, resent, want)
+			}
+			posted++
+		}
+		if step.then != nil {
+			if err := am.Notify(ctx, step.then); err != nil {
+				t.Fatal(err)
+			}
+			posted++
+		}
+	}
+}
+
+func resolvedAlert(a Alert) Alert {
+	a.State = "resolved"
+	end := time.Now()
+	a.EndsAt = &end
+	return a
+}
+
+func TestAlertmanagerError(t *testing.T) {
+	srv, _ := fakeHook(http.StatusBadRequest)
+	defer srv.Close()
+	am := testAlertmanager(t, srv.URL)
+	if err := am.Notify(context.Background(), []Alert{alert("r", "vm1", "firing")}); err == nil {
+		t.Error("no error on 400")
+	}
+	if _, err := newAlertmanager(ReceiverConfig{}); err == nil {
+		t.Error("no error without url")
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package notify delivers alerts to receivers. Receiver types register a
+// Factory under their type name; the policy then configures receivers of
+// those types by name and rules list the receivers they notify.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// Alert is the payload handed to receivers for one alert transition.
+type Alert struct {
+	Key         string            `json:"idempotencyKey"` // of the transition: rule, labels, state and time; and repeat
+	Rule        string            `json:"rule"`           // record name of the rule
+	RuleID      string            `json:"ruleID"`         // e.g. test1[0]
+	Group       string            `json:"group"`
+	Labels      map[string]string `json:"labels"`
+	Values      []float64         `json:"values"`
+	State       string            `json:"state"` // firing or resolved
+	ActiveAt    time.Time         `json:"activeAt"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      *time.Time        `json:"endsAt,omitempty"` // set once resolved
+	Annotations []string          `json:"annotations,omitempty"`
+	Threshold   string            `json:"threshold,omitempty"` // right-hand side of the rule's comparison
+	Summary     string            `json:"summary,omitempty"`
+	Description string            `json:"description,omitempty"`
+	RunbookURL  string            `json:"runbookURL,omitempty"`
+	Linked      []string          `json:"linked,omitempty"` // alerts this one is the root cause of
+}
+
+// Firing reports whether the alert is firing rather than resolved.
+func (a *Alert) Firing() bool {
+	return a.State == "firing"
+}
+
+// Label returns the value alerts are routed, grouped and silenced on: the
+// rule and group names under "rule" and "group", otherwise the labels.
+func (a *Alert) Label(name string) string {
+	switch name {
+	case "rule":
+		return a.Rule
+	case "group":
+		return a.Group
+	}
+	return a.Labels[name]
+}
+
+// Notifier sends alerts to one receiver.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert) error
+}
+
+// ReceiverConfig is one entry of the policy's receivers list; each type
+// uses the fields that apply to it.
+type ReceiverConfig struct {
+	Name    string            `yaml:"name"`
+	Type    string            `yaml:"type"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout string            `yaml:"timeout"`
+
+	// templates of the summary and description of alerts whose rule has
+	// none, and of the body of notifications (webhook)
+	Summary     string `yaml:"summary"`
+	Description string `yaml:"description"`
+	Body        string `yaml:"body"`
+
+	// at most RateLimit notifications per RateWindow (1m if unset),
+	// unlimited if 0; the dispatcher holds back the others
+	RateLimit  int    `yaml:"rate_limit"`
+	RateWindow string `yaml:"rate_window"`
+
+	// alertmanager
+	ResendDelay string `yaml:"resend_delay"`
+
+	// ves
+	Username string `yaml:"username"`
+	Password string `yaml:"password"` // also the redis password
+	Event    string `yaml:"event"`    // fault or thresholdCrossingAlert
+	Severity string `yaml:"severity"` // of firing alerts, MAJOR if unset
+
+	// redis
+	Address string `yaml:"address"`
+	DB      int    `yaml:"db"`
+	Stream  string `yaml:"stream"`
+	MaxLen  int64  `yaml:"maxlen"` // trims the stream, unbounded if 0
+	Channel string `yaml:"channel"`
+
+	// collectd
+	Socket string `yaml:"socket"`
+	Plugin string `yaml:"plugin"`
+}
+
+// TimeoutOr returns the configured timeout, or def when none is set.
+func (c *ReceiverConfig) TimeoutOr(def time.Duration) (time.Duration, error) {
+	if c.Timeout == "" {
+		return def, nil
+	}
+	return parser.ParseDuration(c.Timeout)
+}
+
+// Ticker is implemented by notifiers with periodic work, such as
+// resending firing alerts; Receivers.Run ticks them every second.
+type Ticker interface {
+	Tick(ctx context.Context, now time.Time)
+}
+
+// Observer is implemented by notifiers that keep track of what they were
+// sent; standby engines have them observe what the leader sends instead.
+type Observer interface {
+	Observe(alerts []Alert)
+}
+
+// Leader tells whether this engine is the one that notifies, and the
+// fencing token of its leadership.
+type Leader interface {
+	IsLeader() bool
+	Token() int64
+}
+
+type fencingToken struct{}
+
+// WithFencingToken attaches the leader's fencing token to ctx; HTTP
+// receivers send it as the Fencing-Token header.
+func WithFencingToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, fencingToken{}, token)
+}
+
+// FencingToken returns the token attached to ctx, 0 if none.
+func FencingToken(ctx context.Context) int64 {
+	token, _ := ctx.Value(fencingToken{}).(int64)
+	return token
+}
+
+type Factory func(c ReceiverConfig) (Notifier, error)
+
+var factories = map[string]Factory{}
+
+// Register makes a receiver type available to the policy.
+func Register(typ string, f Factory) {
+	factories[typ] = f
+}
+
+// Types lists the registered receiver types.
+func Types() []string {
+	types := []string{}
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Receivers are the receivers configured in the policy, by name.
+type Receivers struct {
+	notifiers map[string]Notifier
+	limits    map[string]*rateLimit
+	leader    Leader
+}
+
+// rateLimit counts the notifications sent to one receiver in a window.
+type rateLimit struct {
+	mu     sync.Mutex
+	max    int
+	window time.Duration
+	sent   []time.Time
+}
+
+// take counts one notification, unless max are already sent in the window.
+func (l *rateLimit) take(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent := l.sent[:0]
+	for _, t := range l.sent {
+		if now.Sub(t) < l.window {
+			sent = append(sent, t)
+		}
+	}
+	l.sent = sent
+	if len(l.sent) >= l.max {
+		return false
+	}
+	l.sent = append(l.sent, now)
+	return true
+}
+
+func NewReceivers(configs []ReceiverConfig) (*Receivers, error) {
+	r := &Receivers{notifiers: map[string]Notifier{}, limits: map[string]*rateLimit{}}
+	for _, c := range configs {
+		f, ok := factories[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("receiver %s: unknown type %q (known: %s)", c.Name, c.Type, strings.Join(Types(), ", "))
+		}
+		if _, ok := r.notifiers[c.Name]; ok {
+			return nil, fmt.Errorf("receiver %s: defined twice", c.Name)
+		}
+		n, err := f(c)
+		if err != nil {
+			return nil, fmt.Errorf("receiver %s: %v", c.Name, err)
+		}
+		if c.Summary != "" || c.Description != "" {
+			t, err := NewTemplates(c.Summary, c.Description, "", "")
+			if err != nil {
+				return nil, fmt.Errorf("receiver %s: %v", c.Name, err)
+			}
+			n = &templated{Notifier: n, templates: t}
+		}
+		r.notifiers[c.Name] = n
+
+		if c.RateLimit > 0 {
+			window := time.Minute
+			if c.RateWindow != "" {
+				if window, err = parser.ParseDuration(c.RateWindow); err != nil {
+					return nil, fmt.Errorf("receiver %s: rate_window: %v", c.Name, err)
+				}
+			}
+			r.limits[c.Name] = &rateLimit{max: c.RateLimit, window: window}
+		}
+	}
+	return r, nil
+}
+
+// allow reports whether one more notification may be sent to name now,
+// counting it if so.
+func (r *Receivers) allow(name string, now time.Time) bool {
+	l, ok := r.limits[name]
+	return !ok || l.take(now)
+}
+
+// Has reports whether a receiver is configured under name.
+func (r *Receivers) Has(name string) bool {
+	_, ok := r.notifiers[name]
+	return ok
+}
+
+// SetLeader makes the receivers notify only while l is the leader;
+// without one they always do.
+func (r *Receivers) SetLeader(l Leader) {
+	r.leader = l
+}
+
+// leading reports whether this engine notifies, and returns ctx with the
+// fencing token when there is a leader election.
+func (r *Receivers) leading(ctx context.Context) (context.Context, bool) {
+	if r.leader == nil {
+		return ctx, true
+	}
+	if !r.leader.IsLeader() {
+		return ctx, false
+	}
+	return WithFencingToken(ctx, r.leader.Token()), true
+}
+
+// Observe lets the receiver's notifier record alerts it is not sent.
+func (r *Receivers) Observe(receiver string, alerts []Alert) {
+	if o, ok := r.notifiers[receiver].(Observer); ok {
+		o.Observe(alerts)
+	}
+}
+
+// Run ticks the receivers every second while leading, until ctx is done.
+func (r *Receivers) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			lctx, ok := r.leading(ctx)
+			if !ok {
+				continue
+			}
+			for _, n := range r.notifiers {
+				if t, ok := n.(Ticker); ok {
+					t.Tick(lctx, now)
+				}
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Send sends alerts to one receiver right away.
+func (r *Receivers) Send(ctx context.Context, receiver string, alerts []Alert) error {
+	return r.Notify(ctx, []string{receiver}, alerts)
+}
+
+// Notify sends alerts to each named receiver, carrying on past failures;
+// the first error is returned.
+func (r *Receivers) Notify(ctx context.Context, names []string, alerts []Alert) error {
+	if len(alerts) == 0 {
+		return nil
+	}
+	var first error
+	for _, name := range names {
+		n, ok := r.notifiers[name]
+		if !ok {
+			err := fmt.Errorf("unknown receiver: %s", name)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if err := n.Notify(ctx, alerts); err != nil && first == nil {
+			first = fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,416 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey attaches the key of a delivery to ctx; HTTP receivers
+// send it as the Idempotency-Key header.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey returns the key attached to ctx, if any.
+func IdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// Entry is one notification waiting in the outbox.
+type Entry struct {
+	ID        string    `json:"id"` // idempotency key, from the receiver and its alerts' keys
+	Receiver  string    `json:"receiver"`
+	Alerts    []Alert   `json:"alerts"`
+	Attempts  int       `json:"attempts"`
+	Created   time.Time `json:"created"`
+	NextAt    time.Time `json:"nextAt"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+func entryID(receiver string, alerts []Alert) string {
+	h := fnv.New64a()
+	h.Write([]byte(receiver))
+	for _, a := range alerts {
+		h.Write([]byte{0})
+		h.Write([]byte(a.Key))
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// OutboxStore keeps entries until they are delivered or dead-lettered.
+type OutboxStore interface {
+	Put(e Entry) error
+	Get(id string) (Entry, bool, error)
+	Delete(id string) error
+	List() ([]Entry, error) // oldest first
+	DeadLetter(e Entry) error
+}
+
+func sortEntries(list []Entry) {
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Created.Equal(list[j].Created) {
+			return list[i].Created.Before(list[j].Created)
+		}
+		return list[i].ID < list[j].ID
+	})
+}
+
+// FileStore keeps one JSON file per entry in a directory, and moves dead
+// letters into its dead subdirectory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "dead"), 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) write(path string, e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// write then rename, so that a crash never leaves half an entry
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) Put(e Entry) error {
+	return s.write(filepath.Join(s.dir, e.ID+".json"), e)
+}
+
+func (s *FileStore) Get(id string) (Entry, bool, error) {
+	var e Entry
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return e, false, nil
+	} else if err != nil {
+		return e, false, err
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return e, false, fmt.Errorf("outbox %s: %v", id, err)
+	}
+	return e, true, nil
+}
+
+func (s *FileStore) Delete(id string) error {
+	err := os.Remove(filepath.Join(s.dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStore) List() ([]Entry, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []Entry{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("outbox %s: %v", f.Name(), err)
+		}
+		list = append(list, e)
+	}
+	sortEntries(list)
+	return list, nil
+}
+
+func (s *FileStore) DeadLetter(e Entry) error {
+	if err := s.write(filepath.Join(s.dir, "dead", e.ID+".json"), e); err != nil {
+		return err
+	}
+	return s.Delete(e.ID)
+}
+
+// Redis keys of RedisStore.
+const (
+	OutboxKey     = "policyengine:outbox"      // hash of entries by ID
+	DeadLetterKey = "policyengine:outbox:dead" // list of dead entries, newest first
+)
+
+// RedisStore keeps entries in redis.
+type RedisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(opts *redis.Options) *RedisStore {
+	return &RedisStore{client: redis.NewClient(opts)}
+}
+
+func (s *RedisStore) Put(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(OutboxKey, e.ID, string(b)).Err()
+}
+
+func (s *RedisStore) Get(id string) (Entry, bool, error) {
+	var e Entry
+	v, err := s.client.HGet(OutboxKey, id).Result()
+	if err == redis.Nil {
+		return e, false, nil
+	} else if err != nil {
+		return e, false, err
+	}
+	if err := json.Unmarshal([]byte(v), &e); err != nil {
+		return e, false, fmt.Errorf("outbox %s: %v", id, err)
+	}
+	return e, true, nil
+}
+
+func (s *RedisStore) Delete(id string) error {
+	return s.client.HDel(OutboxKey, id).Err()
+}
+
+func (s *RedisStore) List() ([]Entry, error) {
+	all, err := s.client.HGetAll(OutboxKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []Entry{}
+	for id, v := range all {
+		var e Entry
+		if err := json.Unmarshal([]byte(v), &e); err != nil {
+			return nil, fmt.Errorf("outbox %s: %v", id, err)
+		}
+		list = append(list, e)
+	}
+	sortEntries(list)
+	return list, nil
+}
+
+func (s *RedisStore) DeadLetter(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.LPush(DeadLetterKey, string(b))
+		pipe.HDel(OutboxKey, e.ID)
+		return nil
+	})
+	return err
+}
+
+// Outbox stores every notification before delivering it, and retries
+// failed deliveries with exponential backoff until MaxAttempts, after
+// which they are dead-lettered. Each receiver is delivered to on its
+// own, and in order: a notification waits while an older one to the
+// same receiver about one of its alerts is pending.
+type Outbox struct {
+	store       OutboxStore
+	receivers   *Receivers
+	MaxAttempts int           // 10 if unset
+	Backoff     time.Duration // first retry delay, 1s if unset
+	MaxBackoff  time.Duration // 5m if unset
+
+	mu   sync.Mutex
+	busy map[string]bool // receivers being delivered to
+}
+
+func NewOutbox(store OutboxStore, receivers *Receivers) *Outbox {
+	return &Outbox{store: store, receivers: receivers, busy: map[string]bool{}}
+}
+
+// Send queues alerts for the receiver; delivery happens in Run. The
+// same notification queued again while pending keeps its attempts.
+func (o *Outbox) Send(ctx context.Context, receiver string, alerts []Alert) error {
+	id := entryID(receiver, alerts)
+	if _, ok, err := o.store.Get(id); err != nil || ok {
+		return err
+	}
+	now := time.Now()
+	return o.store.Put(Entry{
+		ID:       id,
+		Receiver: receiver,
+		Alerts:   alerts,
+		Created:  now,
+		NextAt:   now,
+	})
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d, max := o.Backoff, o.MaxBackoff
+	if d <= 0 {
+		d = time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Deliver tries every entry that is due, unless a standby, delivering
+// to the receivers concurrently. Receivers still being delivered to by
+// an earlier call are left to it.
+func (o *Outbox) Deliver(ctx context.Context, now time.Time) error {
+	ctx, leading := o.receivers.leading(ctx)
+	if !leading {
+		return nil
+	}
+	list, err := o.store.List()
+	if err != nil {
+		return err
+	}
+	byReceiver := map[string][]Entry{}
+	for _, e := range list {
+		byReceiver[e.Receiver] = append(byReceiver[e.Receiver], e)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for receiver, entries := range byReceiver {
+		o.mu.Lock()
+		busy := o.busy[receiver]
+		o.busy[receiver] = true
+		o.mu.Unlock()
+		if busy {
+			continue
+		}
+		wg.Add(1)
+		go func(receiver string, entries []Entry) {
+			defer wg.Done()
+			defer func() {
+				o.mu.Lock()
+				delete(o.busy, receiver)
+				o.mu.Unlock()
+			}()
+			if err := o.deliver(ctx, entries, now); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(receiver, entries)
+	}
+	wg.Wait()
+	return first
+}
+
+// deliver tries the due entries of one receiver, oldest first, skipping
+// those about an alert an older pending entry is about.
+func (o *Outbox) deliver(ctx context.Context, entries []Entry, now time.Time) error {
+	maxAttempts := o.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+	pending := map[string]bool{} // alerts of the entries left in the outbox
+	held := func(e Entry) bool {
+		for _, a := range e.Alerts {
+			if pending[memberKey(a)] {
+				return true
+			}
+		}
+		return false
+	}
+	hold := func(e Entry) {
+		for _, a := range e.Alerts {
+			pending[memberKey(a)] = true
+		}
+	}
+	for _, e := range entries {
+		if now.Before(e.NextAt) || held(e) {
+			hold(e)
+			continue
+		}
+		err := o.receivers.Notify(WithIdempotencyKey(ctx, e.ID), []string{e.Receiver}, e.Alerts)
+		if err == nil {
+			if err := o.store.Delete(e.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		e.Attempts++
+		e.LastError = err.Error()
+		if e.Attempts >= maxAttempts {
+			fmt.Fprintf(os.Stderr, "outbox: %s to %s dead-lettered after %d attempts: %v\n", e.ID, e.Receiver, e.Attempts, err)
+			if err := o.store.DeadLetter(e); err != nil {
+				return err
+			}
+			continue
+		}
+		hold(e)
+		e.NextAt = now.Add(o.backoff(e.Attempts))
+		fmt.Fprintf(os.Stderr, "outbox: %s to %s failed (attempt %d, retry at %s): %v\n", e.ID, e.Receiver, e.Attempts, e.NextAt.Format(time.RFC3339), err)
+		if err := o.store.Put(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run delivers the entries every second until ctx is done; a slow
+// receiver does not hold up the deliveries to the others.
+func (o *Outbox) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			go func() {
+				if err := o.Deliver(ctx, now); err != nil {
+					fmt.Fprintf(os.Stderr, "outbox: %v\n", err)
+				}
+			}()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
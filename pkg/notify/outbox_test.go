@@ -0,0 +1,215 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyNotifier fails while down, recording the alerts it is sent.
+type flakyNotifier struct {
+	mu    sync.Mutex
+	down  bool
+	block chan struct{} // if set, Notify waits for it
+	sent  []string
+}
+
+func (n *flakyNotifier) Notify(ctx context.Context, alerts []Alert) error {
+	if n.block != nil {
+		<-n.block
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down {
+		return fmt.Errorf("down")
+	}
+	for _, a := range alerts {
+		n.sent = append(n.sent, a.Labels["vm"]+" "+a.State)
+	}
+	return nil
+}
+
+func (n *flakyNotifier) setDown(down bool) {
+	n.mu.Lock()
+	n.down = down
+	n.mu.Unlock()
+}
+
+func (n *flakyNotifier) list() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.sent...)
+}
+
+func testOutbox(t *testing.T, notifiers map[string]Notifier) (*Outbox, OutboxStore, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := NewOutbox(store, &Receivers{notifiers: notifiers, limits: map[string]*rateLimit{}})
+	o.Backoff = time.Second
+	return o, store, func() { os.RemoveAll(dir) }
+}
+
+func keyed(vm, state string) Alert {
+	a := alert("r", vm, state)
+	a.Key = vm + "/" + state
+	return a
+}
+
+func TestOutboxRetry(t *testing.T) {
+	n := &flakyNotifier{down: true}
+	o, store, cleanup := testOutbox(t, map[string]Notifier{"ops": n})
+	defer cleanup()
+	o.MaxAttempts = 3
+
+	ctx := context.Background()
+	if err := o.Send(ctx, "ops", []Alert{keyed("vm1", "firing")}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	o.Deliver(ctx, now)
+	list, _ := store.List()
+	if len(list) != 1 || list[0].Attempts != 1 || !list[0].NextAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("after a failure: %+v", list)
+	}
+
+	// queued again while pending: the attempts and retry time stay
+	if err := o.Send(ctx, "ops", []Alert{keyed("vm1", "firing")}); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.List(); len(again) != 1 || again[0].Attempts != 1 || !again[0].NextAt.Equal(list[0].NextAt) {
+		t.Fatalf("after queuing again: %+v", again)
+	}
+
+	o.Deliver(ctx, now.Add(time.Second))
+	o.Deliver(ctx, now.Add(3*time.Second))
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("not dead-lettered after 3 attempts: %+v", list)
+	}
+	dead, _ := ioutil.ReadDir(o.store.(*FileStore).dir + "/dead")
+	if len(dead) != 1 {
+		t.Errorf("%d dead letters, want 1", len(dead))
+	}
+}
+
+func TestOutboxOrder(t *testing.T) {
+	n := &flakyNotifier{down: true}
+	o, store, cleanup := testOutbox(t, map[string]Notifier{"ops": n})
+	defer cleanup()
+
+	ctx := context.Background()
+	o.Send(ctx, "ops", []Alert{keyed("vm1", "firing")})
+	now := time.Now()
+	o.Deliver(ctx, now)
+
+	// vm1's resolution waits for its firing, vm2 goes on its own
+	n.setDown(false)
+	time.Sleep(time.Millisecond) // order entries by creation
+	o.Send(ctx, "ops", []Alert{keyed("vm1", "resolved")})
+	o.Send(ctx, "ops", []Alert{keyed("vm2", "firing")})
+	o.Deliver(ctx, now.Add(500*time.Millisecond))
+	if got, want := n.list(), []string{"vm2 firing"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("before the retry: sent %v, want %v", got, want)
+	}
+	o.Deliver(ctx, now.Add(time.Second))
+	if got, want := n.list(), []string{"vm2 firing", "vm1 firing", "vm1 resolved"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("left in the outbox: %+v", list)
+	}
+}
+
+// TestOutboxSharedRecord checks that an entry waits only for the pending
+// ones about the same rule, not for those of a rule writing the same
+// record.
+func TestOutboxSharedRecord(t *testing.T) {
+	n := &flakyNotifier{down: true}
+	o, _, cleanup := testOutbox(t, map[string]Notifier{"ops": n})
+	defer cleanup()
+
+	of := func(id string, state string) Alert {
+		a := keyed("vm1", state)
+		a.RuleID, a.Key = id, id+"/"+a.Key
+		return a
+	}
+	ctx := context.Background()
+	o.Send(ctx, "ops", []Alert{of("g1[0]", "firing")})
+	now := time.Now()
+	o.Deliver(ctx, now)
+
+	n.setDown(false)
+	time.Sleep(time.Millisecond) // order entries by creation
+	o.Send(ctx, "ops", []Alert{of("g1[0]", "resolved")})
+	o.Send(ctx, "ops", []Alert{of("g2[0]", "firing")})
+	o.Deliver(ctx, now.Add(500*time.Millisecond))
+	if got, want := n.list(), []string{"vm1 firing"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("before the retry: sent %v, want %v", got, want)
+	}
+	o.Deliver(ctx, now.Add(time.Second))
+	if got, want := n.list(), []string{"vm1 firing", "vm1 firing", "vm1 resolved"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+func TestOutboxSlowReceiver(t *testing.T) {
+	slow := &flakyNotifier{block: make(chan struct{})}
+	fast := &flakyNotifier{}
+	o, _, cleanup := testOutbox(t, map[string]Notifier{"slow": slow, "fast": fast})
+	defer cleanup()
+
+	ctx := context.Background()
+	o.Send(ctx, "slow", []Alert{keyed("vm1", "firing")})
+	done := make(chan struct{})
+	go func() {
+		o.Deliver(ctx, time.Now())
+		close(done)
+	}()
+	// wait for the slow receiver to be busy
+	for {
+		o.mu.Lock()
+		busy := o.busy["slow"]
+		o.mu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	o.Send(ctx, "fast", []Alert{keyed("vm2", "firing")})
+	o.Deliver(ctx, time.Now())
+	if got := fast.list(); len(got) != 1 {
+		t.Errorf("fast receiver sent %v while the slow one is busy", got)
+	}
+	close(slow.block)
+	<-done
+	if got := slow.list(); len(got) != 1 {
+		t.Errorf("slow receiver sent %v, want once", got)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis"
+)
+
+func init() {
+	Register("redis", newRedis)
+}
+
+// Redis hands alerts to other redis clients: each alert transition is
+// added to a stream, with fields rule, state and alert (the alert as
+// JSON, as in the webhook payload), and/or published as JSON on a channel.
+type Redis struct {
+	client  *redis.Client
+	stream  string
+	maxLen  int64
+	channel string
+}
+
+func newRedis(c ReceiverConfig) (Notifier, error) {
+	if c.Stream == "" && c.Channel == "" {
+		return nil, fmt.Errorf("redis needs a stream or a channel")
+	}
+	addr := c.Address
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	timeout, err := c.TimeoutOr(0)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{
+		client: redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Password:     c.Password,
+			DB:           c.DB,
+			ReadTimeout:  timeout,
+			WriteTimeout: timeout,
+		}),
+		stream:  c.Stream,
+		maxLen:  c.MaxLen,
+		channel: c.Channel,
+	}, nil
+}
+
+func (r *Redis) Notify(ctx context.Context, alerts []Alert) error {
+	client := r.client.WithContext(ctx)
+	for _, a := range alerts {
+		b, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		if r.stream != "" {
+			err := client.XAdd(&redis.XAddArgs{
+				Stream: r.stream,
+				MaxLen: r.maxLen,
+				Values: map[string]interface{}{
+					"rule":  a.Rule,
+					"state": a.State,
+					"alert": string(b),
+				},
+			}).Err()
+			if err != nil {
+				return fmt.Errorf("XADD %s: %v", r.stream, err)
+			}
+		}
+		if r.channel != "" {
+			if err := client.Publish(r.channel, string(b)).Err(); err != nil {
+				return fmt.Errorf("PUBLISH %s: %v", r.channel, err)
+			}
+		}
+	}
+	return nil
+}
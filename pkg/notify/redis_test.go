@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/server"
+)
+
+// fakeRedis answers XADD and PUBLISH, remembering the commands.
+type fakeRedis struct {
+	mu       sync.Mutex
+	commands [][]string
+}
+
+// serve starts a server answering for f; the caller closes it.
+func (f *fakeRedis) serve(t *testing.T) *server.Server {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(c *server.Peer, cmd string, args []string) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.commands = append(f.commands, append([]string{cmd}, args...))
+		return len(f.commands)
+	}
+	srv.Register("XADD", func(c *server.Peer, cmd string, args []string) {
+		n := record(c, cmd, args)
+		c.WriteBulk(strconv.Itoa(n) + "-0")
+	})
+	srv.Register("PUBLISH", func(c *server.Peer, cmd string, args []string) {
+		record(c, cmd, args)
+		c.WriteInt(1)
+	})
+	return srv
+}
+
+func (f *fakeRedis) recorded() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.commands...)
+}
+
+// xadd splits the arguments of an XADD into the stream, the MAXLEN
+// (-1 if none), the entry ID and the fields.
+func xadd(t *testing.T, args []string) (string, int64, string, map[string]string) {
+	t.Helper()
+	stream, maxLen, i := args[0], int64(-1), 1
+	if len(args) > 2 && (args[1] == "maxlen" || args[1] == "MAXLEN") {
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxLen, i = n, 3
+	}
+	id := args[i]
+	fields := map[string]string{}
+	for i++; i+1 < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	return stream, maxLen, id, fields
+}
+
+func TestRedis(t *testing.T) {
+	firing := keyed("vm1", "firing")
+	firing.RuleID = "test1[0]"
+	resolved := keyed("vm1", "resolved")
+	resolved.RuleID = "test1[0]"
+
+	tests := []struct {
+		name     string
+		config   ReceiverConfig
+		commands []string
+		maxLen   int64
+	}{
+		{"stream", ReceiverConfig{Stream: "alerts"}, []string{"XADD", "XADD"}, -1},
+		{"capped stream", ReceiverConfig{Stream: "alerts", MaxLen: 1000}, []string{"XADD", "XADD"}, 1000},
+		{"channel", ReceiverConfig{Channel: "alerts-ch"}, []string{"PUBLISH", "PUBLISH"}, -1},
+		{"stream and channel", ReceiverConfig{Stream: "alerts", MaxLen: 10, Channel: "alerts-ch"},
+			[]string{"XADD", "PUBLISH", "XADD", "PUBLISH"}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRedis{}
+			srv := f.serve(t)
+			defer srv.Close()
+
+			tt.config.Address = srv.Addr().String()
+			n, err := newRedis(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := n.Notify(context.Background(), []Alert{firing, resolved}); err != nil {
+				t.Fatal(err)
+			}
+			commands := f.recorded()
+			if len(commands) != len(tt.commands) {
+				t.Fatalf("commands = %v, want %v", commands, tt.commands)
+			}
+			alerts := []Alert{firing, resolved}
+			for i, cmd := range commands {
+				if cmd[0] != tt.commands[i] {
+					t.Fatalf("command %d = %v, want %s", i, cmd, tt.commands[i])
+				}
+				a := alerts[i*len(alerts)/len(commands)]
+				want, err := json.Marshal(a)
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch cmd[0] {
+				case "XADD":
+					stream, maxLen, id, fields := xadd(t, cmd[1:])
+					if stream != tt.config.Stream || maxLen != tt.maxLen || id != "*" {
+						t.Errorf("XADD %s MAXLEN %d %s, want %s MAXLEN %d *", stream, maxLen, id, tt.config.Stream, tt.maxLen)
+					}
+					wantFields := map[string]string{"rule": a.Rule, "state": a.State, "alert": string(want)}
+					if !reflect.DeepEqual(fields, wantFields) {
+						t.Errorf("XADD fields = %v, want %v", fields, wantFields)
+					}
+				case "PUBLISH":
+					if !reflect.DeepEqual(cmd[1:], []string{tt.config.Channel, string(want)}) {
+						t.Errorf("PUBLISH %v, want %s %s", cmd[1:], tt.config.Channel, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Register("XADD", func(c *server.Peer, cmd string, args []string) {
+		c.WriteError("ERR The ID specified in XADD is equal or smaller")
+	})
+	n, err := newRedis(ReceiverConfig{Address: srv.Addr().String(), Stream: "alerts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), []Alert{keyed("vm1", "firing")}); err == nil {
+		t.Error("no error on a failed XADD")
+	}
+	if _, err := newRedis(ReceiverConfig{}); err == nil {
+		t.Error("no error without a stream or a channel")
+	}
+}
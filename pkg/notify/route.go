@@ -0,0 +1,555 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// RouteConfig is a node of the routing tree in the policy. Unset fields
+// are inherited from the parent node.
+type RouteConfig struct {
+	Receiver       string            `yaml:"receiver"`
+	GroupBy        []string          `yaml:"group_by"`
+	GroupWait      string            `yaml:"group_wait"`
+	GroupInterval  string            `yaml:"group_interval"`
+	RepeatInterval string            `yaml:"repeat_interval"`
+	Match          map[string]string `yaml:"match"`
+	MatchRE        map[string]string `yaml:"match_re"`
+	Continue       bool              `yaml:"continue"`
+	Routes         []RouteConfig     `yaml:"routes"`
+}
+
+// Route is a node of the routing tree, ready to match alerts.
+type Route struct {
+	id             string
+	receiver       string
+	groupBy        []string
+	groupWait      time.Duration
+	groupInterval  time.Duration
+	repeatInterval time.Duration
+	match          map[string]string
+	matchRE        map[string]*regexp.Regexp
+	cont           bool
+	routes         []*Route
+}
+
+func optDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return parser.ParseDuration(s)
+}
+
+// Timings of the root route when the policy sets none, as in Alertmanager.
+const (
+	DefaultGroupWait      = 30 * time.Second
+	DefaultGroupInterval  = 5 * time.Minute
+	DefaultRepeatInterval = 4 * time.Hour
+)
+
+// NewRoute builds the routing tree; the root matches every alert.
+func NewRoute(c RouteConfig) (*Route, error) {
+	return newRoute(c, &Route{
+		groupWait:      DefaultGroupWait,
+		groupInterval:  DefaultGroupInterval,
+		repeatInterval: DefaultRepeatInterval,
+	}, "0")
+}
+
+func newRoute(c RouteConfig, parent *Route, id string) (*Route, error) {
+	r := &Route{
+		id:       id,
+		receiver: parent.receiver,
+		groupBy:  parent.groupBy,
+		match:    c.Match,
+		matchRE:  map[string]*regexp.Regexp{},
+		cont:     c.Continue,
+	}
+	if c.Receiver != "" {
+		r.receiver = c.Receiver
+	}
+	if c.GroupBy != nil {
+		r.groupBy = c.GroupBy
+	}
+	var err error
+	if r.groupWait, err = optDuration(c.GroupWait, parent.groupWait); err != nil {
+		return nil, fmt.Errorf("route %s: group_wait: %v", id, err)
+	}
+	if r.groupInterval, err = optDuration(c.GroupInterval, parent.groupInterval); err != nil {
+		return nil, fmt.Errorf("route %s: group_interval: %v", id, err)
+	}
+	if r.repeatInterval, err = optDuration(c.RepeatInterval, parent.repeatInterval); err != nil {
+		return nil, fmt.Errorf("route %s: repeat_interval: %v", id, err)
+	}
+	for name, expr := range c.MatchRE {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("route %s: match_re %s: %v", id, name, err)
+		}
+		r.matchRE[name] = re
+	}
+	for i, child := range c.Routes {
+		cr, err := newRoute(child, r, fmt.Sprintf("%s.%d", id, i))
+		if err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, cr)
+	}
+	return r, nil
+}
+
+// Receivers lists the receivers the tree can route to.
+func (r *Route) Receivers() []string {
+	names := []string{}
+	if r.receiver != "" {
+		names = append(names, r.receiver)
+	}
+	for _, child := range r.routes {
+		names = append(names, child.Receivers()...)
+	}
+	return names
+}
+
+func (r *Route) matches(a Alert) bool {
+	for name, value := range r.match {
+		if a.Label(name) != value {
+			return false
+		}
+	}
+	for name, re := range r.matchRE {
+		if !re.MatchString(a.Label(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the routes an alert ends up on: the first matching child,
+// or each matching one up to the first without continue, recursively;
+// a node none of whose children match is used itself.
+func (r *Route) Match(a Alert) []*Route {
+	if !r.matches(a) {
+		return nil
+	}
+	routes := []*Route{}
+	for _, child := range r.routes {
+		matched := child.Match(a)
+		routes = append(routes, matched...)
+		if len(matched) > 0 && !child.cont {
+			break
+		}
+	}
+	if len(routes) == 0 {
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// aggrGroup batches the alerts one route sends to one receiver that share
+// the values of the route's group_by labels.
+type aggrGroup struct {
+	route    *Route
+	receiver string
+	alerts   map[string]Alert // by memberKey
+	created  time.Time
+	flushed  time.Time       // zero until the first notification
+	dirty    bool            // alerts were added or changed state since
+	muted    map[string]bool // firing alerts held back at the last flush
+}
+
+// memberKey identifies an alert within a group by rule ID and labels:
+// rules of different groups may write the same record.
+func memberKey(a Alert) string {
+	return a.RuleID + "\x00" + fingerprint(a.Labels)
+}
+
+func (g *aggrGroup) add(a Alert) {
+	fp := memberKey(a)
+	if old, ok := g.alerts[fp]; !ok || old.State != a.State {
+		g.dirty = true
+	}
+	g.alerts[fp] = a
+}
+
+// due reports whether the group is to be notified now: group_wait after
+// it was created, group_interval after the last notification if it has
+// changed since, and every repeat_interval while anything still fires.
+func (g *aggrGroup) due(now time.Time) bool {
+	if g.flushed.IsZero() {
+		return !now.Before(g.created.Add(g.route.groupWait))
+	}
+	if g.dirty {
+		return !now.Before(g.flushed.Add(g.route.groupInterval))
+	}
+	if g.route.repeatInterval == 0 {
+		return false
+	}
+	for _, a := range g.alerts {
+		if a.Firing() {
+			return !now.Before(g.flushed.Add(g.route.repeatInterval))
+		}
+	}
+	return false
+}
+
+// unmuted reports whether an alert held back at the last flush still
+// fires and is no longer muted.
+func (g *aggrGroup) unmuted(m Muter, now time.Time) bool {
+	for fp := range g.muted {
+		if a, ok := g.alerts[fp]; ok && a.Firing() && m.Muted(a, now) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *aggrGroup) list() []Alert {
+	fps := make([]string, 0, len(g.alerts))
+	for fp := range g.alerts {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	alerts := make([]Alert, 0, len(fps))
+	for _, fp := range fps {
+		alerts = append(alerts, g.alerts[fp])
+	}
+	return alerts
+}
+
+// Inhibitor holds back alerts explained by other ones.
+type Inhibitor interface {
+	// Inhibited returns what explains a, or "" if nothing does.
+	Inhibited(a Alert) string
+	// Linked lists the alerts a is the root cause of.
+	Linked(a Alert) []string
+}
+
+// Muter holds back firing alerts, such as silenced ones.
+type Muter interface {
+	// Muted returns what mutes a at now, or "" if nothing does.
+	Muted(a Alert, now time.Time) string
+}
+
+// Sender hands a notification to a receiver, such as Receivers itself or
+// an Outbox in front of them.
+type Sender interface {
+	Send(ctx context.Context, receiver string, alerts []Alert) error
+}
+
+// Dispatcher batches alerts into notifications. Alerts of rules listing
+// receivers in notify go to those receivers, grouped by the root route's
+// settings; the others are routed through the tree.
+type Dispatcher struct {
+	receivers *Receivers
+	root      *Route
+	inhibitor Inhibitor
+	sender    Sender
+	muter     Muter // nil if nothing mutes alerts
+
+	mu     sync.Mutex
+	groups map[string]*aggrGroup
+}
+
+// NewDispatcher checks that every receiver of the tree exists; root may
+// be nil, leaving only the rules' notify lists, and so may inhibitor.
+func NewDispatcher(receivers *Receivers, root *RouteConfig, inhibitor Inhibitor) (*Dispatcher, error) {
+	d := &Dispatcher{
+		receivers: receivers,
+		inhibitor: inhibitor,
+		sender:    receivers,
+		groups:    map[string]*aggrGroup{},
+	}
+	if root == nil {
+		root = &RouteConfig{}
+	}
+	r, err := NewRoute(*root)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range r.Receivers() {
+		if !receivers.Has(name) {
+			return nil, fmt.Errorf("route: unknown receiver %s", name)
+		}
+	}
+	d.root = r
+	return d, nil
+}
+
+func groupKey(r *Route, receiver string, a Alert) string {
+	values := make([]string, 0, len(r.groupBy))
+	for _, name := range r.groupBy {
+		values = append(values, fmt.Sprintf("%s=%q", name, a.Label(name)))
+	}
+	return r.id + "/" + receiver + "/{" + strings.Join(values, ",") + "}"
+}
+
+// target is a route and receiver an alert is dispatched to.
+type target struct {
+	route    *Route
+	receiver string
+}
+
+// targets returns the receivers in notify, with the root route's
+// settings, or the routes a matches when notify is empty.
+func (d *Dispatcher) targets(notify []string, a Alert) []target {
+	targets := []target{}
+	if len(notify) > 0 {
+		for _, name := range notify {
+			targets = append(targets, target{d.root, name})
+		}
+		return targets
+	}
+	for _, r := range d.root.Match(a) {
+		if r.receiver != "" {
+			targets = append(targets, target{r, r.receiver})
+		}
+	}
+	return targets
+}
+
+// group returns the group of a on t, created at now if there is none.
+func (d *Dispatcher) group(t target, a Alert, now time.Time) *aggrGroup {
+	key := groupKey(t.route, t.receiver, a)
+	g, ok := d.groups[key]
+	if !ok {
+		g = &aggrGroup{route: t.route, receiver: t.receiver, alerts: map[string]Alert{}, created: now}
+		d.groups[key] = g
+	}
+	return g
+}
+
+// Dispatch queues alerts for the receivers in notify, or for the routes
+// they match when notify is empty.
+func (d *Dispatcher) Dispatch(notify []string, alerts []Alert, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, a := range alerts {
+		for _, t := range d.targets(notify, a) {
+			d.group(t, a, now).add(a)
+		}
+	}
+}
+
+// Restore gives back a firing alert restored from a previous run, last
+// notified at notifiedAt: it is not sent again, but is repeated
+// repeat_interval after notifiedAt, and the receivers observe it as if
+// they had just been sent it, unless it is muted.
+func (d *Dispatcher) Restore(notify []string, a Alert, notifiedAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fp := memberKey(a)
+	muted := d.muter != nil && d.muter.Muted(a, notifiedAt) != ""
+	for _, t := range d.targets(notify, a) {
+		g := d.group(t, a, notifiedAt)
+		g.alerts[fp] = a
+		if notifiedAt.After(g.flushed) {
+			g.flushed = notifiedAt
+		}
+		if muted {
+			if g.muted == nil {
+				g.muted = map[string]bool{}
+			}
+			g.muted[fp] = true
+			continue
+		}
+		d.receivers.Observe(t.receiver, []Alert{a})
+	}
+}
+
+// Withdraw drops a firing alert another engine now evaluates from the
+// groups it was dispatched to, without notifying anyone: its receivers
+// observe it as resolved, so that they stop repeating it, and its new
+// owner notifies it again.
+func (d *Dispatcher) Withdraw(notify []string, a Alert) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fp := memberKey(a)
+	resolved := a
+	resolved.State = "resolved"
+	for _, t := range d.targets(notify, a) {
+		key := groupKey(t.route, t.receiver, a)
+		g, ok := d.groups[key]
+		if !ok {
+			continue
+		}
+		if _, ok := g.alerts[fp]; !ok {
+			continue
+		}
+		delete(g.alerts, fp)
+		delete(g.muted, fp)
+		if len(g.alerts) == 0 {
+			delete(d.groups, key)
+		}
+		d.receivers.Observe(t.receiver, []Alert{resolved})
+	}
+}
+
+// mute splits the alerts of a group being flushed into those to send and
+// the fingerprints of the firing ones the muter holds back. Resolved
+// alerts are always sent.
+func (d *Dispatcher) mute(key string, alerts []Alert, now time.Time) ([]Alert, map[string]bool) {
+	if d.muter == nil {
+		return alerts, nil
+	}
+	kept := []Alert{}
+	muted := map[string]bool{}
+	for _, a := range alerts {
+		if a.Firing() {
+			if by := d.muter.Muted(a, now); by != "" {
+				fmt.Printf("muted: %s %s %v by %s\n", key, a.Rule, a.Labels, by)
+				muted[memberKey(a)] = true
+				continue
+			}
+		}
+		kept = append(kept, a)
+	}
+	return kept, muted
+}
+
+// inhibit drops the alerts the inhibitor explains and links the others
+// to the alerts they are the root cause of.
+func (d *Dispatcher) inhibit(key string, alerts []Alert) []Alert {
+	if d.inhibitor == nil {
+		return alerts
+	}
+	kept := []Alert{}
+	for _, a := range alerts {
+		if by := d.inhibitor.Inhibited(a); by != "" {
+			fmt.Printf("inhibited: %s %s %v by %s\n", key, a.Rule, a.Labels, by)
+			continue
+		}
+		if linked := d.inhibitor.Linked(a); len(linked) > 0 {
+			a.Linked = linked
+		}
+		kept = append(kept, a)
+	}
+	return kept
+}
+
+// Flush notifies the groups that are due and allowed by their receiver's
+// rate limit. Firing alerts muted at the time are held back, and the
+// group is due again once their mute lifts. Resolved alerts are dropped
+// once sent, and so are groups left empty.
+func (d *Dispatcher) Flush(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	keys := make([]string, 0, len(d.groups))
+	for key := range d.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	type batch struct {
+		key      string
+		receiver string
+		alerts   []Alert
+	}
+	batches := []batch{}
+	for _, key := range keys {
+		g := d.groups[key]
+		if d.muter != nil && g.unmuted(d.muter, now) {
+			g.dirty = true
+		}
+		if !g.due(now) {
+			continue
+		}
+		alerts, muted := d.mute(key, g.list(), now)
+		if !g.flushed.IsZero() && !g.dirty {
+			alerts = repeated(alerts, g.route.repeatInterval, now)
+		}
+		if len(alerts) > 0 {
+			if !d.receivers.allow(g.receiver, now) {
+				continue
+			}
+			batches = append(batches, batch{key, g.receiver, alerts})
+		}
+		g.flushed, g.dirty, g.muted = now, false, muted
+		for fp, a := range g.alerts {
+			if !a.Firing() {
+				delete(g.alerts, fp)
+			}
+		}
+		if len(g.alerts) == 0 {
+			delete(d.groups, key)
+		}
+	}
+	d.mu.Unlock()
+
+	lctx, leading := d.receivers.leading(ctx)
+	for _, b := range batches {
+		if b.alerts = d.inhibit(b.key, b.alerts); len(b.alerts) == 0 {
+			continue
+		}
+		if !leading {
+			// standby: keep the receivers' view in step with the leader's
+			d.receivers.Observe(b.receiver, b.alerts)
+			continue
+		}
+		if err := d.sender.Send(lctx, b.receiver, b.alerts); err != nil {
+			fmt.Fprintf(os.Stderr, "notify: %s: %v\n", b.key, err)
+		}
+	}
+}
+
+// repeated gives the firing alerts of a repeat notification keys of their
+// own, so that receivers deduplicating on the key do not drop it: the
+// number of repeat intervals since the alert fired, the same on every
+// engine, is appended.
+func repeated(alerts []Alert, interval time.Duration, now time.Time) []Alert {
+	for i := range alerts {
+		if alerts[i].Firing() {
+			alerts[i].Key = fmt.Sprintf("%s/%d", alerts[i].Key, now.Sub(alerts[i].StartsAt)/interval)
+		}
+	}
+	return alerts
+}
+
+// SendThrough makes the dispatcher hand its notifications to s, e.g. an
+// Outbox, instead of sending them itself.
+func (d *Dispatcher) SendThrough(s Sender) {
+	d.sender = s
+}
+
+// MuteWith makes the dispatcher hold back the firing alerts m mutes.
+func (d *Dispatcher) MuteWith(m Muter) {
+	d.muter = m
+}
+
+// Run flushes the groups every second until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.Flush(ctx, now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,503 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendRecorder is a Sender recording each notification as
+// "receiver: vm state, ...".
+type sendRecorder struct {
+	sent []string
+}
+
+func (s *sendRecorder) Send(ctx context.Context, receiver string, alerts []Alert) error {
+	list := []string{}
+	for _, a := range alerts {
+		list = append(list, a.Labels["vm"]+" "+a.State)
+	}
+	s.sent = append(s.sent, receiver+": "+strings.Join(list, ", "))
+	return nil
+}
+
+func testReceivers(names ...string) *Receivers {
+	r := &Receivers{notifiers: map[string]Notifier{}, limits: map[string]*rateLimit{}}
+	for _, name := range names {
+		r.notifiers[name] = nil
+	}
+	return r
+}
+
+func alert(rule, vm, state string) Alert {
+	return Alert{Rule: rule, Labels: map[string]string{"vm": vm}, State: state}
+}
+
+// ruleAlert is an alert of the rule with the given ID writing record.
+func ruleAlert(id, record, vm, state string) Alert {
+	a := alert(record, vm, state)
+	a.RuleID = id
+	return a
+}
+
+// step dispatches alerts at the given time after the start, then
+// flushes and expects the notifications in want.
+type step struct {
+	at     time.Duration
+	alerts []Alert
+	want   []string
+}
+
+func TestDispatcherTiming(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  *RouteConfig
+		notify []string
+		limit  int
+		steps  []step
+	}{
+		{
+			name:  "default timings",
+			route: &RouteConfig{Receiver: "ops"},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: 29 * time.Second},
+				{at: 30 * time.Second, want: []string{"ops: vm1 firing"}},
+				{at: time.Minute, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: 2 * time.Minute, alerts: []Alert{alert("r", "vm1", "resolved")}},
+				{at: 5*time.Minute + 29*time.Second},
+				{at: 5*time.Minute + 30*time.Second, want: []string{"ops: vm1 resolved"}},
+				{at: 5 * time.Hour},
+			},
+		},
+		{
+			name:  "repeat while firing",
+			route: &RouteConfig{Receiver: "ops"},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: 30 * time.Second, want: []string{"ops: vm1 firing"}},
+				{at: 4 * time.Hour},
+				{at: 4*time.Hour + 30*time.Second, want: []string{"ops: vm1 firing"}},
+			},
+		},
+		{
+			name:  "changes batched per group interval",
+			route: &RouteConfig{Receiver: "ops", GroupWait: "10s", GroupInterval: "1m"},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: 5 * time.Second, alerts: []Alert{alert("r", "vm2", "firing")}},
+				{at: 10 * time.Second, want: []string{"ops: vm1 firing, vm2 firing"}},
+				{at: 20 * time.Second, alerts: []Alert{alert("r", "vm1", "resolved")}},
+				{at: 30 * time.Second, alerts: []Alert{alert("r", "vm3", "firing")}},
+				{at: 70 * time.Second, want: []string{"ops: vm1 resolved, vm2 firing, vm3 firing"}},
+			},
+		},
+		{
+			name:  "zero timings send at once and never repeat",
+			route: &RouteConfig{Receiver: "ops", GroupWait: "0s", GroupInterval: "0s", RepeatInterval: "0s"},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}, want: []string{"ops: vm1 firing"}},
+				{at: 24 * time.Hour},
+				{at: 25 * time.Hour, alerts: []Alert{alert("r", "vm1", "resolved")}, want: []string{"ops: vm1 resolved"}},
+			},
+		},
+		{
+			name: "group by and child routes",
+			route: &RouteConfig{
+				Receiver: "ops",
+				GroupBy:  []string{"vm"},
+				Routes: []RouteConfig{
+					{Match: map[string]string{"rule": "fast"}, Receiver: "pager", GroupWait: "0s"},
+				},
+			},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("slow", "vm1", "firing"), alert("slow", "vm2", "firing"), alert("fast", "vm1", "firing")},
+					want: []string{"pager: vm1 firing"}},
+				{at: 30 * time.Second, want: []string{"ops: vm1 firing", "ops: vm2 firing"}},
+			},
+		},
+		{
+			name:   "rules with notify use the root timings",
+			notify: []string{"pager"},
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: 30 * time.Second, want: []string{"pager: vm1 firing"}},
+			},
+		},
+		{
+			name:  "rate limit holds groups back",
+			route: &RouteConfig{Receiver: "ops", GroupBy: []string{"vm"}, GroupWait: "0s"},
+			limit: 1,
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing"), alert("r", "vm2", "firing")}, want: []string{"ops: vm1 firing"}},
+				{at: 30 * time.Second},
+				{at: time.Minute, want: []string{"ops: vm2 firing"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receivers := testReceivers("ops", "pager")
+			if tt.limit > 0 {
+				receivers.limits["ops"] = &rateLimit{max: tt.limit, window: time.Minute}
+			}
+			d, err := NewDispatcher(receivers, tt.route, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &sendRecorder{}
+			d.SendThrough(s)
+
+			start := time.Unix(1000, 0)
+			for _, st := range tt.steps {
+				now := start.Add(st.at)
+				if len(st.alerts) > 0 {
+					d.Dispatch(tt.notify, st.alerts, now)
+				}
+				s.sent = nil
+				d.Flush(context.Background(), now)
+				if len(s.sent) != 0 || len(st.want) != 0 {
+					if !reflect.DeepEqual(s.sent, st.want) {
+						t.Errorf("at %v: sent %q, want %q", st.at, s.sent, st.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	r, err := NewRoute(RouteConfig{
+		Receiver: "ops",
+		Routes: []RouteConfig{
+			{Match: map[string]string{"rule": "a"}, Receiver: "a", Continue: true},
+			{MatchRE: map[string]string{"vm": "instance-0+1"}, Receiver: "one"},
+			{Match: map[string]string{"group": "g"}, Receiver: "g"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		alert Alert
+		want  []string
+	}{
+		{Alert{Rule: "b", Labels: map[string]string{"vm": "x"}}, []string{"ops"}},
+		{Alert{Rule: "a", Labels: map[string]string{"vm": "x"}}, []string{"a"}},
+		{Alert{Rule: "a", Labels: map[string]string{"vm": "instance-001"}}, []string{"a", "one"}},
+		{Alert{Rule: "b", Group: "g", Labels: map[string]string{"vm": "instance-0011"}}, []string{"g"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, route := range r.Match(tt.alert) {
+			got = append(got, route.receiver)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%s %v) = %v, want %v", tt.alert.Rule, tt.alert.Labels, got, tt.want)
+		}
+	}
+}
+
+// muteUntil mutes every alert of vm1 until a time.
+type muteUntil time.Time
+
+func (m muteUntil) Muted(a Alert, now time.Time) string {
+	if a.Labels["vm"] == "vm1" && now.Before(time.Time(m)) {
+		return "test"
+	}
+	return ""
+}
+
+func TestDispatcherMute(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		until time.Duration
+		steps []step
+	}{
+		{
+			name:  "held back until the mute lifts",
+			until: 2 * time.Minute,
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing"), alert("r", "vm2", "firing")}, want: []string{"ops: vm2 firing"}},
+				{at: time.Minute},
+				{at: 2 * time.Minute, want: []string{"ops: vm1 firing, vm2 firing"}},
+				{at: 3 * time.Minute},
+			},
+		},
+		{
+			name:  "resolved never muted",
+			until: time.Hour,
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing")}},
+				{at: time.Minute, alerts: []Alert{alert("r", "vm1", "resolved")}, want: []string{"ops: vm1 resolved"}},
+				{at: 2 * time.Hour},
+			},
+		},
+		{
+			name:  "rules sharing a record muted apart",
+			until: 2 * time.Minute,
+			steps: []step{
+				{at: 0, alerts: []Alert{ruleAlert("g1[0]", "r", "vm1", "firing"), ruleAlert("g2[0]", "r", "vm1", "firing")}},
+				{at: time.Minute, alerts: []Alert{ruleAlert("g2[0]", "r", "vm1", "resolved")}, want: []string{"ops: vm1 resolved"}},
+				{at: 2 * time.Minute, want: []string{"ops: vm1 firing"}},
+			},
+		},
+		{
+			name:  "resolved during the mute",
+			until: 2 * time.Minute,
+			steps: []step{
+				{at: 0, alerts: []Alert{alert("r", "vm1", "firing"), alert("r", "vm2", "firing")}, want: []string{"ops: vm2 firing"}},
+				{at: time.Minute, alerts: []Alert{alert("r", "vm2", "resolved")}, want: []string{"ops: vm2 resolved"}},
+				{at: 2 * time.Minute, want: []string{"ops: vm1 firing"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDispatcher(testReceivers("ops"), &RouteConfig{
+				Receiver: "ops", GroupWait: "0s", GroupInterval: "0s", RepeatInterval: "0s",
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &sendRecorder{}
+			d.SendThrough(s)
+			d.MuteWith(muteUntil(start.Add(tt.until)))
+
+			for _, st := range tt.steps {
+				now := start.Add(st.at)
+				if len(st.alerts) > 0 {
+					d.Dispatch(nil, st.alerts, now)
+				}
+				s.sent = nil
+				d.Flush(context.Background(), now)
+				if len(s.sent) != 0 || len(st.want) != 0 {
+					if !reflect.DeepEqual(s.sent, st.want) {
+						t.Errorf("at %v: sent %q, want %q", st.at, s.sent, st.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// observeRecorder is a Notifier recording what it observes.
+type observeRecorder struct {
+	observed []string
+}
+
+func (o *observeRecorder) Notify(ctx context.Context, alerts []Alert) error {
+	return nil
+}
+
+func (o *observeRecorder) Observe(alerts []Alert) {
+	for _, a := range alerts {
+		o.observed = append(o.observed, a.Labels["vm"]+" "+a.State)
+	}
+}
+
+func TestDispatcherRestore(t *testing.T) {
+	start := time.Unix(100000, 0)
+	o := &observeRecorder{}
+	receivers := testReceivers()
+	receivers.notifiers["ops"] = o
+	d, err := NewDispatcher(receivers, &RouteConfig{Receiver: "ops", RepeatInterval: "1h"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sendRecorder{}
+	d.SendThrough(s)
+
+	// notified 50m before the restart: repeated 10m after it, not before
+	d.Restore(nil, alert("r", "vm1", "firing"), start.Add(-50*time.Minute))
+	if want := []string{"vm1 firing"}; !reflect.DeepEqual(o.observed, want) {
+		t.Errorf("observed %v, want %v", o.observed, want)
+	}
+	for _, st := range []step{
+		{at: 0},
+		{at: 9 * time.Minute},
+		{at: 10 * time.Minute, want: []string{"ops: vm1 firing"}},
+		{at: 12 * time.Minute, alerts: []Alert{alert("r", "vm1", "resolved")}},
+		{at: 15 * time.Minute, want: []string{"ops: vm1 resolved"}},
+	} {
+		now := start.Add(st.at)
+		if len(st.alerts) > 0 {
+			d.Dispatch(nil, st.alerts, now)
+		}
+		s.sent = nil
+		d.Flush(context.Background(), now)
+		if len(s.sent) != 0 || len(st.want) != 0 {
+			if !reflect.DeepEqual(s.sent, st.want) {
+				t.Errorf("at %v: sent %q, want %q", st.at, s.sent, st.want)
+			}
+		}
+	}
+}
+
+// TestDispatcherSharedRecord checks that the alerts of two rules writing
+// the same record with the same labels are kept apart in a group.
+func TestDispatcherSharedRecord(t *testing.T) {
+	start := time.Unix(100000, 0)
+	o := &observeRecorder{}
+	receivers := testReceivers()
+	receivers.notifiers["ops"] = o
+	d, err := NewDispatcher(receivers, &RouteConfig{Receiver: "ops", RepeatInterval: "1h"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sendRecorder{}
+	d.SendThrough(s)
+
+	d.Restore(nil, ruleAlert("g1[0]", "shared", "vm1", "firing"), start.Add(-50*time.Minute))
+	d.Restore(nil, ruleAlert("g2[0]", "shared", "vm1", "firing"), start.Add(-50*time.Minute))
+	if want := []string{"vm1 firing", "vm1 firing"}; !reflect.DeepEqual(o.observed, want) {
+		t.Errorf("observed %v, want %v", o.observed, want)
+	}
+	for _, st := range []step{
+		{at: 0},
+		{at: time.Minute, alerts: []Alert{ruleAlert("g1[0]", "shared", "vm1", "resolved")},
+			want: []string{"ops: vm1 resolved, vm1 firing"}},
+		{at: 3 * time.Minute, alerts: []Alert{ruleAlert("g1[0]", "shared", "vm1", "firing")}},
+		{at: 6 * time.Minute, want: []string{"ops: vm1 firing, vm1 firing"}},
+	} {
+		now := start.Add(st.at)
+		if len(st.alerts) > 0 {
+			d.Dispatch(nil, st.alerts, now)
+		}
+		s.sent = nil
+		d.Flush(context.Background(), now)
+		if len(s.sent) != 0 || len(st.want) != 0 {
+			if !reflect.DeepEqual(s.sent, st.want) {
+				t.Errorf("at %v: sent %q, want %q", st.at, s.sent, st.want)
+			}
+		}
+	}
+}
+
+// keyRecorder is a Sender recording the keys of the alerts sent.
+type keyRecorder struct {
+	keys [][]string
+}
+
+func (k *keyRecorder) Send(ctx context.Context, receiver string, alerts []Alert) error {
+	keys := []string{}
+	for _, a := range alerts {
+		keys = append(keys, a.Key)
+	}
+	k.keys = append(k.keys, keys)
+	return nil
+}
+
+// TestDispatcherRepeatKeys checks that repeats carry keys of their own,
+// numbered by the repeat intervals since the alert fired.
+func TestDispatcherRepeatKeys(t *testing.T) {
+	d, err := NewDispatcher(testReceivers("ops"), &RouteConfig{
+		Receiver: "ops", GroupWait: "0s", GroupInterval: "1m", RepeatInterval: "1h",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &keyRecorder{}
+	d.SendThrough(k)
+
+	start := time.Unix(100000, 0)
+	firing := func(vm string, at time.Duration) Alert {
+		a := alert("r", vm, "firing")
+		a.Key, a.StartsAt = vm+"-fired", start.Add(at)
+		return a
+	}
+	resolved := alert("r", "vm1", "resolved")
+	resolved.Key, resolved.StartsAt = "vm1-resolved", start
+	for _, st := range []struct {
+		at     time.Duration
+		alerts []Alert
+		want   []string
+	}{
+		{at: 0, alerts: []Alert{firing("vm1", 0)}, want: []string{"vm1-fired"}},
+		{at: 30 * time.Minute, alerts: []Alert{firing("vm2", 30*time.Minute)}, want: []string{"vm1-fired", "vm2-fired"}},
+		{at: 90 * time.Minute, want: []string{"vm1-fired/1", "vm2-fired/1"}},
+		{at: 150 * time.Minute, want: []string{"vm1-fired/2", "vm2-fired/2"}},
+		{at: 200 * time.Minute, alerts: []Alert{resolved}, want: []string{"vm1-resolved", "vm2-fired"}},
+	} {
+		now := start.Add(st.at)
+		if len(st.alerts) > 0 {
+			d.Dispatch(nil, st.alerts, now)
+		}
+		k.keys = nil
+		d.Flush(context.Background(), now)
+		if len(k.keys) != 1 || !reflect.DeepEqual(k.keys[0], st.want) {
+			t.Errorf("at %v: sent %q, want %q", st.at, k.keys, st.want)
+		}
+	}
+}
+
+// TestDispatcherWithdraw checks that a withdrawn alert is neither resolved
+// nor repeated, and that its receivers stop tracking it.
+func TestDispatcherWithdraw(t *testing.T) {
+	start := time.Unix(100000, 0)
+	o := &observeRecorder{}
+	receivers := testReceivers()
+	receivers.notifiers["ops"] = o
+	d, err := NewDispatcher(receivers, &RouteConfig{
+		Receiver: "ops", GroupBy: []string{"vm"}, GroupWait: "0s", GroupInterval: "1m", RepeatInterval: "1h",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sendRecorder{}
+	d.SendThrough(s)
+
+	for _, st := range []struct {
+		step
+		withdraw []Alert
+	}{
+		{step: step{at: 0, alerts: []Alert{ruleAlert("r[0]", "r", "vm1", "firing"), ruleAlert("r[0]", "r", "vm2", "firing"), ruleAlert("q[0]", "q", "vm2", "firing")},
+			want: []string{"ops: vm1 firing", "ops: vm2 firing, vm2 firing"}}},
+		{step: step{at: time.Minute}, withdraw: []Alert{ruleAlert("r[0]", "r", "vm1", "firing"), ruleAlert("r[0]", "r", "vm2", "firing")}},
+		{step: step{at: 2 * time.Minute}},
+		{step: step{at: time.Hour, want: []string{"ops: vm2 firing"}}},
+		{step: step{at: 3 * time.Hour, want: []string{"ops: vm2 firing"}}},
+	} {
+		now := start.Add(st.at)
+		if len(st.alerts) > 0 {
+			d.Dispatch(nil, st.alerts, now)
+		}
+		for _, a := range st.withdraw {
+			d.Withdraw(nil, a)
+		}
+		s.sent = nil
+		d.Flush(context.Background(), now)
+		if len(s.sent) != 0 || len(st.want) != 0 {
+			if !reflect.DeepEqual(s.sent, st.want) {
+				t.Errorf("at %v: sent %q, want %q", st.at, s.sent, st.want)
+			}
+		}
+	}
+	if want := []string{"vm1 resolved", "vm2 resolved"}; !reflect.DeepEqual(o.observed, want) {
+		t.Errorf("observed %v, want %v", o.observed, want)
+	}
+	// withdrawing what was never dispatched does nothing
+	d.Withdraw(nil, ruleAlert("r[0]", "r", "vm3", "firing"))
+	if len(o.observed) != 2 {
+		t.Errorf("observed %v", o.observed)
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is what summary, description and runbook_url templates
+// are executed with: the alert's fields (.Rule, .Group, .Labels, .Values,
+// .State, .Threshold, .RunbookURL, .Annotations, ...), its first value as
+// .Value and its name=value annotations as .Annotation.
+type TemplateData struct {
+	Alert
+	Value      float64
+	Annotation map[string]string
+}
+
+func newTemplateData(a Alert) TemplateData {
+	d := TemplateData{Alert: a, Annotation: annotations(a.Annotations)}
+	if len(a.Values) > 0 {
+		d.Value = a.Values[0]
+	}
+	return d
+}
+
+// BodyData is what body templates are executed with.
+type BodyData struct {
+	Receiver string
+	Alerts   []TemplateData
+}
+
+var templateFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// sampleAlert is what templates are tried on when they are loaded.
+var sampleAlert = Alert{
+	Rule:        "rule",
+	Group:       "group",
+	Labels:      map[string]string{"vm": "instance-00000001", "if": "tapd21acb51-35"},
+	Values:      []float64{0},
+	State:       "firing",
+	Threshold:   "0",
+	StartsAt:    time.Unix(0, 0),
+	Annotations: []string{"label1"},
+}
+
+// Templates render the summary, description and runbook URL of alerts,
+// and the body of notifications.
+type Templates struct {
+	summary, description, runbook, body *template.Template
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewTemplates parses the templates, any of which may be empty, and tries
+// them on a sample alert so that mistakes show up when the policy loads.
+func NewTemplates(summary, description, runbook, body string) (*Templates, error) {
+	t := &Templates{}
+	var err error
+	for _, s := range []struct {
+		t    **template.Template
+		name string
+		text string
+	}{
+		{&t.summary, "summary", summary},
+		{&t.description, "description", description},
+		{&t.runbook, "runbook_url", runbook},
+		{&t.body, "body", body},
+	} {
+		if *s.t, err = parseTemplate(s.name, s.text); err != nil {
+			return nil, err
+		}
+	}
+
+	a := sampleAlert
+	if err := t.Render(&a); err != nil {
+		return nil, err
+	}
+	if _, err := t.Body("receiver", []Alert{a}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func execute(t *template.Template, data interface{}) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Render fills in the summary, description and runbook URL the alert does
+// not have yet.
+func (t *Templates) Render(a *Alert) error {
+	if t == nil {
+		return nil
+	}
+	data := newTemplateData(*a)
+	for _, s := range []struct {
+		t   *template.Template
+		out *string
+	}{
+		{t.runbook, &a.RunbookURL},
+		{t.summary, &a.Summary},
+		{t.description, &a.Description},
+	} {
+		if s.t == nil || *s.out != "" {
+			continue
+		}
+		v, err := execute(s.t, data)
+		if err != nil {
+			return err
+		}
+		*s.out = v
+		data = newTemplateData(*a)
+	}
+	return nil
+}
+
+// HasBody reports whether there is a body template.
+func (t *Templates) HasBody() bool {
+	return t != nil && t.body != nil
+}
+
+// Body renders the body of a notification.
+func (t *Templates) Body(receiver string, alerts []Alert) (string, error) {
+	if !t.HasBody() {
+		return "", nil
+	}
+	data := BodyData{Receiver: receiver}
+	for _, a := range alerts {
+		data.Alerts = append(data.Alerts, newTemplateData(a))
+	}
+	return execute(t.body, data)
+}
+
+// templated fills in the summary and description of alerts from the
+// receiver's templates, for those the rule's templates left empty.
+type templated struct {
+	Notifier
+	templates *Templates
+}
+
+func (n *templated) Notify(ctx context.Context, alerts []Alert) error {
+	rendered := make([]Alert, len(alerts))
+	for i, a := range alerts {
+		if err := n.templates.Render(&a); err != nil {
+			fmt.Fprintf(os.Stderr, "template: %s: %v\n", a.Rule, err)
+		}
+		rendered[i] = a
+	}
+	return n.Notifier.Notify(ctx, rendered)
+}
+
+func (n *templated) Tick(ctx context.Context, now time.Time) {
+	if t, ok := n.Notifier.(Ticker); ok {
+		t.Tick(ctx, now)
+	}
+}
+
+func (n *templated) Observe(alerts []Alert) {
+	if o, ok := n.Notifier.(Observer); ok {
+		o.Observe(alerts)
+	}
+}
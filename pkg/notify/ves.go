@@ -0,0 +1,258 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("ves", newVES)
+}
+
+const vesListenerVersion = "7.1.1"
+
+// VES event domains the receiver can produce.
+const (
+	vesFault                  = "fault"
+	vesThresholdCrossingAlert = "thresholdCrossingAlert"
+)
+
+type vesCommonEventHeader struct {
+	Domain                  string `json:"domain"`
+	EventID                 string `json:"eventId"`
+	EventName               string `json:"eventName"`
+	EventType               string `json:"eventType,omitempty"`
+	LastEpochMicrosec       int64  `json:"lastEpochMicrosec"`
+	Priority                string `json:"priority"`
+	ReportingEntityName     string `json:"reportingEntityName"`
+	Sequence                int    `json:"sequence"`
+	SourceName              string `json:"sourceName"`
+	StartEpochMicrosec      int64  `json:"startEpochMicrosec"`
+	Version                 string `json:"version"`
+	VesEventListenerVersion string `json:"vesEventListenerVersion"`
+}
+
+type vesFaultFields struct {
+	AlarmCondition             string            `json:"alarmCondition"`
+	AlarmInterfaceA            string            `json:"alarmInterfaceA,omitempty"`
+	AlarmAdditionalInformation map[string]string `json:"alarmAdditionalInformation,omitempty"`
+	EventSeverity              string            `json:"eventSeverity"`
+	EventSourceType            string            `json:"eventSourceType"`
+	FaultFieldsVersion         string            `json:"faultFieldsVersion"`
+	SpecificProblem            string            `json:"specificProblem"`
+	VfStatus                   string            `json:"vfStatus"`
+}
+
+type vesCounter struct {
+	Criticality      string            `json:"criticality"`
+	HashMap          map[string]string `json:"hashMap"`
+	ThresholdCrossed string            `json:"thresholdCrossed"`
+}
+
+type vesThresholdCrossingAlertFields struct {
+	AdditionalParameters           []vesCounter `json:"additionalParameters"`
+	AlertAction                    string       `json:"alertAction"`
+	AlertDescription               string       `json:"alertDescription"`
+	AlertType                      string       `json:"alertType"`
+	CollectionTimestamp            string       `json:"collectionTimestamp"`
+	EventSeverity                  string       `json:"eventSeverity"`
+	EventStartTimestamp            string       `json:"eventStartTimestamp"`
+	InterfaceName                  string       `json:"interfaceName,omitempty"`
+	ThresholdCrossingFieldsVersion string       `json:"thresholdCrossingFieldsVersion"`
+}
+
+type vesEvent struct {
+	CommonEventHeader            vesCommonEventHeader             `json:"commonEventHeader"`
+	FaultFields                  *vesFaultFields                  `json:"faultFields,omitempty"`
+	ThresholdCrossingAlertFields *vesThresholdCrossingAlertFields `json:"thresholdCrossingAlertFields,omitempty"`
+}
+
+// VES posts alerts as VES 7.x events to a collector's event listener:
+// one event to the listener URL, several to its /eventBatch. The alert's
+// vm label becomes the sourceName and its if label alarmInterfaceA (or
+// interfaceName for threshold crossing alerts).
+type VES struct {
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	domain   string
+	severity string
+	reporter string
+
+	mu       sync.Mutex
+	sequence map[string]int
+}
+
+func newVES(c ReceiverConfig) (Notifier, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("ves needs a url")
+	}
+	timeout, err := c.TimeoutOr(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	domain := c.Event
+	switch domain {
+	case "":
+		domain = vesFault
+	case vesFault, vesThresholdCrossingAlert:
+	default:
+		return nil, fmt.Errorf("ves: unknown event %q (fault or thresholdCrossingAlert)", c.Event)
+	}
+	severity := strings.ToUpper(c.Severity)
+	switch severity {
+	case "":
+		severity = "MAJOR"
+	case "CRITICAL", "MAJOR", "MINOR", "WARNING":
+	default:
+		return nil, fmt.Errorf("ves: unknown severity %q", c.Severity)
+	}
+	headers := map[string]string{}
+	for k, v := range c.Headers {
+		headers[k] = v
+	}
+	if c.Username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	}
+	reporter, err := os.Hostname()
+	if err != nil {
+		reporter = "policyengine"
+	}
+	return &VES{
+		url:      strings.TrimSuffix(c.URL, "/"),
+		headers:  headers,
+		client:   &http.Client{Timeout: timeout},
+		domain:   domain,
+		severity: severity,
+		reporter: reporter,
+		sequence: map[string]int{},
+	}, nil
+}
+
+func microsec(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// eventID is shared by the raise and the clear of one alert, so that the
+// collector can correlate them. It is keyed by rule ID: rules of different
+// groups may write the same record.
+func eventID(a Alert) string {
+	h := fnv.New64a()
+	h.Write([]byte(a.RuleID + "\x00" + fingerprint(a.Labels)))
+	return fmt.Sprintf("policyengine-%016x", h.Sum64())
+}
+
+func (v *VES) event(a Alert, now time.Time) vesEvent {
+	id := eventID(a)
+	v.mu.Lock()
+	seq := v.sequence[id]
+	if a.Firing() {
+		v.sequence[id] = seq + 1
+	} else {
+		delete(v.sequence, id)
+	}
+	v.mu.Unlock()
+
+	severity, priority, last := v.severity, "High", now
+	if !a.Firing() {
+		severity, priority, last = "NORMAL", "Normal", *a.EndsAt
+	}
+	problem := fmt.Sprintf("%s %s", a.Rule, a.State)
+	if a.Summary != "" {
+		problem = a.Summary
+	}
+	values := map[string]string{}
+	for i, val := range a.Values {
+		values["value"+strconv.Itoa(i)] = strconv.FormatFloat(val, 'g', -1, 64)
+	}
+
+	ev := vesEvent{
+		CommonEventHeader: vesCommonEventHeader{
+			Domain:                  v.domain,
+			EventID:                 id,
+			EventName:               v.domain + "_policyengine_" + a.Rule,
+			EventType:               a.Group,
+			LastEpochMicrosec:       microsec(last),
+			Priority:                priority,
+			ReportingEntityName:     v.reporter,
+			Sequence:                seq,
+			SourceName:              a.Labels["vm"],
+			StartEpochMicrosec:      microsec(a.StartsAt),
+			Version:                 "4.1",
+			VesEventListenerVersion: vesListenerVersion,
+		},
+	}
+	switch v.domain {
+	case vesFault:
+		ev.FaultFields = &vesFaultFields{
+			AlarmCondition:             a.Rule,
+			AlarmInterfaceA:            a.Labels["if"],
+			AlarmAdditionalInformation: values,
+			EventSeverity:              severity,
+			EventSourceType:            "virtualMachine",
+			FaultFieldsVersion:         "4.0",
+			SpecificProblem:            problem,
+			VfStatus:                   "Active",
+		}
+	case vesThresholdCrossingAlert:
+		action, criticality := "SET", "MAJ"
+		if !a.Firing() {
+			action = "CLEAR"
+		}
+		if v.severity == "CRITICAL" {
+			criticality = "CRIT"
+		}
+		ev.ThresholdCrossingAlertFields = &vesThresholdCrossingAlertFields{
+			AdditionalParameters: []vesCounter{{
+				Criticality:      criticality,
+				HashMap:          values,
+				ThresholdCrossed: a.Rule,
+			}},
+			AlertAction:                    action,
+			AlertDescription:               problem,
+			AlertType:                      "INTERFACE-ANOMALY",
+			CollectionTimestamp:            now.UTC().Format(time.RFC1123Z),
+			EventSeverity:                  severity,
+			EventStartTimestamp:            a.StartsAt.UTC().Format(time.RFC1123Z),
+			InterfaceName:                  a.Labels["if"],
+			ThresholdCrossingFieldsVersion: "4.0",
+		}
+	}
+	return ev
+}
+
+func (v *VES) Notify(ctx context.Context, alerts []Alert) error {
+	now := time.Now()
+	events := make([]vesEvent, 0, len(alerts))
+	for _, a := range alerts {
+		events = append(events, v.event(a, now))
+	}
+	if len(events) == 1 {
+		return postJSON(ctx, v.client, v.url, v.headers, map[string]vesEvent{"event": events[0]})
+	}
+	return postJSON(ctx, v.client, v.url+"/eventBatch", v.headers, map[string][]vesEvent{"eventList": events})
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// vesRequest is one request received by fakeCollector.
+type vesRequest struct {
+	path   string
+	auth   string
+	events []vesEvent
+}
+
+// fakeCollector stands in for a VES collector's event listener, decoding
+// single events and batches alike.
+func fakeCollector(status int) (*httptest.Server, func() []vesRequest) {
+	var mu sync.Mutex
+	requests := []vesRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Event     *vesEvent  `json:"event"`
+			EventList []vesEvent `json:"eventList"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := vesRequest{path: r.URL.Path, auth: r.Header.Get("Authorization"), events: body.EventList}
+		if body.Event != nil {
+			req.events = []vesEvent{*body.Event}
+		}
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return srv, func() []vesRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]vesRequest(nil), requests...)
+	}
+}
+
+func vesAlert(state string, ifname string) Alert {
+	start := time.Unix(1000, 0)
+	a := Alert{
+		Rule:     "test-rec1",
+		RuleID:   "test1[0]",
+		Group:    "test1",
+		Labels:   map[string]string{"vm": "instance-00000001", "if": ifname},
+		Values:   []float64{1500},
+		State:    state,
+		StartsAt: start,
+	}
+	if state == "resolved" {
+		end := start.Add(time.Minute)
+		a.EndsAt = &end
+	}
+	return a
+}
+
+func TestVES(t *testing.T) {
+	tests := []struct {
+		name     string
+		event    string
+		alerts   []Alert
+		path     string
+		severity []string
+		sequence []int
+	}{
+		{
+			name:     "single fault",
+			alerts:   []Alert{vesAlert("firing", "tap0")},
+			path:     "/eventListener/v7",
+			severity: []string{"MAJOR"},
+			sequence: []int{0},
+		},
+		{
+			name:     "batch",
+			alerts:   []Alert{vesAlert("firing", "tap0"), vesAlert("firing", "tap1")},
+			path:     "/eventListener/v7/eventBatch",
+			severity: []string{"MAJOR", "MAJOR"},
+			sequence: []int{0, 0},
+		},
+		{
+			name:     "threshold crossing clear",
+			event:    vesThresholdCrossingAlert,
+			alerts:   []Alert{vesAlert("resolved", "tap0")},
+			path:     "/eventListener/v7",
+			severity: []string{"NORMAL"},
+			sequence: []int{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := fakeCollector(http.StatusAccepted)
+			defer srv.Close()
+
+			n, err := newVES(ReceiverConfig{
+				URL:      srv.URL + "/eventListener/v7/",
+				Event:    tt.event,
+				Username: "user",
+				Password: "pass",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := n.Notify(context.Background(), tt.alerts); err != nil {
+				t.Fatal(err)
+			}
+			reqs := requests()
+			if len(reqs) != 1 {
+				t.Fatalf("got %d requests, want 1", len(reqs))
+			}
+			req := reqs[0]
+			if req.path != tt.path {
+				t.Errorf("path = %q, want %q", req.path, tt.path)
+			}
+			if req.auth != "Basic dXNlcjpwYXNz" {
+				t.Errorf("authorization = %q", req.auth)
+			}
+			if len(req.events) != len(tt.alerts) {
+				t.Fatalf("got %d events, want %d", len(req.events), len(tt.alerts))
+			}
+			for i, ev := range req.events {
+				a := tt.alerts[i]
+				h := ev.CommonEventHeader
+				if h.EventID != eventID(a) || h.SourceName != a.Labels["vm"] || h.Sequence != tt.sequence[i] {
+					t.Errorf("event %d: header %+v", i, h)
+				}
+				switch {
+				case ev.FaultFields != nil:
+					f := ev.FaultFields
+					if f.EventSeverity != tt.severity[i] || f.AlarmInterfaceA != a.Labels["if"] || f.AlarmAdditionalInformation["value0"] != "1500" {
+						t.Errorf("event %d: fault fields %+v", i, f)
+					}
+				case ev.ThresholdCrossingAlertFields != nil:
+					f := ev.ThresholdCrossingAlertFields
+					action := "SET"
+					if !a.Firing() {
+						action = "CLEAR"
+					}
+					if f.EventSeverity != tt.severity[i] || f.AlertAction != action || f.InterfaceName != a.Labels["if"] {
+						t.Errorf("event %d: threshold crossing fields %+v", i, f)
+					}
+				default:
+					t.Errorf("event %d: no domain fields", i)
+				}
+			}
+		})
+	}
+}
+
+// TestVESSequence checks that the raise and clear of an alert share their
+// event ID and that the sequence counts the raises until the clear.
+func TestVESSequence(t *testing.T) {
+	srv, requests := fakeCollector(http.StatusAccepted)
+	defer srv.Close()
+
+	n, err := newVES(ReceiverConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []string{"firing", "firing", "resolved", "firing"} {
+		if err := n.Notify(context.Background(), []Alert{vesAlert(state, "tap0")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []int{0, 1, 2, 0}
+	reqs := requests()
+	if len(reqs) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(reqs), len(want))
+	}
+	id := reqs[0].events[0].CommonEventHeader.EventID
+	for i, req := range reqs {
+		h := req.events[0].CommonEventHeader
+		if h.Sequence != want[i] || h.EventID != id {
+			t.Errorf("request %d: sequence %d, event ID %s; want %d, %s", i, h.Sequence, h.EventID, want[i], id)
+		}
+	}
+}
+
+// TestVESSharedRecord checks that rules writing the same record keep
+// their own event IDs and sequences.
+func TestVESSharedRecord(t *testing.T) {
+	srv, requests := fakeCollector(http.StatusAccepted)
+	defer srv.Close()
+
+	n, err := newVES(ReceiverConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := func(state string) Alert {
+		a := vesAlert(state, "tap0")
+		a.RuleID, a.Group = "test2[0]", "test2"
+		return a
+	}
+	alerts := []Alert{vesAlert("firing", "tap0"), other("firing"), vesAlert("firing", "tap0"), other("resolved"), vesAlert("firing", "tap0")}
+	for _, a := range alerts {
+		if err := n.Notify(context.Background(), []Alert{a}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []int{0, 0, 1, 1, 2}
+	reqs := requests()
+	if len(reqs) != len(want) {
+		t.Fatalf("got %d requests, want %d", len(reqs), len(want))
+	}
+	for i, req := range reqs {
+		h := req.events[0].CommonEventHeader
+		if h.Sequence != want[i] || h.EventID != eventID(alerts[i]) {
+			t.Errorf("request %d: sequence %d, event ID %s; want %d, %s", i, h.Sequence, h.EventID, want[i], eventID(alerts[i]))
+		}
+	}
+	if eventID(alerts[0]) == eventID(alerts[1]) {
+		t.Errorf("rules %s and %s share event ID %s", alerts[0].RuleID, alerts[1].RuleID, eventID(alerts[0]))
+	}
+}
+
+func TestVESError(t *testing.T) {
+	srv, requests := fakeCollector(http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	n, err := newVES(ReceiverConfig{URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), []Alert{vesAlert("firing", "tap0")}); err == nil {
+		t.Error("Notify succeeded on a 503")
+	}
+	if len(requests()) != 1 {
+		t.Error("collector not reached")
+	}
+}
+
+func TestNewVESConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		c    ReceiverConfig
+		ok   bool
+	}{
+		{"defaults", ReceiverConfig{URL: "http://collector"}, true},
+		{"no url", ReceiverConfig{}, false},
+		{"unknown event", ReceiverConfig{URL: "http://collector", Event: "heartbeat"}, false},
+		{"lower case severity", ReceiverConfig{URL: "http://collector", Severity: "critical"}, true},
+		{"unknown severity", ReceiverConfig{URL: "http://collector", Severity: "fatal"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newVES(tt.c)
+			if (err == nil) != tt.ok {
+				t.Errorf("newVES: %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	Register("webhook", newWebhook)
+}
+
+// Webhook posts alerts as JSON to an HTTP endpoint:
+//
+//	{"receiver": "ops", "alerts": [{"rule": ..., "state": "firing", ...}]}
+//
+// or, with a body template, the rendered body as text/plain unless the
+// headers say otherwise.
+type Webhook struct {
+	name      string
+	url       string
+	headers   map[string]string
+	client    *http.Client
+	templates *Templates
+}
+
+type webhookPayload struct {
+	Receiver string  `json:"receiver"`
+	Alerts   []Alert `json:"alerts"`
+}
+
+func newWebhook(c ReceiverConfig) (Notifier, error) {
+	if c.URL == "" {
+		return nil, fmt.Errorf("webhook needs a url")
+	}
+	timeout, err := c.TimeoutOr(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := NewTemplates("", "", "", c.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Webhook{
+		name:      c.Name,
+		url:       c.URL,
+		headers:   c.Headers,
+		client:    &http.Client{Timeout: timeout},
+		templates: templates,
+	}, nil
+}
+
+// postJSON posts body as JSON to url and fails on any non-2xx response.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return post(ctx, client, url, "application/json", headers, b)
+}
+
+// post posts b to url, headers overriding the content type.
+func post(ctx context.Context, client *http.Client, url, contentType string, headers map[string]string, b []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if key := IdempotencyKey(ctx); key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if token := FencingToken(ctx); token != 0 {
+		req.Header.Set("Fencing-Token", strconv.FormatInt(token, 10))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) Notify(ctx context.Context, alerts []Alert) error {
+	if w.templates.HasBody() {
+		body, err := w.templates.Body(w.name, alerts)
+		if err != nil {
+			return err
+		}
+		return post(ctx, w.client, w.url, "text/plain; charset=utf-8", w.headers, []byte(body))
+	}
+	return postJSON(ctx, w.client, w.url, w.headers, webhookPayload{Receiver: w.name, Alerts: alerts})
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookRequest is one request received by fakeHook.
+type hookRequest struct {
+	header http.Header
+	body   string
+}
+
+// fakeHook answers with the given statuses in turn, the last one for
+// every request after them, recording the requests.
+func fakeHook(statuses ...int) (*httptest.Server, func() []hookRequest) {
+	var mu sync.Mutex
+	requests := []hookRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		status := statuses[len(statuses)-1]
+		if len(requests) < len(statuses) {
+			status = statuses[len(requests)]
+		}
+		requests = append(requests, hookRequest{header: r.Header, body: string(b)})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return srv, func() []hookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]hookRequest(nil), requests...)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      ReceiverConfig
+		ctx         func(context.Context) context.Context
+		contentType string
+		headers     map[string]string
+		body        string // the text body, or "" for the JSON payload
+	}{
+		{
+			name:        "json payload",
+			config:      ReceiverConfig{Name: "ops"},
+			contentType: "application/json",
+		},
+		{
+			name:        "configured headers",
+			config:      ReceiverConfig{Name: "ops", Headers: map[string]string{"X-Auth-Token": "xxx"}},
+			contentType: "application/json",
+			headers:     map[string]string{"X-Auth-Token": "xxx"},
+		},
+		{
+			name:   "idempotency key and fencing token",
+			config: ReceiverConfig{Name: "ops"},
+			ctx: func(ctx context.Context) context.Context {
+				return WithFencingToken(WithIdempotencyKey(ctx, "k1"), 7)
+			},
+			contentType: "application/json",
+			headers:     map[string]string{"Idempotency-Key": "k1", "Fencing-Token": "7"},
+		},
+		{
+			name:        "body template",
+			config:      ReceiverConfig{Name: "ops", Body: "{{.Receiver}}:{{range .Alerts}} {{.State}} {{.Labels.vm}}{{end}}"},
+			contentType: "text/plain; charset=utf-8",
+			body:        "ops: firing vm1 resolved vm2",
+		},
+		{
+			name: "body template with its content type",
+			config: ReceiverConfig{Name: "ops", Body: `{"text": "{{len .Alerts}} alerts"}`,
+				Headers: map[string]string{"Content-Type": "application/json"}},
+			contentType: "application/json",
+			body:        `{"text": "2 alerts"}`,
+		},
+	}
+	alerts := []Alert{alert("test-rec1", "vm1", "firing"), alert("test-rec1", "vm2", "resolved")}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := fakeHook(http.StatusOK)
+			defer srv.Close()
+			tt.config.URL = srv.URL
+			n, err := newWebhook(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.ctx != nil {
+				ctx = tt.ctx(ctx)
+			}
+			if err := n.Notify(ctx, alerts); err != nil {
+				t.Fatal(err)
+			}
+			reqs := requests()
+			if len(reqs) != 1 {
+				t.Fatalf("%d requests, want 1", len(reqs))
+			}
+			req := reqs[0]
+			if ct := req.header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			for name, want := range tt.headers {
+				if got := req.header.Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.ctx == nil && (req.header.Get("Idempotency-Key") != "" || req.header.Get("Fencing-Token") != "") {
+				t.Errorf("unexpected key or token: %v", req.header)
+			}
+			if tt.body != "" {
+				if req.body != tt.body {
+					t.Errorf("body = %q, want %q", req.body, tt.body)
+				}
+				return
+			}
+			var payload webhookPayload
+			if err := json.Unmarshal([]byte(req.body), &payload); err != nil {
+				t.Fatalf("%v: %s", err, req.body)
+			}
+			if !reflect.DeepEqual(payload, webhookPayload{Receiver: "ops", Alerts: alerts}) {
+				t.Errorf("payload = %+v", payload)
+			}
+		})
+	}
+}
+
+func TestWebhookPayloadFields(t *testing.T) {
+	srv, requests := fakeHook(http.StatusNoContent)
+	defer srv.Close()
+	n, err := newWebhook(ReceiverConfig{Name: "ops", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := alert("test-rec1", "vm1", "resolved")
+	a.Key = "0123456789abcdef"
+	a.RuleID = "test1[0]"
+	end := time.Unix(1000, 0)
+	a.EndsAt = &end
+	if err := n.Notify(context.Background(), []Alert{a}); err != nil {
+		t.Fatal(err)
+	}
+	var payload struct {
+		Alerts []map[string]interface{} `json:"alerts"`
+	}
+	if err := json.Unmarshal([]byte(requests()[0].body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"idempotencyKey", "rule", "ruleID", "group", "labels", "values", "state", "activeAt", "startsAt", "endsAt"} {
+		if _, ok := payload.Alerts[0][field]; !ok {
+			t.Errorf("no %s in %v", field, payload.Alerts[0])
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	// down twice, then up: the first failure is returned as is, the
+	// outbox retries the second with the same key
+	srv, requests := fakeHook(http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK)
+	defer srv.Close()
+	n, err := newWebhook(ReceiverConfig{Name: "ops", URL: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Notify(context.Background(), []Alert{alert("r", "vm1", "firing")}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v, want the 503 status", err)
+	}
+
+	o, store, cleanup := testOutbox(t, map[string]Notifier{"ops": n})
+	defer cleanup()
+	ctx := context.Background()
+	if err := o.Send(ctx, "ops", []Alert{keyed("vm1", "firing")}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, at := range []time.Duration{0, time.Second, 3 * time.Second} {
+		o.Deliver(ctx, now.Add(at))
+	}
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("still pending: %+v", list)
+	}
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatalf("%d requests, want 3", len(reqs))
+	}
+	key := reqs[1].header.Get("Idempotency-Key")
+	if key == "" || reqs[2].header.Get("Idempotency-Key") != key || reqs[1].body != reqs[2].body {
+		t.Errorf("retry differs: %v / %v", reqs[1], reqs[2])
+	}
+}
@@ -20,13 +20,32 @@ const (
 	ruleUnknown pegRule = iota
 	ruleroot
 	ruleexpression
+	rulejoin
 	rulecondition
+	rulematching
+	rulematchinglabel
+	ruleside
 	rulesymbol
+	ruledurations
 	rulenumbers
 	rulevariables
 	rulestrings
 	ruleStringChar
 	ruleidchar
+	rulefunction
+	rulegrouping
+	rulegroupinglabel
+	rulefuncname
+	rulearguments
+	ruleargument
+	ruleselector
+	rulematchers
+	rulematcher
+	rulelabelname
+	rulematchop
+	rulewindow
+	ruleoffset
+	ruleduration
 	ruleops
 	ruleopeq
 	ruleopne
@@ -34,30 +53,78 @@ const (
 	ruleopge
 	ruleoplt
 	ruleopgt
+	ruleboolsym
+	ruleland
+	rulelor
+	rulelunless
 	rulesp
-	rulePegText
 	ruleAction0
 	ruleAction1
 	ruleAction2
 	ruleAction3
+	rulePegText
 	ruleAction4
 	ruleAction5
 	ruleAction6
 	ruleAction7
 	ruleAction8
+	ruleAction9
+	ruleAction10
+	ruleAction11
+	ruleAction12
+	ruleAction13
+	ruleAction14
+	ruleAction15
+	ruleAction16
+	ruleAction17
+	ruleAction18
+	ruleAction19
+	ruleAction20
+	ruleAction21
+	ruleAction22
+	ruleAction23
+	ruleAction24
+	ruleAction25
+	ruleAction26
+	ruleAction27
+	ruleAction28
+	ruleAction29
+	ruleAction30
+	ruleAction31
+	ruleAction32
+	ruleAction33
 )
 
 var rul3s = [...]string{
 	"Unknown",
 	"root",
 	"expression",
+	"join",
 	"condition",
+	"matching",
+	"matchinglabel",
+	"side",
 	"symbol",
+	"durations",
 	"numbers",
 	"variables",
 	"strings",
 	"StringChar",
 	"idchar",
+	"function",
+	"grouping",
+	"groupinglabel",
+	"funcname",
+	"arguments",
+	"argument",
+	"selector",
+	"matchers",
+	"matcher",
+	"labelname",
+	"matchop",
+	"window",
+	"offset",
+	"duration",
 	"ops",
 	"opeq",
 	"opne",
@@ -65,17 +132,46 @@ var rul3s = [...]string{
 	"opge",
 	"oplt",
 	"opgt",
+	"boolsym",
+	"land",
+	"lor",
+	"lunless",
 	"sp",
-	"PegText",
 	"Action0",
 	"Action1",
 	"Action2",
 	"Action3",
+	"PegText",
 	"Action4",
 	"Action5",
 	"Action6",
 	"Action7",
 	"Action8",
+	"Action9",
+	"Action10",
+	"Action11",
+	"Action12",
+	"Action13",
+	"Action14",
+	"Action15",
+	"Action16",
+	"Action17",
+	"Action18",
+	"Action19",
+	"Action20",
+	"Action21",
+	"Action22",
+	"Action23",
+	"Action24",
+	"Action25",
+	"Action26",
+	"Action27",
+	"Action28",
+	"Action29",
+	"Action30",
+	"Action31",
+	"Action32",
+	"Action33",
 }
 
 type token32 struct {
@@ -196,7 +292,7 @@ type Parser struct {
 
 	Buffer string
 	buffer []rune
-	rules  [28]func() bool
+	rules  [76]func() bool
 	parse  func(rule ...int) error
 	reset  func()
 	Pretty bool
@@ -293,23 +389,73 @@ func (p *Parser) Execute() {
 			text = string(_buffer[begin:end])
 
 		case ruleAction0:
-			p.AddNum(buffer[begin:end])
+			p.AddExpr()
 		case ruleAction1:
-			p.AddVar(buffer[begin:end])
+			p.AddJoin()
 		case ruleAction2:
-			p.AddStr(buffer[begin:end])
+			p.AddMatching(true)
 		case ruleAction3:
-			p.AddOps(ExprEq)
+			p.AddMatching(false)
 		case ruleAction4:
-			p.AddOps(ExprNe)
+			p.AddMatchingLabel(buffer[begin:end])
 		case ruleAction5:
-			p.AddOps(ExprLe)
+			p.AddSide(false)
 		case ruleAction6:
-			p.AddOps(ExprGe)
+			p.AddSide(true)
 		case ruleAction7:
-			p.AddOps(ExprLt)
+			p.AddDur(buffer[begin:end])
 		case ruleAction8:
+			p.AddNum(buffer[begin:end])
+		case ruleAction9:
+			p.AddVar(buffer[begin:end])
+		case ruleAction10:
+			p.AddStr(buffer[begin:end])
+		case ruleAction11:
+			p.BeginCall(buffer[begin:end])
+		case ruleAction12:
+			p.EndCall()
+		case ruleAction13:
+			p.AddGrouping(false)
+		case ruleAction14:
+			p.AddGrouping(true)
+		case ruleAction15:
+			p.AddGroupingLabel(buffer[begin:end])
+		case ruleAction16:
+			p.AddArgCond()
+		case ruleAction17:
+			p.AddLabel(buffer[begin:end])
+		case ruleAction18:
+			p.AddLabelValue(buffer[begin:end])
+		case ruleAction19:
+			p.AddMatchOp(MatchRegexp)
+		case ruleAction20:
+			p.AddMatchOp(MatchNotRegexp)
+		case ruleAction21:
+			p.AddMatchOp(MatchNotEqual)
+		case ruleAction22:
+			p.AddMatchOp(MatchEqual)
+		case ruleAction23:
+			p.AddWindow(buffer[begin:end])
+		case ruleAction24:
+			p.AddOffset(buffer[begin:end])
+		case ruleAction25:
+			p.AddOps(ExprEq)
+		case ruleAction26:
+			p.AddOps(ExprNe)
+		case ruleAction27:
+			p.AddOps(ExprLe)
+		case ruleAction28:
+			p.AddOps(ExprGe)
+		case ruleAction29:
+			p.AddOps(ExprLt)
+		case ruleAction30:
 			p.AddOps(ExprGt)
+		case ruleAction31:
+			p.BeginJoin(ExprAnd)
+		case ruleAction32:
+			p.BeginJoin(ExprOr)
+		case ruleAction33:
+			p.BeginJoin(ExprUnless)
 
 		}
 	}
@@ -411,14 +557,37 @@ func (p *Parser) Init() {
 			position, tokenIndex = position0, tokenIndex0
 			return false
 		},
-		/* 1 expression <- <condition> */
+		/* 1 expression <- <((condition / symbol) Action0 join*)> */
 		func() bool {
 			position3, tokenIndex3 := position, tokenIndex
 			{
 				position4 := position
-				if !_rules[rulecondition]() {
+				{
+					position5, tokenIndex5 := position, tokenIndex
+					if !_rules[rulecondition]() {
+						goto l6
+					}
+					goto l5
+				l6:
+					position, tokenIndex = position5, tokenIndex5
+					if !_rules[rulesymbol]() {
+						goto l3
+					}
+				}
+			l5:
+				if !_rules[ruleAction0]() {
 					goto l3
 				}
+			l7:
+				{
+					position8, tokenIndex8 := position, tokenIndex
+					if !_rules[rulejoin]() {
+						goto l8
+					}
+					goto l7
+				l8:
+					position, tokenIndex = position8, tokenIndex8
+				}
 				add(ruleexpression, position4)
 			}
 			return true
@@ -426,555 +595,2084 @@ func (p *Parser) Init() {
 			position, tokenIndex = position3, tokenIndex3
 			return false
 		},
-		/* 2 condition <- <(symbol ops symbol)> */
+		/* 2 join <- <(boolsym sp matching? (condition / symbol) Action1)> */
 		func() bool {
-			position5, tokenIndex5 := position, tokenIndex
+			position9, tokenIndex9 := position, tokenIndex
 			{
-				position6 := position
-				if !_rules[rulesymbol]() {
-					goto l5
-				}
-				if !_rules[ruleops]() {
-					goto l5
+				position10 := position
+				if !_rules[ruleboolsym]() {
+					goto l9
 				}
-				if !_rules[rulesymbol]() {
-					goto l5
+				if !_rules[rulesp]() {
+					goto l9
 				}
-				add(rulecondition, position6)
-			}
-			return true
-		l5:
-			position, tokenIndex = position5, tokenIndex5
-			return false
-		},
-		/* 3 symbol <- <((numbers sp) / (strings sp) / (variables sp))> */
-		func() bool {
-			position7, tokenIndex7 := position, tokenIndex
-			{
-				position8 := position
 				{
-					position9, tokenIndex9 := position, tokenIndex
-					if !_rules[rulenumbers]() {
-						goto l10
-					}
-					if !_rules[rulesp]() {
-						goto l10
-					}
-					goto l9
-				l10:
-					position, tokenIndex = position9, tokenIndex9
-					if !_rules[rulestrings]() {
-						goto l11
-					}
-					if !_rules[rulesp]() {
+					position11, tokenIndex11 := position, tokenIndex
+					if !_rules[rulematching]() {
 						goto l11
 					}
-					goto l9
+					goto l12
 				l11:
-					position, tokenIndex = position9, tokenIndex9
-					if !_rules[rulevariables]() {
-						goto l7
-					}
-					if !_rules[rulesp]() {
-						goto l7
-					}
+					position, tokenIndex = position11, tokenIndex11
 				}
-			l9:
-				add(rulesymbol, position8)
-			}
-			return true
-		l7:
-			position, tokenIndex = position7, tokenIndex7
-			return false
-		},
-		/* 4 numbers <- <(<[0-9]+> Action0)> */
-		func() bool {
-			position12, tokenIndex12 := position, tokenIndex
-			{
-				position13 := position
+			l12:
 				{
-					position14 := position
-					if c := buffer[position]; c < rune('0') || c > rune('9') {
-						goto l12
+					position13, tokenIndex13 := position, tokenIndex
+					if !_rules[rulecondition]() {
+						goto l14
 					}
-					position++
-				l15:
-					{
-						position16, tokenIndex16 := position, tokenIndex
-						if c := buffer[position]; c < rune('0') || c > rune('9') {
-							goto l16
-						}
-						position++
-						goto l15
-					l16:
-						position, tokenIndex = position16, tokenIndex16
+					goto l13
+				l14:
+					position, tokenIndex = position13, tokenIndex13
+					if !_rules[rulesymbol]() {
+						goto l9
 					}
-					add(rulePegText, position14)
 				}
-				if !_rules[ruleAction0]() {
-					goto l12
+			l13:
+				if !_rules[ruleAction1]() {
+					goto l9
 				}
-				add(rulenumbers, position13)
+				add(rulejoin, position10)
 			}
 			return true
-		l12:
-			position, tokenIndex = position12, tokenIndex12
+		l9:
+			position, tokenIndex = position9, tokenIndex9
 			return false
 		},
-		/* 5 variables <- <(<idchar*> Action1)> */
+		/* 3 condition <- <(symbol ops matching? symbol)> */
 		func() bool {
-			position17, tokenIndex17 := position, tokenIndex
+			position15, tokenIndex15 := position, tokenIndex
 			{
-				position18 := position
+				position16 := position
+				if !_rules[rulesymbol]() {
+					goto l15
+				}
+				if !_rules[ruleops]() {
+					goto l15
+				}
 				{
-					position19 := position
-				l20:
-					{
-						position21, tokenIndex21 := position, tokenIndex
-						if !_rules[ruleidchar]() {
-							goto l21
-						}
-						goto l20
-					l21:
-						position, tokenIndex = position21, tokenIndex21
+					position17, tokenIndex17 := position, tokenIndex
+					if !_rules[rulematching]() {
+						goto l17
 					}
-					add(rulePegText, position19)
+					goto l18
+				l17:
+					position, tokenIndex = position17, tokenIndex17
 				}
-				if !_rules[ruleAction1]() {
-					goto l17
+			l18:
+				if !_rules[rulesymbol]() {
+					goto l15
 				}
-				add(rulevariables, position18)
+				add(rulecondition, position16)
 			}
 			return true
-		l17:
-			position, tokenIndex = position17, tokenIndex17
+		l15:
+			position, tokenIndex = position15, tokenIndex15
 			return false
 		},
-		/* 6 strings <- <('"' <StringChar*> '"' sp Action2)> */
+		/* 4 matching <- <((('o' 'n' sp Action2) / ('i' 'g' 'n' 'o' 'r' 'i' 'n' 'g' sp Action3)) '(' sp (matchinglabel (',' sp matchinglabel)*)? ')' sp side?)> */
 		func() bool {
-			position22, tokenIndex22 := position, tokenIndex
+			position19, tokenIndex19 := position, tokenIndex
 			{
-				position23 := position
-				if buffer[position] != rune('"') {
-					goto l22
+				position20 := position
+				{
+					position21, tokenIndex21 := position, tokenIndex
+					if buffer[position] != rune('o') {
+						goto l22
+					}
+					position++
+					if buffer[position] != rune('n') {
+						goto l22
+					}
+					position++
+					if !_rules[rulesp]() {
+						goto l22
+					}
+					if !_rules[ruleAction2]() {
+						goto l22
+					}
+					goto l21
+				l22:
+					position, tokenIndex = position21, tokenIndex21
+					if buffer[position] != rune('i') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('g') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('n') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('o') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('r') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('i') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('n') {
+						goto l19
+					}
+					position++
+					if buffer[position] != rune('g') {
+						goto l19
+					}
+					position++
+					if !_rules[rulesp]() {
+						goto l19
+					}
+					if !_rules[ruleAction3]() {
+						goto l19
+					}
+				}
+			l21:
+				if buffer[position] != rune('(') {
+					goto l19
 				}
 				position++
+				if !_rules[rulesp]() {
+					goto l19
+				}
 				{
-					position24 := position
+					position23, tokenIndex23 := position, tokenIndex
+					if !_rules[rulematchinglabel]() {
+						goto l23
+					}
 				l25:
 					{
 						position26, tokenIndex26 := position, tokenIndex
-						if !_rules[ruleStringChar]() {
+						if buffer[position] != rune(',') {
+							goto l26
+						}
+						position++
+						if !_rules[rulesp]() {
+							goto l26
+						}
+						if !_rules[rulematchinglabel]() {
 							goto l26
 						}
 						goto l25
 					l26:
 						position, tokenIndex = position26, tokenIndex26
 					}
-					add(rulePegText, position24)
+					goto l24
+				l23:
+					position, tokenIndex = position23, tokenIndex23
 				}
-				if buffer[position] != rune('"') {
-					goto l22
+			l24:
+				if buffer[position] != rune(')') {
+					goto l19
 				}
 				position++
 				if !_rules[rulesp]() {
-					goto l22
+					goto l19
 				}
-				if !_rules[ruleAction2]() {
-					goto l22
+				{
+					position27, tokenIndex27 := position, tokenIndex
+					if !_rules[ruleside]() {
+						goto l27
+					}
+					goto l28
+				l27:
+					position, tokenIndex = position27, tokenIndex27
 				}
-				add(rulestrings, position23)
+			l28:
+				add(rulematching, position20)
 			}
 			return true
-		l22:
-			position, tokenIndex = position22, tokenIndex22
+		l19:
+			position, tokenIndex = position19, tokenIndex19
 			return false
 		},
-		/* 7 StringChar <- <(!('"' / '\n' / '\\') .)> */
+		/* 5 matchinglabel <- <(<labelname> sp Action4)> */
 		func() bool {
-			position27, tokenIndex27 := position, tokenIndex
+			position29, tokenIndex29 := position, tokenIndex
 			{
-				position28 := position
+				position30 := position
 				{
-					position29, tokenIndex29 := position, tokenIndex
-					{
-						position30, tokenIndex30 := position, tokenIndex
-						if buffer[position] != rune('"') {
-							goto l31
-						}
-						position++
-						goto l30
-					l31:
-						position, tokenIndex = position30, tokenIndex30
-						if buffer[position] != rune('\n') {
-							goto l32
-						}
-						position++
-						goto l30
-					l32:
-						position, tokenIndex = position30, tokenIndex30
-						if buffer[position] != rune('\\') {
-							goto l29
-						}
-						position++
+					position31 := position
+					if !_rules[rulelabelname]() {
+						goto l29
 					}
-				l30:
-					goto l27
-				l29:
-					position, tokenIndex = position29, tokenIndex29
+					add(rulePegText, position31)
 				}
-				if !matchDot() {
-					goto l27
+				if !_rules[rulesp]() {
+					goto l29
 				}
-				add(ruleStringChar, position28)
+				if !_rules[ruleAction4]() {
+					goto l29
+				}
+				add(rulematchinglabel, position30)
 			}
 			return true
-		l27:
-			position, tokenIndex = position27, tokenIndex27
+		l29:
+			position, tokenIndex = position29, tokenIndex29
 			return false
 		},
-		/* 8 idchar <- <([a-z] / [A-Z] / [0-9] / '_' / '.' / '-')> */
+		/* 6 side <- <(('g' 'r' 'o' 'u' 'p' '_' 'l' 'e' 'f' 't' sp Action5) / ('g' 'r' 'o' 'u' 'p' '_' 'r' 'i' 'g' 'h' 't' sp Action6))> */
 		func() bool {
-			position33, tokenIndex33 := position, tokenIndex
+			position32, tokenIndex32 := position, tokenIndex
 			{
-				position34 := position
+				position33 := position
 				{
-					position35, tokenIndex35 := position, tokenIndex
-					if c := buffer[position]; c < rune('a') || c > rune('z') {
-						goto l36
+					position34, tokenIndex34 := position, tokenIndex
+					if buffer[position] != rune('g') {
+						goto l35
 					}
 					position++
-					goto l35
-				l36:
-					position, tokenIndex = position35, tokenIndex35
-					if c := buffer[position]; c < rune('A') || c > rune('Z') {
-						goto l37
+					if buffer[position] != rune('r') {
+						goto l35
 					}
 					position++
-					goto l35
-				l37:
-					position, tokenIndex = position35, tokenIndex35
-					if c := buffer[position]; c < rune('0') || c > rune('9') {
-						goto l38
+					if buffer[position] != rune('o') {
+						goto l35
 					}
 					position++
-					goto l35
-				l38:
-					position, tokenIndex = position35, tokenIndex35
-					if buffer[position] != rune('_') {
-						goto l39
+					if buffer[position] != rune('u') {
+						goto l35
 					}
 					position++
-					goto l35
-				l39:
-					position, tokenIndex = position35, tokenIndex35
-					if buffer[position] != rune('.') {
-						goto l40
+					if buffer[position] != rune('p') {
+						goto l35
 					}
 					position++
-					goto l35
-				l40:
-					position, tokenIndex = position35, tokenIndex35
-					if buffer[position] != rune('-') {
-						goto l33
+					if buffer[position] != rune('_') {
+						goto l35
 					}
 					position++
-				}
-			l35:
-				add(ruleidchar, position34)
-			}
-			return true
-		l33:
-			position, tokenIndex = position33, tokenIndex33
-			return false
-		},
-		/* 9 ops <- <((opeq sp Action3) / (opne sp Action4) / (ople sp Action5) / (opge sp Action6) / (oplt sp Action7) / (opgt sp Action8))> */
-		func() bool {
-			position41, tokenIndex41 := position, tokenIndex
-			{
-				position42 := position
-				{
-					position43, tokenIndex43 := position, tokenIndex
-					if !_rules[ruleopeq]() {
-						goto l44
+					if buffer[position] != rune('l') {
+						goto l35
 					}
-					if !_rules[rulesp]() {
-						goto l44
+					position++
+					if buffer[position] != rune('e') {
+						goto l35
 					}
-					if !_rules[ruleAction3]() {
-						goto l44
+					position++
+					if buffer[position] != rune('f') {
+						goto l35
 					}
-					goto l43
-				l44:
-					position, tokenIndex = position43, tokenIndex43
-					if !_rules[ruleopne]() {
-						goto l45
+					position++
+					if buffer[position] != rune('t') {
+						goto l35
 					}
+					position++
 					if !_rules[rulesp]() {
-						goto l45
+						goto l35
 					}
-					if !_rules[ruleAction4]() {
-						goto l45
+					if !_rules[ruleAction5]() {
+						goto l35
 					}
-					goto l43
-				l45:
-					position, tokenIndex = position43, tokenIndex43
-					if !_rules[ruleople]() {
-						goto l46
+					goto l34
+				l35:
+					position, tokenIndex = position34, tokenIndex34
+					if buffer[position] != rune('g') {
+						goto l32
 					}
-					if !_rules[rulesp]() {
-						goto l46
+					position++
+					if buffer[position] != rune('r') {
+						goto l32
 					}
-					if !_rules[ruleAction5]() {
-						goto l46
+					position++
+					if buffer[position] != rune('o') {
+						goto l32
 					}
-					goto l43
-				l46:
-					position, tokenIndex = position43, tokenIndex43
-					if !_rules[ruleopge]() {
-						goto l47
+					position++
+					if buffer[position] != rune('u') {
+						goto l32
 					}
-					if !_rules[rulesp]() {
-						goto l47
+					position++
+					if buffer[position] != rune('p') {
+						goto l32
 					}
-					if !_rules[ruleAction6]() {
-						goto l47
+					position++
+					if buffer[position] != rune('_') {
+						goto l32
 					}
-					goto l43
-				l47:
-					position, tokenIndex = position43, tokenIndex43
-					if !_rules[ruleoplt]() {
-						goto l48
+					position++
+					if buffer[position] != rune('r') {
+						goto l32
 					}
-					if !_rules[rulesp]() {
-						goto l48
+					position++
+					if buffer[position] != rune('i') {
+						goto l32
 					}
-					if !_rules[ruleAction7]() {
-						goto l48
+					position++
+					if buffer[position] != rune('g') {
+						goto l32
 					}
-					goto l43
-				l48:
-					position, tokenIndex = position43, tokenIndex43
-					if !_rules[ruleopgt]() {
-						goto l41
+					position++
+					if buffer[position] != rune('h') {
+						goto l32
 					}
+					position++
+					if buffer[position] != rune('t') {
+						goto l32
+					}
+					position++
 					if !_rules[rulesp]() {
-						goto l41
+						goto l32
 					}
-					if !_rules[ruleAction8]() {
-						goto l41
+					if !_rules[ruleAction6]() {
+						goto l32
 					}
 				}
-			l43:
-				add(ruleops, position42)
+			l34:
+				add(ruleside, position33)
 			}
 			return true
-		l41:
-			position, tokenIndex = position41, tokenIndex41
+		l32:
+			position, tokenIndex = position32, tokenIndex32
 			return false
 		},
-		/* 10 opeq <- <('=' '=')> */
+		/* 7 symbol <- <((durations sp) / (numbers sp) / (strings sp) / function / selector)> */
 		func() bool {
-			position49, tokenIndex49 := position, tokenIndex
+			position36, tokenIndex36 := position, tokenIndex
 			{
-				position50 := position
-				if buffer[position] != rune('=') {
-					goto l49
-				}
-				position++
-				if buffer[position] != rune('=') {
-					goto l49
+				position37 := position
+				{
+					position38, tokenIndex38 := position, tokenIndex
+					if !_rules[ruledurations]() {
+						goto l39
+					}
+					if !_rules[rulesp]() {
+						goto l39
+					}
+					goto l38
+				l39:
+					position, tokenIndex = position38, tokenIndex38
+					if !_rules[rulenumbers]() {
+						goto l40
+					}
+					if !_rules[rulesp]() {
+						goto l40
+					}
+					goto l38
+				l40:
+					position, tokenIndex = position38, tokenIndex38
+					if !_rules[rulestrings]() {
+						goto l41
+					}
+					if !_rules[rulesp]() {
+						goto l41
+					}
+					goto l38
+				l41:
+					position, tokenIndex = position38, tokenIndex38
+					if !_rules[rulefunction]() {
+						goto l42
+					}
+					goto l38
+				l42:
+					position, tokenIndex = position38, tokenIndex38
+					if !_rules[ruleselector]() {
+						goto l36
+					}
 				}
-				position++
-				add(ruleopeq, position50)
+			l38:
+				add(rulesymbol, position37)
 			}
 			return true
-		l49:
-			position, tokenIndex = position49, tokenIndex49
+		l36:
+			position, tokenIndex = position36, tokenIndex36
 			return false
 		},
-		/* 11 opne <- <('!' '=')> */
+		/* 8 durations <- <(<duration> !idchar Action7)> */
 		func() bool {
-			position51, tokenIndex51 := position, tokenIndex
+			position43, tokenIndex43 := position, tokenIndex
 			{
-				position52 := position
-				if buffer[position] != rune('!') {
-					goto l51
+				position44 := position
+				{
+					position45 := position
+					if !_rules[ruleduration]() {
+						goto l43
+					}
+					add(rulePegText, position45)
 				}
-				position++
-				if buffer[position] != rune('=') {
-					goto l51
+				{
+					position46, tokenIndex46 := position, tokenIndex
+					if !_rules[ruleidchar]() {
+						goto l46
+					}
+					goto l43
+				l46:
+					position, tokenIndex = position46, tokenIndex46
 				}
-				position++
-				add(ruleopne, position52)
+				if !_rules[ruleAction7]() {
+					goto l43
+				}
+				add(ruledurations, position44)
 			}
 			return true
-		l51:
-			position, tokenIndex = position51, tokenIndex51
+		l43:
+			position, tokenIndex = position43, tokenIndex43
 			return false
 		},
-		/* 12 ople <- <('<' '=')> */
+		/* 9 numbers <- <(<('-'? [0-9]+ ('.' [0-9]+)?)> Action8)> */
 		func() bool {
-			position53, tokenIndex53 := position, tokenIndex
+			position47, tokenIndex47 := position, tokenIndex
 			{
-				position54 := position
-				if buffer[position] != rune('<') {
-					goto l53
-				}
-				position++
-				if buffer[position] != rune('=') {
-					goto l53
-				}
-				position++
-				add(ruleople, position54)
-			}
-			return true
-		l53:
-			position, tokenIndex = position53, tokenIndex53
-			return false
+				position48 := position
+				{
+					position49 := position
+					{
+						position50, tokenIndex50 := position, tokenIndex
+						if buffer[position] != rune('-') {
+							goto l50
+						}
+						position++
+						goto l51
+					l50:
+						position, tokenIndex = position50, tokenIndex50
+					}
+				l51:
+					if c := buffer[position]; c < rune('0') || c > rune('9') {
+						goto l47
+					}
+					position++
+				l52:
+					{
+						position53, tokenIndex53 := position, tokenIndex
+						if c := buffer[position]; c < rune('0') || c > rune('9') {
+							goto l53
+						}
+						position++
+						goto l52
+					l53:
+						position, tokenIndex = position53, tokenIndex53
+					}
+					{
+						position54, tokenIndex54 := position, tokenIndex
+						if buffer[position] != rune('.') {
+							goto l54
+						}
+						position++
+						if c := buffer[position]; c < rune('0') || c > rune('9') {
+							goto l54
+						}
+						position++
+					l56:
+						{
+							position57, tokenIndex57 := position, tokenIndex
+							if c := buffer[position]; c < rune('0') || c > rune('9') {
+								goto l57
+							}
+							position++
+							goto l56
+						l57:
+							position, tokenIndex = position57, tokenIndex57
+						}
+						goto l55
+					l54:
+						position, tokenIndex = position54, tokenIndex54
+					}
+				l55:
+					add(rulePegText, position49)
+				}
+				if !_rules[ruleAction8]() {
+					goto l47
+				}
+				add(rulenumbers, position48)
+			}
+			return true
+		l47:
+			position, tokenIndex = position47, tokenIndex47
+			return false
+		},
+		/* 10 variables <- <(<idchar+> Action9)> */
+		func() bool {
+			position58, tokenIndex58 := position, tokenIndex
+			{
+				position59 := position
+				{
+					position60 := position
+					if !_rules[ruleidchar]() {
+						goto l58
+					}
+				l61:
+					{
+						position62, tokenIndex62 := position, tokenIndex
+						if !_rules[ruleidchar]() {
+							goto l62
+						}
+						goto l61
+					l62:
+						position, tokenIndex = position62, tokenIndex62
+					}
+					add(rulePegText, position60)
+				}
+				if !_rules[ruleAction9]() {
+					goto l58
+				}
+				add(rulevariables, position59)
+			}
+			return true
+		l58:
+			position, tokenIndex = position58, tokenIndex58
+			return false
+		},
+		/* 11 strings <- <('"' <StringChar*> '"' sp Action10)> */
+		func() bool {
+			position63, tokenIndex63 := position, tokenIndex
+			{
+				position64 := position
+				if buffer[position] != rune('"') {
+					goto l63
+				}
+				position++
+				{
+					position65 := position
+				l66:
+					{
+						position67, tokenIndex67 := position, tokenIndex
+						if !_rules[ruleStringChar]() {
+							goto l67
+						}
+						goto l66
+					l67:
+						position, tokenIndex = position67, tokenIndex67
+					}
+					add(rulePegText, position65)
+				}
+				if buffer[position] != rune('"') {
+					goto l63
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l63
+				}
+				if !_rules[ruleAction10]() {
+					goto l63
+				}
+				add(rulestrings, position64)
+			}
+			return true
+		l63:
+			position, tokenIndex = position63, tokenIndex63
+			return false
+		},
+		/* 12 StringChar <- <(!('"' / '\n' / '\\') .)> */
+		func() bool {
+			position68, tokenIndex68 := position, tokenIndex
+			{
+				position69 := position
+				{
+					position70, tokenIndex70 := position, tokenIndex
+					{
+						position71, tokenIndex71 := position, tokenIndex
+						if buffer[position] != rune('"') {
+							goto l72
+						}
+						position++
+						goto l71
+					l72:
+						position, tokenIndex = position71, tokenIndex71
+						if buffer[position] != rune('\n') {
+							goto l73
+						}
+						position++
+						goto l71
+					l73:
+						position, tokenIndex = position71, tokenIndex71
+						if buffer[position] != rune('\\') {
+							goto l70
+						}
+						position++
+					}
+				l71:
+					goto l68
+				l70:
+					position, tokenIndex = position70, tokenIndex70
+				}
+				if !matchDot() {
+					goto l68
+				}
+				add(ruleStringChar, position69)
+			}
+			return true
+		l68:
+			position, tokenIndex = position68, tokenIndex68
+			return false
+		},
+		/* 13 idchar <- <([a-z] / [A-Z] / [0-9] / '_' / '.' / '-')> */
+		func() bool {
+			position74, tokenIndex74 := position, tokenIndex
+			{
+				position75 := position
+				{
+					position76, tokenIndex76 := position, tokenIndex
+					if c := buffer[position]; c < rune('a') || c > rune('z') {
+						goto l77
+					}
+					position++
+					goto l76
+				l77:
+					position, tokenIndex = position76, tokenIndex76
+					if c := buffer[position]; c < rune('A') || c > rune('Z') {
+						goto l78
+					}
+					position++
+					goto l76
+				l78:
+					position, tokenIndex = position76, tokenIndex76
+					if c := buffer[position]; c < rune('0') || c > rune('9') {
+						goto l79
+					}
+					position++
+					goto l76
+				l79:
+					position, tokenIndex = position76, tokenIndex76
+					if buffer[position] != rune('_') {
+						goto l80
+					}
+					position++
+					goto l76
+				l80:
+					position, tokenIndex = position76, tokenIndex76
+					if buffer[position] != rune('.') {
+						goto l81
+					}
+					position++
+					goto l76
+				l81:
+					position, tokenIndex = position76, tokenIndex76
+					if buffer[position] != rune('-') {
+						goto l74
+					}
+					position++
+				}
+			l76:
+				add(ruleidchar, position75)
+			}
+			return true
+		l74:
+			position, tokenIndex = position74, tokenIndex74
+			return false
+		},
+		/* 14 function <- <(<funcname> sp Action11 grouping? '(' sp arguments? ')' sp grouping? Action12)> */
+		func() bool {
+			position82, tokenIndex82 := position, tokenIndex
+			{
+				position83 := position
+				{
+					position84 := position
+					if !_rules[rulefuncname]() {
+						goto l82
+					}
+					add(rulePegText, position84)
+				}
+				if !_rules[rulesp]() {
+					goto l82
+				}
+				if !_rules[ruleAction11]() {
+					goto l82
+				}
+				{
+					position85, tokenIndex85 := position, tokenIndex
+					if !_rules[rulegrouping]() {
+						goto l85
+					}
+					goto l86
+				l85:
+					position, tokenIndex = position85, tokenIndex85
+				}
+			l86:
+				if buffer[position] != rune('(') {
+					goto l82
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l82
+				}
+				{
+					position87, tokenIndex87 := position, tokenIndex
+					if !_rules[rulearguments]() {
+						goto l87
+					}
+					goto l88
+				l87:
+					position, tokenIndex = position87, tokenIndex87
+				}
+			l88:
+				if buffer[position] != rune(')') {
+					goto l82
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l82
+				}
+				{
+					position89, tokenIndex89 := position, tokenIndex
+					if !_rules[rulegrouping]() {
+						goto l89
+					}
+					goto l90
+				l89:
+					position, tokenIndex = position89, tokenIndex89
+				}
+			l90:
+				if !_rules[ruleAction12]() {
+					goto l82
+				}
+				add(rulefunction, position83)
+			}
+			return true
+		l82:
+			position, tokenIndex = position82, tokenIndex82
+			return false
+		},
+		/* 15 grouping <- <((('b' 'y' sp Action13) / ('w' 'i' 't' 'h' 'o' 'u' 't' sp Action14)) '(' sp (groupinglabel (',' sp groupinglabel)*)? ')' sp)> */
+		func() bool {
+			position91, tokenIndex91 := position, tokenIndex
+			{
+				position92 := position
+				{
+					position93, tokenIndex93 := position, tokenIndex
+					if buffer[position] != rune('b') {
+						goto l94
+					}
+					position++
+					if buffer[position] != rune('y') {
+						goto l94
+					}
+					position++
+					if !_rules[rulesp]() {
+						goto l94
+					}
+					if !_rules[ruleAction13]() {
+						goto l94
+					}
+					goto l93
+				l94:
+					position, tokenIndex = position93, tokenIndex93
+					if buffer[position] != rune('w') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('i') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('t') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('h') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('o') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('u') {
+						goto l91
+					}
+					position++
+					if buffer[position] != rune('t') {
+						goto l91
+					}
+					position++
+					if !_rules[rulesp]() {
+						goto l91
+					}
+					if !_rules[ruleAction14]() {
+						goto l91
+					}
+				}
+			l93:
+				if buffer[position] != rune('(') {
+					goto l91
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l91
+				}
+				{
+					position95, tokenIndex95 := position, tokenIndex
+					if !_rules[rulegroupinglabel]() {
+						goto l95
+					}
+				l97:
+					{
+						position98, tokenIndex98 := position, tokenIndex
+						if buffer[position] != rune(',') {
+							goto l98
+						}
+						position++
+						if !_rules[rulesp]() {
+							goto l98
+						}
+						if !_rules[rulegroupinglabel]() {
+							goto l98
+						}
+						goto l97
+					l98:
+						position, tokenIndex = position98, tokenIndex98
+					}
+					goto l96
+				l95:
+					position, tokenIndex = position95, tokenIndex95
+				}
+			l96:
+				if buffer[position] != rune(')') {
+					goto l91
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l91
+				}
+				add(rulegrouping, position92)
+			}
+			return true
+		l91:
+			position, tokenIndex = position91, tokenIndex91
+			return false
+		},
+		/* 16 groupinglabel <- <(<labelname> sp Action15)> */
+		func() bool {
+			position99, tokenIndex99 := position, tokenIndex
+			{
+				position100 := position
+				{
+					position101 := position
+					if !_rules[rulelabelname]() {
+						goto l99
+					}
+					add(rulePegText, position101)
+				}
+				if !_rules[rulesp]() {
+					goto l99
+				}
+				if !_rules[ruleAction15]() {
+					goto l99
+				}
+				add(rulegroupinglabel, position100)
+			}
+			return true
+		l99:
+			position, tokenIndex = position99, tokenIndex99
+			return false
+		},
+		/* 17 funcname <- <([a-z] / '_')+> */
+		func() bool {
+			position102, tokenIndex102 := position, tokenIndex
+			{
+				position103 := position
+				{
+					position106, tokenIndex106 := position, tokenIndex
+					if c := buffer[position]; c < rune('a') || c > rune('z') {
+						goto l107
+					}
+					position++
+					goto l106
+				l107:
+					position, tokenIndex = position106, tokenIndex106
+					if buffer[position] != rune('_') {
+						goto l102
+					}
+					position++
+				}
+			l106:
+			l104:
+				{
+					position105, tokenIndex105 := position, tokenIndex
+					{
+						position108, tokenIndex108 := position, tokenIndex
+						if c := buffer[position]; c < rune('a') || c > rune('z') {
+							goto l109
+						}
+						position++
+						goto l108
+					l109:
+						position, tokenIndex = position108, tokenIndex108
+						if buffer[position] != rune('_') {
+							goto l105
+						}
+						position++
+					}
+				l108:
+					goto l104
+				l105:
+					position, tokenIndex = position105, tokenIndex105
+				}
+				add(rulefuncname, position103)
+			}
+			return true
+		l102:
+			position, tokenIndex = position102, tokenIndex102
+			return false
+		},
+		/* 18 arguments <- <(argument (',' sp argument)*)> */
+		func() bool {
+			position110, tokenIndex110 := position, tokenIndex
+			{
+				position111 := position
+				if !_rules[ruleargument]() {
+					goto l110
+				}
+			l112:
+				{
+					position113, tokenIndex113 := position, tokenIndex
+					if buffer[position] != rune(',') {
+						goto l113
+					}
+					position++
+					if !_rules[rulesp]() {
+						goto l113
+					}
+					if !_rules[ruleargument]() {
+						goto l113
+					}
+					goto l112
+				l113:
+					position, tokenIndex = position113, tokenIndex113
+				}
+				add(rulearguments, position111)
+			}
+			return true
+		l110:
+			position, tokenIndex = position110, tokenIndex110
+			return false
+		},
+		/* 19 argument <- <((condition Action16) / symbol)> */
+		func() bool {
+			position114, tokenIndex114 := position, tokenIndex
+			{
+				position115 := position
+				{
+					position116, tokenIndex116 := position, tokenIndex
+					if !_rules[rulecondition]() {
+						goto l117
+					}
+					if !_rules[ruleAction16]() {
+						goto l117
+					}
+					goto l116
+				l117:
+					position, tokenIndex = position116, tokenIndex116
+					if !_rules[rulesymbol]() {
+						goto l114
+					}
+				}
+			l116:
+				add(ruleargument, position115)
+			}
+			return true
+		l114:
+			position, tokenIndex = position114, tokenIndex114
+			return false
+		},
+		/* 20 selector <- <(variables sp matchers? window? offset?)> */
+		func() bool {
+			position118, tokenIndex118 := position, tokenIndex
+			{
+				position119 := position
+				if !_rules[rulevariables]() {
+					goto l118
+				}
+				if !_rules[rulesp]() {
+					goto l118
+				}
+				{
+					position120, tokenIndex120 := position, tokenIndex
+					if !_rules[rulematchers]() {
+						goto l120
+					}
+					goto l121
+				l120:
+					position, tokenIndex = position120, tokenIndex120
+				}
+			l121:
+				{
+					position122, tokenIndex122 := position, tokenIndex
+					if !_rules[rulewindow]() {
+						goto l122
+					}
+					goto l123
+				l122:
+					position, tokenIndex = position122, tokenIndex122
+				}
+			l123:
+				{
+					position124, tokenIndex124 := position, tokenIndex
+					if !_rules[ruleoffset]() {
+						goto l124
+					}
+					goto l125
+				l124:
+					position, tokenIndex = position124, tokenIndex124
+				}
+			l125:
+				add(ruleselector, position119)
+			}
+			return true
+		l118:
+			position, tokenIndex = position118, tokenIndex118
+			return false
+		},
+		/* 21 matchers <- <('{' sp (matcher (',' sp matcher)*)? '}' sp)> */
+		func() bool {
+			position126, tokenIndex126 := position, tokenIndex
+			{
+				position127 := position
+				if buffer[position] != rune('{') {
+					goto l126
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l126
+				}
+				{
+					position128, tokenIndex128 := position, tokenIndex
+					if !_rules[rulematcher]() {
+						goto l128
+					}
+				l130:
+					{
+						position131, tokenIndex131 := position, tokenIndex
+						if buffer[position] != rune(',') {
+							goto l131
+						}
+						position++
+						if !_rules[rulesp]() {
+							goto l131
+						}
+						if !_rules[rulematcher]() {
+							goto l131
+						}
+						goto l130
+					l131:
+						position, tokenIndex = position131, tokenIndex131
+					}
+					goto l129
+				l128:
+					position, tokenIndex = position128, tokenIndex128
+				}
+			l129:
+				if buffer[position] != rune('}') {
+					goto l126
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l126
+				}
+				add(rulematchers, position127)
+			}
+			return true
+		l126:
+			position, tokenIndex = position126, tokenIndex126
+			return false
+		},
+		/* 22 matcher <- <(<labelname> sp Action17 matchop sp '"' <StringChar*> '"' sp Action18)> */
+		func() bool {
+			position132, tokenIndex132 := position, tokenIndex
+			{
+				position133 := position
+				{
+					position134 := position
+					if !_rules[rulelabelname]() {
+						goto l132
+					}
+					add(rulePegText, position134)
+				}
+				if !_rules[rulesp]() {
+					goto l132
+				}
+				if !_rules[ruleAction17]() {
+					goto l132
+				}
+				if !_rules[rulematchop]() {
+					goto l132
+				}
+				if !_rules[rulesp]() {
+					goto l132
+				}
+				if buffer[position] != rune('"') {
+					goto l132
+				}
+				position++
+				{
+					position135 := position
+				l136:
+					{
+						position137, tokenIndex137 := position, tokenIndex
+						if !_rules[ruleStringChar]() {
+							goto l137
+						}
+						goto l136
+					l137:
+						position, tokenIndex = position137, tokenIndex137
+					}
+					add(rulePegText, position135)
+				}
+				if buffer[position] != rune('"') {
+					goto l132
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l132
+				}
+				if !_rules[ruleAction18]() {
+					goto l132
+				}
+				add(rulematcher, position133)
+			}
+			return true
+		l132:
+			position, tokenIndex = position132, tokenIndex132
+			return false
+		},
+		/* 23 labelname <- <(([a-z] / [A-Z] / '_') ([a-z] / [A-Z] / [0-9] / '_')*)> */
+		func() bool {
+			position138, tokenIndex138 := position, tokenIndex
+			{
+				position139 := position
+				{
+					position140, tokenIndex140 := position, tokenIndex
+					if c := buffer[position]; c < rune('a') || c > rune('z') {
+						goto l141
+					}
+					position++
+					goto l140
+				l141:
+					position, tokenIndex = position140, tokenIndex140
+					if c := buffer[position]; c < rune('A') || c > rune('Z') {
+						goto l142
+					}
+					position++
+					goto l140
+				l142:
+					position, tokenIndex = position140, tokenIndex140
+					if buffer[position] != rune('_') {
+						goto l138
+					}
+					position++
+				}
+			l140:
+			l143:
+				{
+					position144, tokenIndex144 := position, tokenIndex
+					{
+						position145, tokenIndex145 := position, tokenIndex
+						if c := buffer[position]; c < rune('a') || c > rune('z') {
+							goto l146
+						}
+						position++
+						goto l145
+					l146:
+						position, tokenIndex = position145, tokenIndex145
+						if c := buffer[position]; c < rune('A') || c > rune('Z') {
+							goto l147
+						}
+						position++
+						goto l145
+					l147:
+						position, tokenIndex = position145, tokenIndex145
+						if c := buffer[position]; c < rune('0') || c > rune('9') {
+							goto l148
+						}
+						position++
+						goto l145
+					l148:
+						position, tokenIndex = position145, tokenIndex145
+						if buffer[position] != rune('_') {
+							goto l144
+						}
+						position++
+					}
+				l145:
+					goto l143
+				l144:
+					position, tokenIndex = position144, tokenIndex144
+				}
+				add(rulelabelname, position139)
+			}
+			return true
+		l138:
+			position, tokenIndex = position138, tokenIndex138
+			return false
+		},
+		/* 24 matchop <- <(('=' '~' Action19) / ('!' '~' Action20) / ('!' '=' Action21) / ('=' Action22))> */
+		func() bool {
+			position149, tokenIndex149 := position, tokenIndex
+			{
+				position150 := position
+				{
+					position151, tokenIndex151 := position, tokenIndex
+					if buffer[position] != rune('=') {
+						goto l152
+					}
+					position++
+					if buffer[position] != rune('~') {
+						goto l152
+					}
+					position++
+					if !_rules[ruleAction19]() {
+						goto l152
+					}
+					goto l151
+				l152:
+					position, tokenIndex = position151, tokenIndex151
+					if buffer[position] != rune('!') {
+						goto l153
+					}
+					position++
+					if buffer[position] != rune('~') {
+						goto l153
+					}
+					position++
+					if !_rules[ruleAction20]() {
+						goto l153
+					}
+					goto l151
+				l153:
+					position, tokenIndex = position151, tokenIndex151
+					if buffer[position] != rune('!') {
+						goto l154
+					}
+					position++
+					if buffer[position] != rune('=') {
+						goto l154
+					}
+					position++
+					if !_rules[ruleAction21]() {
+						goto l154
+					}
+					goto l151
+				l154:
+					position, tokenIndex = position151, tokenIndex151
+					if buffer[position] != rune('=') {
+						goto l149
+					}
+					position++
+					if !_rules[ruleAction22]() {
+						goto l149
+					}
+				}
+			l151:
+				add(rulematchop, position150)
+			}
+			return true
+		l149:
+			position, tokenIndex = position149, tokenIndex149
+			return false
+		},
+		/* 25 window <- <('[' sp <duration> sp ']' sp Action23)> */
+		func() bool {
+			position155, tokenIndex155 := position, tokenIndex
+			{
+				position156 := position
+				if buffer[position] != rune('[') {
+					goto l155
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l155
+				}
+				{
+					position157 := position
+					if !_rules[ruleduration]() {
+						goto l155
+					}
+					add(rulePegText, position157)
+				}
+				if !_rules[rulesp]() {
+					goto l155
+				}
+				if buffer[position] != rune(']') {
+					goto l155
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l155
+				}
+				if !_rules[ruleAction23]() {
+					goto l155
+				}
+				add(rulewindow, position156)
+			}
+			return true
+		l155:
+			position, tokenIndex = position155, tokenIndex155
+			return false
+		},
+		/* 26 offset <- <('o' 'f' 'f' 's' 'e' 't' sp <duration> sp Action24)> */
+		func() bool {
+			position158, tokenIndex158 := position, tokenIndex
+			{
+				position159 := position
+				if buffer[position] != rune('o') {
+					goto l158
+				}
+				position++
+				if buffer[position] != rune('f') {
+					goto l158
+				}
+				position++
+				if buffer[position] != rune('f') {
+					goto l158
+				}
+				position++
+				if buffer[position] != rune('s') {
+					goto l158
+				}
+				position++
+				if buffer[position] != rune('e') {
+					goto l158
+				}
+				position++
+				if buffer[position] != rune('t') {
+					goto l158
+				}
+				position++
+				if !_rules[rulesp]() {
+					goto l158
+				}
+				{
+					position160 := position
+					if !_rules[ruleduration]() {
+						goto l158
+					}
+					add(rulePegText, position160)
+				}
+				if !_rules[rulesp]() {
+					goto l158
+				}
+				if !_rules[ruleAction24]() {
+					goto l158
+				}
+				add(ruleoffset, position159)
+			}
+			return true
+		l158:
+			position, tokenIndex = position158, tokenIndex158
+			return false
+		},
+		/* 27 duration <- <([0-9]+ (('m' 's') / 's' / 'm' / 'h' / 'd' / 'w'))> */
+		func() bool {
+			position161, tokenIndex161 := position, tokenIndex
+			{
+				position162 := position
+				if c := buffer[position]; c < rune('0') || c > rune('9') {
+					goto l161
+				}
+				position++
+			l163:
+				{
+					position164, tokenIndex164 := position, tokenIndex
+					if c := buffer[position]; c < rune('0') || c > rune('9') {
+						goto l164
+					}
+					position++
+					goto l163
+				l164:
+					position, tokenIndex = position164, tokenIndex164
+				}
+				{
+					position165, tokenIndex165 := position, tokenIndex
+					if buffer[position] != rune('m') {
+						goto l166
+					}
+					position++
+					if buffer[position] != rune('s') {
+						goto l166
+					}
+					position++
+					goto l165
+				l166:
+					position, tokenIndex = position165, tokenIndex165
+					if buffer[position] != rune('s') {
+						goto l167
+					}
+					position++
+					goto l165
+				l167:
+					position, tokenIndex = position165, tokenIndex165
+					if buffer[position] != rune('m') {
+						goto l168
+					}
+					position++
+					goto l165
+				l168:
+					position, tokenIndex = position165, tokenIndex165
+					if buffer[position] != rune('h') {
+						goto l169
+					}
+					position++
+					goto l165
+				l169:
+					position, tokenIndex = position165, tokenIndex165
+					if buffer[position] != rune('d') {
+						goto l170
+					}
+					position++
+					goto l165
+				l170:
+					position, tokenIndex = position165, tokenIndex165
+					if buffer[position] != rune('w') {
+						goto l161
+					}
+					position++
+				}
+			l165:
+				add(ruleduration, position162)
+			}
+			return true
+		l161:
+			position, tokenIndex = position161, tokenIndex161
+			return false
+		},
+		/* 28 ops <- <((opeq sp Action25) / (opne sp Action26) / (ople sp Action27) / (opge sp Action28) / (oplt sp Action29) / (opgt sp Action30))> */
+		func() bool {
+			position171, tokenIndex171 := position, tokenIndex
+			{
+				position172 := position
+				{
+					position173, tokenIndex173 := position, tokenIndex
+					if !_rules[ruleopeq]() {
+						goto l174
+					}
+					if !_rules[rulesp]() {
+						goto l174
+					}
+					if !_rules[ruleAction25]() {
+						goto l174
+					}
+					goto l173
+				l174:
+					position, tokenIndex = position173, tokenIndex173
+					if !_rules[ruleopne]() {
+						goto l175
+					}
+					if !_rules[rulesp]() {
+						goto l175
+					}
+					if !_rules[ruleAction26]() {
+						goto l175
+					}
+					goto l173
+				l175:
+					position, tokenIndex = position173, tokenIndex173
+					if !_rules[ruleople]() {
+						goto l176
+					}
+					if !_rules[rulesp]() {
+						goto l176
+					}
+					if !_rules[ruleAction27]() {
+						goto l176
+					}
+					goto l173
+				l176:
+					position, tokenIndex = position173, tokenIndex173
+					if !_rules[ruleopge]() {
+						goto l177
+					}
+					if !_rules[rulesp]() {
+						goto l177
+					}
+					if !_rules[ruleAction28]() {
+						goto l177
+					}
+					goto l173
+				l177:
+					position, tokenIndex = position173, tokenIndex173
+					if !_rules[ruleoplt]() {
+						goto l178
+					}
+					if !_rules[rulesp]() {
+						goto l178
+					}
+					if !_rules[ruleAction29]() {
+						goto l178
+					}
+					goto l173
+				l178:
+					position, tokenIndex = position173, tokenIndex173
+					if !_rules[ruleopgt]() {
+						goto l171
+					}
+					if !_rules[rulesp]() {
+						goto l171
+					}
+					if !_rules[ruleAction30]() {
+						goto l171
+					}
+				}
+			l173:
+				add(ruleops, position172)
+			}
+			return true
+		l171:
+			position, tokenIndex = position171, tokenIndex171
+			return false
+		},
+		/* 29 opeq <- <('=' '=')> */
+		func() bool {
+			position179, tokenIndex179 := position, tokenIndex
+			{
+				position180 := position
+				if buffer[position] != rune('=') {
+					goto l179
+				}
+				position++
+				if buffer[position] != rune('=') {
+					goto l179
+				}
+				position++
+				add(ruleopeq, position180)
+			}
+			return true
+		l179:
+			position, tokenIndex = position179, tokenIndex179
+			return false
+		},
+		/* 30 opne <- <('!' '=')> */
+		func() bool {
+			position181, tokenIndex181 := position, tokenIndex
+			{
+				position182 := position
+				if buffer[position] != rune('!') {
+					goto l181
+				}
+				position++
+				if buffer[position] != rune('=') {
+					goto l181
+				}
+				position++
+				add(ruleopne, position182)
+			}
+			return true
+		l181:
+			position, tokenIndex = position181, tokenIndex181
+			return false
+		},
+		/* 31 ople <- <('<' '=')> */
+		func() bool {
+			position183, tokenIndex183 := position, tokenIndex
+			{
+				position184 := position
+				if buffer[position] != rune('<') {
+					goto l183
+				}
+				position++
+				if buffer[position] != rune('=') {
+					goto l183
+				}
+				position++
+				add(ruleople, position184)
+			}
+			return true
+		l183:
+			position, tokenIndex = position183, tokenIndex183
+			return false
 		},
-		/* 13 opge <- <'='> */
+		/* 32 opge <- <('>' '=')> */
 		func() bool {
-			position55, tokenIndex55 := position, tokenIndex
+			position185, tokenIndex185 := position, tokenIndex
 			{
-				position56 := position
+				position186 := position
+				if buffer[position] != rune('>') {
+					goto l185
+				}
+				position++
 				if buffer[position] != rune('=') {
-					goto l55
+					goto l185
 				}
 				position++
-				add(ruleopge, position56)
+				add(ruleopge, position186)
 			}
 			return true
-		l55:
-			position, tokenIndex = position55, tokenIndex55
+		l185:
+			position, tokenIndex = position185, tokenIndex185
 			return false
 		},
-		/* 14 oplt <- <'<'> */
+		/* 33 oplt <- <'<'> */
 		func() bool {
-			position57, tokenIndex57 := position, tokenIndex
+			position187, tokenIndex187 := position, tokenIndex
 			{
-				position58 := position
+				position188 := position
 				if buffer[position] != rune('<') {
-					goto l57
+					goto l187
 				}
 				position++
-				add(ruleoplt, position58)
+				add(ruleoplt, position188)
 			}
 			return true
-		l57:
-			position, tokenIndex = position57, tokenIndex57
+		l187:
+			position, tokenIndex = position187, tokenIndex187
 			return false
 		},
-		/* 15 opgt <- <'>'> */
+		/* 34 opgt <- <'>'> */
 		func() bool {
-			position59, tokenIndex59 := position, tokenIndex
+			position189, tokenIndex189 := position, tokenIndex
 			{
-				position60 := position
+				position190 := position
 				if buffer[position] != rune('>') {
-					goto l59
+					goto l189
+				}
+				position++
+				add(ruleopgt, position190)
+			}
+			return true
+		l189:
+			position, tokenIndex = position189, tokenIndex189
+			return false
+		},
+		/* 35 boolsym <- <((land Action31) / (lor Action32) / (lunless Action33))> */
+		func() bool {
+			position191, tokenIndex191 := position, tokenIndex
+			{
+				position192 := position
+				{
+					position193, tokenIndex193 := position, tokenIndex
+					if !_rules[ruleland]() {
+						goto l194
+					}
+					if !_rules[ruleAction31]() {
+						goto l194
+					}
+					goto l193
+				l194:
+					position, tokenIndex = position193, tokenIndex193
+					if !_rules[rulelor]() {
+						goto l195
+					}
+					if !_rules[ruleAction32]() {
+						goto l195
+					}
+					goto l193
+				l195:
+					position, tokenIndex = position193, tokenIndex193
+					if !_rules[rulelunless]() {
+						goto l191
+					}
+					if !_rules[ruleAction33]() {
+						goto l191
+					}
+				}
+			l193:
+				add(ruleboolsym, position192)
+			}
+			return true
+		l191:
+			position, tokenIndex = position191, tokenIndex191
+			return false
+		},
+		/* 36 land <- <(('&' '&') / ('a' 'n' 'd' !idchar))> */
+		func() bool {
+			position196, tokenIndex196 := position, tokenIndex
+			{
+				position197 := position
+				{
+					position198, tokenIndex198 := position, tokenIndex
+					if buffer[position] != rune('&') {
+						goto l199
+					}
+					position++
+					if buffer[position] != rune('&') {
+						goto l199
+					}
+					position++
+					goto l198
+				l199:
+					position, tokenIndex = position198, tokenIndex198
+					if buffer[position] != rune('a') {
+						goto l196
+					}
+					position++
+					if buffer[position] != rune('n') {
+						goto l196
+					}
+					position++
+					if buffer[position] != rune('d') {
+						goto l196
+					}
+					position++
+					{
+						position200, tokenIndex200 := position, tokenIndex
+						if !_rules[ruleidchar]() {
+							goto l200
+						}
+						goto l196
+					l200:
+						position, tokenIndex = position200, tokenIndex200
+					}
+				}
+			l198:
+				add(ruleland, position197)
+			}
+			return true
+		l196:
+			position, tokenIndex = position196, tokenIndex196
+			return false
+		},
+		/* 37 lor <- <(('|' '|') / ('o' 'r' !idchar))> */
+		func() bool {
+			position201, tokenIndex201 := position, tokenIndex
+			{
+				position202 := position
+				{
+					position203, tokenIndex203 := position, tokenIndex
+					if buffer[position] != rune('|') {
+						goto l204
+					}
+					position++
+					if buffer[position] != rune('|') {
+						goto l204
+					}
+					position++
+					goto l203
+				l204:
+					position, tokenIndex = position203, tokenIndex203
+					if buffer[position] != rune('o') {
+						goto l201
+					}
+					position++
+					if buffer[position] != rune('r') {
+						goto l201
+					}
+					position++
+					{
+						position205, tokenIndex205 := position, tokenIndex
+						if !_rules[ruleidchar]() {
+							goto l205
+						}
+						goto l201
+					l205:
+						position, tokenIndex = position205, tokenIndex205
+					}
+				}
+			l203:
+				add(rulelor, position202)
+			}
+			return true
+		l201:
+			position, tokenIndex = position201, tokenIndex201
+			return false
+		},
+		/* 38 lunless <- <('u' 'n' 'l' 'e' 's' 's' !idchar)> */
+		func() bool {
+			position206, tokenIndex206 := position, tokenIndex
+			{
+				position207 := position
+				if buffer[position] != rune('u') {
+					goto l206
+				}
+				position++
+				if buffer[position] != rune('n') {
+					goto l206
+				}
+				position++
+				if buffer[position] != rune('l') {
+					goto l206
+				}
+				position++
+				if buffer[position] != rune('e') {
+					goto l206
+				}
+				position++
+				if buffer[position] != rune('s') {
+					goto l206
+				}
+				position++
+				if buffer[position] != rune('s') {
+					goto l206
 				}
 				position++
-				add(ruleopgt, position60)
+				{
+					position208, tokenIndex208 := position, tokenIndex
+					if !_rules[ruleidchar]() {
+						goto l208
+					}
+					goto l206
+				l208:
+					position, tokenIndex = position208, tokenIndex208
+				}
+				add(rulelunless, position207)
 			}
 			return true
-		l59:
-			position, tokenIndex = position59, tokenIndex59
+		l206:
+			position, tokenIndex = position206, tokenIndex206
 			return false
 		},
-		/* 16 sp <- <(' ' / '\t')*> */
+		/* 39 sp <- <(' ' / '\t')*> */
 		func() bool {
 			{
-				position62 := position
-			l63:
+				position210 := position
+			l211:
 				{
-					position64, tokenIndex64 := position, tokenIndex
+					position212, tokenIndex212 := position, tokenIndex
 					{
-						position65, tokenIndex65 := position, tokenIndex
+						position213, tokenIndex213 := position, tokenIndex
 						if buffer[position] != rune(' ') {
-							goto l66
+							goto l214
 						}
 						position++
-						goto l65
-					l66:
-						position, tokenIndex = position65, tokenIndex65
+						goto l213
+					l214:
+						position, tokenIndex = position213, tokenIndex213
 						if buffer[position] != rune('\t') {
-							goto l64
+							goto l212
 						}
 						position++
 					}
-				l65:
-					goto l63
-				l64:
-					position, tokenIndex = position64, tokenIndex64
+				l213:
+					goto l211
+				l212:
+					position, tokenIndex = position212, tokenIndex212
 				}
-				add(rulesp, position62)
+				add(rulesp, position210)
 			}
 			return true
 		},
-		nil,
-		/* 19 Action0 <- <{ p.AddNum(buffer[begin:end]) }> */
+		/* 41 Action0 <- <{ p.AddExpr() }> */
 		func() bool {
 			{
 				add(ruleAction0, position)
 			}
 			return true
 		},
-		/* 20 Action1 <- <{ p.AddVar(buffer[begin:end]) }> */
+		/* 42 Action1 <- <{ p.AddJoin() }> */
 		func() bool {
 			{
 				add(ruleAction1, position)
 			}
 			return true
 		},
-		/* 21 Action2 <- <{ p.AddStr(buffer[begin:end]) }> */
+		/* 43 Action2 <- <{ p.AddMatching(true) }> */
 		func() bool {
 			{
 				add(ruleAction2, position)
 			}
 			return true
 		},
-		/* 22 Action3 <- <{ p.AddOps(ExprEq) }> */
+		/* 44 Action3 <- <{ p.AddMatching(false) }> */
 		func() bool {
 			{
 				add(ruleAction3, position)
 			}
 			return true
 		},
-		/* 23 Action4 <- <{ p.AddOps(ExprNe) }> */
+		nil,
+		/* 46 Action4 <- <{ p.AddMatchingLabel(buffer[begin:end]) }> */
 		func() bool {
 			{
 				add(ruleAction4, position)
 			}
 			return true
 		},
-		/* 24 Action5 <- <{ p.AddOps(ExprLe) }> */
+		/* 47 Action5 <- <{ p.AddSide(false) }> */
 		func() bool {
 			{
 				add(ruleAction5, position)
 			}
 			return true
 		},
-		/* 25 Action6 <- <{ p.AddOps(ExprGe) }> */
+		/* 48 Action6 <- <{ p.AddSide(true) }> */
 		func() bool {
 			{
 				add(ruleAction6, position)
 			}
 			return true
 		},
-		/* 26 Action7 <- <{ p.AddOps(ExprLt) }> */
+		/* 49 Action7 <- <{ p.AddDur(buffer[begin:end]) }> */
 		func() bool {
 			{
 				add(ruleAction7, position)
 			}
 			return true
 		},
-		/* 27 Action8 <- <{ p.AddOps(ExprGt) }> */
+		/* 50 Action8 <- <{ p.AddNum(buffer[begin:end]) }> */
 		func() bool {
 			{
 				add(ruleAction8, position)
 			}
 			return true
 		},
+		/* 51 Action9 <- <{ p.AddVar(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction9, position)
+			}
+			return true
+		},
+		/* 52 Action10 <- <{ p.AddStr(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction10, position)
+			}
+			return true
+		},
+		/* 53 Action11 <- <{ p.BeginCall(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction11, position)
+			}
+			return true
+		},
+		/* 54 Action12 <- <{ p.EndCall() }> */
+		func() bool {
+			{
+				add(ruleAction12, position)
+			}
+			return true
+		},
+		/* 55 Action13 <- <{ p.AddGrouping(false) }> */
+		func() bool {
+			{
+				add(ruleAction13, position)
+			}
+			return true
+		},
+		/* 56 Action14 <- <{ p.AddGrouping(true) }> */
+		func() bool {
+			{
+				add(ruleAction14, position)
+			}
+			return true
+		},
+		/* 57 Action15 <- <{ p.AddGroupingLabel(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction15, position)
+			}
+			return true
+		},
+		/* 58 Action16 <- <{ p.AddArgCond() }> */
+		func() bool {
+			{
+				add(ruleAction16, position)
+			}
+			return true
+		},
+		/* 59 Action17 <- <{ p.AddLabel(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction17, position)
+			}
+			return true
+		},
+		/* 60 Action18 <- <{ p.AddLabelValue(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction18, position)
+			}
+			return true
+		},
+		/* 61 Action19 <- <{ p.AddMatchOp(MatchRegexp) }> */
+		func() bool {
+			{
+				add(ruleAction19, position)
+			}
+			return true
+		},
+		/* 62 Action20 <- <{ p.AddMatchOp(MatchNotRegexp) }> */
+		func() bool {
+			{
+				add(ruleAction20, position)
+			}
+			return true
+		},
+		/* 63 Action21 <- <{ p.AddMatchOp(MatchNotEqual) }> */
+		func() bool {
+			{
+				add(ruleAction21, position)
+			}
+			return true
+		},
+		/* 64 Action22 <- <{ p.AddMatchOp(MatchEqual) }> */
+		func() bool {
+			{
+				add(ruleAction22, position)
+			}
+			return true
+		},
+		/* 65 Action23 <- <{ p.AddWindow(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction23, position)
+			}
+			return true
+		},
+		/* 66 Action24 <- <{ p.AddOffset(buffer[begin:end]) }> */
+		func() bool {
+			{
+				add(ruleAction24, position)
+			}
+			return true
+		},
+		/* 67 Action25 <- <{ p.AddOps(ExprEq) }> */
+		func() bool {
+			{
+				add(ruleAction25, position)
+			}
+			return true
+		},
+		/* 68 Action26 <- <{ p.AddOps(ExprNe) }> */
+		func() bool {
+			{
+				add(ruleAction26, position)
+			}
+			return true
+		},
+		/* 69 Action27 <- <{ p.AddOps(ExprLe) }> */
+		func() bool {
+			{
+				add(ruleAction27, position)
+			}
+			return true
+		},
+		/* 70 Action28 <- <{ p.AddOps(ExprGe) }> */
+		func() bool {
+			{
+				add(ruleAction28, position)
+			}
+			return true
+		},
+		/* 71 Action29 <- <{ p.AddOps(ExprLt) }> */
+		func() bool {
+			{
+				add(ruleAction29, position)
+			}
+			return true
+		},
+		/* 72 Action30 <- <{ p.AddOps(ExprGt) }> */
+		func() bool {
+			{
+				add(ruleAction30, position)
+			}
+			return true
+		},
+		/* 73 Action31 <- <{ p.BeginJoin(ExprAnd) }> */
+		func() bool {
+			{
+				add(ruleAction31, position)
+			}
+			return true
+		},
+		/* 74 Action32 <- <{ p.BeginJoin(ExprOr) }> */
+		func() bool {
+			{
+				add(ruleAction32, position)
+			}
+			return true
+		},
+		/* 75 Action33 <- <{ p.BeginJoin(ExprUnless) }> */
+		func() bool {
+			{
+				add(ruleAction33, position)
+			}
+			return true
+		},
 	}
 	p.rules = _rules
 }
@@ -3,6 +3,10 @@ package parser
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ExprTypes int
@@ -18,81 +22,583 @@ const (
 	ExprGe
 	ExprLt
 	ExprGt
+	ExprFunc
+	ExprAnd
+	ExprOr
+	ExprUnless
+	ExprDur
+	ExprCmp // a comparison given as an aggregation argument
 )
 
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+// LabelMatcher selects series by one of their resource labels,
+// e.g. vm="instance-00000001" or if=~"tap.*".
+type LabelMatcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+
+	re *regexp.Regexp
+}
+
+func NewLabelMatcher(name string, t MatchType, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Name: name, Type: t, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, fmt.Errorf("label %s: %v", name, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+var matcherRe = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"([^"\\\n]*)"\s*(,|$)`)
+
+// ParseMatchers parses label matchers as written in selectors, with or
+// without the braces: {vm="instance-00000001", if=~"tap.*"}.
+func ParseMatchers(s string) ([]*LabelMatcher, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+	matchers := []*LabelMatcher{}
+	for strings.TrimSpace(s) != "" {
+		sm := matcherRe.FindStringSubmatch(s)
+		if sm == nil {
+			return nil, fmt.Errorf("bad label matcher at %q", s)
+		}
+		t := MatchEqual
+		switch sm[2] {
+		case "!=":
+			t = MatchNotEqual
+		case "=~":
+			t = MatchRegexp
+		case "!~":
+			t = MatchNotRegexp
+		}
+		m, err := NewLabelMatcher(sm[1], t, sm[3])
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		s = s[len(sm[0]):]
+	}
+	return matchers, nil
+}
+
+func (m *LabelMatcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+func (m *LabelMatcher) String() string {
+	ops := ""
+	switch m.Type {
+	case MatchEqual:
+		ops = "="
+	case MatchNotEqual:
+		ops = "!="
+	case MatchRegexp:
+		ops = "=~"
+	case MatchNotRegexp:
+		ops = "!~"
+	}
+	return fmt.Sprintf("%s%s%q", m.Name, ops, m.Value)
+}
+
 type ExprSymbol struct {
 	Types   ExprTypes
 	ExprNum string
 	ExprVar string
 	ExprStr string
+	ExprDur time.Duration
+
+	// Matchers and Window narrow an ExprVar metric to a set of series
+	// and to the time range read for them (zero means the default),
+	// which Offset moves back in time.
+	Matchers []*LabelMatcher
+	Window   time.Duration
+	Offset   time.Duration
+
+	// Func and Args describe an ExprFunc call such as absent(...).
+	Func string
+	Args []*ExprSymbol
+
+	// Cond is the comparison of an ExprCmp, such as vm.cpu > 90 in
+	// count by (host) (vm.cpu > 90).
+	Cond *ExprCond
+
+	// Grouping lists the labels an aggregation keeps, as in
+	// sum by (vm) (...), or drops when Without, as in avg without (if).
+	Grouping []string
+	Without  bool
+	grouped  bool
+}
+
+// Selector returns the metric referenced by the symbol, looking into
+// function arguments, or nil when the symbol has none.
+func (s *ExprSymbol) Selector() *ExprSymbol {
+	if s == nil {
+		return nil
+	}
+	switch s.Types {
+	case ExprVar:
+		return s
+	case ExprFunc:
+		for _, arg := range s.Args {
+			if sel := arg.Selector(); sel != nil {
+				return sel
+			}
+		}
+	case ExprCmp:
+		if sel := s.Cond.Left.Selector(); sel != nil {
+			return sel
+		}
+		return s.Cond.Right.Selector()
+	}
+	return nil
+}
+
+// Selectors returns every metric referenced under the symbol.
+func (s *ExprSymbol) Selectors() []*ExprSymbol {
+	if s == nil {
+		return nil
+	}
+	switch s.Types {
+	case ExprVar:
+		return []*ExprSymbol{s}
+	case ExprFunc:
+		sels := []*ExprSymbol{}
+		for _, arg := range s.Args {
+			sels = append(sels, arg.Selectors()...)
+		}
+		return sels
+	case ExprCmp:
+		return append(s.Cond.Left.Selectors(), s.Cond.Right.Selectors()...)
+	}
+	return nil
+}
+
+// Selectors returns every metric referenced by the expression, joined
+// conditions included.
+func (p *PolicyExpr) Selectors() []*ExprSymbol {
+	sels := append(p.Left.Selectors(), p.Right.Selectors()...)
+	for _, j := range p.Joins {
+		sels = append(sels, j.Cond.Left.Selectors()...)
+		sels = append(sels, j.Cond.Right.Selectors()...)
+	}
+	return sels
+}
+
+// functions lists the known functions and their number of arguments.
+var functions = map[string]int{
+	"absent":          1,
+	"avg_over_time":   1,
+	"max_over_time":   1,
+	"min_over_time":   1,
+	"sum_over_time":   1,
+	"count_over_time": 1,
+	"rate":            1,
+
+	// aggregations across series, taking by or without
+	"sum":     1,
+	"avg":     1,
+	"min":     1,
+	"max":     1,
+	"count":   1,
+	"topk":    2,
+	"bottomk": 2,
+
+	// anomaly detection over each series' own samples
+	"zscore":      1,
+	"ewma":        2,
+	"mad_outlier": 2,
+
+	// smoothing and comparison with the same window one period earlier
+	"holt_winters":   3,
+	"seasonal_ratio": 2,
+	"seasonal_delta": 2,
+}
+
+// argTypes gives the type each argument of a function must have, ExprNone
+// taking any.
+var argTypes = map[string][]ExprTypes{
+	"topk":           {ExprNum, ExprNone},
+	"bottomk":        {ExprNum, ExprNone},
+	"ewma":           {ExprNone, ExprNum},
+	"mad_outlier":    {ExprNone, ExprNum},
+	"holt_winters":   {ExprNone, ExprNum, ExprNum},
+	"seasonal_ratio": {ExprVar, ExprDur},
+	"seasonal_delta": {ExprVar, ExprDur},
+}
+
+var typeNames = map[ExprTypes]string{
+	ExprNum: "number",
+	ExprVar: "metric",
+	ExprDur: "duration",
+}
+
+// Aggregations are the functions aggregating across series.
+var Aggregations = map[string]bool{
+	"sum":     true,
+	"avg":     true,
+	"min":     true,
+	"max":     true,
+	"count":   true,
+	"topk":    true,
+	"bottomk": true,
 }
 
 type ExprCond struct {
-	Left  *ExprSymbol
-	Ops   ExprTypes
-	Right *ExprSymbol
+	Left     *ExprSymbol
+	Ops      ExprTypes
+	Right    *ExprSymbol
+	Matching Matching // of Left and Right series, when Right is not a number
+}
+
+// Matching tells which series of two sides go together: those with the
+// same values of the On labels, or of all the labels but the ignored
+// ones, or of all of them when neither is given. The result carries the
+// series of the left side, or of the right one with GroupRight, so that
+// the side with several series per match (group_left or group_right)
+// keeps them all.
+type Matching struct {
+	Labels     []string
+	On         bool // Labels are the ones matched on rather than ignored
+	GroupRight bool
+	set        bool
+}
+
+// Join combines the series matched so far with those of Cond.
+type Join struct {
+	Op       ExprTypes // ExprAnd, ExprOr or ExprUnless
+	Matching Matching
+	Cond     ExprCond
 }
 
 type PolicyExpr struct {
-	Left  *ExprSymbol
-	Ops   ExprTypes
-	Right *ExprSymbol
+	Left     *ExprSymbol
+	Ops      ExprTypes
+	Right    *ExprSymbol
+	Matching Matching
+	Joins    []*Join // applied left to right
+
+	// stack holds the symbols parsed so far, calls the stack depth at
+	// which each open function call started and conds the comparisons
+	// being parsed as their arguments.
+	stack    []*ExprSymbol
+	calls    []int
+	conds    []*ExprCond
+	matcher  *LabelMatcher
+	join     *Join     // being parsed
+	matching *Matching // being parsed
+	err      error
+}
+
+// Err returns the first error found while building the expression.
+func (p *PolicyExpr) Err() error {
+	return p.err
+}
+
+func (p *PolicyExpr) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *PolicyExpr) push(s *ExprSymbol) {
+	p.stack = append(p.stack, s)
+}
+
+func (p *PolicyExpr) pop() *ExprSymbol {
+	if len(p.stack) == 0 {
+		return nil
+	}
+	s := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	return s
+}
+
+func (p *PolicyExpr) top() *ExprSymbol {
+	if len(p.stack) == 0 {
+		return nil
+	}
+	return p.stack[len(p.stack)-1]
 }
 
 func (p *PolicyExpr) AddOps(ops ExprTypes) {
-	if p.Ops == ExprNone {
+	if len(p.calls) > 0 {
+		c := &ExprCond{Ops: ops}
+		p.conds = append(p.conds, c)
+		p.matching = &c.Matching
+	} else if p.join != nil {
+		p.join.Cond.Ops = ops
+		p.matching = &p.join.Cond.Matching
+	} else if p.Ops == ExprNone {
 		p.Ops = ops
+		p.matching = &p.Matching
 	} else {
 		fmt.Fprintf(os.Stderr, "error")
 	}
 }
 
+// BeginJoin starts an and, or or unless with the next condition.
+func (p *PolicyExpr) BeginJoin(op ExprTypes) {
+	p.join = &Join{Op: op}
+	p.matching = &p.join.Matching
+}
+
+// AddJoin takes the joined condition off the stack.
+func (p *PolicyExpr) AddJoin() {
+	c := &p.join.Cond
+	if c.Ops != ExprNone {
+		c.Right = p.pop()
+	}
+	c.Left = p.pop()
+	checkCond(p, c.Left, c.Ops, c.Right, c.Matching)
+	p.Joins = append(p.Joins, p.join)
+	p.join = nil
+}
+
+// AddArgCond takes the comparison given as a function argument off the
+// stack.
+func (p *PolicyExpr) AddArgCond() {
+	c := p.conds[len(p.conds)-1]
+	p.conds = p.conds[:len(p.conds)-1]
+	c.Right = p.pop()
+	c.Left = p.pop()
+	checkCond(p, c.Left, c.Ops, c.Right, c.Matching)
+	p.push(&ExprSymbol{
+		Types: ExprCmp,
+		Cond:  c,
+	})
+}
+
+// AddMatching starts an on (true) or ignoring (false) clause.
+func (p *PolicyExpr) AddMatching(on bool) {
+	p.matching.set = true
+	p.matching.On = on
+	p.matching.Labels = []string{}
+}
+
+func (p *PolicyExpr) AddMatchingLabel(s string) {
+	p.matching.Labels = append(p.matching.Labels, s)
+}
+
+// AddSide records group_left (false) or group_right (true).
+func (p *PolicyExpr) AddSide(right bool) {
+	p.matching.GroupRight = right
+}
+
+// checkCond rejects durations outside function arguments and matching
+// clauses on comparisons with a number.
+func checkCond(p *PolicyExpr, left *ExprSymbol, ops ExprTypes, right *ExprSymbol, m Matching) {
+	if (left != nil && left.Types == ExprDur) || (right != nil && right.Types == ExprDur) {
+		p.setErr(fmt.Errorf("a duration is only a function argument"))
+	}
+	if m.set && ops != ExprNone && right != nil && right.Types == ExprNum {
+		p.setErr(fmt.Errorf("on or ignoring needs series on both sides"))
+	}
+}
+
 func (p *PolicyExpr) AddNum(s string) {
-	if p.Left == nil {
-		p.Left = &ExprSymbol{
-			Types:   ExprNum,
-			ExprNum: s,
-		}
-	} else if p.Right == nil {
-		p.Right = &ExprSymbol{
-			Types:   ExprNum,
-			ExprNum: s,
-		}
-	} else {
-		fmt.Fprintf(os.Stderr, "error")
+	p.push(&ExprSymbol{
+		Types:   ExprNum,
+		ExprNum: s,
+	})
+}
+
+func (p *PolicyExpr) AddDur(s string) {
+	d, err := ParseDuration(s)
+	if err != nil {
+		p.setErr(err)
 	}
+	p.push(&ExprSymbol{
+		Types:   ExprDur,
+		ExprDur: d,
+	})
 }
 
 func (p *PolicyExpr) AddVar(s string) {
-	if p.Left == nil {
-		p.Left = &ExprSymbol{
-			Types:   ExprVar,
-			ExprVar: s,
+	p.push(&ExprSymbol{
+		Types:   ExprVar,
+		ExprVar: s,
+	})
+}
+
+func (p *PolicyExpr) AddStr(s string) {
+	p.push(&ExprSymbol{
+		Types:   ExprStr,
+		ExprStr: s,
+	})
+}
+
+func (p *PolicyExpr) BeginCall(name string) {
+	if _, ok := functions[name]; !ok {
+		p.setErr(fmt.Errorf("unknown function: %s", name))
+	}
+	p.push(&ExprSymbol{
+		Types: ExprFunc,
+		Func:  name,
+	})
+	p.calls = append(p.calls, len(p.stack))
+}
+
+func (p *PolicyExpr) EndCall() {
+	base := p.calls[len(p.calls)-1]
+	p.calls = p.calls[:len(p.calls)-1]
+
+	args := append([]*ExprSymbol{}, p.stack[base:]...)
+	p.stack = p.stack[:base]
+	call := p.top()
+	call.Args = args
+	if n := functions[call.Func]; n != len(args) {
+		p.setErr(fmt.Errorf("%s() takes %d argument(s), got %d", call.Func, n, len(args)))
+	}
+	if call.grouped && !Aggregations[call.Func] {
+		p.setErr(fmt.Errorf("%s() takes no by or without", call.Func))
+	}
+	for _, arg := range args {
+		if arg.Types == ExprCmp && !Aggregations[call.Func] {
+			p.setErr(fmt.Errorf("%s() takes no comparison", call.Func))
 		}
-	} else if p.Right == nil {
-		p.Right = &ExprSymbol{
-			Types:   ExprVar,
-			ExprVar: s,
+	}
+	for i, t := range argTypes[call.Func] {
+		if t != ExprNone && i < len(args) && args[i].Types != t {
+			p.setErr(fmt.Errorf("%s() takes a %s as argument %d", call.Func, typeNames[t], i+1))
 		}
-	} else {
-		fmt.Fprintf(os.Stderr, "error")
 	}
 }
 
-func (p *PolicyExpr) AddStr(s string) {
-	if p.Left == nil {
-		p.Left = &ExprSymbol{
-			Types:   ExprStr,
-			ExprNum: s,
-		}
-	} else if p.Right == nil {
-		p.Right = &ExprSymbol{
-			Types:   ExprStr,
-			ExprNum: s,
+// AddGrouping starts the by (without false) or without clause of the
+// call being parsed.
+func (p *PolicyExpr) AddGrouping(without bool) {
+	call := p.stack[p.calls[len(p.calls)-1]-1]
+	if call.grouped {
+		p.setErr(fmt.Errorf("%s() takes a single by or without", call.Func))
+	}
+	call.grouped = true
+	call.Without = without
+	call.Grouping = []string{}
+}
+
+func (p *PolicyExpr) AddGroupingLabel(s string) {
+	call := p.stack[p.calls[len(p.calls)-1]-1]
+	call.Grouping = append(call.Grouping, s)
+}
+
+func (p *PolicyExpr) AddLabel(s string) {
+	p.matcher = &LabelMatcher{Name: s}
+}
+
+func (p *PolicyExpr) AddMatchOp(t MatchType) {
+	p.matcher.Type = t
+}
+
+func (p *PolicyExpr) AddLabelValue(s string) {
+	m, err := NewLabelMatcher(p.matcher.Name, p.matcher.Type, s)
+	if err != nil {
+		p.setErr(err)
+	}
+	sel := p.top()
+	sel.Matchers = append(sel.Matchers, m)
+	p.matcher = nil
+}
+
+func (p *PolicyExpr) AddWindow(s string) {
+	d, err := ParseDuration(s)
+	if err != nil {
+		p.setErr(err)
+	}
+	p.top().Window = d
+}
+
+func (p *PolicyExpr) AddOffset(s string) {
+	d, err := ParseDuration(s)
+	if err != nil {
+		p.setErr(err)
+	}
+	p.top().Offset = d
+}
+
+// AddExpr takes the parsed symbols off the stack once the whole
+// expression has been read.
+func (p *PolicyExpr) AddExpr() {
+	if p.Ops != ExprNone {
+		p.Right = p.pop()
+	}
+	p.Left = p.pop()
+	checkCond(p, p.Left, p.Ops, p.Right, p.Matching)
+	if p.Left != nil && p.Left.Types == ExprFunc && p.Ops == ExprNone {
+		return
+	}
+	if p.Ops == ExprNone {
+		p.setErr(fmt.Errorf("expression needs a comparison or a function"))
+	}
+}
+
+// ParseDuration parses durations such as "90s", "5m", "1d" or "1w",
+// which time.ParseDuration does not accept.
+func ParseDuration(s string) (time.Duration, error) {
+	unit := strings.TrimLeft(s, "0123456789")
+	n, err := strconv.Atoi(strings.TrimSuffix(s, unit))
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	switch unit {
+	case "ms":
+		return time.Duration(n) * time.Millisecond, nil
+	case "s":
+		return time.Duration(n) * time.Second, nil
+	case "m":
+		return time.Duration(n) * time.Minute, nil
+	case "h":
+		return time.Duration(n) * time.Hour, nil
+	case "d":
+		return time.Duration(n) * 24 * time.Hour, nil
+	case "w":
+		return time.Duration(n) * 7 * 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid duration unit: %q", s)
+}
+
+// FormatDuration is the inverse of ParseDuration, using the largest unit
+// that represents d exactly.
+func FormatDuration(d time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if d != 0 && d%u.size == 0 {
+			return fmt.Sprintf("%d%s", d/u.size, u.name)
 		}
-	} else {
-		fmt.Fprintf(os.Stderr, "error")
 	}
+	return fmt.Sprintf("%dms", d/time.Millisecond)
 }
 
 func (s *ExprSymbol) Print() {
@@ -101,8 +607,45 @@ func (s *ExprSymbol) Print() {
 		fmt.Printf("%s", s.ExprNum)
 	case ExprVar:
 		fmt.Printf("%s", s.ExprVar)
+		if len(s.Matchers) > 0 {
+			ms := []string{}
+			for _, m := range s.Matchers {
+				ms = append(ms, m.String())
+			}
+			fmt.Printf("{%s}", strings.Join(ms, ", "))
+		}
+		if s.Window != 0 {
+			fmt.Printf("[%s]", FormatDuration(s.Window))
+		}
+		if s.Offset != 0 {
+			fmt.Printf(" offset %s", FormatDuration(s.Offset))
+		}
 	case ExprStr:
 		fmt.Printf("'%s'", s.ExprStr)
+	case ExprDur:
+		fmt.Printf("%s", FormatDuration(s.ExprDur))
+	case ExprFunc:
+		fmt.Printf("%s", s.Func)
+		if s.grouped {
+			clause := "by"
+			if s.Without {
+				clause = "without"
+			}
+			fmt.Printf(" %s (%s) ", clause, strings.Join(s.Grouping, ", "))
+		}
+		fmt.Printf("(")
+		for i, arg := range s.Args {
+			if i > 0 {
+				fmt.Printf(", ")
+			}
+			arg.Print()
+		}
+		fmt.Printf(")")
+	case ExprCmp:
+		s.Cond.Left.Print()
+		s.Cond.Ops.Print()
+		s.Cond.Matching.Print()
+		s.Cond.Right.Print()
 	default:
 		fmt.Printf("??%d??", s.Types)
 	}
@@ -127,25 +670,66 @@ func (t *ExprTypes) Print() {
 	fmt.Printf(" %s ", ops_symbol)
 }
 
+func (m *Matching) Print() {
+	if !m.set {
+		return
+	}
+	clause := "ignoring"
+	if m.On {
+		clause = "on"
+	}
+	fmt.Printf("%s(%s) ", clause, strings.Join(m.Labels, ", "))
+	if m.GroupRight {
+		fmt.Printf("group_right ")
+	}
+}
+
 func (policy *PolicyExpr) PrintPolicy() {
 	policy.Left.Print()
-	policy.Ops.Print()
-	policy.Right.Print()
+	if policy.Right != nil {
+		policy.Ops.Print()
+		policy.Matching.Print()
+		policy.Right.Print()
+	}
+	for _, j := range policy.Joins {
+		switch j.Op {
+		case ExprAnd:
+			fmt.Printf(" and ")
+		case ExprOr:
+			fmt.Printf(" or ")
+		case ExprUnless:
+			fmt.Printf(" unless ")
+		}
+		j.Matching.Print()
+		j.Cond.Left.Print()
+		if j.Cond.Right != nil {
+			j.Cond.Ops.Print()
+			j.Cond.Matching.Print()
+			j.Cond.Right.Print()
+		}
+	}
 }
 
-func Policyexpr_main(expr_val string) *Parser {
-	fmt.Printf("Text of expr: %s\n", expr_val)
-	parser := &Parser{Buffer: expr_val}
-	parser.Init()
+// ParseExpr parses a rule's expression.
+func ParseExpr(expr string) (*Parser, error) {
+	p := &Parser{Buffer: expr}
+	p.Init()
+	if err := p.Parse(); err != nil {
+		return nil, err
+	}
+	p.Execute()
+	if err := p.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-	err := parser.Parse()
+// Policyexpr_main parses expr, or tells on stderr why it cannot.
+func Policyexpr_main(expr_val string) *Parser {
+	parser, err := ParseExpr(expr_val)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return nil
 	}
-
-	parser.Execute()
-	parser.PrintPolicy()
-	fmt.Printf("\ndone!\n")
 	return parser
 }
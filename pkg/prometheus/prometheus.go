@@ -0,0 +1,284 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package prometheus evaluates the engine's metric selectors against the
+// Prometheus HTTP API instead of redis.
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// Config describes how to reach Prometheus and how its names map onto
+// the ones used in the policy.
+type Config struct {
+	URL     string
+	Timeout time.Duration
+	Step    time.Duration // resolution of query_range, 15s if unset
+
+	// Metrics maps policy metric names (vm.if_octets.rx) onto Prometheus
+	// metric names; unmapped names get every invalid character turned
+	// into '_' (vm_if_octets_rx).
+	Metrics map[string]string
+	// Labels maps policy label names (vm, if) onto Prometheus label names.
+	Labels map[string]string
+}
+
+// Source is a threshold.DataSource backed by /api/v1/query_range,
+// /api/v1/query and /api/v1/series.
+type Source struct {
+	config Config
+	client *http.Client
+}
+
+func NewSource(config Config) *Source {
+	if config.Step == 0 {
+		config.Step = 15 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &Source{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+var invalidChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func (s *Source) metricName(name string) string {
+	if m, ok := s.config.Metrics[name]; ok {
+		return m
+	}
+	return invalidChars.ReplaceAllString(name, "_")
+}
+
+func (s *Source) labelName(name string) string {
+	if l, ok := s.config.Labels[name]; ok {
+		return l
+	}
+	return name
+}
+
+// resourceLabel turns a Prometheus label set back into policy labels.
+func (s *Source) resourceLabel(metric map[string]string) threshold.ResourceLabel {
+	rl := threshold.ResourceLabel{}
+	for name, value := range metric {
+		if name == "__name__" {
+			continue
+		}
+		rl[name] = value
+	}
+	for name, promName := range s.config.Labels {
+		if value, ok := metric[promName]; ok {
+			delete(rl, promName)
+			rl[name] = value
+		}
+	}
+	return rl
+}
+
+// selector renders q as a PromQL series selector.
+func (s *Source) selector(q threshold.Query) string {
+	matchers := []string{}
+	for _, m := range q.Matchers {
+		ops := "="
+		switch m.Type {
+		case parser.MatchNotEqual:
+			ops = "!="
+		case parser.MatchRegexp:
+			ops = "=~"
+		case parser.MatchNotRegexp:
+			ops = "!~"
+		}
+		matchers = append(matchers, fmt.Sprintf("%s%s%s", s.labelName(m.Name), ops, strconv.Quote(m.Value)))
+	}
+	return s.metricName(q.Metric) + "{" + strings.Join(matchers, ",") + "}"
+}
+
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data"`
+	ErrorType string          `json:"errorType"`
+	Error     string          `json:"error"`
+}
+
+type matrixData struct {
+	ResultType string `json:"resultType"`
+	Result     []struct {
+		Metric map[string]string   `json:"metric"`
+		Values [][]json.RawMessage `json:"values"`
+	} `json:"result"`
+}
+
+type vectorData struct {
+	ResultType string `json:"resultType"`
+	Result     []struct {
+		Metric map[string]string `json:"metric"`
+		Value  []json.RawMessage `json:"value"`
+	} `json:"result"`
+}
+
+func (s *Source) get(ctx context.Context, path string, params url.Values, data interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(s.config.URL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var ar apiResponse
+	err = json.NewDecoder(resp.Body).Decode(&ar)
+	if resp.StatusCode/100 != 2 {
+		if err == nil && ar.Error != "" {
+			return fmt.Errorf("%s: %s: %s", path, resp.Status, ar.Error)
+		}
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s: %v", path, resp.Status, err)
+	}
+	if ar.Status != "success" {
+		return fmt.Errorf("%s: %s: %s", path, ar.ErrorType, ar.Error)
+	}
+	return json.Unmarshal(ar.Data, data)
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 3, 64)
+}
+
+func parseSample(pair []json.RawMessage) (threshold.Sample, error) {
+	if len(pair) != 2 {
+		return threshold.Sample{}, fmt.Errorf("malformed sample")
+	}
+	var ts float64
+	var val string
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return threshold.Sample{}, err
+	}
+	if err := json.Unmarshal(pair[1], &val); err != nil {
+		return threshold.Sample{}, err
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return threshold.Sample{}, err
+	}
+	return threshold.Sample{Time: time.Unix(0, int64(ts*1e9)), Value: f}, nil
+}
+
+func (s *Source) Query(ctx context.Context, q threshold.Query) ([]threshold.Series, error) {
+	sel := s.selector(q)
+
+	// Series first, so that the ones without samples in the window are
+	// still reported.
+	var known []map[string]string
+	err := s.get(ctx, "/api/v1/series", url.Values{
+		"match[]": {sel},
+		"start":   {formatTime(q.Start)},
+		"end":     {formatTime(q.End)},
+	}, &known)
+	if err != nil {
+		return nil, err
+	}
+
+	var matrix matrixData
+	err = s.get(ctx, "/api/v1/query_range", url.Values{
+		"query": {sel},
+		"start": {formatTime(q.Start)},
+		"end":   {formatTime(q.End)},
+		"step":  {strconv.FormatFloat(s.config.Step.Seconds(), 'f', -1, 64)},
+	}, &matrix)
+	if err != nil {
+		return nil, err
+	}
+	if matrix.ResultType != "matrix" {
+		return nil, fmt.Errorf("query_range: unexpected result type %q", matrix.ResultType)
+	}
+
+	// query_range repeats the last sample at each step for up to the
+	// lookback delta, so the time of the newest real sample is asked
+	// separately.
+	var newest vectorData
+	err = s.get(ctx, "/api/v1/query", url.Values{
+		"query": {"timestamp(" + sel + ")"},
+		"time":  {formatTime(q.End)},
+	}, &newest)
+	if err != nil {
+		return nil, err
+	}
+	if newest.ResultType != "vector" {
+		return nil, fmt.Errorf("query: unexpected result type %q", newest.ResultType)
+	}
+
+	series := map[string]*threshold.Series{}
+	for _, metric := range known {
+		rl := s.resourceLabel(metric)
+		series[rl.Fingerprint()] = &threshold.Series{Key: rl, Samples: []threshold.Sample{}}
+	}
+	for _, r := range matrix.Result {
+		rl := s.resourceLabel(r.Metric)
+		sr, ok := series[rl.Fingerprint()]
+		if !ok {
+			sr = &threshold.Series{Key: rl}
+			series[rl.Fingerprint()] = sr
+		}
+		for _, pair := range r.Values {
+			sample, err := parseSample(pair)
+			if err != nil {
+				return nil, fmt.Errorf("query_range: %v", err)
+			}
+			sr.Samples = append(sr.Samples, sample)
+		}
+	}
+	for _, r := range newest.Result {
+		sr, ok := series[s.resourceLabel(r.Metric).Fingerprint()]
+		if !ok {
+			continue
+		}
+		sample, err := parseSample(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("query: %v", err)
+		}
+		sr.LastSeen = time.Unix(0, int64(sample.Value*1e9))
+	}
+
+	fps := make([]string, 0, len(series))
+	for fp := range series {
+		fps = append(fps, fp)
+	}
+	sort.Strings(fps)
+	list := make([]threshold.Series, 0, len(fps))
+	for _, fp := range fps {
+		list = append(list, *series[fp])
+	}
+	return list, nil
+}
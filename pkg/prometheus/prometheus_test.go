@@ -0,0 +1,128 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// fakePrometheus answers the three endpoints Source uses for one metric
+// with two series, the second of which has no sample in the window.
+func fakePrometheus(queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/api/v1/series":
+			*queries = append(*queries, r.Form.Get("match[]"))
+			fmt.Fprint(w, `{"status":"success","data":[
+				{"__name__":"vm_if_octets_rx","instance":"instance-00000001"},
+				{"__name__":"vm_if_octets_rx","instance":"instance-00000002"}]}`)
+		case "/api/v1/query_range":
+			*queries = append(*queries, r.Form.Get("query"))
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[
+				{"metric":{"__name__":"vm_if_octets_rx","instance":"instance-00000001"},
+				 "values":[[1000,"1.5"],[1015,"2.5"]]}]}}`)
+		case "/api/v1/query":
+			*queries = append(*queries, r.Form.Get("query"))
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"instance":"instance-00000001"},"value":[1015,"1003.25"]}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestQuery(t *testing.T) {
+	var queries []string
+	srv := fakePrometheus(&queries)
+	defer srv.Close()
+
+	matchers, err := parser.ParseMatchers(`{vm=~"instance-.*"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSource(Config{URL: srv.URL, Labels: map[string]string{"vm": "instance"}})
+	series, err := s.Query(context.Background(), threshold.Query{
+		Metric:   "vm.if_octets.rx",
+		Matchers: matchers,
+		Start:    time.Unix(1000, 0),
+		End:      time.Unix(1015, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `vm_if_octets_rx{instance=~"instance-.*"}`
+	for _, q := range queries {
+		if !strings.Contains(q, want) {
+			t.Errorf("query %q does not select %s", q, want)
+		}
+	}
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want 2", len(series))
+	}
+	first, second := series[0], series[1]
+	if first.Key["vm"] != "instance-00000001" || len(first.Key) != 1 {
+		t.Errorf("labels %v, want vm only", first.Key)
+	}
+	if got := first.Values(); len(got) != 2 || got[0] != 1.5 || got[1] != 2.5 {
+		t.Errorf("values %v, want [1.5 2.5]", got)
+	}
+	if want := time.Unix(1003, 250000000); !first.LastSeen.Equal(want) {
+		t.Errorf("last seen %v, want the real sample time %v", first.LastSeen, want)
+	}
+	if len(second.Samples) != 0 || !second.LastSeen.IsZero() {
+		t.Errorf("series without samples: %+v", second)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		body string
+		want string
+	}{
+		{"api error", http.StatusBadRequest, `{"status":"error","errorType":"bad_data","error":"parse error"}`, "parse error"},
+		{"not json", http.StatusBadGateway, `<html>bad gateway</html>`, "502"},
+		{"error status with data", http.StatusServiceUnavailable, `{"status":"success","data":[]}`, "503"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			s := NewSource(Config{URL: srv.URL})
+			_, err := s.Query(context.Background(), threshold.Query{Metric: "vm.cpu", End: time.Now()})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package redists reads metrics stored with the RedisTimeSeries module.
+// Series are found by their labels: one label carries the metric name,
+// the others are the resource labels (vm, if, ...).
+package redists
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+	"github.com/go-redis/redis"
+)
+
+type Config struct {
+	// MetricLabel is the label holding the metric name, "metric" if unset.
+	MetricLabel string
+	// Metrics and Labels rename policy metric and label names, as for
+	// the prometheus datasource.
+	Metrics map[string]string
+	Labels  map[string]string
+}
+
+// Source is a threshold.DataSource using TS.MRANGE and TS.MGET. Label
+// matchers become MRANGE filters and *_over_time functions become its
+// server-side AGGREGATION.
+type Source struct {
+	config Config
+	client *threshold.RedisClient
+}
+
+func NewSource(opts *redis.Options, config Config) *Source {
+	if config.MetricLabel == "" {
+		config.MetricLabel = "metric"
+	}
+	return &Source{config: config, client: threshold.NewRedisClient(opts)}
+}
+
+func (s *Source) labelName(name string) string {
+	if l, ok := s.config.Labels[name]; ok {
+		return l
+	}
+	return name
+}
+
+// filters renders q as TS.MRANGE filters. Regular expressions cannot be
+// filtered on by the module; they are checked on the results instead.
+func (s *Source) filters(q threshold.Query) []interface{} {
+	metric := q.Metric
+	if m, ok := s.config.Metrics[metric]; ok {
+		metric = m
+	}
+	args := []interface{}{"FILTER", s.config.MetricLabel + "=" + metric}
+	for _, m := range q.Matchers {
+		switch m.Type {
+		case parser.MatchEqual:
+			args = append(args, s.labelName(m.Name)+"="+m.Value)
+		case parser.MatchNotEqual:
+			args = append(args, s.labelName(m.Name)+"!="+m.Value)
+		}
+	}
+	return args
+}
+
+func (s *Source) resourceLabel(labels map[string]string) threshold.ResourceLabel {
+	rl := threshold.ResourceLabel{}
+	for name, value := range labels {
+		if name == s.config.MetricLabel {
+			continue
+		}
+		rl[name] = value
+	}
+	for name, tsName := range s.config.Labels {
+		if value, ok := labels[tsName]; ok {
+			delete(rl, tsName)
+			rl[name] = value
+		}
+	}
+	return rl
+}
+
+func msec(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+type tsSeries struct {
+	key     string
+	labels  map[string]string
+	samples []threshold.Sample
+}
+
+func parseSample(v interface{}) (threshold.Sample, error) {
+	pair, ok := v.([]interface{})
+	if !ok || len(pair) != 2 {
+		return threshold.Sample{}, fmt.Errorf("redists: malformed sample %v", v)
+	}
+	ts, ok := pair[0].(int64)
+	if !ok {
+		return threshold.Sample{}, fmt.Errorf("redists: malformed timestamp %v", pair[0])
+	}
+	var value float64
+	switch val := pair[1].(type) {
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return threshold.Sample{}, err
+		}
+		value = f
+	case int64:
+		value = float64(val)
+	default:
+		return threshold.Sample{}, fmt.Errorf("redists: malformed value %v", pair[1])
+	}
+	return threshold.Sample{Time: time.Unix(0, ts*int64(time.Millisecond)), Value: value}, nil
+}
+
+// parseReply decodes the [key, [[label, value]...], samples] entries
+// of an MRANGE or MGET reply; MGET has a single sample instead of a list.
+func parseReply(reply interface{}, single bool) ([]tsSeries, error) {
+	entries, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redists: unexpected reply %v", reply)
+	}
+	list := []tsSeries{}
+	for _, e := range entries {
+		fields, ok := e.([]interface{})
+		if !ok || len(fields) != 3 {
+			return nil, fmt.Errorf("redists: unexpected entry %v", e)
+		}
+		ts := tsSeries{labels: map[string]string{}}
+		ts.key, _ = fields[0].(string)
+		labels, _ := fields[1].([]interface{})
+		for _, l := range labels {
+			pair, ok := l.([]interface{})
+			if !ok || len(pair) != 2 {
+				continue
+			}
+			name, _ := pair[0].(string)
+			value, _ := pair[1].(string)
+			ts.labels[name] = value
+		}
+		samples := []interface{}{}
+		if single {
+			if sample, ok := fields[2].([]interface{}); ok && len(sample) > 0 {
+				samples = append(samples, sample)
+			}
+		} else {
+			samples, _ = fields[2].([]interface{})
+		}
+		for _, v := range samples {
+			sample, err := parseSample(v)
+			if err != nil {
+				return nil, err
+			}
+			ts.samples = append(ts.samples, sample)
+		}
+		list = append(list, ts)
+	}
+	return list, nil
+}
+
+func (s *Source) Query(ctx context.Context, q threshold.Query) ([]threshold.Series, error) {
+	filters := s.filters(q)
+	client := s.client.For(ctx)
+
+	start, end := msec(q.Start), msec(q.End)
+	aggregation := []interface{}{}
+	if q.Aggregation != "" {
+		// one bucket per window, aligned to its start: the range is
+		// inclusive, so a sample right at End would open a second one
+		end--
+		aggregation = []interface{}{"ALIGN", "start", "AGGREGATION", q.Aggregation, int64(q.Bucket / time.Millisecond)}
+	}
+	args := append([]interface{}{"TS.MRANGE", start, end, "WITHLABELS"}, aggregation...)
+	reply, err := client.Do(append(args, filters...)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseReply(reply, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// The newest sample of each series, for the ones silent in the window.
+	reply, err = client.Do(append([]interface{}{"TS.MGET", "WITHLABELS"}, filters...)...).Result()
+	if err != nil {
+		return nil, err
+	}
+	latest, err := parseReply(reply, true)
+	if err != nil {
+		return nil, err
+	}
+	lastSeen := map[string]time.Time{}
+	for _, ts := range latest {
+		if len(ts.samples) > 0 {
+			lastSeen[ts.key] = ts.samples[0].Time
+		}
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].key < ranges[j].key })
+	series := []threshold.Series{}
+	for _, ts := range ranges {
+		rl := s.resourceLabel(ts.labels)
+		if !threshold.MatchLabels(q.Matchers, rl) {
+			continue
+		}
+		samples := ts.samples
+		if samples == nil {
+			samples = []threshold.Sample{}
+		}
+		series = append(series, threshold.Series{
+			Key:         rl,
+			Samples:     samples,
+			LastSeen:    lastSeen[ts.key],
+			Aggregation: q.Aggregation,
+		})
+	}
+	return series, nil
+}
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package redists
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/server"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+	"github.com/go-redis/redis"
+)
+
+type tsSample struct {
+	ms    int64
+	value string
+}
+
+type fakeSeries struct {
+	key     string
+	labels  map[string]string
+	samples []tsSample
+}
+
+// fakeTS answers TS.MRANGE and TS.MGET over the series it holds, taking
+// the label=value and label!=value filters, and remembers the commands.
+type fakeTS struct {
+	mu       sync.Mutex
+	series   []fakeSeries
+	commands [][]string
+}
+
+func (f *fakeTS) filter(args []string) []fakeSeries {
+	i := 0
+	for i < len(args) && strings.ToUpper(args[i]) != "FILTER" {
+		i++
+	}
+	kept := []fakeSeries{}
+	for _, fs := range f.series {
+		ok := true
+		for _, filter := range args[i+1:] {
+			if kv := strings.SplitN(filter, "!=", 2); len(kv) == 2 {
+				ok = ok && fs.labels[kv[0]] != kv[1]
+			} else if kv := strings.SplitN(filter, "=", 2); len(kv) == 2 {
+				ok = ok && fs.labels[kv[0]] == kv[1]
+			}
+		}
+		if ok {
+			kept = append(kept, fs)
+		}
+	}
+	return kept
+}
+
+func writeEntry(c *server.Peer, fs fakeSeries) {
+	c.WriteLen(3)
+	c.WriteBulk(fs.key)
+	names := []string{}
+	for name := range fs.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c.WriteLen(len(names))
+	for _, name := range names {
+		c.WriteLen(2)
+		c.WriteBulk(name)
+		c.WriteBulk(fs.labels[name])
+	}
+}
+
+func writeSample(c *server.Peer, s tsSample) {
+	c.WriteLen(2)
+	c.WriteInt(int(s.ms))
+	c.WriteBulk(s.value)
+}
+
+// serve starts a server answering for f, to be closed by the caller.
+func (f *fakeTS) serve(t *testing.T) (*redis.Options, func()) {
+	srv, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(cmd string, args []string) {
+		f.mu.Lock()
+		f.commands = append(f.commands, append([]string{cmd}, args...))
+		f.mu.Unlock()
+	}
+	srv.Register("TS.MRANGE", func(c *server.Peer, cmd string, args []string) {
+		record(cmd, args)
+		start, _ := strconv.ParseInt(args[0], 10, 64)
+		end, _ := strconv.ParseInt(args[1], 10, 64)
+		list := f.filter(args)
+		c.WriteLen(len(list))
+		for _, fs := range list {
+			writeEntry(c, fs)
+			in := []tsSample{}
+			for _, s := range fs.samples {
+				if s.ms >= start && s.ms <= end {
+					in = append(in, s)
+				}
+			}
+			c.WriteLen(len(in))
+			for _, s := range in {
+				writeSample(c, s)
+			}
+		}
+	})
+	srv.Register("TS.MGET", func(c *server.Peer, cmd string, args []string) {
+		record(cmd, args)
+		list := f.filter(args)
+		c.WriteLen(len(list))
+		for _, fs := range list {
+			writeEntry(c, fs)
+			if len(fs.samples) == 0 {
+				c.WriteLen(0)
+				continue
+			}
+			writeSample(c, fs.samples[len(fs.samples)-1])
+		}
+	})
+	return &redis.Options{Addr: srv.Addr().String()}, srv.Close
+}
+
+func ms(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func matchers(t *testing.T, s string) []*parser.LabelMatcher {
+	ms, err := parser.ParseMatchers(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestQuery(t *testing.T) {
+	now := time.Unix(100000, 0)
+	cpu := func(vm string, samples ...tsSample) fakeSeries {
+		return fakeSeries{
+			key:     "cpu:" + vm,
+			labels:  map[string]string{"metric": "vm.cpu", "vm": vm},
+			samples: samples,
+		}
+	}
+	fake := &fakeTS{series: []fakeSeries{
+		cpu("vm1", tsSample{ms(now.Add(-30 * time.Second)), "10"}, tsSample{ms(now.Add(-10 * time.Second)), "20.5"}),
+		cpu("vm2", tsSample{ms(now.Add(-20 * time.Second)), "30"}),
+		cpu("vm3", tsSample{ms(now.Add(-time.Hour)), "40"}), // silent in the window
+		{key: "mem:vm1", labels: map[string]string{"metric": "vm.memory", "vm": "vm1"}},
+	}}
+	opts, stop := fake.serve(t)
+	defer stop()
+	source := NewSource(opts, Config{})
+
+	type result struct {
+		vm       string
+		values   []float64
+		lastSeen time.Time
+	}
+	tests := []struct {
+		name     string
+		metric   string
+		matchers string
+		want     []result
+	}{
+		{"every series", "vm.cpu", "", []result{
+			{"vm1", []float64{10, 20.5}, now.Add(-10 * time.Second)},
+			{"vm2", []float64{30}, now.Add(-20 * time.Second)},
+			{"vm3", []float64{}, now.Add(-time.Hour)},
+		}},
+		{"equal", "vm.cpu", `vm="vm2"`, []result{{"vm2", []float64{30}, now.Add(-20 * time.Second)}}},
+		{"not equal", "vm.cpu", `vm!="vm1"`, []result{
+			{"vm2", []float64{30}, now.Add(-20 * time.Second)},
+			{"vm3", []float64{}, now.Add(-time.Hour)},
+		}},
+		{"regexp checked on the results", "vm.cpu", `vm=~"vm[13]"`, []result{
+			{"vm1", []float64{10, 20.5}, now.Add(-10 * time.Second)},
+			{"vm3", []float64{}, now.Add(-time.Hour)},
+		}},
+		{"series without samples", "vm.memory", "", []result{{"vm1", []float64{}, time.Time{}}}},
+		{"no series", "vm.disk", "", []result{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := threshold.Query{
+				Metric:   tt.metric,
+				Matchers: matchers(t, tt.matchers),
+				Start:    now.Add(-time.Minute),
+				End:      now,
+			}
+			series, err := source.Query(context.Background(), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []result{}
+			for _, sr := range series {
+				if len(sr.Key) != 1 {
+					t.Errorf("labels %v, want vm only", sr.Key)
+				}
+				got = append(got, result{sr.Key["vm"], sr.Values(), sr.LastSeen})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	now := time.Unix(100000, 0)
+	fake := &fakeTS{}
+	opts, stop := fake.serve(t)
+	defer stop()
+	source := NewSource(opts, Config{
+		MetricLabel: "__name__",
+		Metrics:     map[string]string{"vm.cpu": "cpu_percent"},
+		Labels:      map[string]string{"vm": "instance"},
+	})
+	tests := []struct {
+		name  string
+		query threshold.Query
+		want  []string // the TS.MRANGE command
+	}{
+		{
+			name: "raw samples",
+			query: threshold.Query{Metric: "vm.cpu", Matchers: matchers(t, `vm="vm1", if!="lo", if=~"tap.*"`),
+				Start: now.Add(-time.Minute), End: now},
+			want: []string{"TS.MRANGE", "99940000", "100000000", "WITHLABELS",
+				"FILTER", "__name__=cpu_percent", "instance=vm1", "if!=lo"},
+		},
+		{
+			name: "one bucket per window",
+			query: threshold.Query{Metric: "vm.memory", Start: now.Add(-time.Minute), End: now,
+				Aggregation: "avg", Bucket: time.Minute},
+			want: []string{"TS.MRANGE", "99940000", "99999999", "WITHLABELS",
+				"ALIGN", "start", "AGGREGATION", "avg", "60000", "FILTER", "__name__=vm.memory"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.commands = nil
+			series, err := source.Query(context.Background(), tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(series) != 0 {
+				t.Errorf("series = %v, want none", series)
+			}
+			if len(fake.commands) != 2 {
+				t.Fatalf("commands = %v", fake.commands)
+			}
+			if got := fake.commands[0]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if got := fake.commands[1]; got[0] != "TS.MGET" || got[1] != "WITHLABELS" {
+				t.Errorf("then %q, want TS.MGET WITHLABELS", got)
+			}
+		})
+	}
+}
+
+func TestQueryLabels(t *testing.T) {
+	fake := &fakeTS{series: []fakeSeries{{
+		key:     "k",
+		labels:  map[string]string{"__name__": "cpu_percent", "instance": "vm1", "zone": "a"},
+		samples: []tsSample{{1000, "1"}},
+	}}}
+	opts, stop := fake.serve(t)
+	defer stop()
+	source := NewSource(opts, Config{
+		MetricLabel: "__name__",
+		Metrics:     map[string]string{"vm.cpu": "cpu_percent"},
+		Labels:      map[string]string{"vm": "instance"},
+	})
+	series, err := source.Query(context.Background(), threshold.Query{
+		Metric: "vm.cpu", Matchers: matchers(t, `vm="vm1"`), Start: time.Unix(0, 0), End: time.Unix(2, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := threshold.ResourceLabel{"vm": "vm1", "zone": "a"}
+	if len(series) != 1 || !reflect.DeepEqual(series[0].Key, want) {
+		t.Errorf("series = %+v, want labels %v", series, want)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	entry := func(samples interface{}) []interface{} {
+		return []interface{}{"k", []interface{}{[]interface{}{"vm", "vm1"}}, samples}
+	}
+	tests := []struct {
+		name   string
+		reply  interface{}
+		single bool
+		want   []threshold.Sample
+		err    bool
+	}{
+		{"range", []interface{}{entry([]interface{}{
+			[]interface{}{int64(1000), "1.5"}, []interface{}{int64(2000), int64(2)}})}, false,
+			[]threshold.Sample{{Time: time.Unix(1, 0), Value: 1.5}, {Time: time.Unix(2, 0), Value: 2}}, false},
+		{"empty range", []interface{}{entry([]interface{}{})}, false, nil, false},
+		{"get", []interface{}{entry([]interface{}{int64(3000), "7"})}, true,
+			[]threshold.Sample{{Time: time.Unix(3, 0), Value: 7}}, false},
+		{"get without sample", []interface{}{entry([]interface{}{})}, true, nil, false},
+		{"not a list", "OK", false, nil, true},
+		{"short entry", []interface{}{[]interface{}{"k"}}, false, nil, true},
+		{"bad value", []interface{}{entry([]interface{}{[]interface{}{int64(1000), "x"}})}, false, nil, true},
+		{"bad timestamp", []interface{}{entry([]interface{}{[]interface{}{"1000", "1"}})}, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := parseReply(tt.reply, tt.single)
+			if tt.err {
+				if err == nil {
+					t.Errorf("no error, got %+v", list)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].key != "k" || list[0].labels["vm"] != "vm1" {
+				t.Fatalf("got %+v", list)
+			}
+			if !reflect.DeepEqual(list[0].samples, tt.want) {
+				t.Errorf("samples = %v, want %v", list[0].samples, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package silence
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIPath is where Handler serves the silences.
+const APIPath = "/api/v1/silences"
+
+// Handler serves the store over HTTP:
+//
+//	GET    /api/v1/silences       list them
+//	POST   /api/v1/silences       add one, {"matchers": ..., "startsAt": ..., "endsAt": ...}
+//	DELETE /api/v1/silences/<id>  expire one
+func Handler(st *Store) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIPath, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			list, err := st.List(time.Now(), 24*time.Hour)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, list)
+		case "POST":
+			var s Silence
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if s.StartsAt.IsZero() {
+				s.StartsAt = time.Now()
+			}
+			if err := st.Add(&s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, map[string]string{"id": s.ID})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(APIPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := st.Expire(strings.TrimPrefix(r.URL.Path, APIPath+"/"), time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
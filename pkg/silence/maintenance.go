@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package silence
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// WindowConfig is one entry of the policy's maintenance list.
+type WindowConfig struct {
+	Name     string `yaml:"name"`
+	Schedule string `yaml:"schedule"` // cron: minute hour day-of-month month day-of-week
+	Duration string `yaml:"duration"`
+	Matchers string `yaml:"matchers"` // e.g. {vm=~"instance-0000000[1-4]"}, every alert if unset
+	Location string `yaml:"location"` // time zone of the schedule, local if unset
+}
+
+// Window is a recurring maintenance window: it opens at each time the
+// schedule fires and stays open for its duration.
+type Window struct {
+	Name     string
+	schedule *schedule
+	duration time.Duration
+	matchers []*parser.LabelMatcher
+	loc      *time.Location
+}
+
+func NewWindow(c WindowConfig) (*Window, error) {
+	w := &Window{Name: c.Name, loc: time.Local}
+	var err error
+	if w.schedule, err = parseSchedule(c.Schedule); err != nil {
+		return nil, fmt.Errorf("maintenance %s: schedule: %v", c.Name, err)
+	}
+	if w.duration, err = parser.ParseDuration(c.Duration); err != nil {
+		return nil, fmt.Errorf("maintenance %s: duration: %v", c.Name, err)
+	}
+	if w.matchers, err = parser.ParseMatchers(c.Matchers); err != nil {
+		return nil, fmt.Errorf("maintenance %s: matchers: %v", c.Name, err)
+	}
+	if c.Location != "" {
+		if w.loc, err = time.LoadLocation(c.Location); err != nil {
+			return nil, fmt.Errorf("maintenance %s: %v", c.Name, err)
+		}
+	}
+	return w, nil
+}
+
+// Active reports whether the schedule fired within the duration before t,
+// that is whether its last start at or before t is less than the
+// duration ago.
+func (w *Window) Active(t time.Time) bool {
+	start, ok := w.schedule.last(t.In(w.loc), t.Add(-w.duration))
+	return ok && t.Sub(start) < w.duration
+}
+
+// schedule holds the allowed values of each cron field.
+type schedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+func (s *schedule) matches(t time.Time) bool {
+	return s.minute[t.Minute()] && s.hour[t.Hour()] && s.matchesDay(t)
+}
+
+// matchesDay reports whether the schedule fires on the day of t.
+func (s *schedule) matchesDay(t time.Time) bool {
+	if !s.month[int(t.Month())] {
+		return false
+	}
+	// as in cron, either day field matches when both are restricted
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// last returns the latest time at or before t, in the zone of t, at which
+// the schedule fires, looking back to the day of since at the earliest.
+func (s *schedule) last(t, since time.Time) (time.Time, bool) {
+	loc := t.Location()
+	y, m, d := t.Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, loc); day.AddDate(0, 0, 1).After(since); day = day.AddDate(0, 0, -1) {
+		if !s.matchesDay(day) {
+			continue
+		}
+		for hour := 23; hour >= 0; hour-- {
+			if !s.hour[hour] {
+				continue
+			}
+			for minute := 59; minute >= 0; minute-- {
+				if !s.minute[minute] {
+					continue
+				}
+				if start, ok := wallClock(day, hour, minute, t); ok {
+					return start, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// wallClock returns the latest time at or before t at which the clock
+// reads hour:minute on day, in the zone of day. DST changes skip some
+// wall clock times and repeat others.
+func wallClock(day time.Time, hour, minute int, t time.Time) (time.Time, bool) {
+	at := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+	_, before := at.Add(-12 * time.Hour).Zone()
+	_, after := at.Add(12 * time.Hour).Zone()
+	candidates := []time.Time{at}
+	if shift := time.Duration(before-after) * time.Second; shift > 0 {
+		candidates = append(candidates, at.Add(-shift), at.Add(shift))
+	}
+	var last time.Time
+	for _, c := range candidates {
+		if c.Day() == day.Day() && c.Hour() == hour && c.Minute() == minute && !c.After(t) && c.After(last) {
+			last = c
+		}
+	}
+	return last, !last.IsZero()
+}
+
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q: want 5 fields", spec)
+	}
+	s := &schedule{}
+	var err error
+	for _, f := range []struct {
+		set      *map[int]bool
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		if *f.set, err = parseField(fields[0], f.min, f.max); err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	}
+	if s.dow[7] {
+		s.dow[0] = true // Sunday is both 0 and 7
+	}
+	s.domStar = strings.HasPrefix(strings.Fields(spec)[2], "*")
+	s.dowStar = strings.HasPrefix(strings.Fields(spec)[4], "*")
+	return s, nil
+}
+
+// parseField parses a comma separated list of *, n, a-b, each with an
+// optional /step.
+func parseField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad step in %q", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", part)
+			}
+			lo, hi = n, n
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("bad range %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
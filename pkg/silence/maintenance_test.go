@@ -0,0 +1,194 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package silence
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int // nil if the field is rejected
+	}{
+		{"*", 0, 6, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"5", 0, 59, []int{5}},
+		{"1,3,5", 0, 6, []int{1, 3, 5}},
+		{"1-3", 0, 6, []int{1, 2, 3}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"10-20/5", 0, 59, []int{10, 15, 20}},
+		{"50/5", 0, 59, []int{50, 55}},
+		{"1-2,5-6", 1, 12, []int{1, 2, 5, 6}},
+		{"60", 0, 59, nil},
+		{"0", 1, 31, nil},
+		{"5-1", 0, 59, nil},
+		{"*/0", 0, 59, nil},
+		{"a", 0, 59, nil},
+		{"1-b", 0, 59, nil},
+		{"", 0, 59, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			set, err := parseField(tt.field, tt.min, tt.max)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parseField accepted it: %v", set)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []int{}
+			for v := range set {
+				got = append(got, v)
+			}
+			sort.Ints(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "* * * * * *", "* 24 * * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	// 2018-06-03 is a Sunday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2018, time.June, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		spec string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(3, 12, 34), true},
+		{"30 2 * * *", at(3, 2, 30), true},
+		{"30 2 * * *", at(3, 2, 31), false},
+		{"0 3 * * 0", at(3, 3, 0), true},
+		{"0 3 * * 7", at(3, 3, 0), true},
+		{"0 3 * * 1-5", at(3, 3, 0), false},
+		{"0 3 * * 1-5", at(4, 3, 0), true},
+		{"0 0 1 * *", at(1, 0, 0), true},
+		{"0 0 1 * *", at(2, 0, 0), false},
+		{"0 0 * 7 *", at(1, 0, 0), false},
+		// both day fields restricted: either one matches
+		{"0 0 15 * 0", at(3, 0, 0), true},
+		{"0 0 15 * 0", at(15, 0, 0), true},
+		{"0 0 15 * 0", at(4, 0, 0), false},
+		// as in cron, a stepped star leaves the day to the other field
+		{"0 0 */2 * 1", at(4, 0, 0), true},
+		{"0 0 */2 * 1", at(3, 0, 0), false},
+		{"0 0 */2 * 1", at(5, 0, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" "+tt.t.Format("Mon 02 15:04"), func(t *testing.T) {
+			s, err := parseSchedule(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.matches(tt.t); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowActive(t *testing.T) {
+	w, err := NewWindow(WindowConfig{
+		Name:     "weekly-patch",
+		Schedule: "0 2 * * 0",
+		Duration: "2h",
+		Location: "UTC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sunday := time.Date(2018, time.June, 3, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{sunday.Add(time.Hour + 59*time.Minute), false},
+		{sunday.Add(2 * time.Hour), true},
+		{sunday.Add(3*time.Hour + 59*time.Minute + 59*time.Second), true},
+		{sunday.Add(4 * time.Hour), false},
+		{sunday.Add(7*24*time.Hour + 3*time.Hour), true},
+		{sunday.Add(24*time.Hour + 3*time.Hour), false},
+		// the schedule is in UTC whatever the zone of t
+		{sunday.Add(3 * time.Hour).In(time.FixedZone("UTC+9", 9*3600)), true},
+	}
+	for _, tt := range tests {
+		if got := w.Active(tt.t); got != tt.want {
+			t.Errorf("Active(%v) = %v, want %v", tt.t, got, tt.want)
+		}
+	}
+}
+
+// walkActive is Active as a minute by minute walk back from t.
+func walkActive(w *Window, t time.Time) bool {
+	t = t.In(w.loc)
+	for m := t.Truncate(time.Minute); t.Sub(m) < w.duration; m = m.Add(-time.Minute) {
+		if w.schedule.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWindowActiveSchedules(t *testing.T) {
+	tests := []WindowConfig{
+		{Schedule: "*/15 * * * *", Duration: "5m"},
+		{Schedule: "30 23 * * 1-5", Duration: "90m"},
+		{Schedule: "0 0 1 * *", Duration: "3d"},
+		{Schedule: "0 12 29 2 *", Duration: "1h"},
+		{Schedule: "0 0 13 * 5", Duration: "1d"},
+		{Schedule: "30 2 * * *", Duration: "1h", Location: "America/New_York"},
+		{Schedule: "0 1 * * *", Duration: "2h", Location: "America/New_York"},
+	}
+	// around the 2018 DST changes in New York and a leap day
+	starts := []time.Time{
+		time.Date(2018, time.March, 9, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, time.October, 31, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, time.February, 27, 0, 0, 0, 0, time.UTC),
+	}
+	for _, c := range tests {
+		c.Name = c.Schedule
+		w, err := NewWindow(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, start := range starts {
+			for at := start; at.Before(start.AddDate(0, 0, 5)); at = at.Add(7 * time.Minute) {
+				if got, want := w.Active(at), walkActive(w, at); got != want {
+					t.Errorf("%s %s: Active(%v) = %v, want %v", c.Schedule, c.Location, at, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package silence mutes alerts: silences are created at run time and
+// kept in redis, maintenance windows recur as the policy schedules them.
+// Muted alerts keep their state; only their notifications and actions
+// are held back.
+package silence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/go-redis/redis"
+)
+
+// Key is the redis hash holding the silences as JSON, by ID.
+const Key = "policyengine:silences"
+
+// Silence mutes the alerts its matchers select between StartsAt and
+// EndsAt. Matchers are written as in selectors, e.g. {vm=~"instance-0.*"},
+// and may also match "rule" and "group".
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  string    `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+
+	matchers []*parser.LabelMatcher
+}
+
+func (s *Silence) compile() error {
+	m, err := parser.ParseMatchers(s.Matchers)
+	if err != nil {
+		return fmt.Errorf("silence %s: %v", s.ID, err)
+	}
+	s.matchers = m
+	return nil
+}
+
+// Active reports whether the silence is in effect at t.
+func (s *Silence) Active(t time.Time) bool {
+	return !t.Before(s.StartsAt) && t.Before(s.EndsAt)
+}
+
+func match(matchers []*parser.LabelMatcher, a notify.Alert) bool {
+	for _, m := range matchers {
+		if !m.Matches(a.Label(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Store keeps silences in redis, so that every engine and the CLI see
+// the same ones.
+type Store struct {
+	client *redis.Client
+}
+
+func NewStore(opts *redis.Options) *Store {
+	return &Store{client: redis.NewClient(opts)}
+}
+
+// Add validates and stores s, giving it an ID if it has none.
+func (st *Store) Add(s *Silence) error {
+	if err := s.compile(); err != nil {
+		return err
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("silence ends before it starts")
+	}
+	if s.ID == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		s.ID = hex.EncodeToString(b)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return st.client.HSet(Key, s.ID, string(b)).Err()
+}
+
+// Expire ends a silence now.
+func (st *Store) Expire(id string, now time.Time) error {
+	v, err := st.client.HGet(Key, id).Result()
+	if err == redis.Nil {
+		return fmt.Errorf("no silence %s", id)
+	} else if err != nil {
+		return err
+	}
+	var s Silence
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		return err
+	}
+	if s.EndsAt.After(now) {
+		s.EndsAt = now
+	}
+	if s.StartsAt.After(s.EndsAt) {
+		s.StartsAt = s.EndsAt
+	}
+	b, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	return st.client.HSet(Key, id, string(b)).Err()
+}
+
+// List returns the silences, oldest first. Silences ended before
+// now-retention are deleted on the way.
+func (st *Store) List(now time.Time, retention time.Duration) ([]Silence, error) {
+	all, err := st.client.HGetAll(Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []Silence{}
+	for id, v := range all {
+		var s Silence
+		if err := json.Unmarshal([]byte(v), &s); err != nil {
+			return nil, fmt.Errorf("silence %s: %v", id, err)
+		}
+		if s.EndsAt.Before(now.Add(-retention)) {
+			st.client.HDel(Key, id)
+			continue
+		}
+		if err := s.compile(); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StartsAt.Equal(list[j].StartsAt) {
+			return list[i].StartsAt.Before(list[j].StartsAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// Silencer tells whether an alert is muted, by a silence from the store
+// (when there is one) or by a maintenance window.
+type Silencer struct {
+	store   *Store
+	windows []*Window
+
+	mu       sync.RWMutex
+	silences []Silence
+}
+
+func NewSilencer(store *Store, windows []*Window) *Silencer {
+	return &Silencer{store: store, windows: windows}
+}
+
+// Refresh reloads the silences from the store.
+func (s *Silencer) Refresh(now time.Time) error {
+	if s.store == nil {
+		return nil
+	}
+	list, err := s.store.List(now, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.silences = list
+	s.mu.Unlock()
+	return nil
+}
+
+// Muted returns what mutes the alert at now, e.g. "silence 1f3a..." or
+// "maintenance weekly-patch", or "" if nothing does.
+func (s *Silencer) Muted(a notify.Alert, now time.Time) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.silences {
+		sl := &s.silences[i]
+		if sl.Active(now) && match(sl.matchers, a) {
+			return "silence " + sl.ID
+		}
+	}
+	for _, w := range s.windows {
+		if w.Active(now) && match(w.matchers, a) {
+			return "maintenance " + w.Name
+		}
+	}
+	return ""
+}
+
+// String describes the silence on one line, as the CLI lists it.
+func (s *Silence) String() string {
+	fields := []string{
+		s.ID,
+		s.StartsAt.Format(time.RFC3339),
+		s.EndsAt.Format(time.RFC3339),
+		s.Matchers,
+	}
+	if s.CreatedBy != "" {
+		fields = append(fields, "by "+s.CreatedBy)
+	}
+	if s.Comment != "" {
+		fields = append(fields, fmt.Sprintf("%q", s.Comment))
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package silence
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/go-redis/redis"
+)
+
+func testStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(&redis.Options{Addr: m.Addr()}), m
+}
+
+func TestStore(t *testing.T) {
+	st, m := testStore(t)
+	defer m.Close()
+
+	now := time.Unix(100000, 0).UTC()
+	for _, s := range []*Silence{
+		{ID: "later", Matchers: `{vm="vm2"}`, StartsAt: now.Add(time.Hour), EndsAt: now.Add(2 * time.Hour)},
+		{ID: "now", Matchers: `{vm="vm1"}`, StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{ID: "old", Matchers: `{vm="vm1"}`, StartsAt: now.Add(-50 * time.Hour), EndsAt: now.Add(-49 * time.Hour)},
+	} {
+		if err := st.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generated := &Silence{Matchers: `{rule="r"}`, StartsAt: now, EndsAt: now.Add(time.Minute)}
+	if err := st.Add(generated); err != nil {
+		t.Fatal(err)
+	}
+	if len(generated.ID) != 16 {
+		t.Errorf("generated ID %q", generated.ID)
+	}
+	for _, bad := range []*Silence{
+		{Matchers: `{vm=~"("}`, StartsAt: now, EndsAt: now.Add(time.Hour)},
+		{Matchers: `{vm="vm1"}`, StartsAt: now, EndsAt: now},
+	} {
+		if err := st.Add(bad); err == nil {
+			t.Errorf("Add(%v) accepted", bad)
+		}
+	}
+
+	ids := func(list []Silence) []string {
+		got := []string{}
+		for _, s := range list {
+			got = append(got, s.ID)
+		}
+		return got
+	}
+	// oldest first, those ended over a day ago deleted
+	list, err := st.List(now, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"now", generated.ID, "later"}
+	if generated.ID < "now" {
+		want = []string{generated.ID, "now", "later"}
+	}
+	if got := ids(list); !reflect.DeepEqual(got, want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	if m.HGet(Key, "old") != "" {
+		t.Error("old silence not deleted")
+	}
+	if len(list[0].matchers) == 0 {
+		t.Error("listed silences not compiled")
+	}
+
+	// expiring ends a silence at once, one not started yet is emptied
+	at := now.Add(10 * time.Minute)
+	if err := st.Expire("now", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Expire("later", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Expire("missing", at); err == nil {
+		t.Error("expired a missing silence")
+	}
+	list, err = st.List(at, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range list {
+		switch s.ID {
+		case "now":
+			if !s.StartsAt.Equal(now) || !s.EndsAt.Equal(at) {
+				t.Errorf("expired silence %v", &s)
+			}
+		case "later":
+			if !s.StartsAt.Equal(at) || !s.EndsAt.Equal(at) {
+				t.Errorf("expired future silence %v", &s)
+			}
+		}
+		if s.ID != generated.ID && s.Active(at) {
+			t.Errorf("silence %s still active", s.ID)
+		}
+	}
+}
+
+func TestSilencerMuted(t *testing.T) {
+	st, m := testStore(t)
+	defer m.Close()
+
+	now := time.Date(2018, time.June, 3, 2, 30, 0, 0, time.UTC) // a Sunday
+	for _, s := range []*Silence{
+		{ID: "vm1", Matchers: `{vm="vm1"}`, StartsAt: now.Add(-time.Hour), EndsAt: now.Add(time.Hour)},
+		{ID: "taps", Matchers: `{rule="rx-low", if=~"tap.*"}`, StartsAt: now, EndsAt: now.Add(time.Minute)},
+		{ID: "over", Matchers: `{vm="vm2"}`, StartsAt: now.Add(-time.Hour), EndsAt: now},
+		{ID: "ahead", Matchers: `{vm="vm3"}`, StartsAt: now.Add(time.Second), EndsAt: now.Add(time.Hour)},
+	} {
+		if err := st.Add(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patch, err := NewWindow(WindowConfig{
+		Name:     "weekly-patch",
+		Schedule: "0 2 * * 0",
+		Duration: "1h",
+		Matchers: `{group="compute", vm!="vm1"}`,
+		Location: "UTC",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSilencer(st, []*Window{patch})
+	if err := s.Refresh(now); err != nil {
+		t.Fatal(err)
+	}
+
+	alert := func(rule, group string, labels map[string]string) notify.Alert {
+		return notify.Alert{Rule: rule, Group: group, Labels: labels, State: "firing"}
+	}
+	tests := []struct {
+		name  string
+		alert notify.Alert
+		at    time.Time
+		want  string
+	}{
+		{"label", alert("cpu-high", "storage", map[string]string{"vm": "vm1"}), now, "silence vm1"},
+		{"rule and regexp", alert("rx-low", "storage", map[string]string{"vm": "vm4", "if": "tap0"}), now, "silence taps"},
+		{"rule differs", alert("tx-low", "storage", map[string]string{"vm": "vm4", "if": "tap0"}), now, ""},
+		{"regexp anchored", alert("rx-low", "storage", map[string]string{"vm": "vm4", "if": "eth-tap0"}), now, ""},
+		{"ended", alert("cpu-high", "storage", map[string]string{"vm": "vm2"}), now, ""},
+		{"not started", alert("cpu-high", "storage", map[string]string{"vm": "vm3"}), now, ""},
+		{"maintenance", alert("cpu-high", "compute", map[string]string{"vm": "vm3"}), now, "maintenance weekly-patch"},
+		{"silence first", alert("cpu-high", "compute", map[string]string{"vm": "vm1"}), now, "silence vm1"},
+		{"maintenance over", alert("cpu-high", "compute", map[string]string{"vm": "vm5"}), now.Add(31 * time.Minute), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Muted(tt.alert, tt.at); got != tt.want {
+				t.Errorf("Muted = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
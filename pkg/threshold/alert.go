@@ -0,0 +1,226 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// Rule describes an alerting rule to the alert tracker and receivers.
+type Rule struct {
+	ID          string // e.g. test1[0]
+	Group       string
+	Record      string
+	Expr        *parser.Parser // parsed once, when the rules load
+	For         time.Duration  // how long a series must match before firing
+	Annotations []string
+	Notify      []string // receiver names
+	Threshold   string   // right-hand side of the comparison, if any
+	Templates   *notify.Templates
+	NoDataAfter time.Duration // set on the rule raising silent series
+}
+
+type AlertState int
+
+const (
+	StatePending AlertState = iota
+	StateFiring
+	StateResolved
+)
+
+func (s AlertState) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateFiring:
+		return "firing"
+	case StateResolved:
+		return "resolved"
+	}
+	return "unknown"
+}
+
+// Alert is one series of a rule that matches, or matched until ResolvedAt.
+type Alert struct {
+	Rule       Rule
+	Key        ResourceLabel
+	Metric     string // of the series it was raised on, "" if unknown
+	Values     []float64
+	State      AlertState
+	ActiveAt   time.Time // first evaluation it matched
+	FiredAt    time.Time // when it became firing
+	ResolvedAt time.Time
+	NotifiedAt time.Time // last transition handed to the receivers
+
+	// restored alerts are kept, without data, until the grace period ends
+	restored bool
+}
+
+// AlertTracker keeps the alerts of every rule between evaluations. Rules
+// may be updated concurrently.
+type AlertTracker struct {
+	mu         sync.Mutex
+	alerts     map[string]map[string]*Alert
+	graceUntil time.Time
+}
+
+func NewAlertTracker() *AlertTracker {
+	return &AlertTracker{alerts: map[string]map[string]*Alert{}}
+}
+
+// Update records the series the rule matches now and returns the alerts
+// that became firing or resolved. Pending alerts that stop matching are
+// dropped silently.
+func (t *AlertTracker) Update(rule Rule, matched []Series, now time.Time) []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	alerts, ok := t.alerts[rule.ID]
+	if !ok {
+		alerts = map[string]*Alert{}
+		t.alerts[rule.ID] = alerts
+	}
+	trans := []Alert{}
+
+	seen := map[string]bool{}
+	for _, sr := range matched {
+		fp := sr.Key.Fingerprint()
+		seen[fp] = true
+		a, ok := alerts[fp]
+		if !ok {
+			a = &Alert{Key: sr.Key, State: StatePending, ActiveAt: now}
+			alerts[fp] = a
+		}
+		a.Rule = rule
+		a.Metric = sr.Metric()
+		a.Values = sr.Values()
+		a.restored = false
+		if a.State == StatePending && now.Sub(a.ActiveAt) >= rule.For {
+			a.State = StateFiring
+			a.FiredAt = now
+			a.NotifiedAt = now
+			trans = append(trans, *a)
+		}
+	}
+	for fp, a := range alerts {
+		if seen[fp] {
+			continue
+		}
+		if a.restored && now.Before(t.graceUntil) {
+			continue
+		}
+		a.Rule = rule
+		if a.State == StateFiring {
+			a.State = StateResolved
+			a.ResolvedAt = now
+			a.NotifiedAt = now
+			trans = append(trans, *a)
+		}
+		delete(alerts, fp)
+	}
+
+	sort.Slice(trans, func(i, j int) bool {
+		return trans[i].Key.Fingerprint() < trans[j].Key.Fingerprint()
+	})
+	return trans
+}
+
+// Observe tells the tracker which series of the rule had data read, so
+// that restored alerts of those no longer wait for the grace period. A
+// series counts for an alert with the same labels and metric, or any
+// metric if the alert's is unknown; series read with an offset or as a
+// seasonal baseline do not count.
+func (t *AlertTracker) Observe(ruleID string, read []Series) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	alerts := t.alerts[ruleID]
+	for _, sr := range read {
+		if sr.shifted() {
+			continue
+		}
+		a, ok := alerts[sr.Key.Fingerprint()]
+		if ok && len(sr.Samples) > 0 && (a.Metric == "" || a.Metric == sr.Metric()) {
+			a.restored = false
+		}
+	}
+}
+
+// Forget drops the alerts of a rule that keep rejects, all of them if
+// keep is nil, and returns those that were firing, still firing. Alerts
+// are forgotten once another engine evaluates their series: they are
+// handed over without being resolved, and their new owner fires them
+// again if they still match.
+func (t *AlertTracker) Forget(ruleID string, keep func(ResourceLabel) bool) []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	firing := []Alert{}
+	for fp, a := range t.alerts[ruleID] {
+		if keep != nil && keep(a.Key) {
+			continue
+		}
+		if a.State == StateFiring {
+			firing = append(firing, *a)
+		}
+		delete(t.alerts[ruleID], fp)
+	}
+	sort.Slice(firing, func(i, j int) bool {
+		return firing[i].Key.Fingerprint() < firing[j].Key.Fingerprint()
+	})
+	return firing
+}
+
+// Active returns the pending and firing alerts of a rule.
+func (t *AlertTracker) Active(ruleID string) []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active(ruleID)
+}
+
+func (t *AlertTracker) active(ruleID string) []Alert {
+	active := []Alert{}
+	for _, a := range t.alerts[ruleID] {
+		active = append(active, *a)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Key.Fingerprint() < active[j].Key.Fingerprint()
+	})
+	return active
+}
+
+// Firing returns the firing alerts of every rule.
+func (t *AlertTracker) Firing() []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, 0, len(t.alerts))
+	for id := range t.alerts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	firing := []Alert{}
+	for _, id := range ids {
+		for _, a := range t.active(id) {
+			if a.State == StateFiring {
+				firing = append(firing, a)
+			}
+		}
+	}
+	return firing
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// read marks the series as read for metric.
+func read(metric string, sr Series) Series {
+	sr.sel = &parser.ExprSymbol{Types: parser.ExprVar, ExprVar: metric}
+	return sr
+}
+
+func series(vm string, values ...float64) Series {
+	sr := Series{Key: ResourceLabel{"vm": vm}}
+	for i, v := range values {
+		sr.Samples = append(sr.Samples, Sample{Time: time.Unix(int64(i), 0), Value: v})
+	}
+	return sr
+}
+
+// transition is an alert transition as TestAlertTrackerUpdate compares them.
+type transition struct {
+	vm    string
+	state AlertState
+}
+
+func transitions(alerts []Alert) []transition {
+	trans := []transition{}
+	for _, a := range alerts {
+		trans = append(trans, transition{a.Key["vm"], a.State})
+	}
+	return trans
+}
+
+func TestAlertTrackerUpdate(t *testing.T) {
+	// each step evaluates the rule a minute after the previous one with
+	// the series named as matching
+	tests := []struct {
+		name  string
+		For   time.Duration
+		steps [][]string
+		want  [][]transition
+	}{
+		{
+			name:  "fires at once without for",
+			steps: [][]string{{"vm1"}, {"vm1"}, {}},
+			want:  [][]transition{{{"vm1", StateFiring}}, {}, {{"vm1", StateResolved}}},
+		},
+		{
+			name:  "pending until for elapses",
+			For:   2 * time.Minute,
+			steps: [][]string{{"vm1"}, {"vm1"}, {"vm1"}, {}},
+			want:  [][]transition{{}, {}, {{"vm1", StateFiring}}, {{"vm1", StateResolved}}},
+		},
+		{
+			name:  "pending dropped silently",
+			For:   2 * time.Minute,
+			steps: [][]string{{"vm1"}, {}, {"vm1"}, {"vm1"}},
+			want:  [][]transition{{}, {}, {}, {}},
+		},
+		{
+			name:  "series tracked apart, sorted",
+			steps: [][]string{{"vm2", "vm1"}, {"vm2"}, {"vm1", "vm2"}},
+			want: [][]transition{
+				{{"vm1", StateFiring}, {"vm2", StateFiring}},
+				{{"vm1", StateResolved}},
+				{{"vm1", StateFiring}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewAlertTracker()
+			rule := Rule{ID: "test1[0]", For: tt.For}
+			now := time.Unix(1000, 0)
+			for i, step := range tt.steps {
+				matched := []Series{}
+				for _, vm := range step {
+					matched = append(matched, series(vm, 1))
+				}
+				got := transitions(tracker.Update(rule, matched, now))
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("step %d: got %v, want %v", i, got, tt.want[i])
+				}
+				now = now.Add(time.Minute)
+			}
+		})
+	}
+}
+
+func TestAlertTrackerTimes(t *testing.T) {
+	tracker := NewAlertTracker()
+	rule := Rule{ID: "test1[0]", For: time.Minute}
+	t0 := time.Unix(1000, 0)
+
+	tracker.Update(rule, []Series{series("vm1", 1, 2)}, t0)
+	fired := tracker.Update(rule, []Series{series("vm1", 3)}, t0.Add(time.Minute))
+	if len(fired) != 1 {
+		t.Fatalf("got %d transitions, want 1", len(fired))
+	}
+	a := fired[0]
+	if !a.ActiveAt.Equal(t0) || !a.FiredAt.Equal(t0.Add(time.Minute)) || !a.NotifiedAt.Equal(a.FiredAt) {
+		t.Errorf("firing times: active %v, fired %v, notified %v", a.ActiveAt, a.FiredAt, a.NotifiedAt)
+	}
+	if !reflect.DeepEqual(a.Values, []float64{3}) {
+		t.Errorf("values = %v, want the last read", a.Values)
+	}
+
+	resolved := tracker.Update(rule, nil, t0.Add(2*time.Minute))
+	if len(resolved) != 1 || !resolved[0].ResolvedAt.Equal(t0.Add(2*time.Minute)) {
+		t.Fatalf("resolved = %+v", resolved)
+	}
+	if active := tracker.Active(rule.ID); len(active) != 0 {
+		t.Errorf("resolved alert still active: %+v", active)
+	}
+}
+
+func TestAlertTrackerFiring(t *testing.T) {
+	tracker := NewAlertTracker()
+	now := time.Unix(1000, 0)
+	tracker.Update(Rule{ID: "b[0]"}, []Series{series("vm2"), series("vm1")}, now)
+	tracker.Update(Rule{ID: "a[0]", For: time.Hour}, []Series{series("vm3")}, now)
+	tracker.Update(Rule{ID: "a[1]"}, []Series{series("vm4")}, now)
+
+	got := []string{}
+	for _, a := range tracker.Firing() {
+		got = append(got, a.Rule.ID+" "+a.Key["vm"])
+	}
+	want := []string{"a[1] vm4", "b[0] vm1", "b[0] vm2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Firing() = %v, want %v", got, want)
+	}
+}
+
+func TestAlertTrackerRestore(t *testing.T) {
+	tracker := NewAlertTracker()
+	rule := Rule{ID: "test1[0]"}
+	t0 := time.Unix(1000, 0)
+	tracker.Restore([]AlertRecord{
+		{Rule: rule.ID, Labels: ResourceLabel{"vm": "vm1"}, State: "firing", ActiveAt: t0, FiredAt: t0},
+		{Rule: rule.ID, Labels: ResourceLabel{"vm": "vm2"}, State: "firing", ActiveAt: t0, FiredAt: t0},
+	}, map[string]Rule{rule.ID: rule}, t0.Add(5*time.Minute))
+
+	// vm1 still matches, vm2 has no data yet: neither fires again
+	// nor resolves during the grace period
+	if trans := tracker.Update(rule, []Series{series("vm1", 1)}, t0.Add(time.Minute)); len(trans) != 0 {
+		t.Errorf("during grace: %v", transitions(trans))
+	}
+	// data read for vm2 ends its grace
+	tracker.Observe(rule.ID, []Series{series("vm2", 1)})
+	want := []transition{{"vm2", StateResolved}}
+	if got := transitions(tracker.Update(rule, []Series{series("vm1", 1)}, t0.Add(2*time.Minute))); !reflect.DeepEqual(got, want) {
+		t.Errorf("after observe: got %v, want %v", got, want)
+	}
+	if active := tracker.Active(rule.ID); len(active) != 1 || active[0].Key["vm"] != "vm1" || active[0].State != StateFiring {
+		t.Errorf("active = %+v", active)
+	}
+}
+
+func TestAlertTrackerObserveMetric(t *testing.T) {
+	tracker := NewAlertTracker()
+	rule := Rule{ID: "test1[0]"}
+	t0 := time.Unix(1000, 0)
+	tracker.Restore([]AlertRecord{
+		{Rule: rule.ID, Labels: ResourceLabel{"vm": "vm1"}, Metric: "vm.cpu", State: "firing", ActiveAt: t0, FiredAt: t0},
+	}, map[string]Rule{rule.ID: rule}, t0.Add(5*time.Minute))
+
+	// data of another metric with the same labels leaves the grace on
+	tracker.Observe(rule.ID, []Series{read("vm.memory", series("vm1", 1))})
+	if trans := tracker.Update(rule, nil, t0.Add(time.Minute)); len(trans) != 0 {
+		t.Errorf("after another metric: %v", transitions(trans))
+	}
+	tracker.Observe(rule.ID, []Series{read("vm.cpu", series("vm1", 1))})
+	want := []transition{{"vm1", StateResolved}}
+	if got := transitions(tracker.Update(rule, nil, t0.Add(2*time.Minute))); !reflect.DeepEqual(got, want) {
+		t.Errorf("after its metric: got %v, want %v", got, want)
+	}
+
+	// alerts remember the metric of their series
+	tracker.Update(rule, []Series{read("vm.cpu", series("vm2", 1))}, t0.Add(3*time.Minute))
+	if records := tracker.Snapshot(); len(records) != 1 || records[0].Metric != "vm.cpu" {
+		t.Errorf("snapshot = %+v", records)
+	}
+}
+
+func TestAlertTrackerForget(t *testing.T) {
+	tracker := NewAlertTracker()
+	now := time.Unix(1000, 0)
+	tracker.Update(Rule{ID: "test1[0]"}, []Series{series("vm1"), series("vm2"), series("vm3")}, now)
+	tracker.Update(Rule{ID: "test1[1]", For: time.Hour}, []Series{series("vm1")}, now)
+
+	later := now.Add(time.Minute)
+	// handed over as they are, not resolved
+	firing := tracker.Forget("test1[0]", func(rl ResourceLabel) bool { return rl["vm"] == "vm1" })
+	want := []transition{{"vm2", StateFiring}, {"vm3", StateFiring}}
+	if got := transitions(firing); !reflect.DeepEqual(got, want) {
+		t.Errorf("Forget returned %v, want %v", got, want)
+	}
+	for _, a := range firing {
+		if !a.ResolvedAt.IsZero() || !a.FiredAt.Equal(now) {
+			t.Errorf("%v: fired %v, resolved %v", a.Key, a.FiredAt, a.ResolvedAt)
+		}
+	}
+	if active := tracker.Active("test1[0]"); len(active) != 1 || active[0].Key["vm"] != "vm1" {
+		t.Errorf("kept = %+v", active)
+	}
+	if trans := tracker.Forget("test1[1]", nil); len(trans) != 0 {
+		t.Errorf("Forget of a pending alert returned %v", transitions(trans))
+	}
+	if active := tracker.Active("test1[1]"); len(active) != 0 {
+		t.Errorf("not forgotten: %+v", active)
+	}
+	// forgotten alerts are not resolved again on the next update
+	if trans := tracker.Update(Rule{ID: "test1[0]"}, []Series{series("vm1")}, later.Add(time.Minute)); len(trans) != 0 {
+		t.Errorf("after forget: %v", transitions(trans))
+	}
+}
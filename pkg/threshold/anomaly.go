@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// anomalies are the functions measuring how far each series strays from
+// its own history in the window, given the function call and the series.
+var anomalies = map[string]func(s *parser.ExprSymbol, rdlist []Series) []Series{
+	"zscore":      zscore,
+	"ewma":        ewma,
+	"mad_outlier": madOutlier,
+}
+
+// Predicate reports whether the function selects series rather than
+// computing values, so that an expression made of it alone alerts
+// instead of recording.
+func Predicate(name string) bool {
+	return name == "absent" || name == "mad_outlier"
+}
+
+// numArg returns argument i of a call, a number.
+func numArg(s *parser.ExprSymbol, i int) float64 {
+	v, _ := strconv.ParseFloat(s.Args[i].ExprNum, 64)
+	return v
+}
+
+// single returns the series with value as its only sample, at the time
+// of its newest one.
+func single(rd Series, value float64) Series {
+	last := rd.Samples[len(rd.Samples)-1]
+	return Series{Key: rd.Key, Samples: []Sample{{Time: last.Time, Value: value}}, LastSeen: rd.LastSeen, sel: rd.sel}
+}
+
+func meanStddev(list []float64) (float64, float64) {
+	mean := sum(list) / float64(len(list))
+	variance := 0.0
+	for _, el := range list {
+		variance += (el - mean) * (el - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(list)))
+}
+
+func median(list []float64) float64 {
+	sorted := append([]float64{}, list...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// zscore is how many standard deviations the newest value of each series
+// is from the mean of its samples, 0 when they are all equal.
+func zscore(s *parser.ExprSymbol, rdlist []Series) []Series {
+	result := []Series{}
+	for _, rd := range rdlist {
+		if len(rd.Samples) < 2 {
+			continue
+		}
+		values := rd.Values()
+		mean, stddev := meanStddev(values)
+		z := 0.0
+		if stddev > 0 {
+			z = (values[len(values)-1] - mean) / stddev
+		}
+		result = append(result, single(rd, z))
+	}
+	return result
+}
+
+// ewma is the exponentially weighted moving average of the samples of
+// each series, each new sample weighing alpha (0 < alpha <= 1).
+func ewma(s *parser.ExprSymbol, rdlist []Series) []Series {
+	alpha := numArg(s, 1)
+	result := []Series{}
+	if alpha <= 0 || alpha > 1 {
+		return result
+	}
+	for _, rd := range rdlist {
+		if len(rd.Samples) == 0 {
+			continue
+		}
+		values := rd.Values()
+		avg := values[0]
+		for _, v := range values[1:] {
+			avg = alpha*v + (1-alpha)*avg
+		}
+		result = append(result, single(rd, avg))
+	}
+	return result
+}
+
+// madScale makes the median absolute deviation estimate the standard
+// deviation of normally distributed samples.
+const madScale = 1.4826
+
+// madOutlier selects the series whose newest value is more than k scaled
+// median absolute deviations from the median of their samples, valued
+// with that distance. It is robust to the spikes that skew zscore.
+func madOutlier(s *parser.ExprSymbol, rdlist []Series) []Series {
+	k := numArg(s, 1)
+	result := []Series{}
+	for _, rd := range rdlist {
+		if len(rd.Samples) < 3 {
+			continue
+		}
+		values := rd.Values()
+		med := median(values)
+		deviations := make([]float64, len(values))
+		for i, v := range values {
+			deviations[i] = math.Abs(v - med)
+		}
+		mad := madScale * median(deviations)
+		d := math.Abs(values[len(values)-1] - med)
+		if mad == 0 {
+			if d == 0 {
+				continue
+			}
+			d = math.Inf(1)
+		} else {
+			d /= mad
+		}
+		if d > k {
+			result = append(result, single(rd, d))
+		}
+	}
+	return result
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnomalies(t *testing.T) {
+	tests := []struct {
+		name   string
+		expr   string
+		values []float64
+		want   []float64 // value of the series, none if dropped
+	}{
+		{"zscore", "zscore(vm.cpu)", []float64{2, 4, 4, 4, 5, 5, 7, 9}, []float64{2}},
+		{"zscore below the mean", "zscore(vm.cpu)", []float64{10, 0}, []float64{-1}},
+		{"zscore of a flat series", "zscore(vm.cpu)", []float64{1, 1, 1}, []float64{0}},
+		{"zscore of one sample", "zscore(vm.cpu)", []float64{5}, nil},
+
+		{"ewma", "ewma(vm.cpu, 0.5)", []float64{4, 8, 12}, []float64{9}},
+		{"ewma of one sample", "ewma(vm.cpu, 0.5)", []float64{3}, []float64{3}},
+		{"ewma with alpha 1", "ewma(vm.cpu, 1)", []float64{3, 7}, []float64{7}},
+		{"ewma with alpha 0", "ewma(vm.cpu, 0)", []float64{3, 7}, nil},
+		{"ewma with alpha above 1", "ewma(vm.cpu, 1.5)", []float64{3, 7}, nil},
+
+		// median 10, median absolute deviation 0.5
+		{"mad outlier", "mad_outlier(vm.cpu, 3)", []float64{10, 10, 11, 9, 10, 30}, []float64{20 / (madScale * 0.5)}},
+		{"mad within k", "mad_outlier(vm.cpu, 3)", []float64{10, 11, 9, 10, 12}, nil},
+		{"mad of a flat series", "mad_outlier(vm.cpu, 3)", []float64{5, 5, 5}, nil},
+		{"mad off a flat series", "mad_outlier(vm.cpu, 3)", []float64{5, 5, 5, 6}, []float64{math.Inf(1)}},
+		{"mad of two samples", "mad_outlier(vm.cpu, 3)", []float64{5, 50}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EvaluateRecord(parse(t, tt.expr), []Series{series("vm1", tt.values...)})
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d series, want %d", len(got), len(tt.want))
+			}
+			for i, sr := range got {
+				if v := newest(sr); math.Abs(v-tt.want[i]) > 1e-9 && v != tt.want[i] {
+					t.Errorf("value = %v, want %v", v, tt.want[i])
+				}
+				// at the time of the newest sample
+				if at := time.Unix(int64(len(tt.values)-1), 0); len(sr.Samples) != 1 || !sr.Samples[0].Time.Equal(at) {
+					t.Errorf("samples = %v, want one at %v", sr.Samples, at)
+				}
+			}
+		})
+	}
+}
+
+func TestAnomalyCondition(t *testing.T) {
+	rdlist := []Series{
+		series("vm1", 10, 10, 11, 9, 10, 30),
+		series("vm2", 10, 11, 9, 10, 12),
+	}
+	tests := []struct {
+		expr string
+		want []string // vms matching
+	}{
+		{"mad_outlier(vm.cpu, 3)", []string{"vm1"}},
+		{"zscore(vm.cpu) > 2", []string{"vm1"}},
+		{"ewma(vm.cpu, 0.5) < 12", []string{"vm2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := []string{}
+			for _, rl := range Evaluate(parse(t, tt.expr), rdlist) {
+				got = append(got, rl["vm"])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// defaultWindow is how far back a metric without [window] is read.
+const defaultWindow = 60 * time.Second
+
+// Query asks a DataSource for the samples of one metric selector.
+type Query struct {
+	Metric   string // e.g. vm.if_octets.rx
+	Matchers []*parser.LabelMatcher
+	Start    time.Time
+	End      time.Time
+
+	// Aggregation, when set (avg, max, min, sum or count), lets the
+	// datasource return one aggregate per Bucket instead of the raw
+	// samples. Datasources that do so mark the series with it.
+	Aggregation string
+	Bucket      time.Duration
+}
+
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is one series matching a Query, with its samples in [Start, End].
+type Series struct {
+	Key      ResourceLabel
+	Samples  []Sample
+	LastSeen time.Time // time of the newest sample, zero if unknown
+
+	Aggregation string // set when Samples are per-bucket aggregates
+
+	sel   *parser.ExprSymbol // the series was read for, or computed from; nil if unknown
+	shift time.Duration      // how much earlier than sel asks it was read
+}
+
+// Metric returns the metric the series was read for, or computed from,
+// "" if unknown.
+func (s Series) Metric() string {
+	if s.sel == nil {
+		return ""
+	}
+	return s.sel.ExprVar
+}
+
+// shifted reports whether the series was read earlier than its window,
+// with an offset or as the baseline of a seasonal function.
+func (s Series) shifted() bool {
+	return s.shift != 0 || (s.sel != nil && s.sel.Offset != 0)
+}
+
+func (s Series) Values() []float64 {
+	datalist := make([]float64, 0, len(s.Samples))
+	for _, sample := range s.Samples {
+		datalist = append(datalist, sample.Value)
+	}
+	return datalist
+}
+
+// DataSource is a metric store the rules can be evaluated against.
+// Series known to the store but without samples in the window should
+// still be returned, so that they can be tracked as stale. Queries should
+// give up once ctx is done.
+type DataSource interface {
+	Query(ctx context.Context, q Query) ([]Series, error)
+}
+
+// MatchLabels reports whether rl satisfies every matcher; missing labels are empty.
+func MatchLabels(matchers []*parser.LabelMatcher, rl ResourceLabel) bool {
+	for _, m := range matchers {
+		if !m.Matches(rl[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read reads the series of every metric the expression references; each
+// series remembers the selector it was read for. Series read with an
+// offset have their sample times moved forward by it, to line up with the
+// current window; LastSeen is left as the datasource reports it.
+func Read(ctx context.Context, ds DataSource, p *parser.Parser) ([]Series, error) {
+	// the *_over_time function directly applied to each selector, which
+	// the datasource may compute, and the period of seasonal functions,
+	// whose selector is also read that much earlier as the baseline
+	overTimeOf := map[*parser.ExprSymbol]string{}
+	periodOf := map[*parser.ExprSymbol]time.Duration{}
+	var walk func(s *parser.ExprSymbol)
+	walk = func(s *parser.ExprSymbol) {
+		if s != nil && s.Types == parser.ExprCmp {
+			walk(s.Cond.Left)
+			walk(s.Cond.Right)
+			return
+		}
+		if s == nil || s.Types != parser.ExprFunc {
+			return
+		}
+		for _, arg := range s.Args {
+			if arg.Types == parser.ExprVar {
+				overTimeOf[arg] = s.Func
+				if _, ok := seasonal[s.Func]; ok {
+					periodOf[arg] = s.Args[1].ExprDur
+				}
+			}
+			walk(arg)
+		}
+	}
+	roots := []*parser.ExprSymbol{p.Left, p.Right}
+	for _, j := range p.Joins {
+		roots = append(roots, j.Cond.Left, j.Cond.Right)
+	}
+	for _, s := range roots {
+		walk(s)
+	}
+
+	sels := p.Selectors()
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("no metric in expression")
+	}
+	now := time.Now()
+	all := []Series{}
+	for _, sel := range sels {
+		window := sel.Window
+		if window == 0 {
+			window = defaultWindow
+		}
+		shifts := []time.Duration{0}
+		if period, ok := periodOf[sel]; ok {
+			shifts = append(shifts, period)
+		}
+		for _, shift := range shifts {
+			offset := sel.Offset + shift
+			q := Query{
+				Metric:   sel.ExprVar,
+				Matchers: sel.Matchers,
+				Start:    now.Add(-offset - window),
+				End:      now.Add(-offset),
+			}
+			if aggr, ok := overTimeAggregation(overTimeOf[sel]); ok {
+				q.Aggregation = aggr
+				q.Bucket = window
+			}
+			series, err := ds.Query(ctx, q)
+			if err != nil {
+				return nil, err
+			}
+			for i := range series {
+				series[i].sel = sel
+				series[i].shift = shift
+				for j := range series[i].Samples {
+					series[i].Samples[j].Time = series[i].Samples[j].Time.Add(offset)
+				}
+			}
+			all = append(all, series...)
+		}
+	}
+	return all, nil
+}
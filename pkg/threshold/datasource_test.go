@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// timedSource serves the samples of each metric in the queried range,
+// with the time of the newest one up to its end as LastSeen.
+type timedSource map[string][]Series
+
+func (ts timedSource) Query(ctx context.Context, q Query) ([]Series, error) {
+	series := []Series{}
+	for _, sr := range ts[q.Metric] {
+		rd := Series{Key: sr.Key, Samples: []Sample{}}
+		for _, sm := range sr.Samples {
+			if !sm.Time.Before(q.Start) && !sm.Time.After(q.End) {
+				rd.Samples = append(rd.Samples, sm)
+			}
+			if !sm.Time.After(q.End) && sm.Time.After(rd.LastSeen) {
+				rd.LastSeen = sm.Time
+			}
+		}
+		series = append(series, rd)
+	}
+	return series, nil
+}
+
+func TestReadOffset(t *testing.T) {
+	now := time.Now()
+	ds := timedSource{"vm.cpu": {{
+		Key: ResourceLabel{"vm": "vm1"},
+		Samples: []Sample{
+			{Time: now.Add(-time.Hour - 20*time.Second), Value: 1},
+			{Time: now.Add(-time.Hour - 10*time.Second), Value: 2},
+			{Time: now.Add(-10 * time.Second), Value: 3},
+		},
+	}}}
+	rdlist, err := Read(context.Background(), ds, parse(t, "vm.cpu offset 1h > 0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rdlist) != 1 || len(rdlist[0].Samples) != 2 {
+		t.Fatalf("read %+v", rdlist)
+	}
+	rd := rdlist[0]
+	if at, want := rd.Samples[1].Time, now.Add(-10*time.Second); !at.Equal(want) {
+		t.Errorf("newest sample at %v, want %v", at, want)
+	}
+	if want := now.Add(-time.Hour - 10*time.Second); !rd.LastSeen.Equal(want) {
+		t.Errorf("LastSeen = %v, want %v", rd.LastSeen, want)
+	}
+}
+
+// lastSource serves the samples of each metric in the queried range,
+// with the time of its newest sample ever as LastSeen, as redis does
+// from the score of the newest member.
+type lastSource map[string][]Series
+
+func (ls lastSource) Query(ctx context.Context, q Query) ([]Series, error) {
+	series, _ := timedSource(ls).Query(ctx, q)
+	for i, sr := range ls[q.Metric] {
+		for _, sm := range sr.Samples {
+			if sm.Time.After(series[i].LastSeen) {
+				series[i].LastSeen = sm.Time
+			}
+		}
+	}
+	return series, nil
+}
+
+func TestReadShiftedStale(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	// vm1 stopped reporting ten minutes ago, its baseline a day earlier is there
+	ds := lastSource{"vm.cpu": {{
+		Key: ResourceLabel{"vm": "vm1"},
+		Samples: []Sample{
+			{Time: now.Add(-day - 30*time.Second), Value: 1},
+			{Time: now.Add(-10 * time.Minute), Value: 2},
+		},
+	}}}
+	stale := StaleSeries{Key: ResourceLabel{"vm": "vm1"}, Metric: "vm.cpu", LastSeen: now.Add(-10 * time.Minute)}
+	tests := []struct {
+		expr string
+		want []StaleSeries
+	}{
+		// offset reads are not tracked
+		{"vm.cpu offset 1h > 0", []StaleSeries{}},
+		// the baseline does not keep the silent series fresh
+		{"seasonal_ratio(vm.cpu[1m], 1d) > 1.2", []StaleSeries{stale}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			rdlist, err := Read(context.Background(), ds, parse(t, tt.expr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rd := range rdlist {
+				if rd.LastSeen.After(now) {
+					t.Errorf("%s%v: LastSeen %v after now", rd.Metric(), rd.Key, rd.LastSeen)
+				}
+			}
+			st := NewStaleTracker()
+			st.Update("test1[0]", rdlist, now)
+			if got := st.Stale("test1[0]", 5*time.Minute, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Stale = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
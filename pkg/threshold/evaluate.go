@@ -17,7 +17,11 @@
 package threshold
 
 import (
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
 )
@@ -27,10 +31,20 @@ func compareFalse(_ []float64, _ float64) bool {
 }
 
 func compareEq(list []float64, val float64) bool {
+	for _, el := range list {
+		if el == val {
+			return true
+		}
+	}
 	return false
 }
 
 func compareNe(list []float64, val float64) bool {
+	for _, el := range list {
+		if el != val {
+			return true
+		}
+	}
 	return false
 }
 
@@ -70,30 +84,455 @@ func compareGt(list []float64, val float64) bool {
 	return false
 }
 
-func Evaluate(p *parser.Parser, rdlist []rawData) []ResourceLabel {
-	rllist := []ResourceLabel{}
+// absent reports the series the selector asks for when none of them has
+// any sample in the window, labelled from its equality matchers.
+func absent(sel *parser.ExprSymbol, rdlist []Series) []ResourceLabel {
+	for _, rd := range rdlist {
+		if len(rd.Samples) > 0 {
+			return []ResourceLabel{}
+		}
+	}
+	rl := ResourceLabel{}
+	for _, m := range sel.Matchers {
+		if m.Type == parser.MatchEqual {
+			rl[m.Name] = m.Value
+		}
+	}
+	return []ResourceLabel{rl}
+}
+
+func sum(list []float64) float64 {
+	total := 0.0
+	for _, el := range list {
+		total += el
+	}
+	return total
+}
+
+// overTime are the functions reducing the samples of each series in the
+// window to a single value.
+var overTime = map[string]func([]float64) float64{
+	"avg_over_time": func(list []float64) float64 {
+		return sum(list) / float64(len(list))
+	},
+	"max_over_time": func(list []float64) float64 {
+		max := math.Inf(-1)
+		for _, el := range list {
+			max = math.Max(max, el)
+		}
+		return max
+	},
+	"min_over_time": func(list []float64) float64 {
+		min := math.Inf(1)
+		for _, el := range list {
+			min = math.Min(min, el)
+		}
+		return min
+	},
+	"sum_over_time": sum,
+	"count_over_time": func(list []float64) float64 {
+		return float64(len(list))
+	},
+}
+
+// overTimeAggregation returns the datasource aggregation an *_over_time
+// function can be pushed down as, e.g. "avg" for avg_over_time.
+func overTimeAggregation(name string) (string, bool) {
+	if _, ok := overTime[name]; !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "_over_time"), true
+}
+
+func aggregateOverTime(name string, rdlist []Series) []Series {
+	result := []Series{}
+	for _, rd := range rdlist {
+		if len(rd.Samples) == 0 {
+			continue
+		}
+		f := overTime[name]
+		if rd.Aggregation == "count" {
+			// bucket counts add up
+			f = sum
+		}
+		last := rd.Samples[len(rd.Samples)-1]
+		result = append(result, Series{
+			Key:      rd.Key,
+			Samples:  []Sample{{Time: last.Time, Value: f(rd.Values())}},
+			LastSeen: rd.LastSeen,
+			sel:      rd.sel,
+		})
+	}
+	return result
+}
 
-	value, _ := strconv.ParseFloat(p.Right.ExprNum, 64)
+// rate is the per-second increase of a counter over the samples of each
+// series, taking counter resets into account.
+func rate(rdlist []Series) []Series {
+	result := []Series{}
+	for _, rd := range rdlist {
+		if len(rd.Samples) < 2 {
+			continue
+		}
+		first, last := rd.Samples[0], rd.Samples[len(rd.Samples)-1]
+		seconds := last.Time.Sub(first.Time).Seconds()
+		if seconds <= 0 {
+			continue
+		}
+		increase := 0.0
+		for i := 1; i < len(rd.Samples); i++ {
+			d := rd.Samples[i].Value - rd.Samples[i-1].Value
+			if d < 0 {
+				// reset: the counter restarted from 0
+				d = rd.Samples[i].Value
+			}
+			increase += d
+		}
+		result = append(result, Series{
+			Key:      rd.Key,
+			Samples:  []Sample{{Time: last.Time, Value: increase / seconds}},
+			LastSeen: rd.LastSeen,
+			sel:      rd.sel,
+		})
+	}
+	return result
+}
 
+// groupKey returns the labels of rl an aggregation keeps.
+func groupKey(s *parser.ExprSymbol, rl ResourceLabel) ResourceLabel {
+	key := ResourceLabel{}
+	if s.Without {
+		drop := map[string]bool{}
+		for _, name := range s.Grouping {
+			drop[name] = true
+		}
+		for name, value := range rl {
+			if !drop[name] {
+				key[name] = value
+			}
+		}
+		return key
+	}
+	for _, name := range s.Grouping {
+		if value, ok := rl[name]; ok {
+			key[name] = value
+		}
+	}
+	return key
+}
+
+// aggregations reduce the newest values of the series of a group to one.
+var aggregations = map[string]func([]float64) float64{
+	"sum":   sum,
+	"avg":   overTime["avg_over_time"],
+	"min":   overTime["min_over_time"],
+	"max":   overTime["max_over_time"],
+	"count": overTime["count_over_time"],
+}
+
+// aggregate applies an aggregation across the series, grouped on their
+// labels by or without the listed ones, to the newest value of each.
+// sum, avg, min, max and count return one series per group, labelled
+// with the labels kept; topk and bottomk return the k series of each
+// group with the largest or smallest values, with their own labels.
+func aggregate(s *parser.ExprSymbol, rdlist []Series) []Series {
+	type group struct {
+		key    ResourceLabel
+		series []Series
+	}
+	groups := map[string]*group{}
+	fps := []string{}
 	for _, rd := range rdlist {
-		compareFunc := compareFalse
-		switch p.Ops {
-		case parser.ExprEq:
-			compareFunc = compareEq
-		case parser.ExprNe:
-			compareFunc = compareNe
-		case parser.ExprLe:
-			compareFunc = compareLe
-		case parser.ExprGe:
-			compareFunc = compareGe
-		case parser.ExprLt:
-			compareFunc = compareLt
-		case parser.ExprGt:
-			compareFunc = compareGt
-		}
-		if compareFunc(rd.datalist, value) {
-			rllist = append(rllist, rd.key)
+		if len(rd.Samples) == 0 {
+			continue
+		}
+		key := groupKey(s, rd.Key)
+		fp := key.Fingerprint()
+		g, ok := groups[fp]
+		if !ok {
+			g = &group{key: key}
+			groups[fp] = g
+			fps = append(fps, fp)
+		}
+		g.series = append(g.series, rd)
+	}
+	sort.Strings(fps)
+
+	last := func(rd Series) Sample {
+		return rd.Samples[len(rd.Samples)-1]
+	}
+	result := []Series{}
+	for _, fp := range fps {
+		g := groups[fp]
+		if s.Func == "topk" || s.Func == "bottomk" {
+			k, _ := strconv.Atoi(s.Args[0].ExprNum)
+			sort.SliceStable(g.series, func(i, j int) bool {
+				if s.Func == "topk" {
+					return last(g.series[i]).Value > last(g.series[j]).Value
+				}
+				return last(g.series[i]).Value < last(g.series[j]).Value
+			})
+			for i := 0; i < k && i < len(g.series); i++ {
+				rd := g.series[i]
+				result = append(result, Series{Key: rd.Key, Samples: []Sample{last(rd)}, LastSeen: rd.LastSeen, sel: rd.sel})
+			}
+			continue
+		}
+		values := []float64{}
+		var latest Sample
+		var lastSeen time.Time
+		for _, rd := range g.series {
+			sample := last(rd)
+			values = append(values, sample.Value)
+			if sample.Time.After(latest.Time) {
+				latest = sample
+			}
+			if rd.LastSeen.After(lastSeen) {
+				lastSeen = rd.LastSeen
+			}
+		}
+		result = append(result, Series{
+			Key:      g.key,
+			Samples:  []Sample{{Time: latest.Time, Value: aggregations[s.Func](values)}},
+			LastSeen: lastSeen,
+			sel:      g.series[0].sel,
+		})
+	}
+	return result
+}
+
+// CrossSeries reports whether the expression relates series to each other,
+// by aggregating or joining them, and so needs to see all of them.
+func CrossSeries(p *parser.Parser) bool {
+	var walk func(s *parser.ExprSymbol) bool
+	walk = func(s *parser.ExprSymbol) bool {
+		if s == nil || s.Types != parser.ExprFunc {
+			return false
 		}
+		if parser.Aggregations[s.Func] {
+			return true
+		}
+		for _, arg := range s.Args {
+			if walk(arg) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(p.Joins) > 0 || (p.Right != nil && p.Right.Types != parser.ExprNum) {
+		return true
+	}
+	return walk(p.Left)
+}
+
+// evaluation is one evaluation of a rule's expression over the series
+// read for it.
+type evaluation struct {
+	rdlist []Series
+
+	// models holds the holt_winters state of the previous evaluation,
+	// kept what this one used; both are nil when nothing is kept.
+	models map[string]*hwModel
+	kept   map[string]*hwModel
+	calls  int // holt_winters calls evaluated so far
+}
+
+// evalSymbol computes the series a symbol stands for, from the series
+// read for the metric of the rule; those of a comparison are the ones
+// matching it.
+func (e *evaluation) evalSymbol(s *parser.ExprSymbol) []Series {
+	switch s.Types {
+	case parser.ExprVar:
+		series := []Series{}
+		for _, rd := range e.rdlist {
+			if rd.sel == nil || (rd.sel == s && rd.shift == 0) {
+				series = append(series, rd)
+			}
+		}
+		return series
+	case parser.ExprFunc:
+		if _, ok := overTime[s.Func]; ok {
+			return aggregateOverTime(s.Func, e.evalSymbol(s.Args[0]))
+		}
+		if s.Func == "rate" {
+			return rate(e.evalSymbol(s.Args[0]))
+		}
+		if f, ok := anomalies[s.Func]; ok {
+			return f(s, e.evalSymbol(s.Args[0]))
+		}
+		if parser.Aggregations[s.Func] {
+			return aggregate(s, e.evalSymbol(s.Args[len(s.Args)-1]))
+		}
+		if s.Func == "holt_winters" {
+			return e.holtWinters(s, e.evalSymbol(s.Args[0]))
+		}
+		if f, ok := seasonal[s.Func]; ok {
+			return compareSeasons(f, e.evalSymbol(s.Args[0]), e.baseline(s))
+		}
+	case parser.ExprCmp:
+		return e.evalCond(s.Cond.Left, s.Cond.Ops, s.Cond.Right, s.Cond.Matching)
+	}
+	return []Series{}
+}
+
+// compareFunc returns the comparison of an operator.
+func compareFunc(ops parser.ExprTypes) func([]float64, float64) bool {
+	switch ops {
+	case parser.ExprEq:
+		return compareEq
+	case parser.ExprNe:
+		return compareNe
+	case parser.ExprLe:
+		return compareLe
+	case parser.ExprGe:
+		return compareGe
+	case parser.ExprLt:
+		return compareLt
+	case parser.ExprGt:
+		return compareGt
+	}
+	return compareFalse
+}
+
+// matchKey returns what series must share to be matched.
+func matchKey(m parser.Matching, rl ResourceLabel) string {
+	if len(m.Labels) == 0 && !m.On {
+		return rl.Fingerprint()
+	}
+	key := ResourceLabel{}
+	listed := map[string]bool{}
+	for _, name := range m.Labels {
+		listed[name] = true
+	}
+	for name, value := range rl {
+		if listed[name] == m.On {
+			key[name] = value
+		}
+	}
+	return key.Fingerprint()
+}
+
+// newest is the value of the newest sample of a series, which must have one.
+func newest(rd Series) float64 {
+	return rd.Samples[len(rd.Samples)-1].Value
+}
+
+// evalCond returns the series of left matching the comparison. Compared
+// with a number, a series matches if any of its values does; compared
+// with series, the newest values of the matched series are compared, and
+// those of the right side are returned with group_right.
+func (e *evaluation) evalCond(left *parser.ExprSymbol, ops parser.ExprTypes, right *parser.ExprSymbol, m parser.Matching) []Series {
+	matched := []Series{}
+	lhs := e.evalSymbol(left)
+	if ops == parser.ExprNone {
+		return lhs
+	}
+	compare := compareFunc(ops)
+	if right.Types == parser.ExprNum {
+		value, _ := strconv.ParseFloat(right.ExprNum, 64)
+		for _, rd := range lhs {
+			if compare(rd.Values(), value) {
+				matched = append(matched, rd)
+			}
+		}
+		return matched
+	}
+
+	rhs := map[string][]Series{}
+	for _, rd := range e.evalSymbol(right) {
+		if len(rd.Samples) > 0 {
+			k := matchKey(m, rd.Key)
+			rhs[k] = append(rhs[k], rd)
+		}
+	}
+	seen := map[string]bool{}
+	for _, l := range lhs {
+		if len(l.Samples) == 0 {
+			continue
+		}
+		for _, r := range rhs[matchKey(m, l.Key)] {
+			if !compare([]float64{newest(l)}, newest(r)) {
+				continue
+			}
+			rd := l
+			if m.GroupRight {
+				rd = r
+			}
+			if fp := rd.Key.Fingerprint(); !seen[fp] {
+				seen[fp] = true
+				matched = append(matched, rd)
+			}
+			if !m.GroupRight {
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// join combines the series matched so far with those of the joined
+// condition: and keeps those with a match on the other side, unless
+// those without, and or adds the other side's unmatched series.
+func join(j *parser.Join, lhs, rhs []Series) []Series {
+	m := j.Matching
+	keys := func(list []Series) map[string]bool {
+		set := map[string]bool{}
+		for _, rd := range list {
+			set[matchKey(m, rd.Key)] = true
+		}
+		return set
+	}
+	filter := func(list []Series, set map[string]bool, in bool) []Series {
+		kept := []Series{}
+		for _, rd := range list {
+			if set[matchKey(m, rd.Key)] == in {
+				kept = append(kept, rd)
+			}
+		}
+		return kept
+	}
+	switch j.Op {
+	case parser.ExprAnd:
+		if m.GroupRight {
+			return filter(rhs, keys(lhs), true)
+		}
+		return filter(lhs, keys(rhs), true)
+	case parser.ExprOr:
+		return append(lhs, filter(rhs, keys(lhs), false)...)
+	case parser.ExprUnless:
+		return filter(lhs, keys(rhs), false)
+	}
+	return lhs
+}
+
+func (e *evaluation) evaluateSeries(p *parser.Parser) []Series {
+	var matched []Series
+	if p.Left.Types == parser.ExprFunc && p.Left.Func == "absent" {
+		matched = []Series{}
+		for _, rl := range absent(p.Left.Selector(), e.evalSymbol(p.Left.Args[0])) {
+			matched = append(matched, Series{Key: rl, Samples: []Sample{}, sel: p.Left.Selector()})
+		}
+	} else {
+		matched = e.evalCond(p.Left, p.Ops, p.Right, p.Matching)
+	}
+	for _, j := range p.Joins {
+		c := j.Cond
+		matched = join(j, matched, e.evalCond(c.Left, c.Ops, c.Right, c.Matching))
+	}
+	return matched
+}
+
+// EvaluateSeries returns the series matching the rule's expression,
+// with the values they were compared on.
+func EvaluateSeries(p *parser.Parser, rdlist []Series) []Series {
+	e := &evaluation{rdlist: rdlist}
+	return e.evaluateSeries(p)
+}
+
+func Evaluate(p *parser.Parser, rdlist []Series) []ResourceLabel {
+	rllist := []ResourceLabel{}
+	for _, sr := range EvaluateSeries(p, rdlist) {
+		rllist = append(rllist, sr.Key)
 	}
 	return rllist
 }
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// parse parses a rule expression, failing the test on errors.
+func parse(t *testing.T, expr string) *parser.Parser {
+	t.Helper()
+	p, err := parser.ParseExpr(expr)
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	return p
+}
+
+func labelled(rl ResourceLabel, values ...float64) Series {
+	sr := series("", values...)
+	sr.Key = rl
+	return sr
+}
+
+// newestValues maps the series by fingerprint to their newest value.
+func newestValues(list []Series) map[string]float64 {
+	values := map[string]float64{}
+	for _, sr := range list {
+		values[sr.Key.Fingerprint()] = newest(sr)
+	}
+	return values
+}
+
+func TestAggregate(t *testing.T) {
+	cpu := []Series{
+		labelled(ResourceLabel{"vm": "i-1", "host": "h1"}, 95, 50),
+		labelled(ResourceLabel{"vm": "i-2", "host": "h1"}, 95),
+		labelled(ResourceLabel{"vm": "i-3", "host": "h2"}, 99),
+		labelled(ResourceLabel{"vm": "i-4", "host": "h2"}), // no samples
+	}
+	h1, h2 := `{host="h1"}`, `{host="h2"}`
+	tests := []struct {
+		expr string
+		want map[string]float64
+	}{
+		{"sum by (host) (vm.cpu)", map[string]float64{h1: 145, h2: 99}},
+		{"avg by (host) (vm.cpu)", map[string]float64{h1: 72.5, h2: 99}},
+		{"min by (host) (vm.cpu)", map[string]float64{h1: 50, h2: 99}},
+		{"max without (vm) (vm.cpu)", map[string]float64{h1: 95, h2: 99}},
+		{"count(vm.cpu)", map[string]float64{"{}": 3}},
+		{"sum(vm.cpu) by (host)", map[string]float64{h1: 145, h2: 99}},
+		{"topk by (host) (1, vm.cpu)", map[string]float64{
+			`{host="h1", vm="i-2"}`: 95, `{host="h2", vm="i-3"}`: 99}},
+		{"bottomk(2, vm.cpu)", map[string]float64{
+			`{host="h1", vm="i-1"}`: 50, `{host="h1", vm="i-2"}`: 95}},
+		// a series passes a comparison with a number if any value does
+		{"count by (host) (vm.cpu > 90)", map[string]float64{h1: 2, h2: 1}},
+		{"sum by (host) (vm.cpu < 90)", map[string]float64{h1: 50}},
+		{"count(vm.cpu > 100)", map[string]float64{}},
+		{"count by (host) (vm.cpu == 95)", map[string]float64{h1: 2}},
+		{"count(vm.cpu != 95)", map[string]float64{"{}": 2}},
+		{"topk(1, vm.cpu < 95)", map[string]float64{`{host="h1", vm="i-1"}`: 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got := newestValues(EvaluateRecord(parse(t, tt.expr), cpu))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateCondition(t *testing.T) {
+	var cpu []Series
+	for i, host := range []string{"h1", "h1", "h1", "h2", "h2"} {
+		cpu = append(cpu, labelled(ResourceLabel{"vm": fmt.Sprintf("i-%d", i), "host": host}, 95))
+	}
+	p := parse(t, "count by (host) (vm.cpu > 90) > 2")
+	got := Evaluate(p, cpu)
+	want := []ResourceLabel{{"host": "h1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if sels := p.Selectors(); len(sels) != 1 || sels[0].ExprVar != "vm.cpu" {
+		t.Errorf("selectors = %v, want vm.cpu", sels)
+	}
+}
+
+func TestAggregateConditionErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string // in the error
+	}{
+		{"avg_over_time(vm.cpu > 90) > 1", "takes no comparison"},
+		{"rate(vm.cpu[5m] > 1)", "takes no comparison"},
+		{"count(vm.cpu > 5m) > 1", "a duration is only a function argument"},
+		{"sum(vm.cpu > on(vm) 1)", "on or ignoring needs series on both sides"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p := &parser.Parser{Buffer: tt.expr}
+			p.Init()
+			if err := p.Parse(); err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			p.Execute()
+			if err := p.Err(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// fakeSource serves series by metric.
+type fakeSource map[string][]Series
+
+func (fs fakeSource) Query(ctx context.Context, q Query) ([]Series, error) {
+	series := []Series{}
+	for _, sr := range fs[q.Metric] {
+		sr.Samples = append([]Sample{}, sr.Samples...)
+		series = append(series, sr)
+	}
+	return series, nil
+}
+
+// correlated has a few metrics of three vms, the first with two interfaces.
+var correlated = fakeSource{
+	"vm.cpu": {
+		labelled(ResourceLabel{"vm": "vm1"}, 95),
+		labelled(ResourceLabel{"vm": "vm2"}, 50),
+		labelled(ResourceLabel{"vm": "vm3"}, 99),
+	},
+	"vm.memory": {
+		labelled(ResourceLabel{"vm": "vm1"}, 10),
+		labelled(ResourceLabel{"vm": "vm2"}, 80),
+	},
+	"vm.if_octets.rx": {
+		labelled(ResourceLabel{"vm": "vm1", "if": "tap1"}, 0.5),
+		labelled(ResourceLabel{"vm": "vm1", "if": "tap2"}, 1000),
+		labelled(ResourceLabel{"vm": "vm2", "if": "tap3"}, 0.1),
+		labelled(ResourceLabel{"vm": "vm3", "if": "tap4"}, 2000),
+	},
+}
+
+// evaluateKeys reads the series of expr from correlated and returns the
+// labels of those matching, in order.
+func evaluateKeys(t *testing.T, expr string) []string {
+	t.Helper()
+	p := parse(t, expr)
+	rdlist, err := Read(context.Background(), correlated, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, rl := range Evaluate(p, rdlist) {
+		keys = append(keys, rl.String())
+	}
+	return keys
+}
+
+func TestEvalCond(t *testing.T) {
+	vm1, vm2, vm3 := `{vm="vm1"}`, `{vm="vm2"}`, `{vm="vm3"}`
+	tap := func(vm, ifname string) string {
+		return fmt.Sprintf("{if=%q, vm=%q}", ifname, vm)
+	}
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"vm.cpu > 90", []string{vm1, vm3}},
+		{"vm.cpu <= 0", []string{}},
+		{"vm.cpu == 50", []string{vm2}},
+		{"vm.cpu != 50", []string{vm1, vm3}},
+		{"vm.cpu != vm.memory", []string{vm1, vm2}},
+		{"vm.cpu == vm.memory", []string{}},
+		// series on both sides are matched on all their labels by default
+		{"vm.cpu > vm.memory", []string{vm1}},
+		{"vm.cpu < vm.memory", []string{vm2}},
+		// one to many: the left series is kept once, if any match passes
+		{"vm.cpu > on(vm) vm.if_octets.rx", []string{vm1, vm2}},
+		{"vm.if_octets.rx < on(vm) group_left vm.cpu", []string{tap("vm1", "tap1"), tap("vm2", "tap3")}},
+		{"vm.cpu > on(vm) group_right vm.if_octets.rx", []string{tap("vm1", "tap1"), tap("vm2", "tap3")}},
+		{"vm.if_octets.rx > ignoring(if) vm.cpu", []string{tap("vm1", "tap2"), tap("vm3", "tap4")}},
+		// without matching labels, different label sets never match
+		{"vm.cpu > vm.if_octets.rx", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := evaluateKeys(t, tt.expr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCompare checks that every operator holds when any of the values
+// read compares true.
+func TestCompare(t *testing.T) {
+	values := []float64{1, 2, 2}
+	tests := []struct {
+		ops  parser.ExprTypes
+		want map[float64]bool // by value compared against
+	}{
+		{parser.ExprEq, map[float64]bool{0: false, 1: true, 2: true, 3: false}},
+		{parser.ExprNe, map[float64]bool{0: true, 1: true, 2: true, 3: true}},
+		{parser.ExprLt, map[float64]bool{0: false, 1: false, 2: true, 3: true}},
+		{parser.ExprLe, map[float64]bool{0: false, 1: true, 2: true, 3: true}},
+		{parser.ExprGt, map[float64]bool{0: true, 1: true, 2: false, 3: false}},
+		{parser.ExprGe, map[float64]bool{0: true, 1: true, 2: true, 3: false}},
+	}
+	for _, tt := range tests {
+		compare := compareFunc(tt.ops)
+		for val, want := range tt.want {
+			if got := compare(values, val); got != want {
+				t.Errorf("%v %v %v = %v, want %v", values, tt.ops, val, got, want)
+			}
+		}
+		if compare(nil, 0) {
+			t.Errorf("%v on no values holds", tt.ops)
+		}
+	}
+	// != needs a value that differs, not just one value
+	if compareNe([]float64{2, 2}, 2) {
+		t.Error("[2 2] != 2 holds")
+	}
+}
+
+func TestJoin(t *testing.T) {
+	vm1, vm2, vm3 := `{vm="vm1"}`, `{vm="vm2"}`, `{vm="vm3"}`
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		// cpu high and network near zero on the same vm
+		{"vm.cpu > 90 and on(vm) vm.if_octets.rx < 1", []string{vm1}},
+		{"vm.cpu > 90 && on(vm) vm.if_octets.rx < 1", []string{vm1}},
+		{"vm.cpu > 90 and on(vm) group_right vm.if_octets.rx < 1", []string{`{if="tap1", vm="vm1"}`}},
+		{"vm.cpu > 90 and vm.if_octets.rx < 1", []string{}},
+		{"vm.cpu > 90 and ignoring(if) vm.if_octets.rx > 1500", []string{vm3}},
+		{"vm.cpu > 90 or vm.memory > 50", []string{vm1, vm3, vm2}},
+		{"vm.cpu > 90 or vm.memory < 50", []string{vm1, vm3}},
+		{"vm.cpu > 90 unless on(vm) vm.if_octets.rx > 1500", []string{vm1}},
+		// applied left to right
+		{"vm.cpu > 0 and vm.memory > 0 and vm.cpu < 90", []string{vm2}},
+		{"vm.cpu > 90 and on(vm) vm.if_octets.rx < 1 or vm.memory > 50", []string{vm1, vm2}},
+		{"vm.cpu > 90 or vm.memory > 50 unless vm.cpu > 98", []string{vm1, vm2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if got := evaluateKeys(t, tt.expr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAbsent(t *testing.T) {
+	p := parse(t, `absent(vm.cpu{vm="vm1", if=~"tap.*"})`)
+	rule := Rule{ID: "test1[0]"}
+	tracker := NewAlertTracker()
+	t0 := time.Unix(1000, 0)
+	silent := series("vm1")
+	silent.LastSeen = t0
+	steps := []struct {
+		name string
+		read []Series
+		want []transition
+	}{
+		{"reporting", []Series{series("vm1", 1)}, []transition{}},
+		{"silent", []Series{silent}, []transition{{"vm1", StateFiring}}},
+		{"still silent", []Series{silent}, []transition{}},
+		{"expired", []Series{}, []transition{}},
+		{"back", []Series{series("vm1", 2)}, []transition{{"vm1", StateResolved}}},
+		{"reporting again", []Series{series("vm1", 3)}, []transition{}},
+	}
+	for i, step := range steps {
+		matched := EvaluateSeries(p, step.read)
+		got := transitions(tracker.Update(rule, matched, t0.Add(time.Duration(i)*time.Minute)))
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+		// only the equality matchers label the alert
+		for _, sr := range matched {
+			if !reflect.DeepEqual(sr.Key, ResourceLabel{"vm": "vm1"}) {
+				t.Errorf("%s: absent series labelled %v", step.name, sr.Key)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// AlertRecord is the persisted state of one pending or firing alert.
+type AlertRecord struct {
+	Rule       string        `json:"rule"` // rule ID
+	Labels     ResourceLabel `json:"labels"`
+	Metric     string        `json:"metric,omitempty"`
+	State      string        `json:"state"`
+	Values     []float64     `json:"values"` // last values read
+	ActiveAt   time.Time     `json:"activeAt"`
+	FiredAt    time.Time     `json:"firedAt,omitempty"`
+	NotifiedAt time.Time     `json:"notifiedAt,omitempty"`
+}
+
+// Snapshot returns the state of every pending and firing alert.
+func (t *AlertTracker) Snapshot() []AlertRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ids := make([]string, 0, len(t.alerts))
+	for id := range t.alerts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	records := []AlertRecord{}
+	for _, id := range ids {
+		for _, a := range t.active(id) {
+			records = append(records, AlertRecord{
+				Rule:       id,
+				Labels:     a.Key,
+				Metric:     a.Metric,
+				State:      a.State.String(),
+				Values:     a.Values,
+				ActiveAt:   a.ActiveAt,
+				FiredAt:    a.FiredAt,
+				NotifiedAt: a.NotifiedAt,
+			})
+		}
+	}
+	return records
+}
+
+// Restore brings back alerts from a snapshot, with their rule from rules
+// by ID, and returns how many it brought back: those of rules no longer
+// in rules are dropped, since nothing would ever evaluate them again.
+// Until graceUntil, restored alerts whose series have no data yet are
+// kept instead of resolved, and those that fired are not sent again.
+func (t *AlertTracker) Restore(records []AlertRecord, rules map[string]Rule, graceUntil time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.graceUntil = graceUntil
+	n := 0
+	for _, r := range records {
+		rule, ok := rules[r.Rule]
+		if !ok {
+			continue
+		}
+		state := StatePending
+		if r.State == StateFiring.String() {
+			state = StateFiring
+		}
+		alerts, ok := t.alerts[r.Rule]
+		if !ok {
+			alerts = map[string]*Alert{}
+			t.alerts[r.Rule] = alerts
+		}
+		n++
+		alerts[r.Labels.Fingerprint()] = &Alert{
+			Rule:       rule,
+			Key:        r.Labels,
+			Metric:     r.Metric,
+			Values:     r.Values,
+			State:      state,
+			ActiveAt:   r.ActiveAt,
+			FiredAt:    r.FiredAt,
+			NotifiedAt: r.NotifiedAt,
+			restored:   true,
+		}
+	}
+	return n
+}
+
+// StateStore keeps the alert state across restarts.
+type StateStore interface {
+	Save(records []AlertRecord) error
+	Load() ([]AlertRecord, error)
+}
+
+// StateFile keeps the state as JSON in a local file.
+type StateFile struct {
+	Path string
+}
+
+func (f *StateFile) Save(records []AlertRecord) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := f.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.Path)
+}
+
+func (f *StateFile) Load() ([]AlertRecord, error) {
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []AlertRecord
+	err = json.Unmarshal(b, &records)
+	return records, err
+}
+
+// StateKey is where RedisState keeps the state, as JSON.
+const StateKey = "policyengine:alerts"
+
+// RedisState keeps the state in redis.
+type RedisState struct {
+	client *redis.Client
+	Key    string // StateKey if empty
+}
+
+func (s *RedisState) key() string {
+	if s.Key == "" {
+		return StateKey
+	}
+	return s.Key
+}
+
+func NewRedisState(opts *redis.Options) *RedisState {
+	return &RedisState{client: redis.NewClient(opts)}
+}
+
+func (s *RedisState) Save(records []AlertRecord) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(s.key(), string(b), 0).Err()
+}
+
+func (s *RedisState) Load() ([]AlertRecord, error) {
+	v, err := s.client.Get(s.key()).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var records []AlertRecord
+	err = json.Unmarshal([]byte(v), &records)
+	return records, err
+}
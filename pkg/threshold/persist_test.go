@@ -0,0 +1,138 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+)
+
+func testRecords() []AlertRecord {
+	t0 := time.Unix(1000, 0).UTC()
+	return []AlertRecord{
+		{Rule: "test1[0]", Labels: ResourceLabel{"vm": "vm1", "if": "tap0"}, Metric: "vm.if_octets.rx", State: "firing",
+			Values: []float64{1.5}, ActiveAt: t0, FiredAt: t0.Add(time.Minute), NotifiedAt: t0.Add(2 * time.Minute)},
+		{Rule: "test1[0]:nodata", Labels: ResourceLabel{"vm": "vm2"}, Metric: "vm.cpu", State: "pending",
+			Values: []float64{}, ActiveAt: t0},
+	}
+}
+
+func TestRestoreUnknownRule(t *testing.T) {
+	tracker := NewAlertTracker()
+	t0 := time.Unix(1000, 0)
+	rules := map[string]Rule{"test1[0]": {ID: "test1[0]"}}
+	records := []AlertRecord{
+		{Rule: "test1[0]", Labels: ResourceLabel{"vm": "vm1"}, State: "firing", ActiveAt: t0, FiredAt: t0},
+		{Rule: "gone[0]", Labels: ResourceLabel{"vm": "vm1"}, State: "firing", ActiveAt: t0, FiredAt: t0},
+		{Rule: "gone[0]", Labels: ResourceLabel{"vm": "vm2"}, State: "pending", ActiveAt: t0},
+	}
+	if n := tracker.Restore(records, rules, t0.Add(time.Minute)); n != 1 {
+		t.Errorf("restored %d alerts, want 1", n)
+	}
+	got := []string{}
+	for _, a := range tracker.Firing() {
+		got = append(got, a.Rule.ID+" "+a.Key["vm"])
+	}
+	if want := []string{"test1[0] vm1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("firing = %v, want %v", got, want)
+	}
+	if snap := tracker.Snapshot(); len(snap) != 1 || snap[0].Rule != "test1[0]" {
+		t.Errorf("snapshot = %+v", snap)
+	}
+}
+
+// roundTrip saves the records to s, loads them back and restores them
+// into a tracker whose snapshot must give them back again.
+func roundTrip(t *testing.T, s StateStore) {
+	t.Helper()
+	if records, err := s.Load(); err != nil || records != nil {
+		t.Fatalf("Load before Save = %v, %v", records, err)
+	}
+	want := testRecords()
+	if err := s.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Load = %+v, want %+v", got, want)
+	}
+
+	tracker := NewAlertTracker()
+	rules := map[string]Rule{"test1[0]": {ID: "test1[0]"}, "test1[0]:nodata": {ID: "test1[0]:nodata"}}
+	tracker.Restore(got, rules, time.Time{})
+	if snap := tracker.Snapshot(); !reflect.DeepEqual(snap, want) {
+		t.Errorf("Snapshot after Restore = %+v, want %+v", snap, want)
+	}
+
+	// saving again replaces the state
+	if err := s.Save(want[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Load(); err != nil || !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("Load after the second Save = %+v, %v", got, err)
+	}
+}
+
+func TestStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "alerts.json")
+	roundTrip(t, &StateFile{Path: path})
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&StateFile{Path: path}).Load(); err == nil {
+		t.Error("no error on a corrupt state file")
+	}
+}
+
+func TestRedisState(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	roundTrip(t, NewRedisState(&redis.Options{Addr: m.Addr()}))
+	if !m.Exists(StateKey) {
+		t.Errorf("nothing at %s", StateKey)
+	}
+
+	// shards keep their state apart
+	shard := NewRedisState(&redis.Options{Addr: m.Addr()})
+	shard.Key = StateKey + ":engine-2"
+	if records, err := shard.Load(); err != nil || records != nil {
+		t.Errorf("Load of another key = %v, %v", records, err)
+	}
+}
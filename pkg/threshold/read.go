@@ -17,58 +17,70 @@
 package threshold
 
 import (
-	"fmt"
-	"os"
+	"context"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
 	"github.com/go-redis/redis"
 )
 
 // e.g. collectd/instance-00000001/virt/if_octets-tapd21acb51-35
 // const redisKey = "collectd/*/virt/if_octets-*"
 
-func zrangebyscore(client *redis.Client, key string, index int) []float64 {
-
-	unixNow := int(time.Now().Unix())
-	interval := 60
+func zrangebyscore(client *redis.Client, key string, index int, start, end time.Time) ([]Sample, error) {
 
 	val, err := client.ZRangeByScore(key, redis.ZRangeBy{
-		Min: strconv.Itoa(unixNow - interval),
-		Max: strconv.Itoa(unixNow),
+		Min: strconv.FormatInt(start.Unix(), 10),
+		Max: strconv.FormatInt(end.Unix(), 10),
 	}).Result()
 
-	datalist := []float64{}
+	samples := []Sample{}
 
 	if err == redis.Nil {
-		fmt.Println("this key is not exist")
-		os.Exit(1)
+		return samples, nil
 	} else if err != nil {
-		panic(err)
-	} else {
-		for _, strVal := range val {
-			split := strings.Split(strVal, ":")
-			txVal := split[index+1] // First elem is time
-			floatVal, err := strconv.ParseFloat(txVal, 64)
-			if err != nil {
-				os.Exit(1)
-			}
-			datalist = append(datalist, floatVal)
+		return nil, err
+	}
+	for _, strVal := range val {
+		split := strings.Split(strVal, ":")
+		if len(split) <= index+1 {
+			continue
+		}
+		txVal := split[index+1] // First elem is time
+		floatVal, err := strconv.ParseFloat(txVal, 64)
+		if err != nil {
+			continue
+		}
+		unixTime, err := strconv.ParseFloat(split[0], 64)
+		if err != nil {
+			continue
 		}
+		samples = append(samples, Sample{Time: unixToTime(unixTime), Value: floatVal})
 	}
-	return datalist
+	return samples, nil
 }
 
-var client = redis.NewClient(&redis.Options{
-	Addr:     "localhost:6379",
-	Password: "",
-	DB:       0,
-})
+// lastScore returns the time of the newest sample stored under key,
+// however old it is.
+func lastScore(client *redis.Client, key string) (time.Time, error) {
+	val, err := client.ZRevRangeWithScores(key, 0, 0).Result()
+	if err == redis.Nil || len(val) == 0 {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return unixToTime(val[0].Score), nil
+}
+
+func unixToTime(t float64) time.Time {
+	return time.Unix(0, int64(t*float64(time.Second)))
+}
 
-func Read(p *parser.Parser) []rawData {
-	field := p.Left.ExprVar
+// MetricKey maps a metric name such as vm.if_octets.rx onto the redis key
+// pattern and the index of the value within each "time:value:..." member.
+func MetricKey(field string) (string, int) {
 	redisKey := strings.Replace(field, "vm.", "virt/", 1)
 
 	index := -1
@@ -81,24 +93,115 @@ func Read(p *parser.Parser) []rawData {
 	} else {
 		index = 0
 	}
+	return redisKey, index
+}
+
+// KeyLabels extracts the resource labels from a collectd redis key.
+func KeyLabels(key string) (ResourceLabel, bool) {
+	subkeys := strings.Split(key, "/")
+	if len(subkeys) < 4 {
+		return nil, false
+	}
+	if _, rl, ok := recordLabels(subkeys); ok && len(subkeys) == 4 {
+		return rl, true
+	}
+	subsubkeys := strings.SplitN(subkeys[3], "-", 2)
+	if strings.HasPrefix(subsubkeys[0], "if_") && len(subsubkeys) == 2 {
+		return ResourceLabel{"vm": subkeys[1], "if": subsubkeys[1]}, true
+	}
+	return ResourceLabel{"vm": subkeys[1]}, true
+}
+
+// SeriesLabels returns the resource labels of a key found for metric,
+// and false if the key does not hold it after all: the keys of recorded
+// series hold their exact record name only, not those it is part of.
+func SeriesLabels(key, metric string) (ResourceLabel, bool) {
+	if subkeys := strings.Split(key, "/"); len(subkeys) == 4 {
+		if record, rl, ok := recordLabels(subkeys); ok {
+			return rl, record == metric
+		}
+	}
+	return KeyLabels(key)
+}
+
+// RedisClient hands out clients of one redis whose read and write
+// timeouts end with the deadline of the call's context, since go-redis
+// commands do not give up when their context is done. Clients are kept
+// per timeout, rounded up to the second.
+type RedisClient struct {
+	opts redis.Options
+
+	mu      sync.Mutex
+	clients map[time.Duration]*redis.Client
+}
+
+func NewRedisClient(opts *redis.Options) *RedisClient {
+	return &RedisClient{opts: *opts, clients: map[time.Duration]*redis.Client{}}
+}
+
+// For returns the client to run commands within ctx with.
+func (c *RedisClient) For(ctx context.Context) *redis.Client {
+	var timeout time.Duration // the options' own without a deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Second
+		if left := time.Until(deadline); left > timeout {
+			timeout = (left + time.Second - 1).Truncate(time.Second)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.clients[timeout]
+	if !ok {
+		opts := c.opts
+		if timeout > 0 {
+			opts.ReadTimeout, opts.WriteTimeout = timeout, timeout
+		}
+		client = redis.NewClient(&opts)
+		c.clients[timeout] = client
+	}
+	return client.WithContext(ctx)
+}
+
+// RedisSource reads the sorted sets written by collectd's write_redis plugin.
+type RedisSource struct {
+	client *RedisClient
+}
+
+func NewRedisSource(opts *redis.Options) *RedisSource {
+	return &RedisSource{client: NewRedisClient(opts)}
+}
+
+func (rs *RedisSource) Query(ctx context.Context, q Query) ([]Series, error) {
+	redisKey, index := MetricKey(q.Metric)
+	client := rs.client.For(ctx)
 
 	keys, err := client.Keys("*" + redisKey + "*").Result()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	rdlist := []rawData{}
+	series := []Series{}
 
 	for _, key := range keys {
-		datalist := zrangebyscore(client, key, index)
-		subkeys := strings.Split(key, "/")
-		subsubkeys := strings.SplitN(subkeys[3], "-", 2)
-		if strings.HasPrefix(subsubkeys[0], "if_") {
-			rdlist = append(rdlist, rawData{key: ResourceLabel{VM: subkeys[1], IF: subsubkeys[1]}, datalist: datalist})
-		} else {
-			rdlist = append(rdlist, rawData{key: ResourceLabel{VM: subkeys[1], IF: ""}, datalist: datalist})
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rl, ok := SeriesLabels(key, q.Metric)
+		if !ok || !MatchLabels(q.Matchers, rl) {
+			continue
+		}
+		samples, err := zrangebyscore(client, key, index, q.Start, q.End)
+		if err != nil {
+			return nil, err
+		}
+		lastSeen := time.Time{}
+		if len(samples) > 0 {
+			lastSeen = samples[len(samples)-1].Time
+		} else if lastSeen, err = lastScore(client, key); err != nil {
+			return nil, err
 		}
+		series = append(series, Series{Key: rl, Samples: samples, LastSeen: lastSeen})
 	}
 
-	return rdlist
+	return series, nil
 }
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRedisClientFor(t *testing.T) {
+	c := NewRedisClient(&redis.Options{Addr: "localhost:0", ReadTimeout: time.Minute})
+	tests := []struct {
+		name    string
+		timeout time.Duration // of the context, none if 0
+		want    time.Duration
+	}{
+		{"no deadline", 0, time.Minute},
+		{"rounded up", 2500 * time.Millisecond, 3 * time.Second},
+		{"whole seconds", 10 * time.Second, 10 * time.Second},
+		{"at least a second", time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				// a little slack, as time passes before For looks
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout-time.Millisecond/2)
+				defer cancel()
+			}
+			opts := c.For(ctx).Options()
+			if opts.ReadTimeout != tt.want || (tt.timeout > 0 && opts.WriteTimeout != tt.want) {
+				t.Errorf("timeouts %v/%v, want %v", opts.ReadTimeout, opts.WriteTimeout, tt.want)
+			}
+		})
+	}
+	if a, b := c.For(context.Background()), c.For(context.Background()); a.Options() != b.Options() {
+		t.Error("clients of the same timeout not shared")
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/go-redis/redis"
+)
+
+// RecordRetention is how long recorded samples are kept in redis.
+const RecordRetention = time.Hour
+
+// recordPlugin is the collectd plugin name recorded series are stored under.
+const recordPlugin = "policyengine"
+
+// Recording reports whether the expression computes series to record
+// rather than a condition to alert on, e.g. rate(vm.if_octets.rx[5m]).
+func Recording(p *parser.Parser) bool {
+	return p.Ops == parser.ExprNone && len(p.Joins) == 0 && !(p.Left.Types == parser.ExprFunc && Predicate(p.Left.Func))
+}
+
+// Metrics returns the names of every metric the expression reads.
+func Metrics(p *parser.Parser) []string {
+	names := []string{}
+	for _, sel := range p.Selectors() {
+		names = append(names, sel.ExprVar)
+	}
+	return names
+}
+
+// EvaluateRecord computes the series a recording expression stands for,
+// each with its newest value only.
+func EvaluateRecord(p *parser.Parser, rdlist []Series) []Series {
+	e := &evaluation{rdlist: rdlist}
+	return e.evaluateRecord(p)
+}
+
+func (e *evaluation) evaluateRecord(p *parser.Parser) []Series {
+	result := []Series{}
+	for _, sr := range e.evalSymbol(p.Left) {
+		if len(sr.Samples) == 0 {
+			continue
+		}
+		sr.Samples = sr.Samples[len(sr.Samples)-1:]
+		result = append(result, sr)
+	}
+	return result
+}
+
+// RecordKey is where a series recorded under the name record is kept, in
+// collectd's key format so that rules can read it back by that name: the
+// vm label is the host, the if label the plugin instance and the other
+// labels follow the record name as a query string, e.g.
+// collectd/instance-00000001/policyengine-tapd21acb51-35/rx_rate or
+// collectd//policyengine/rx_total?host=compute-1. Names and values are
+// escaped so that KeyLabels gets every label back as it was.
+func RecordKey(record string, key ResourceLabel) string {
+	plugin := recordPlugin
+	if key["if"] != "" {
+		plugin += "-" + url.PathEscape(key["if"])
+	}
+	name := url.PathEscape(record)
+	rest := url.Values{}
+	for k, v := range key {
+		if k != "vm" && k != "if" && v != "" {
+			rest.Set(k, v)
+		}
+	}
+	if len(rest) > 0 {
+		name += "?" + rest.Encode()
+	}
+	return fmt.Sprintf("collectd/%s/%s/%s", url.PathEscape(key["vm"]), plugin, name)
+}
+
+// recordLabels parses the parts of a key RecordKey made, returning the
+// record name and labels; ok is false for other keys.
+func recordLabels(subkeys []string) (record string, rl ResourceLabel, ok bool) {
+	plugin := subkeys[2]
+	if plugin != recordPlugin && !strings.HasPrefix(plugin, recordPlugin+"-") {
+		return "", nil, false
+	}
+	rl = ResourceLabel{}
+	if vm, err := url.PathUnescape(subkeys[1]); err == nil && vm != "" {
+		rl["vm"] = vm
+	}
+	if inst := strings.TrimPrefix(plugin, recordPlugin+"-"); inst != plugin {
+		if ifname, err := url.PathUnescape(inst); err == nil && ifname != "" {
+			rl["if"] = ifname
+		}
+	}
+	name := subkeys[3]
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		if rest, err := url.ParseQuery(name[i+1:]); err == nil {
+			for k, v := range rest {
+				rl[k] = v[0]
+			}
+		}
+		name = name[:i]
+	}
+	record, err := url.PathUnescape(name)
+	if err != nil {
+		record = name
+	}
+	return record, rl, true
+}
+
+// Writer is implemented by the datasources recording rules can write
+// their series into.
+type Writer interface {
+	Write(ctx context.Context, record string, series []Series, now time.Time) error
+}
+
+// Write adds the series as samples at now, in the "time:value" members
+// collectd's write_redis plugin uses. Samples older than RecordRetention
+// are trimmed, and series no longer recorded expire after it.
+func (rs *RedisSource) Write(ctx context.Context, record string, series []Series, now time.Time) error {
+	ts := float64(now.UnixNano()) / 1e9
+	oldest := float64(now.Add(-RecordRetention).UnixNano()) / 1e9
+	_, err := rs.client.For(ctx).Pipelined(func(pipe redis.Pipeliner) error {
+		for _, sr := range series {
+			key := RecordKey(record, sr.Key)
+			value := sr.Samples[len(sr.Samples)-1].Value
+			pipe.ZAdd(key, redis.Z{Score: ts, Member: fmt.Sprintf("%.3f:%g", ts, value)})
+			pipe.ZRemRangeByScore(key, "-inf", fmt.Sprintf("(%f", oldest))
+			pipe.Expire(key, RecordRetention)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		labels ResourceLabel
+		key    string
+	}{
+		{"vm and if", "rx_rate", ResourceLabel{"vm": "instance-00000001", "if": "tapd21acb51-35"},
+			"collectd/instance-00000001/policyengine-tapd21acb51-35/rx_rate"},
+		{"vm only", "rx_rate", ResourceLabel{"vm": "instance-00000001"},
+			"collectd/instance-00000001/policyengine/rx_rate"},
+		{"other labels", "rx_total", ResourceLabel{"host": "compute-1"},
+			"collectd//policyengine/rx_total?host=compute-1"},
+		{"all of them, sorted", "rx_total", ResourceLabel{"vm": "i-1", "if": "tap0", "zone": "a", "host": "c 1"},
+			"collectd/i-1/policyengine-tap0/rx_total?host=c+1&zone=a"},
+		{"escaped", "a/b", ResourceLabel{"vm": "x/y", "if": "t?", "k": "v&w=z"},
+			"collectd/x%2Fy/policyengine-t%3F/a%2Fb?k=v%26w%3Dz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := RecordKey(tt.record, tt.labels)
+			if key != tt.key {
+				t.Errorf("RecordKey = %q, want %q", key, tt.key)
+			}
+			rl, ok := SeriesLabels(key, tt.record)
+			if !ok || !reflect.DeepEqual(rl, tt.labels) {
+				t.Errorf("SeriesLabels = %v, %v; want %v", rl, ok, tt.labels)
+			}
+			if rl, ok := KeyLabels(key); !ok || !reflect.DeepEqual(rl, tt.labels) {
+				t.Errorf("KeyLabels = %v, %v; want %v", rl, ok, tt.labels)
+			}
+		})
+	}
+}
+
+func TestSeriesLabels(t *testing.T) {
+	tests := []struct {
+		key, metric string
+		want        ResourceLabel // nil if the key does not hold metric
+	}{
+		{"collectd/i-1/policyengine/rx_rate", "rx_rate", ResourceLabel{"vm": "i-1"}},
+		{"collectd/i-1/policyengine/rx_rate_max", "rx_rate", nil},
+		{"collectd/i-1/policyengine-tap0/my_rx_rate", "rx_rate", nil},
+		{"collectd/i-1/policyengine/rx_rate?host=c1", "rx_rate", ResourceLabel{"vm": "i-1", "host": "c1"}},
+		{"collectd/instance-00000001/virt/if_octets-tapd21acb51-35", "vm.if_octets.rx",
+			ResourceLabel{"vm": "instance-00000001", "if": "tapd21acb51-35"}},
+		{"collectd/instance-00000001/virt/memory-total", "vm.memory", ResourceLabel{"vm": "instance-00000001"}},
+	}
+	for _, tt := range tests {
+		rl, ok := SeriesLabels(tt.key, tt.metric)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("SeriesLabels(%q, %q) = %v, want no match", tt.key, tt.metric, rl)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(rl, tt.want) {
+			t.Errorf("SeriesLabels(%q, %q) = %v, %v; want %v", tt.key, tt.metric, rl, ok, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+)
+
+// seasonal are the functions comparing the mean of each series in the
+// window with its mean in the same window one period earlier, the
+// baseline, given both means; false drops the series.
+var seasonal = map[string]func(current, baseline float64) (float64, bool){
+	"seasonal_ratio": func(current, baseline float64) (float64, bool) {
+		if baseline == 0 {
+			return 0, false
+		}
+		return current / baseline, true
+	},
+	"seasonal_delta": func(current, baseline float64) (float64, bool) {
+		return current - baseline, true
+	},
+}
+
+// baseline returns the series read one period earlier for a seasonal call.
+func (e *evaluation) baseline(s *parser.ExprSymbol) []Series {
+	series := []Series{}
+	for _, rd := range e.rdlist {
+		if rd.sel == s.Args[0] && rd.shift == s.Args[1].ExprDur {
+			series = append(series, rd)
+		}
+	}
+	return series
+}
+
+// compareSeasons applies f to the means of each series with samples in
+// both the current and the baseline window.
+func compareSeasons(f func(current, baseline float64) (float64, bool), current, baseline []Series) []Series {
+	base := map[string][]float64{}
+	for _, rd := range baseline {
+		if len(rd.Samples) > 0 {
+			base[rd.Key.Fingerprint()] = rd.Values()
+		}
+	}
+	result := []Series{}
+	for _, rd := range current {
+		values, ok := base[rd.Key.Fingerprint()]
+		if len(rd.Samples) == 0 || !ok {
+			continue
+		}
+		cur := rd.Values()
+		if v, ok := f(sum(cur)/float64(len(cur)), sum(values)/float64(len(values))); ok {
+			result = append(result, single(rd, v))
+		}
+	}
+	return result
+}
+
+// hwModel is the double exponential smoothing of one series: its
+// smoothed level and trend after the samples fed so far.
+type hwModel struct {
+	level float64
+	trend float64
+	last  time.Time // of the newest sample fed
+	n     int       // samples fed, counted up to 2
+}
+
+// feed updates the model with the samples newer than those already fed,
+// each weighing sf in the level and tf in the trend.
+func (m *hwModel) feed(samples []Sample, sf, tf float64) {
+	for _, sm := range samples {
+		if m.n > 0 && !sm.Time.After(m.last) {
+			continue
+		}
+		switch m.n {
+		case 0:
+			m.level = sm.Value
+		case 1:
+			m.trend = sm.Value - m.level
+			fallthrough
+		default:
+			prev := m.level
+			m.level = sf*sm.Value + (1-sf)*(m.level+m.trend)
+			m.trend = tf*(m.level-prev) + (1-tf)*m.trend
+		}
+		if m.n < 2 {
+			m.n++
+		}
+		m.last = sm.Time
+	}
+}
+
+// holtWinters is the smoothed level of each series with at least two
+// samples, the smoothing factor sf and trend factor tf both in (0, 1).
+// The models of the previous evaluation, when kept, go on from where
+// they were; otherwise each starts from the oldest sample in the window.
+func (e *evaluation) holtWinters(s *parser.ExprSymbol, rdlist []Series) []Series {
+	sf, tf := numArg(s, 1), numArg(s, 2)
+	call := e.calls
+	e.calls++
+	result := []Series{}
+	if sf <= 0 || sf >= 1 || tf <= 0 || tf >= 1 {
+		return result
+	}
+	for _, rd := range rdlist {
+		m := &hwModel{}
+		if e.kept != nil {
+			id := fmt.Sprintf("%d/%s", call, rd.Key.Fingerprint())
+			if old, ok := e.models[id]; ok {
+				m = old
+			}
+			e.kept[id] = m
+		}
+		m.feed(rd.Samples, sf, tf)
+		if m.n < 2 || len(rd.Samples) == 0 {
+			continue
+		}
+		result = append(result, single(rd, m.level))
+	}
+	return result
+}
+
+// ModelTracker keeps, per rule, the holt_winters model of each series
+// between evaluations, so that only the samples read since the previous
+// one are fed to it. Models of series no longer read are dropped.
+type ModelTracker struct {
+	mu    sync.Mutex
+	rules map[string]map[string]*hwModel
+}
+
+func NewModelTracker() *ModelTracker {
+	return &ModelTracker{rules: map[string]map[string]*hwModel{}}
+}
+
+// evaluate runs f on an evaluation of rdlist with the models of rule,
+// which a rule does not evaluate twice at once.
+func (t *ModelTracker) evaluate(rule string, rdlist []Series, f func(e *evaluation) []Series) []Series {
+	t.mu.Lock()
+	e := &evaluation{rdlist: rdlist, models: t.rules[rule], kept: map[string]*hwModel{}}
+	t.mu.Unlock()
+
+	result := f(e)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(e.kept) == 0 {
+		delete(t.rules, rule)
+	} else {
+		t.rules[rule] = e.kept
+	}
+	return result
+}
+
+// EvaluateSeries is EvaluateSeries for rule, keeping its models.
+func (t *ModelTracker) EvaluateSeries(rule string, p *parser.Parser, rdlist []Series) []Series {
+	return t.evaluate(rule, rdlist, func(e *evaluation) []Series {
+		return e.evaluateSeries(p)
+	})
+}
+
+// EvaluateRecord is EvaluateRecord for rule, keeping its models.
+func (t *ModelTracker) EvaluateRecord(rule string, p *parser.Parser, rdlist []Series) []Series {
+	return t.evaluate(rule, rdlist, func(e *evaluation) []Series {
+		return e.evaluateRecord(p)
+	})
+}
+
+// Forget drops the models of rule, e.g. once another engine evaluates it.
+func (t *ModelTracker) Forget(rule string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rules, rule)
+}
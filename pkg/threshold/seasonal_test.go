@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// samples returns values one second apart from time 0.
+func samples(values ...float64) []Sample {
+	return series("", values...).Samples
+}
+
+func TestHWModelFeed(t *testing.T) {
+	type state struct {
+		level, trend float64
+		n            int
+	}
+	tests := []struct {
+		name  string
+		feeds [][]Sample
+		want  state
+	}{
+		{"one sample", [][]Sample{samples(10)}, state{10, 0, 1}},
+		{"two samples", [][]Sample{samples(10, 12)}, state{12, 2, 2}},
+		{"linear", [][]Sample{samples(10, 12, 14)}, state{14, 2, 2}},
+		{"flat", [][]Sample{samples(5, 5, 5)}, state{5, 0, 2}},
+		{"smoothed", [][]Sample{samples(10, 12, 20)}, state{17, 3.5, 2}},
+		// samples already fed are skipped
+		{"fed again", [][]Sample{samples(10, 12), samples(10, 12, 14)}, state{14, 2, 2}},
+		{"out of order", [][]Sample{{{Time: time.Unix(1, 0), Value: 10}, {Time: time.Unix(0, 0), Value: 50}}}, state{10, 0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &hwModel{}
+			for _, feed := range tt.feeds {
+				m.feed(feed, 0.5, 0.5)
+			}
+			if got := (state{m.level, m.trend, m.n}); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHoltWintersModels(t *testing.T) {
+	p := parse(t, "holt_winters(vm.cpu, 0.5, 0.5)")
+	tracker := NewModelTracker()
+	window := func(from int, values ...float64) []Series {
+		sr := series("vm1")
+		for i, v := range values {
+			sr.Samples = append(sr.Samples, Sample{Time: time.Unix(int64(from+i), 0), Value: v})
+		}
+		return []Series{sr}
+	}
+
+	// the second evaluation goes on from the model of the first, as if
+	// fed 10, 12, 20 at once, although its window starts at 12
+	tracker.EvaluateRecord("test1[0]", p, window(0, 10, 12))
+	got := newestValues(tracker.EvaluateRecord("test1[0]", p, window(1, 12, 20)))
+	if want := map[string]float64{`{vm="vm1"}`: 17}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept model: got %v, want %v", got, want)
+	}
+	// without a kept model, the window alone is fed
+	got = newestValues(EvaluateRecord(p, window(1, 12, 20)))
+	if want := map[string]float64{`{vm="vm1"}`: 20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no model: got %v, want %v", got, want)
+	}
+	tracker.Forget("test1[0]")
+	got = newestValues(tracker.EvaluateRecord("test1[0]", p, window(2, 20)))
+	if len(got) != 0 {
+		t.Errorf("forgotten model with one sample: got %v", got)
+	}
+}
+
+func TestSeasonal(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	// a sample in the window and one in the same window a day earlier
+	seasons := func(vm string, baseline, current float64) Series {
+		sr := Series{Key: ResourceLabel{"vm": vm}}
+		if !math.IsNaN(baseline) {
+			sr.Samples = append(sr.Samples, Sample{Time: now.Add(-day - 30*time.Second), Value: baseline})
+		}
+		sr.Samples = append(sr.Samples, Sample{Time: now.Add(-30 * time.Second), Value: current})
+		return sr
+	}
+	ds := timedSource{"vm.cpu": {
+		seasons("vm1", 10, 15),
+		seasons("vm2", 20, 10),
+		seasons("vm3", 0, 5),
+		seasons("vm4", math.NaN(), 5), // no baseline
+	}}
+	tests := []struct {
+		expr string
+		want map[string]float64
+	}{
+		{"seasonal_ratio(vm.cpu[1m], 1d)", map[string]float64{`{vm="vm1"}`: 1.5, `{vm="vm2"}`: 0.5}},
+		{"seasonal_delta(vm.cpu[1m], 1d)", map[string]float64{`{vm="vm1"}`: 5, `{vm="vm2"}`: -10, `{vm="vm3"}`: 5}},
+		{"seasonal_ratio(vm.cpu[1m], 1h)", map[string]float64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			p := parse(t, tt.expr)
+			rdlist, err := Read(context.Background(), ds, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := newestValues(EvaluateRecord(p, rdlist)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	p := parse(t, "seasonal_ratio(vm.cpu[1m], 1d) > 1.2")
+	rdlist, err := Read(context.Background(), ds, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Evaluate(p, rdlist), []ResourceLabel{{"vm": "vm1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Evaluate = %v, want %v", got, want)
+	}
+}
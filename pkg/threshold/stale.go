@@ -0,0 +1,158 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StaleSeries is a series that stopped reporting.
+type StaleSeries struct {
+	Key      ResourceLabel
+	Metric   string // "" if unknown
+	LastSeen time.Time
+}
+
+type seriesState struct {
+	key      ResourceLabel
+	metric   string
+	lastSeen time.Time
+}
+
+// MetricLabel is the label nodata alerts carry the metric of their
+// series under.
+const MetricLabel = "metric"
+
+// StaleRetention is how long a series that stopped reporting is
+// remembered; its nodata alert then resolves.
+const StaleRetention = 24 * time.Hour
+
+// StaleTracker remembers, per rule, when each series last reported a
+// sample, so that series which existed earlier but stopped updating are
+// still noticed once their keys expire from redis. Series are told apart
+// by metric and labels, as a rule may read several metrics.
+type StaleTracker struct {
+	mu    sync.Mutex
+	rules map[string]map[string]*seriesState
+}
+
+func NewStaleTracker() *StaleTracker {
+	return &StaleTracker{rules: map[string]map[string]*seriesState{}}
+}
+
+// Update records the newest sample time of every series read for rule,
+// and drops those that have not reported for StaleRetention. Series read
+// with an offset or as a seasonal baseline are left out: they tell
+// nothing of whether the series still reports.
+func (t *StaleTracker) Update(rule string, rdlist []Series, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	series, ok := t.rules[rule]
+	if !ok {
+		series = map[string]*seriesState{}
+		t.rules[rule] = series
+	}
+	for _, rd := range rdlist {
+		if rd.LastSeen.IsZero() || rd.shifted() {
+			continue
+		}
+		fp := rd.Metric() + rd.Key.Fingerprint()
+		if st, ok := series[fp]; !ok {
+			series[fp] = &seriesState{key: rd.Key, metric: rd.Metric(), lastSeen: rd.LastSeen}
+		} else if rd.LastSeen.After(st.lastSeen) {
+			st.lastSeen = rd.LastSeen
+		}
+	}
+	for fp, st := range series {
+		if now.Sub(st.lastSeen) >= StaleRetention {
+			delete(series, fp)
+		}
+	}
+}
+
+// Forget drops the series of rule that keep rejects, all of them if keep
+// is nil, e.g. once another engine evaluates them.
+func (t *StaleTracker) Forget(rule string, keep func(ResourceLabel) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fp, st := range t.rules[rule] {
+		if keep == nil || !keep(st.key) {
+			delete(t.rules[rule], fp)
+		}
+	}
+}
+
+// Stale returns the series of rule that have not reported for at least after.
+func (t *StaleTracker) Stale(rule string, after time.Duration, now time.Time) []StaleSeries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stale := []StaleSeries{}
+	for _, st := range t.rules[rule] {
+		if now.Sub(st.lastSeen) >= after {
+			stale = append(stale, StaleSeries{Key: st.key, Metric: st.metric, LastSeen: st.lastSeen})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		if stale[i].Metric != stale[j].Metric {
+			return stale[i].Metric < stale[j].Metric
+		}
+		return stale[i].Key.Fingerprint() < stale[j].Key.Fingerprint()
+	})
+	return stale
+}
+
+// NoData returns the rule raising, as its alerts, the series of r that
+// have not reported for after.
+func (r Rule) NoData(after time.Duration) Rule {
+	r.ID += ":nodata"
+	r.For = 0
+	r.Threshold = ""
+	r.NoDataAfter = after
+	return r
+}
+
+// NoDataSeries returns stale series as the series a nodata rule matches,
+// labelled with their metric so that the series of different metrics
+// raise alerts of their own.
+func NoDataSeries(stale []StaleSeries) []Series {
+	series := []Series{}
+	for _, s := range stale {
+		key := ResourceLabel{}
+		for name, value := range s.Key {
+			key[name] = value
+		}
+		if s.Metric != "" {
+			key[MetricLabel] = s.Metric
+		}
+		series = append(series, Series{Key: key, Samples: []Sample{}, LastSeen: s.LastSeen})
+	}
+	return series
+}
+
+// NoDataKey returns the labels of the series a nodata alert was raised
+// on, without the metric NoDataSeries adds.
+func NoDataKey(key ResourceLabel) ResourceLabel {
+	rl := ResourceLabel{}
+	for name, value := range key {
+		if name != MetricLabel {
+			rl[name] = value
+		}
+	}
+	return rl
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+package threshold
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStaleTracker(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	seen := func(sr Series, at time.Time) Series {
+		sr.LastSeen = at
+		return sr
+	}
+	tracker := NewStaleTracker()
+	// a rule reading two metrics of the same vm, one of which goes silent
+	tracker.Update("test1[0]", []Series{
+		seen(read("vm.cpu", series("vm1")), t0),
+		seen(read("vm.memory", series("vm1")), t0),
+	}, t0)
+	tracker.Update("test1[0]", []Series{
+		seen(read("vm.cpu", series("vm1")), t0.Add(10*time.Minute)),
+		seen(read("vm.memory", series("vm1")), t0),
+	}, t0.Add(10*time.Minute))
+
+	stale := tracker.Stale("test1[0]", 5*time.Minute, t0.Add(10*time.Minute))
+	want := []StaleSeries{{Key: ResourceLabel{"vm": "vm1"}, Metric: "vm.memory", LastSeen: t0}}
+	if !reflect.DeepEqual(stale, want) {
+		t.Fatalf("Stale = %+v, want %+v", stale, want)
+	}
+	series := NoDataSeries(stale)
+	if key := series[0].Key; !reflect.DeepEqual(key, ResourceLabel{"vm": "vm1", "metric": "vm.memory"}) {
+		t.Errorf("nodata series key = %v", key)
+	}
+	if key := NoDataKey(series[0].Key); !reflect.DeepEqual(key, ResourceLabel{"vm": "vm1"}) {
+		t.Errorf("NoDataKey = %v", key)
+	}
+
+	tracker.Update("test1[0]", nil, t0.Add(StaleRetention))
+	if stale := tracker.Stale("test1[0]", 5*time.Minute, t0.Add(StaleRetention)); len(stale) != 1 || stale[0].Metric != "vm.cpu" {
+		t.Errorf("after retention: %+v", stale)
+	}
+}
@@ -18,8 +18,71 @@ package threshold
 
 import (
 	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
 )
 
-func Transmit() {
-	fmt.Printf("NOW TEST")
+// Payload converts an alert into what receivers are sent.
+func (a *Alert) Payload() notify.Alert {
+	n := notify.Alert{
+		Rule:        a.Rule.Record,
+		RuleID:      a.Rule.ID,
+		Group:       a.Rule.Group,
+		Labels:      map[string]string{},
+		Values:      a.Values,
+		State:       a.State.String(),
+		ActiveAt:    a.ActiveAt,
+		StartsAt:    a.FiredAt,
+		Annotations: a.Rule.Annotations,
+		Threshold:   a.Rule.Threshold,
+	}
+	at := a.FiredAt
+	if !a.ResolvedAt.IsZero() {
+		endsAt := a.ResolvedAt
+		n.EndsAt = &endsAt
+		at = endsAt
+	}
+	for k, v := range a.Key {
+		n.Labels[k] = v
+	}
+	if a.Rule.NoDataAfter != 0 {
+		n.Labels["nodata"] = parser.FormatDuration(a.Rule.NoDataAfter)
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%d", a.Rule.ID, a.Key.Fingerprint(), n.State, at.UnixNano())
+	n.Key = fmt.Sprintf("%016x", h.Sum64())
+	if err := a.Rule.Templates.Render(&n); err != nil {
+		fmt.Fprintf(os.Stderr, "template: %s: %v\n", a.Rule.ID, err)
+	}
+	return n
+}
+
+// Threshold returns what the expression compares against, e.g. "10" for
+// vm.if_octets.rx < 10, or "" if it is no comparison with a constant.
+func Threshold(p *parser.Parser) string {
+	if p.Right == nil {
+		return ""
+	}
+	switch p.Right.Types {
+	case parser.ExprNum:
+		return p.Right.ExprNum
+	case parser.ExprStr:
+		return p.Right.ExprStr
+	}
+	return ""
+}
+
+// Transmit queues the alert transitions of one rule for the receivers the
+// rule notifies, or for the routes they match.
+func Transmit(d *notify.Dispatcher, rule Rule, alerts []Alert, now time.Time) {
+	payload := []notify.Alert{}
+	for _, a := range alerts {
+		fmt.Printf("transmit: %s %s %v\n", rule.ID, a.State, a.Key)
+		payload = append(payload, a.Payload())
+	}
+	d.Dispatch(rule.Notify, payload, now)
 }
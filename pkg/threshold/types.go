@@ -16,6 +16,12 @@
 
 package threshold
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 //	"fmt"
 //	"github.com/BurntSushi/toml"
 //	"log"
@@ -48,14 +54,27 @@ type ThresholdConfig struct {
 	CollectdType   string `toml:"collectd_type"`
 }
 
-type ResourceLabel struct {
-	VM string
-	IF string
+// ResourceLabel identifies one series by its labels,
+// e.g. {"vm": "instance-00000001", "if": "tapd21acb51-35"}.
+type ResourceLabel map[string]string
+
+// Fingerprint returns a stable string for the label set, usable as a map key.
+func (rl ResourceLabel) Fingerprint() string {
+	names := make([]string, 0, len(rl))
+	for name := range rl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, rl[name]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
 }
 
-type rawData struct {
-	key      ResourceLabel
-	datalist []float64
+func (rl ResourceLabel) String() string {
+	return rl.Fingerprint()
 }
 
 // func main(p *policyexpr.Parser) []string{
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018 NEC Corporation
+ *
+ *   Licensed under the Apache License, Version 2.0 (the "License");
+ *   you may not use this file except in compliance with the License.
+ *   You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *   Unless required by applicable law or agreed to in writing, software
+ *   distributed under the License is distributed on an "AS IS" BASIS,
+ *   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *   See the License for the specific language governing permissions and
+ *   limitations under the License.
+ */
+
+// Package tsdb is a small in-memory time-series store for sites that
+// have no redis. Each series keeps its newest samples in a fixed-size
+// ring buffer.
+package tsdb
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/threshold"
+)
+
+// DefaultCapacity is the number of samples kept per series when none is given.
+const DefaultCapacity = 720
+
+type point struct {
+	time   time.Time
+	values []float64
+}
+
+// ring holds the newest len(points) samples of one series, oldest first
+// starting at head once it has wrapped.
+type ring struct {
+	points []point
+	head   int
+	full   bool
+}
+
+func (r *ring) add(p point) {
+	r.points[r.head] = p
+	r.head = (r.head + 1) % len(r.points)
+	if r.head == 0 {
+		r.full = true
+	}
+}
+
+func (r *ring) each(f func(p point)) {
+	if r.full {
+		for _, p := range r.points[r.head:] {
+			f(p)
+		}
+	}
+	for _, p := range r.points[:r.head] {
+		f(p)
+	}
+}
+
+func (r *ring) newest() (point, bool) {
+	if !r.full && r.head == 0 {
+		return point{}, false
+	}
+	return r.points[(r.head+len(r.points)-1)%len(r.points)], true
+}
+
+// Store is a threshold.DataSource keeping series under their collectd
+// redis key (collectd/host/plugin-instance/type-instance), so that
+// metric names resolve the same way as with write_redis.
+type Store struct {
+	mu       sync.RWMutex
+	capacity int
+	series   map[string]*ring
+}
+
+func NewStore(capacity int) *Store {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Store{capacity: capacity, series: map[string]*ring{}}
+}
+
+// Append records the values of one sample of the series stored under key.
+// Samples older than the newest one already stored are dropped.
+func (s *Store) Append(key string, t time.Time, values []float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.series[key]
+	if !ok {
+		r = &ring{points: make([]point, s.capacity)}
+		s.series[key] = r
+	}
+	if last, ok := r.newest(); ok && t.Before(last.time) {
+		return
+	}
+	r.add(point{time: t, values: append([]float64{}, values...)})
+}
+
+// Write records the series of a recording rule as samples at now.
+func (s *Store) Write(ctx context.Context, record string, series []threshold.Series, now time.Time) error {
+	for _, sr := range series {
+		s.Append(threshold.RecordKey(record, sr.Key), now, []float64{sr.Samples[len(sr.Samples)-1].Value})
+	}
+	return nil
+}
+
+func (s *Store) Query(ctx context.Context, q threshold.Query) ([]threshold.Series, error) {
+	pattern, index := threshold.MetricKey(q.Metric)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []string{}
+	for key := range s.series {
+		if strings.Contains(key, pattern) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	series := []threshold.Series{}
+	for _, key := range keys {
+		rl, ok := threshold.SeriesLabels(key, q.Metric)
+		if !ok || !threshold.MatchLabels(q.Matchers, rl) {
+			continue
+		}
+		r := s.series[key]
+		samples := []threshold.Sample{}
+		r.each(func(p point) {
+			if p.time.Before(q.Start) || p.time.After(q.End) || index >= len(p.values) {
+				return
+			}
+			samples = append(samples, threshold.Sample{Time: p.time, Value: p.values[index]})
+		})
+		sr := threshold.Series{Key: rl, Samples: samples}
+		if last, ok := r.newest(); ok {
+			sr.LastSeen = last.time
+		}
+		series = append(series, sr)
+	}
+	return series, nil
+}
@@ -6,7 +6,11 @@ import (
 	"log"
 	"os"
 
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/action"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/inhibit"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/notify"
 	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/parser"
+	"github.com/distributed-monitoring/policy-engine-sandbox/pkg/silence"
 	"gopkg.in/yaml.v2"
 )
 
@@ -30,12 +34,112 @@ groups:
 `
 
 type PolicyYaml struct {
-	Groups []struct {
+	Datasource struct {
+		Type string `yaml:"type"` // redis (default), redistimeseries, prometheus, collectd or unixsock
+
+		// redis, redistimeseries
+		Address     string `yaml:"address"`
+		Password    string `yaml:"password"`
+		DB          int    `yaml:"db"`
+		MetricLabel string `yaml:"metric_label"`
+
+		// prometheus (metrics and labels also for redistimeseries)
+		URL     string            `yaml:"url"`
+		Timeout string            `yaml:"timeout"`
+		Step    string            `yaml:"step"`
+		Metrics map[string]string `yaml:"metrics"`
+		Labels  map[string]string `yaml:"labels"`
+
+		// collectd network plugin, into the embedded store
+		Listen        string            `yaml:"listen"`
+		SecurityLevel string            `yaml:"security_level"` // none or sign
+		Users         map[string]string `yaml:"users"`
+		Capacity      int               `yaml:"capacity"` // samples kept per series
+
+		// collectd unixsock plugin
+		Socket string `yaml:"socket"`
+	} `yaml:"datasource"`
+	// Redis keeps the engine's own state (silences, ...); the datasource's
+	// redis is used when unset.
+	Redis struct {
+		Address  string `yaml:"address"`
+		Password string `yaml:"password"`
+		DB       int    `yaml:"db"`
+	} `yaml:"redis"`
+	API struct {
+		Listen string `yaml:"listen"` // e.g. :9099, no API if unset
+	} `yaml:"api"`
+	// Outbox keeps notifications until delivered; they are sent at once,
+	// without retries, if unset.
+	Outbox struct {
+		Type        string `yaml:"type"` // file or redis
+		Path        string `yaml:"path"` // directory of the file outbox
+		MaxAttempts int    `yaml:"max_attempts"`
+		Backoff     string `yaml:"backoff"`
+		MaxBackoff  string `yaml:"max_backoff"`
+	} `yaml:"outbox"`
+	// State keeps the alerts across restarts; they start over if unset.
+	State struct {
+		Type  string `yaml:"type"`  // file or redis
+		Path  string `yaml:"path"`  // of the state file
+		Grace string `yaml:"grace"` // how long restored alerts wait for data, 1m if unset
+	} `yaml:"state"`
+	// HA runs several engines on the same policy; the one holding the
+	// redis lock notifies and acts, the others evaluate and stand by.
+	HA struct {
+		Enabled bool   `yaml:"enabled"`
+		ID      string `yaml:"id"`  // hostname and pid if unset
+		TTL     string `yaml:"ttl"` // of the lock, 10s if unset
+	} `yaml:"ha"`
+	// Sharding splits the rules between the engines running the policy,
+	// which find each other through heartbeats in redis.
+	Sharding struct {
+		Enabled bool   `yaml:"enabled"`
+		By      string `yaml:"by"`  // group (default) or series
+		ID      string `yaml:"id"`  // hostname and pid if unset
+		TTL     string `yaml:"ttl"` // of the heartbeats, 10s if unset
+	} `yaml:"sharding"`
+	// Evaluation runs the groups concurrently, each on up to Workers
+	// rules at once (4 if unset), every rule within Timeout (10s if unset).
+	// HostLabel gives the series without a host label the host of their
+	// vm in the topology.
+	Evaluation struct {
+		Workers   int    `yaml:"workers"`
+		Timeout   string `yaml:"timeout"`
+		HostLabel bool   `yaml:"host_label"`
+	} `yaml:"evaluation"`
+	// Putnotif is the former way of feeding every alert transition into
+	// collectd; it now stands for a collectd receiver all rules notify.
+	Putnotif struct {
+		Socket  string `yaml:"socket"`
+		Plugin  string `yaml:"plugin"`
+		Timeout string `yaml:"timeout"`
+	} `yaml:"putnotif"`
+	Receivers     []notify.ReceiverConfig `yaml:"receivers"`
+	Route         *notify.RouteConfig     `yaml:"route"`
+	InhibitRules  []inhibit.RuleConfig    `yaml:"inhibit_rules"`
+	Topology      string                  `yaml:"topology"` // file mapping VMs to hosts and networks
+	Maintenance   []silence.WindowConfig  `yaml:"maintenance"`
+	ActionLog     string                  `yaml:"action_log"`     // JSON lines of action results
+	ActionQueue   int                     `yaml:"action_queue"`   // runs waiting at most, 100 if unset
+	ActionWorkers int                     `yaml:"action_workers"` // runs at once, 4 if unset
+	Groups        []struct {
 		Name       string   `yaml:"name"`
 		Annotation []string `yaml:"annotation"`
+		Notify     []string `yaml:"notify"` // default receivers of the rules
 		Rules      []struct {
-			Record string `yaml:"record"`
-			Expr   string `yaml:"expr"`
+			Record  string          `yaml:"record"`
+			Expr    string          `yaml:"expr"`
+			For     string          `yaml:"for"`     // e.g. 1m, how long to match before firing
+			NoData  string          `yaml:"nodata"`  // e.g. 5m, raise series silent for that long
+			Timeout string          `yaml:"timeout"` // overrides evaluation.timeout
+			Notify  []string        `yaml:"notify"`  // receiver names, overriding the group's
+			Actions []action.Config `yaml:"actions"`
+
+			// text/template templates, see notify.TemplateData
+			Summary     string `yaml:"summary"`
+			Description string `yaml:"description"`
+			RunbookURL  string `yaml:"runbook_url"`
 		} `yaml:"rules"`
 		Interval     string `yaml:"interval"`
 		LastExecuted string // should be time?